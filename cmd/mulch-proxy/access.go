@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// AccessRules is the compiled version of a common.DomainAccess
+type AccessRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	users map[string]string // user -> hash
+	realm string
+
+	// bcrypt is (intentionally) slow, remember valid credentials
+	valid      map[[sha256.Size]byte]bool
+	validMutex sync.Mutex
+}
+
+// AccessRulesValidMax is the maximum number of remembered valid credentials
+const AccessRulesValidMax = 1000
+
+// NewAccessRules compiles access rules of a domain
+func NewAccessRules(access *common.DomainAccess) (*AccessRules, error) {
+	rules := &AccessRules{
+		users: make(map[string]string),
+		realm: access.Realm,
+		valid: make(map[[sha256.Size]byte]bool),
+	}
+
+	for _, cidr := range access.Allow {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow CIDR '%s'", cidr)
+		}
+		rules.allow = append(rules.allow, ipNet)
+	}
+
+	for _, cidr := range access.Deny {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny CIDR '%s'", cidr)
+		}
+		rules.deny = append(rules.deny, ipNet)
+	}
+
+	for _, line := range access.BasicAuth {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid basic auth line for '%s'", parts[0])
+		}
+		rules.users[parts[0]] = parts[1]
+	}
+
+	return rules, nil
+}
+
+// deny everyone (fail closed when rules are invalid)
+func denyAllAccessRules() *AccessRules {
+	_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, all6, _ := net.ParseCIDR("::/0")
+	return &AccessRules{deny: []*net.IPNet{all4, all6}}
+}
+
+// AllowIP returns true if the client IP is allowed (deny list first)
+func (rules *AccessRules) AllowIP(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return len(rules.allow) == 0 && len(rules.deny) == 0
+	}
+
+	for _, ipNet := range rules.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range rules.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedAuth returns true if a basic authentication is required
+func (rules *AccessRules) NeedAuth() bool {
+	return len(rules.users) > 0
+}
+
+// CheckAuth returns true if the request has valid basic auth credentials
+func (rules *AccessRules) CheckAuth(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	hash, exists := rules.users[user]
+	if !exists {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + ":" + password + ":" + hash))
+	rules.validMutex.Lock()
+	valid := rules.valid[key]
+	rules.validMutex.Unlock()
+	if valid {
+		return true
+	}
+
+	if !htpasswdVerify(hash, password) {
+		return false
+	}
+
+	rules.validMutex.Lock()
+	if len(rules.valid) >= AccessRulesValidMax {
+		rules.valid = make(map[[sha256.Size]byte]bool)
+	}
+	rules.valid[key] = true
+	rules.validMutex.Unlock()
+	return true
+}
+
+// Challenge sets the WWW-Authenticate header of a 401 response
+func (rules *AccessRules) Challenge(res http.ResponseWriter) {
+	res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, rules.realm))
+}
+
+// returns the client IP, using our parent header in chain mode
+func clientIP(req *http.Request, fromParent bool) string {
+	// our parent gives us the real client IP
+	if fromParent && req.Header.Get("X-Real-Ip") != "" {
+		return req.Header.Get("X-Real-Ip")
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// Access log formats
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+)
+
+// AccessLogQueueSize is the number of entries waiting to be written,
+// entries are dropped when the queue is full (slow disk)
+const AccessLogQueueSize = 4096
+
+// AccessLogEntry is a request in the access log
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      uint64    `json:"bytes"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+	Duration   float64   `json:"duration"` // seconds
+	VMName     string    `json:"vm"`
+	FromParent bool      `json:"from_parent"` // chained from our parent proxy
+	ToChild    bool      `json:"to_child"`    // forwarded to a child proxy
+	domain     string
+}
+
+// AccessLog writes access logs, globally and/or per domain (files are
+// only used by the writer goroutine)
+type AccessLog struct {
+	dropped    uint32 // atomic
+	format     string
+	filename   string // global log ("" = disabled)
+	domainsDir string // per domain logs ("" = disabled)
+	files      map[string]*os.File
+	entries    chan *AccessLogEntry // nil entry: reopen files
+	done       chan bool
+	log        *Log
+}
+
+// NewAccessLogEntry creates an entry from the incoming request, before
+// it's modified by the proxy (see Complete)
+func NewAccessLogEntry(req *http.Request, host string, fromParent bool, start time.Time) *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:       start,
+		RemoteIP:   clientIP(req, fromParent),
+		Host:       host,
+		Method:     req.Method,
+		URI:        req.RequestURI,
+		Proto:      req.Proto,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+		FromParent: fromParent,
+	}
+}
+
+// Complete the entry with response informations (domain is nil for
+// unknown hosts)
+func (entry *AccessLogEntry) Complete(domain *common.Domain, status int, bytes uint64, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	entry.Status = status
+	entry.Bytes = bytes
+	entry.Duration = duration.Seconds()
+	if domain != nil {
+		entry.domain = domain.Name
+		entry.VMName = domain.VMName
+		entry.ToChild = domain.Chained
+	}
+}
+
+// Combined Log Format, with extra fields: host, VM, duration, and
+// chaining ("parent" if the request came from our parent proxy, "child" if
+// forwarded to a child proxy, "-" otherwise)
+func (entry *AccessLogEntry) combined() string {
+	dash := func(str string) string {
+		if str == "" {
+			return "-"
+		}
+		return str
+	}
+
+	chain := "-"
+	if entry.FromParent {
+		chain = "parent"
+	}
+	if entry.ToChild {
+		chain = "child"
+	}
+
+	return fmt.Sprintf("%s - - [%s] %s %d %d %s %s %s %s %.3f %s\n",
+		entry.RemoteIP,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto),
+		entry.Status,
+		entry.Bytes,
+		strconv.Quote(dash(entry.Referer)),
+		strconv.Quote(dash(entry.UserAgent)),
+		strconv.Quote(entry.Host),
+		strconv.Quote(dash(entry.VMName)),
+		entry.Duration,
+		chain,
+	)
+}
+
+// NewAccessLog creates an AccessLog, checking that log files are writable
+func NewAccessLog(filename string, domainsDir string, format string, log *Log) (*AccessLog, error) {
+	al := &AccessLog{
+		format:     format,
+		filename:   filename,
+		domainsDir: domainsDir,
+		files:      make(map[string]*os.File),
+		entries:    make(chan *AccessLogEntry, AccessLogQueueSize),
+		done:       make(chan bool),
+		log:        log,
+	}
+
+	if domainsDir != "" {
+		stat, err := os.Stat(domainsDir)
+		if err != nil {
+			return nil, err
+		}
+		if stat.IsDir() == false {
+			return nil, fmt.Errorf("%s is not a directory", domainsDir)
+		}
+	}
+
+	if filename != "" {
+		_, err := al.getFile(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go al.run()
+
+	return al, nil
+}
+
+// writer goroutine
+func (al *AccessLog) run() {
+	for entry := range al.entries {
+		if entry == nil {
+			al.closeFiles()
+			continue
+		}
+		al.write(entry)
+		dropped := atomic.SwapUint32(&al.dropped, 0)
+		if dropped > 0 {
+			al.log.Errorf("access log: %d entries dropped, queue is full", dropped)
+		}
+	}
+	al.closeFiles()
+	close(al.done)
+}
+
+// get an opened log file (writer goroutine only)
+func (al *AccessLog) getFile(filename string) (*os.File, error) {
+	file, exists := al.files[filename]
+	if exists {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	al.files[filename] = file
+	return file, nil
+}
+
+// Write queues an entry for the global and/or domain access logs
+// (never blocks, the entry is dropped if the queue is full)
+func (al *AccessLog) Write(entry *AccessLogEntry) {
+	select {
+	case al.entries <- entry:
+	default:
+		atomic.AddUint32(&al.dropped, 1)
+	}
+}
+
+// write an entry (writer goroutine only)
+func (al *AccessLog) write(entry *AccessLogEntry) {
+	var line []byte
+	switch al.format {
+	case AccessLogFormatJSON:
+		data, err := json.Marshal(entry)
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+			return
+		}
+		line = append(data, '\n')
+	default:
+		line = []byte(entry.combined())
+	}
+
+	var filenames []string
+	if al.filename != "" {
+		filenames = append(filenames, al.filename)
+	}
+	// unknown hosts are only in the global log
+	if al.domainsDir != "" && entry.domain != "" && !strings.ContainsAny(entry.domain, `/\`) {
+		filenames = append(filenames, path.Clean(al.domainsDir+"/"+entry.domain+".log"))
+	}
+
+	for _, filename := range filenames {
+		file, err := al.getFile(filename)
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+			continue
+		}
+		_, err = file.Write(line)
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+		}
+	}
+}
+
+// close all log files (writer goroutine only)
+func (al *AccessLog) closeFiles() {
+	for filename, file := range al.files {
+		err := file.Close()
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+		}
+		delete(al.files, filename)
+	}
+}
+
+// Reopen closes all log files once queued entries are written, they
+// will be reopened on the next write (use this after a log rotation)
+func (al *AccessLog) Reopen() {
+	al.entries <- nil
+}
+
+// Close writes queued entries and closes log files, no more entries
+// can be written after this
+func (al *AccessLog) Close() {
+	close(al.entries)
+	<-al.done
+}
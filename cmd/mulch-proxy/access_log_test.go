@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func testAccessLogEntry(host string, domain *common.Domain) *AccessLogEntry {
+	start := time.Date(2020, time.July, 1, 13, 4, 5, 0, time.FixedZone("CEST", 2*3600))
+	req := httptest.NewRequest("GET", "http://"+host+"/index.html?q=1", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.RequestURI = "/index.html?q=1"
+	req.Header.Set("User-Agent", `curl/7.68.0 "test"`)
+
+	entry := NewAccessLogEntry(req, host, false, start)
+	entry.Complete(domain, 0, 1234, 1500*time.Millisecond)
+	return entry
+}
+
+func TestAccessLogEntryCombined(t *testing.T) {
+	domain := &common.Domain{Name: "test.example.com", VMName: "test"}
+	entry := testAccessLogEntry("test.example.com", domain)
+
+	want := `192.0.2.10 - - [01/Jul/2020:13:04:05 +0200] "GET /index.html?q=1 HTTP/1.1" 200 1234 "-" "curl/7.68.0 \"test\"" "test.example.com" "test" 1.500 -` + "\n"
+	if got := entry.combined(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	entry.FromParent = true
+	if !strings.HasSuffix(entry.combined(), " 1.500 parent\n") {
+		t.Errorf("parent: got %s", entry.combined())
+	}
+	domain.Chained = true
+	entry.Complete(domain, 502, 0, 0)
+	if !strings.Contains(entry.combined(), " 502 0 ") || !strings.HasSuffix(entry.combined(), " 0.000 child\n") {
+		t.Errorf("child: got %s", entry.combined())
+	}
+
+	entry = testAccessLogEntry("unknown.example.com", nil)
+	if !strings.Contains(entry.combined(), ` "unknown.example.com" "-" `) {
+		t.Errorf("unknown host: got %s", entry.combined())
+	}
+}
+
+func TestAccessLogWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulch-access-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	global := path.Join(dir, "access.log")
+	al, err := NewAccessLog(global, dir, AccessLogFormatJSON, NewLog(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al.Write(testAccessLogEntry("test.example.com", &common.Domain{Name: "test.example.com", VMName: "test"}))
+	al.Write(testAccessLogEntry("unknown.example.com", nil))
+	al.Write(testAccessLogEntry("bad.example.com", &common.Domain{Name: "../bad", VMName: "bad"}))
+	al.Close()
+
+	data, err := ioutil.ReadFile(global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("global log: got %d lines", len(lines))
+	}
+	var entry AccessLogEntry
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Host != "test.example.com" || entry.VMName != "test" || entry.Status != 200 || entry.Bytes != 1234 {
+		t.Errorf("got %+v", entry)
+	}
+
+	data, err = ioutil.ReadFile(path.Join(dir, "test.example.com.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 {
+		t.Errorf("domain log: got %s", data)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("got %d files, want 2 (global and domain logs)", len(files))
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mulch-access-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	global := path.Join(dir, "access.log")
+	al, err := NewAccessLog(global, "", AccessLogFormatCombined, NewLog(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log rotation
+	err = os.Rename(global, global+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Reopen()
+	al.Write(testAccessLogEntry("test.example.com", nil))
+	al.Close()
+
+	data, err := ioutil.ReadFile(global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestAccessLogQueueFull(t *testing.T) {
+	// no writer goroutine
+	al := &AccessLog{entries: make(chan *AccessLogEntry, 1)}
+
+	al.Write(&AccessLogEntry{})
+	al.Write(&AccessLogEntry{})
+	if al.dropped != 1 || len(al.entries) != 1 {
+		t.Errorf("got %d dropped entries, %d queued", al.dropped, len(al.entries))
+	}
+}
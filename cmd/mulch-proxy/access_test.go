@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestApr1Crypt(t *testing.T) {
+	// openssl passwd -apr1 -salt <salt> <password>
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{"secret", "saltsalt", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"},
+		{"password", "abc", "$apr1$abc$mehJE/UcwZsj.w5DYe.b5."},
+		{"", "12345678", "$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/"},
+		{"a very long password with more than sixteen characters", "xyz", "$apr1$xyz$SETSsz/JeqfsD1bMuTwDd/"},
+		{"secret", "saltsaltsalt", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"}, // salt is truncated
+	}
+
+	for _, test := range tests {
+		if got := apr1Crypt(test.password, test.salt); got != test.want {
+			t.Errorf("apr1Crypt(%q, %q): got %s, want %s", test.password, test.salt, got, test.want)
+		}
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "Secret", false},
+		{"$apr1$saltsalt", "secret", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret2", false},
+		{"$2a$10$IesIsEA6wMIpdBudtgNB0e8bMdhMrl49aw91hfve7kO4/G6BkdYcu", "secret", true},
+		{"$2a$10$IesIsEA6wMIpdBudtgNB0e8bMdhMrl49aw91hfve7kO4/G6BkdYcu", "wrong", false},
+		{"secret", "secret", false}, // plain passwords are refused
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		if got := htpasswdVerify(test.hash, test.password); got != test.want {
+			t.Errorf("htpasswdVerify(%q, %q): got %t, want %t", test.hash, test.password, got, test.want)
+		}
+	}
+}
+
+func TestAccessRulesAllowIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{"no rules", nil, nil, "192.168.1.1", true},
+		{"no rules, invalid IP", nil, nil, "invalid", true},
+		{"allowed", []string{"192.168.1.0/24"}, nil, "192.168.1.10", true},
+		{"not allowed", []string{"192.168.1.0/24"}, nil, "192.168.2.10", false},
+		{"denied", nil, []string{"10.0.0.0/8"}, "10.1.2.3", false},
+		{"not denied", nil, []string{"10.0.0.0/8"}, "11.1.2.3", true},
+		{"deny first", []string{"10.0.0.0/8"}, []string{"10.1.2.3/32"}, "10.1.2.3", false},
+		{"allowed, not denied", []string{"10.0.0.0/8"}, []string{"10.1.2.3/32"}, "10.1.2.4", true},
+		{"IPv6 allowed", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"IPv6 not allowed", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{"IPv4 rules, IPv6 client", []string{"0.0.0.0/0"}, nil, "2001:db8::1", false},
+		{"invalid IP with rules", nil, []string{"10.0.0.0/8"}, "invalid", false},
+	}
+
+	for _, test := range tests {
+		rules, err := NewAccessRules(&common.DomainAccess{Allow: test.allow, Deny: test.deny})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := rules.AllowIP(test.ip); got != test.want {
+			t.Errorf("%s: AllowIP(%s): got %t, want %t", test.name, test.ip, got, test.want)
+		}
+	}
+
+	deny := denyAllAccessRules()
+	for _, ip := range []string{"1.2.3.4", "2001:db8::1", "invalid"} {
+		if deny.AllowIP(ip) {
+			t.Errorf("deny all: %s is allowed", ip)
+		}
+	}
+}
+
+func TestCheckAccessStripsCredentials(t *testing.T) {
+	rules, err := NewAccessRules(&common.DomainAccess{
+		BasicAuth: []string{"mulch:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := &common.Domain{Name: "test.localhost"}
+	proxy := &ProxyServer{
+		access: map[string]*AccessRules{domain.Key(): rules},
+		config: &ProxyServerParams{ErrorHTMLTemplateFile: "../../etc/templates/error_page.html"},
+		Log:    NewLog(false),
+	}
+
+	req := httptest.NewRequest("GET", "http://test.localhost/", nil)
+	req.SetBasicAuth("mulch", "secret")
+	res := httptest.NewRecorder()
+	if !proxy.checkAccess(domain, res, req, false) {
+		t.Fatalf("valid credentials refused (status %d)", res.Code)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("proxy credentials are forwarded to the VM")
+	}
+
+	req = httptest.NewRequest("GET", "http://test.localhost/", nil)
+	req.SetBasicAuth("mulch", "wrong")
+	res = httptest.NewRecorder()
+	if proxy.checkAccess(domain, res, req, false) {
+		t.Error("invalid credentials accepted")
+	}
+	if res.Code != http.StatusUnauthorized || res.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("got status %d, want 401 with a challenge", res.Code)
+	}
+}
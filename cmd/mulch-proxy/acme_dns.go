@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DNSCertRenewBefore is the remaining validity before renewing a certificate
+const DNSCertRenewBefore = 30 * 24 * time.Hour
+
+// DNSCertRetryDelay is the delay before retrying a failed issuance
+const DNSCertRetryDelay = 1 * time.Hour
+
+// DNSCertCheckInterval is the delay between two certificate checks
+const DNSCertCheckInterval = 1 * time.Hour
+
+// DNSCertTimeout is the maximum duration of a certificate issuance
+const DNSCertTimeout = 10 * time.Minute
+
+// same key as autocert, so the ACME account is shared
+const acmeAccountKeyName = "acme_account+key"
+
+// DNSCertManager issues and renews wildcard certificates using
+// ACME DNS-01 challenges (autocert only supports TLS-ALPN-01 and HTTP-01)
+// Certificates are stored in the autocert cache, using autocert format.
+type DNSCertManager struct {
+	provider     DNSProvider
+	errors       *CertErrorDatabase
+	cache        autocert.DirCache
+	directoryURL string
+	email        string
+	propagation  time.Duration
+	client       *acme.Client
+	names        []string
+	certs        map[string]*tls.Certificate
+	lastFailure  map[string]time.Time
+	forced       map[string]bool // renewals requested by mulchd
+	refresh      chan bool
+	mutex        sync.Mutex
+	log          *Log
+}
+
+// NewDNSCertManager creates a new DNSCertManager, you must call Run()
+func NewDNSCertManager(provider DNSProvider, certErrors *CertErrorDatabase, cacheDir string, directoryURL string, email string, propagation time.Duration, log *Log) *DNSCertManager {
+	return &DNSCertManager{
+		provider:     provider,
+		errors:       certErrors,
+		cache:        autocert.DirCache(cacheDir),
+		directoryURL: directoryURL,
+		email:        email,
+		propagation:  propagation,
+		certs:        make(map[string]*tls.Certificate),
+		lastFailure:  make(map[string]time.Time),
+		forced:       make(map[string]bool),
+		refresh:      make(chan bool, 1),
+		log:          log,
+	}
+}
+
+// Update the list of wildcard names needing a certificate
+func (m *DNSCertManager) Update(names []string) {
+	m.mutex.Lock()
+	m.names = names
+	m.mutex.Unlock()
+
+	select {
+	case m.refresh <- true:
+	default: // a refresh is already pending
+	}
+}
+
+// Forget a certificate deleted from the cache, it will be issued again
+func (m *DNSCertManager) Forget(name string) {
+	m.mutex.Lock()
+	delete(m.certs, name)
+	delete(m.lastFailure, name)
+	m.mutex.Unlock()
+}
+
+// Renew forces the renewal of a certificate, the current one is still
+// served until the new one is issued
+func (m *DNSCertManager) Renew(name string) {
+	m.mutex.Lock()
+	m.forced[name] = true
+	m.mutex.Unlock()
+
+	select {
+	case m.refresh <- true:
+	default: // a refresh is already pending
+	}
+}
+
+// GetCertificate returns the certificate for name, or nil if not (yet) available
+func (m *DNSCertManager) GetCertificate(name string) *tls.Certificate {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cert, exists := m.certs[name]
+	if !exists || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+// Run the manager loop (blocking)
+func (m *DNSCertManager) Run() {
+	ticker := time.NewTicker(DNSCertCheckInterval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-m.refresh:
+		case <-ticker.C:
+		}
+	}
+}
+
+// issue or renew certificates, if needed
+func (m *DNSCertManager) check() {
+	m.mutex.Lock()
+	names := m.names
+	m.mutex.Unlock()
+
+	for _, name := range names {
+		m.mutex.Lock()
+		cert := m.certs[name]
+		lastFailure := m.lastFailure[name]
+		forced := m.forced[name]
+		delete(m.forced, name)
+		m.mutex.Unlock()
+
+		if cert == nil {
+			cert = m.load(name)
+		}
+
+		if cert != nil && time.Until(cert.Leaf.NotAfter) > DNSCertRenewBefore && !forced {
+			continue
+		}
+
+		if time.Since(lastFailure) < DNSCertRetryDelay && !forced {
+			continue
+		}
+
+		m.log.Infof("%s: requesting certificate (DNS-01)", name)
+		newCert, err := m.obtain(name)
+		if err != nil {
+			m.log.Errorf("%s: certificate request failed: %s", name, err)
+			m.errors.Set(name, err)
+			m.mutex.Lock()
+			m.lastFailure[name] = time.Now()
+			m.mutex.Unlock()
+			continue
+		}
+		m.log.Infof("%s: certificate issued, valid until %s", name, newCert.Leaf.NotAfter.Format(time.RFC3339))
+		m.errors.Clear(name)
+
+		m.mutex.Lock()
+		m.certs[name] = newCert
+		delete(m.lastFailure, name)
+		m.mutex.Unlock()
+	}
+}
+
+// load a certificate from the cache
+func (m *DNSCertManager) load(name string) *tls.Certificate {
+	data, err := m.cache.Get(context.Background(), name)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := parseCertificate(data)
+	if err != nil {
+		m.log.Errorf("%s: invalid cached certificate: %s", name, err)
+		return nil
+	}
+
+	m.mutex.Lock()
+	m.certs[name] = cert
+	m.mutex.Unlock()
+	return cert
+}
+
+// obtain a new certificate from the ACME server
+func (m *DNSCertManager) obtain(name string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNSCertTimeout)
+	defer cancel()
+
+	client, err := m.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		err = m.authorize(ctx, client, authzURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// autocert format: private key, then certificate chain (leaf first)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	for _, der := range ders {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.cache.Put(ctx, name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// fulfill a DNS-01 challenge for an authorization
+func (m *DNSCertManager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	// identifier value has no "*." prefix for wildcards
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+
+	err = m.provider.Present(fqdn, value)
+	if err != nil {
+		return fmt.Errorf("DNS record creation: %s", err)
+	}
+	defer func() {
+		errC := m.provider.CleanUp(fqdn, value)
+		if errC != nil {
+			m.log.Warningf("%s: DNS record cleanup: %s", fqdn, errC)
+		}
+	}()
+
+	m.log.Tracef("%s: waiting %s for DNS propagation", fqdn, m.propagation)
+	select {
+	case <-time.After(m.propagation):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	_, err = client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// returns a registered ACME client, sharing the autocert account key
+func (m *DNSCertManager) getClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.directoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+
+	m.client = client
+	return client, nil
+}
+
+// load (or create) the ACME account key, using autocert format
+func (m *DNSCertManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, acmeAccountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, errors.New("invalid ACME account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	err = m.cache.Put(ctx, acmeAccountKeyName, data)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parse a PEM bundle (private key and certificate chain)
+func parseCertificate(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -13,7 +14,8 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 )
 
-// APIServer is used by children to contact us, the parent
+// APIServer is used by children to contact us, the parent. It also
+// provides metrics and stats (PSK protected).
 type APIServer struct {
 	Log         *Log
 	Server      *http.Server
@@ -34,6 +36,7 @@ func (srv *APIServer) registerRoutes() {
 			err := srv.registerDomainsController(w, r)
 			if err == nil {
 				srv.ProxyServer.RefreshReverseProxies()
+				srv.ProxyServer.Stats.Prune(srv.ProxyServer.DomainDB)
 			}
 			return
 		}
@@ -58,6 +61,43 @@ func (srv *APIServer) registerRoutes() {
 		srv.Log.Errorf("%d: %s", 405, errMsg)
 		http.Error(w, errMsg, 405)
 	})
+
+	srv.registerStatsRoutes(true)
+}
+
+// metrics and stats routes, with or without PSK check
+func (srv *APIServer) registerStatsRoutes(checkPSK bool) {
+	srv.Muxer.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if checkPSK && srv.checkPSK(r) == false {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		if r.Method == "GET" {
+			_ = srv.metricsController(w, r)
+			return
+		}
+
+		errMsg := fmt.Sprintf("Method %s not allowed for route /metrics", r.Method)
+		srv.Log.Errorf("%d: %s", 405, errMsg)
+		http.Error(w, errMsg, 405)
+	})
+
+	srv.Muxer.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if checkPSK && srv.checkPSK(r) == false {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		if r.Method == "GET" {
+			_ = srv.statsController(w, r)
+			return
+		}
+
+		errMsg := fmt.Sprintf("Method %s not allowed for route /stats", r.Method)
+		srv.Log.Errorf("%d: %s", 405, errMsg)
+		http.Error(w, errMsg, 405)
+	})
 }
 
 func (srv *APIServer) checkPSK(request *http.Request) bool {
@@ -67,6 +107,33 @@ func (srv *APIServer) checkPSK(request *http.Request) bool {
 	return false
 }
 
+// NewLocalAPIServer creates and runs an HTTP API server without any
+// authentication, providing only metrics and stats
+func NewLocalAPIServer(config *AppConfig, proxyServer *ProxyServer, log *Log) *APIServer {
+	srv := APIServer{
+		Config:      config,
+		ProxyServer: proxyServer,
+		Log:         log,
+		Muxer:       http.NewServeMux(),
+	}
+	srv.registerStatsRoutes(false)
+
+	srv.Server = &http.Server{
+		Handler: srv.Muxer,
+		Addr:    config.ListenAPI,
+	}
+
+	go func() {
+		err := srv.Server.ListenAndServe()
+		log.Errorf("ListenAndServe: %s", err)
+		os.Exit(99)
+	}()
+
+	log.Infof("local API server on %s", config.ListenAPI)
+
+	return &srv
+}
+
 // NewAPIServer creates and runs the API server
 func NewAPIServer(config *AppConfig, cacheDir string, proxyServer *ProxyServer, log *Log) (*APIServer, error) {
 	srv := APIServer{
@@ -178,6 +245,32 @@ func (srv *APIServer) checkDomainsController(response http.ResponseWriter, reque
 	return nil
 }
 
+func (srv *APIServer) metricsController(response http.ResponseWriter, request *http.Request) error {
+	var buf bytes.Buffer
+	err := srv.ProxyServer.Stats.WriteMetrics(&buf)
+	if err != nil {
+		srv.Log.Error(err.Error())
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	response.Header().Set("Content-Type", common.MetricsContentType)
+	response.Write(buf.Bytes())
+	return nil
+}
+
+func (srv *APIServer) statsController(response http.ResponseWriter, request *http.Request) error {
+	response.Header().Set("Content-Type", "application/json")
+	dataJSON, err := json.Marshal(srv.ProxyServer.Stats.Report())
+	if err != nil {
+		srv.Log.Error(err.Error())
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	response.Write([]byte(dataJSON))
+	return nil
+}
+
 func (srv *APIServer) selfCall() error {
 	srv.Log.Trace("self HTTPS URL call to generate/renew certificate")
 
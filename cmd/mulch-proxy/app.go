@@ -23,6 +23,7 @@ type App struct {
 	Config      *AppConfig
 	Log         *Log
 	ProxyServer *ProxyServer
+	PortProxy   *PortProxy
 	APIServer   *APIServer
 	Rand        *rand.Rand
 }
@@ -64,6 +65,36 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		return nil, err
 	}
 
+	// HTTP caches are not persistent
+	httpCacheDir := path.Clean(app.Config.DataPath + "/" + CacheDirectory)
+	err = os.RemoveAll(httpCacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP cache: %s", err)
+	}
+
+	var accessLog *AccessLog
+	if app.Config.AccessLogFile != "" || app.Config.AccessLogDir != "" {
+		accessLog, err = NewAccessLog(app.Config.AccessLogFile, app.Config.AccessLogDir, app.Config.AccessLogFormat, app.Log)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %s", err)
+		}
+	}
+
+	certErrors, err := NewCertErrorDatabase(path.Clean(app.Config.DataPath+"/"+CertErrorsFilename), app.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	var dnsCertManager *DNSCertManager
+	if app.Config.AcmeDNSProvider != "" {
+		provider, errP := NewDNSProvider(app.Config)
+		if errP != nil {
+			return nil, errP
+		}
+		dnsCertManager = NewDNSCertManager(provider, certErrors, cacheDir, app.Config.AcmeURL, app.Config.AcmeEmail, app.Config.AcmeDNSPropagation, app.Log)
+		go dnsCertManager.Run()
+	}
+
 	chainDomain := ""
 	switch app.Config.ChainMode {
 	case ChainModeParent:
@@ -80,18 +111,36 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		DirectoryURL:          app.Config.AcmeURL,
 		DomainDB:              ddb,
 		ErrorHTMLTemplateFile: path.Clean(app.Config.configPath + "/templates/error_page.html"),
+		MaintenanceHTMLFile:   path.Clean(app.Config.configPath + "/templates/maintenance_page.html"),
+		ReadHeaderTimeout:     app.Config.ReadHeaderTimeout,
+		ReadTimeout:           app.Config.ReadTimeout,
+		WriteTimeout:          app.Config.WriteTimeout,
+		IdleTimeout:           app.Config.IdleTimeout,
+		CacheDir:              httpCacheDir,
 		MulchdHTTPSDomain:     app.Config.ListenHTTPSDomain,
 		ChainMode:             app.Config.ChainMode,
 		ChainPSK:              app.Config.ChainPSK,
 		ChainDomain:           chainDomain,
 		Log:                   app.Log,
 		RequestList:           NewRequestList(debug),
+		Stats:                 NewProxyStats(cacheDir),
+		AccessLog:             accessLog,
+		DNSCertManager:        dnsCertManager,
+		CustomCerts:           NewCustomCertStore(path.Clean(app.Config.DataPath+"/"+CustomCertsDirectory), app.Log),
+		CertErrors:            certErrors,
 		Trace:                 trace,
 		Debug:                 debug,
 	})
 
 	app.ProxyServer.RefreshReverseProxies()
 
+	pdb, err := app.createPortDB()
+	if err != nil {
+		return nil, err
+	}
+	app.PortProxy = NewPortProxy(pdb, app.Log)
+	app.PortProxy.RefreshListeners()
+
 	app.initSigHUPHandler()
 	app.initSigQUITHandler()
 
@@ -102,6 +151,10 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		}
 	}
 
+	if app.Config.ListenAPI != "" {
+		NewLocalAPIServer(app.Config, app.ProxyServer, app.Log)
+	}
+
 	if app.Config.ChainMode == ChainModeChild {
 		// if this first refresh fails, we fail.
 		err = app.refreshParentDomains()
@@ -146,6 +199,19 @@ func (app *App) createDomainDB() (*DomainDatabase, error) {
 	return ddb, nil
 }
 
+func (app *App) createPortDB() (*PortDatabase, error) {
+	dbPath := path.Clean(app.Config.DataPath + "/mulch-proxy-ports.db")
+
+	pdb, err := NewPortDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	app.Log.Infof("found %d port(s) in database %s", pdb.Count(), dbPath)
+
+	return pdb, nil
+}
+
 func (app *App) initSigHUPHandler() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
@@ -153,8 +219,12 @@ func (app *App) initSigHUPHandler() {
 	go func() {
 		for sig := range c {
 			if sig == syscall.SIGHUP {
-				app.Log.Infof("HUP Signal, reloading domains")
+				app.Log.Infof("HUP Signal, reloading domains, ports and custom certificates, reopening access logs")
+				if app.ProxyServer.AccessLog != nil {
+					app.ProxyServer.AccessLog.Reopen()
+				}
 				app.ProxyServer.ReloadDomains()
+				app.PortProxy.ReloadPorts()
 				app.refreshDomains()
 			}
 		}
@@ -206,7 +276,7 @@ func (app *App) refreshDomains() {
 // contact our parent proxy and send all our routes so he can forward requests
 func (app *App) refreshParentDomains() error {
 	data := common.ProxyChainDomains{
-		Domains:   app.ProxyServer.DomainDB.GetDomainsNames(),
+		Domains:   app.ProxyServer.DomainDB.GetHostNames(),
 		ForwardTo: app.Config.ChainChildURL.String(),
 	}
 
@@ -233,14 +303,17 @@ func (app *App) refreshParentDomains() error {
 
 	res, err := client.Do(req)
 	if err != nil {
+		app.ProxyServer.Stats.ParentRegistration(false)
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == 200 {
 		app.Log.Info("domains successfully registered on our parent")
+		app.ProxyServer.Stats.ParentRegistration(true)
 	} else {
 		app.Log.Errorf("domains registration failed, parent returned error %d", res.StatusCode)
+		app.ProxyServer.Stats.ParentRegistration(false)
 	}
 
 	return nil
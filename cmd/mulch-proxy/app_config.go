@@ -3,9 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -31,6 +33,19 @@ type AppConfig struct {
 	// ACME for issued certificate alerts
 	AcmeEmail string
 
+	// DNS provider for DNS-01 challenges (wildcard certificates, "" = disabled)
+	AcmeDNSProvider string
+
+	// delay between DNS record creation and challenge validation
+	AcmeDNSPropagation time.Duration
+
+	// RFC2136 DNS provider settings
+	RFC2136Server        string
+	RFC2136Zone          string
+	RFC2136TSIGKey       string
+	RFC2136TSIGSecret    string
+	RFC2136TSIGAlgorithm string
+
 	// Listen HTTP address
 	HTTPAddress string
 
@@ -54,17 +69,53 @@ type AppConfig struct {
 	// Pre-Shared key for the chain
 	ChainPSK string
 
+	// optional local (unauthenticated) API server, for /metrics and /stats
+	ListenAPI string
+
+	// global access log file ("" = disabled)
+	AccessLogFile string
+
+	// per-domain access logs directory ("" = disabled)
+	AccessLogDir string
+
+	// access logs format (see AccessLogFormat* constants)
+	AccessLogFormat string
+
+	// HTTP server timeouts (0 = no timeout)
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
 	// global mulchd configuration path
 	configPath string
 }
 
 type tomlAppConfig struct {
-	DataPath          string `toml:"data_path"`
-	AcmeURL           string `toml:"proxy_acme_url"`
-	AcmeEmail         string `toml:"proxy_acme_email"`
+	DataPath  string `toml:"data_path"`
+	AcmeURL   string `toml:"proxy_acme_url"`
+	AcmeEmail string `toml:"proxy_acme_email"`
+
+	AcmeDNSProvider      string `toml:"proxy_acme_dns_provider"`
+	AcmeDNSPropagation   string `toml:"proxy_acme_dns_propagation"`
+	RFC2136Server        string `toml:"proxy_acme_rfc2136_server"`
+	RFC2136Zone          string `toml:"proxy_acme_rfc2136_zone"`
+	RFC2136TSIGKey       string `toml:"proxy_acme_rfc2136_tsig_key"`
+	RFC2136TSIGSecret    string `toml:"proxy_acme_rfc2136_tsig_secret"`
+	RFC2136TSIGAlgorithm string `toml:"proxy_acme_rfc2136_tsig_algorithm"`
+
 	HTTPAddress       string `toml:"proxy_listen_http"`
 	HTTPSAddress      string `toml:"proxy_listen_https"`
 	ListenHTTPSDomain string `toml:"listen_https_domain"`
+	ListenAPI         string `toml:"proxy_listen_api"`
+	AccessLogFile     string `toml:"proxy_access_log"`
+	AccessLogDir      string `toml:"proxy_access_log_dir"`
+	AccessLogFormat   string `toml:"proxy_access_log_format"`
+
+	ReadHeaderTimeout string `toml:"proxy_read_header_timeout"`
+	ReadTimeout       string `toml:"proxy_read_timeout"`
+	WriteTimeout      string `toml:"proxy_write_timeout"`
+	IdleTimeout       string `toml:"proxy_idle_timeout"`
 
 	ChainMode      string `toml:"proxy_chain_mode"`
 	ChainParentURL string `toml:"proxy_chain_parent_url"`
@@ -84,11 +135,19 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 
 	// defaults (if not in the file)
 	tConfig := &tomlAppConfig{
-		DataPath:     "./var/data", // example: /var/lib/mulch
-		AcmeURL:      "https://acme-staging.api.letsencrypt.org/directory",
-		AcmeEmail:    "root@localhost.localdomain",
-		HTTPAddress:  ":80",
-		HTTPSAddress: ":443",
+		DataPath:        "./var/data", // example: /var/lib/mulch
+		AcmeURL:         "https://acme-staging.api.letsencrypt.org/directory",
+		AcmeEmail:       "root@localhost.localdomain",
+		HTTPAddress:     ":80",
+		HTTPSAddress:    ":443",
+		AccessLogFormat: AccessLogFormatCombined,
+
+		AcmeDNSPropagation: "30s",
+
+		ReadHeaderTimeout: "1m",
+		ReadTimeout:       "0",
+		WriteTimeout:      "0",
+		IdleTimeout:       "15m",
 	}
 
 	meta, err := toml.DecodeFile(filename, tConfig)
@@ -118,11 +177,71 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 		appConfig.AcmeURL = "" // acme package default is production directory
 	}
 	appConfig.AcmeEmail = tConfig.AcmeEmail
+
+	switch tConfig.AcmeDNSProvider {
+	case "", DNSProviderRFC2136:
+	default:
+		return nil, fmt.Errorf("unknown proxy_acme_dns_provider value '%s'", tConfig.AcmeDNSProvider)
+	}
+	appConfig.AcmeDNSProvider = tConfig.AcmeDNSProvider
+
+	appConfig.AcmeDNSPropagation, err = time.ParseDuration(tConfig.AcmeDNSPropagation)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_acme_dns_propagation: %s", err)
+	}
+
+	if appConfig.AcmeDNSProvider == DNSProviderRFC2136 && tConfig.RFC2136Server == "" {
+		return nil, errors.New("proxy_acme_rfc2136_server is required for rfc2136 DNS provider")
+	}
+	if (tConfig.RFC2136TSIGKey == "") != (tConfig.RFC2136TSIGSecret == "") {
+		return nil, errors.New("proxy_acme_rfc2136_tsig_key and proxy_acme_rfc2136_tsig_secret must be used together")
+	}
+	appConfig.RFC2136Server = tConfig.RFC2136Server
+	appConfig.RFC2136Zone = tConfig.RFC2136Zone
+	appConfig.RFC2136TSIGKey = tConfig.RFC2136TSIGKey
+	appConfig.RFC2136TSIGSecret = tConfig.RFC2136TSIGSecret
+	appConfig.RFC2136TSIGAlgorithm = tConfig.RFC2136TSIGAlgorithm
+
 	appConfig.HTTPAddress = tConfig.HTTPAddress
 	appConfig.HTTPSAddress = tConfig.HTTPSAddress
 
 	appConfig.ListenHTTPSDomain = tConfig.ListenHTTPSDomain
 
+	if tConfig.ListenAPI != "" {
+		_, _, errS := net.SplitHostPort(tConfig.ListenAPI)
+		if errS != nil {
+			return nil, fmt.Errorf("proxy_listen_api: '%s': wrong format (ex: '127.0.0.1:8787')", tConfig.ListenAPI)
+		}
+	}
+	appConfig.ListenAPI = tConfig.ListenAPI
+
+	switch tConfig.AccessLogFormat {
+	case AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown proxy_access_log_format value '%s'", tConfig.AccessLogFormat)
+	}
+	appConfig.AccessLogFile = tConfig.AccessLogFile
+	appConfig.AccessLogDir = tConfig.AccessLogDir
+	appConfig.AccessLogFormat = tConfig.AccessLogFormat
+
+	timeouts := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"proxy_read_header_timeout", tConfig.ReadHeaderTimeout, &appConfig.ReadHeaderTimeout},
+		{"proxy_read_timeout", tConfig.ReadTimeout, &appConfig.ReadTimeout},
+		{"proxy_write_timeout", tConfig.WriteTimeout, &appConfig.WriteTimeout},
+		{"proxy_idle_timeout", tConfig.IdleTimeout, &appConfig.IdleTimeout},
+	}
+	for _, timeout := range timeouts {
+		duration, errP := time.ParseDuration(timeout.value)
+		if errP != nil || duration < 0 {
+			return nil, fmt.Errorf("%s: invalid duration '%s'", timeout.name, timeout.value)
+		}
+		*timeout.dest = duration
+	}
+
 	switch tConfig.ChainMode {
 	case "":
 		appConfig.ChainMode = ChainModeNone
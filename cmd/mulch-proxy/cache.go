@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// CacheDirectory is the directory (in data_path) of disk caches, wiped
+// when mulch-proxy starts
+const CacheDirectory = "proxy-cache"
+
+type contextKeyCacheType struct{}
+
+var contextKeyCache = contextKeyCacheType{}
+
+// cacheRequest is attached to cacheable requests (see contextKeyCache),
+// so the response can be stored
+type cacheRequest struct {
+	cache *HTTPCache
+	key   string
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte // memory storage
+	file    string // disk storage (unique per entry)
+	size    uint64
+	stored  time.Time
+	expires time.Time
+}
+
+// HTTPCache is a small LRU HTTP cache for a domain, shared by all clients,
+// so only explicitly fresh and public responses are stored
+type HTTPCache struct {
+	config      common.DomainCache
+	fingerprint string // cache is purged if the domain changes (ex: rebuild)
+	dir         string // disk storage directory
+	entries     map[string]*list.Element
+	lru         *list.List
+	size        uint64
+	purged      bool
+	mutex       sync.Mutex
+	log         *Log
+}
+
+// NewHTTPCache creates a new HTTPCache, baseDir is only used for disk storage
+func NewHTTPCache(config *common.DomainCache, fingerprint string, baseDir string, log *Log) (*HTTPCache, error) {
+	cache := &HTTPCache{
+		config:      *config,
+		fingerprint: fingerprint,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		log:         log,
+	}
+
+	if config.Disk {
+		err := os.MkdirAll(baseDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		// a replaced cache is purged, so never share a directory
+		cache.dir, err = ioutil.TempDir(baseDir, "domain-")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cache, nil
+}
+
+// cacheFingerprint identifies the configuration and the destination of a
+// domain, for cache reuse
+func cacheFingerprint(domain *common.Domain) string {
+	var backends []string
+	for _, backend := range domain.Backends {
+		backends = append(backends, backend.VMName)
+	}
+	// cached responses include response header rules
+	var headers string
+	if domain.Headers != nil {
+		headers = fmt.Sprint(domain.Headers.Response)
+	}
+	return strings.Join([]string{
+		strconv.FormatUint(domain.Cache.MaxSize, 10),
+		strconv.FormatUint(domain.Cache.MaxObjectSize, 10),
+		strconv.FormatBool(domain.Cache.Disk),
+		strconv.FormatBool(domain.Compression != nil),
+		domain.VMName,
+		domain.DestinationHost,
+		strings.Join(backends, ","),
+		headers,
+	}, "|")
+}
+
+// cacheRequestKey returns the cache key of a request, or false if the
+// request can't use the cache
+func cacheRequestKey(req *http.Request, host string, compressed bool) (string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	if req.Header.Get("Range") != "" || req.Header.Get("Authorization") != "" {
+		return "", false
+	}
+	if strings.Contains(req.Header.Get("Cache-Control"), "no-store") {
+		return "", false
+	}
+
+	key := host + req.URL.RequestURI()
+
+	// without proxy compression, we store upstream gzip responses too
+	if !compressed && compressNegotiate(req.Header.Get("Accept-Encoding"), []string{common.CompressionGzip}) != "" {
+		key = key + "|gzip"
+	}
+	return key, true
+}
+
+// returns the freshness lifetime of a response, or false if the response
+// can't be stored in a shared cache
+func cacheResponseTTL(res *http.Response) (time.Duration, bool) {
+	if res.Request.Method != http.MethodGet || res.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	if len(res.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+
+	for _, vary := range strings.Split(strings.Join(res.Header.Values("Vary"), ","), ",") {
+		vary = strings.ToLower(strings.TrimSpace(vary))
+		if vary != "" && vary != "accept-encoding" {
+			return 0, false
+		}
+	}
+
+	var ttl time.Duration
+	found := false
+	for _, directive := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		parts := strings.SplitN(directive, "=", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch parts[0] {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "s-maxage":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+			found = true
+		case "max-age":
+			if found {
+				continue // s-maxage wins
+			}
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+			found = true
+		}
+	}
+
+	if !found {
+		expires, err := http.ParseTime(res.Header.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(res.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = expires.Sub(date)
+	}
+
+	if age, err := strconv.Atoi(res.Header.Get("Age")); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// Get a fresh entry from the cache and its body, nil if none (the body
+// is opened here, so the entry can't be removed meanwhile)
+func (cache *HTTPCache) Get(key string) (*cacheEntry, io.ReadCloser) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, exists := cache.entries[key]
+	if !exists {
+		return nil, nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.remove(elem)
+		return nil, nil
+	}
+
+	if entry.file == "" {
+		cache.lru.MoveToFront(elem)
+		return entry, ioutil.NopCloser(bytes.NewReader(entry.body))
+	}
+
+	f, err := os.Open(entry.file)
+	if err != nil {
+		cache.log.Errorf("cache: %s", err)
+		cache.remove(elem)
+		return nil, nil
+	}
+	cache.lru.MoveToFront(elem)
+	return entry, f
+}
+
+// Put a response in the cache, evicting least recently used entries
+func (cache *HTTPCache) Put(entry *cacheEntry, body []byte) {
+	entry.size = uint64(len(body))
+	if entry.size > cache.config.MaxObjectSize {
+		return
+	}
+
+	cache.mutex.Lock()
+	purged := cache.purged
+	cache.mutex.Unlock()
+	if purged {
+		return // (replaced by a new cache)
+	}
+
+	if cache.dir != "" {
+		// each entry has its own file, removed with the entry (an open
+		// file is still readable by a client being served)
+		f, err := ioutil.TempFile(cache.dir, "entry-")
+		if err != nil {
+			cache.log.Errorf("cache: %s", err)
+			return
+		}
+		_, err = f.Write(body)
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			cache.log.Errorf("cache: %s", err)
+			return
+		}
+		entry.file = f.Name()
+	} else {
+		entry.body = body
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.purged {
+		if entry.file != "" {
+			os.Remove(entry.file)
+		}
+		return
+	}
+
+	// replaced entry
+	if elem, exists := cache.entries[entry.key]; exists {
+		cache.remove(elem)
+	}
+
+	for cache.size+entry.size > cache.config.MaxSize && cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.size += entry.size
+}
+
+// remove an entry (mutex must be locked)
+func (cache *HTTPCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	cache.lru.Remove(elem)
+	delete(cache.entries, entry.key)
+	cache.size -= entry.size
+	if entry.file != "" {
+		os.Remove(entry.file)
+	}
+}
+
+// Purge all entries
+func (cache *HTTPCache) Purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+	cache.size = 0
+	cache.purged = true
+	if cache.dir != "" {
+		os.RemoveAll(cache.dir)
+	}
+}
+
+// Serve a cached response, body is closed
+func (entry *cacheEntry) Serve(res http.ResponseWriter, req *http.Request, body io.ReadCloser) {
+	defer body.Close()
+
+	header := res.Header()
+	for name, values := range entry.header {
+		header[name] = values
+	}
+	header.Set("Content-Length", strconv.FormatUint(entry.size, 10))
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	header.Set("X-Cache", "HIT")
+	res.WriteHeader(entry.status)
+
+	if req.Method != http.MethodHead {
+		io.Copy(res, body)
+	}
+}
+
+// cacheReadCloser stores the response body in the cache once it's been
+// completely read
+type cacheReadCloser struct {
+	io.ReadCloser
+	cache *HTTPCache
+	entry *cacheEntry
+	buf   bytes.Buffer
+	over  bool // body is too large
+}
+
+func (r *cacheReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.over {
+		r.buf.Write(p[:n])
+		if uint64(r.buf.Len()) > r.cache.config.MaxObjectSize {
+			r.over = true
+			r.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !r.over {
+		r.over = true // only once
+		r.cache.Put(r.entry, r.buf.Bytes())
+	}
+	return n, err
+}
+
+// cacheResponse prepares the storage of a response, if cacheable
+func cacheResponse(res *http.Response) {
+	cacheReq, ok := res.Request.Context().Value(contextKeyCache).(*cacheRequest)
+	if !ok {
+		return
+	}
+
+	ttl, cacheable := cacheResponseTTL(res)
+	if !cacheable {
+		res.Header.Set("X-Cache", "MISS")
+		return
+	}
+	if res.ContentLength > int64(cacheReq.cache.config.MaxObjectSize) {
+		res.Header.Set("X-Cache", "MISS")
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     cacheReq.key,
+		status:  res.StatusCode,
+		header:  res.Header.Clone(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	res.Header.Set("X-Cache", "MISS")
+
+	res.Body = &cacheReadCloser{
+		ReadCloser: res.Body,
+		cache:      cacheReq.cache,
+		entry:      entry,
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestCompressNegotiate(t *testing.T) {
+	both := []string{common.CompressionBrotli, common.CompressionGzip}
+	tests := []struct {
+		acceptEncoding string
+		algorithms     []string
+		want           string
+	}{
+		{"", both, ""},
+		{"gzip", both, common.CompressionGzip},
+		{"gzip, deflate, br", both, common.CompressionBrotli},
+		{"br;q=0, gzip", both, common.CompressionGzip},
+		{"BR , GZIP;q=0.5", both, common.CompressionBrotli},
+		{"gzip;q=0", both, ""},
+		{"identity", both, ""},
+		{"gzip, br", []string{common.CompressionGzip}, common.CompressionGzip},
+		{"*", both, ""}, // not supported, client will get identity
+	}
+
+	for _, test := range tests {
+		if got := compressNegotiate(test.acceptEncoding, test.algorithms); got != test.want {
+			t.Errorf("compressNegotiate(%q, %v): got %q, want %q", test.acceptEncoding, test.algorithms, got, test.want)
+		}
+	}
+}
+
+func TestCacheRequestKey(t *testing.T) {
+	tests := []struct {
+		method     string
+		url        string
+		header     map[string]string
+		compressed bool
+		want       string
+		cacheable  bool
+	}{
+		{"GET", "/a.css?v=1", nil, true, "example.com/a.css?v=1", true},
+		{"HEAD", "/a.css", nil, true, "example.com/a.css", true},
+		{"POST", "/a.css", nil, true, "", false},
+		{"GET", "/a.css", map[string]string{"Range": "bytes=0-10"}, true, "", false},
+		{"GET", "/a.css", map[string]string{"Authorization": "Basic eDp5"}, true, "", false},
+		{"GET", "/a.css", map[string]string{"Cache-Control": "no-store"}, true, "", false},
+		{"GET", "/a.css", map[string]string{"Accept-Encoding": "gzip"}, false, "example.com/a.css|gzip", true},
+		{"GET", "/a.css", map[string]string{"Accept-Encoding": "gzip"}, true, "example.com/a.css", true},
+		{"GET", "/a.css", map[string]string{"Accept-Encoding": "br"}, false, "example.com/a.css", true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		got, cacheable := cacheRequestKey(req, "example.com", test.compressed)
+		if got != test.want || cacheable != test.cacheable {
+			t.Errorf("cacheRequestKey(%s %s, %v): got (%q, %t), want (%q, %t)", test.method, test.url, test.header, got, cacheable, test.want, test.cacheable)
+		}
+	}
+}
+
+func TestCacheResponseTTL(t *testing.T) {
+	date := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		method    string
+		status    int
+		header    map[string][]string
+		want      time.Duration
+		cacheable bool
+	}{
+		{"max-age", "GET", 200, map[string][]string{"Cache-Control": {"public, max-age=60"}}, 60 * time.Second, true},
+		{"quoted max-age", "GET", 200, map[string][]string{"Cache-Control": {`max-age="60"`}}, 60 * time.Second, true},
+		{"s-maxage first", "GET", 200, map[string][]string{"Cache-Control": {"s-maxage=120, max-age=60"}}, 120 * time.Second, true},
+		{"s-maxage last", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120 * time.Second, true},
+		{"age", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{"too old", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Age": {"60"}}, 0, false},
+		{"max-age zero", "GET", 200, map[string][]string{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"bad max-age", "GET", 200, map[string][]string{"Cache-Control": {"max-age=abc"}}, 0, false},
+		{"expires", "GET", 200, map[string][]string{
+			"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+			"Date":    {date.Format(http.TimeFormat)},
+		}, time.Hour, true},
+		{"expires and age", "GET", 200, map[string][]string{
+			"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+			"Date":    {date.Format(http.TimeFormat)},
+			"Age":     {"600"},
+		}, 50 * time.Minute, true},
+		{"max-age wins over expires", "GET", 200, map[string][]string{
+			"Cache-Control": {"max-age=10"},
+			"Expires":       {date.Add(time.Hour).Format(http.TimeFormat)},
+			"Date":          {date.Format(http.TimeFormat)},
+		}, 10 * time.Second, true},
+		{"expired", "GET", 200, map[string][]string{
+			"Expires": {date.Format(http.TimeFormat)},
+			"Date":    {date.Format(http.TimeFormat)},
+		}, 0, false},
+		{"invalid expires", "GET", 200, map[string][]string{"Expires": {"0"}}, 0, false},
+		{"no freshness", "GET", 200, nil, 0, false},
+		{"vary encoding", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, 60 * time.Second, true},
+		{"vary cookie", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding, Cookie"}}, 0, false},
+		{"vary headers", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Vary": {"accept-encoding", "User-Agent"}}, 0, false},
+		{"private", "GET", 200, map[string][]string{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"no-store", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60, no-store"}}, 0, false},
+		{"no-cache", "GET", 200, map[string][]string{"Cache-Control": {"no-cache"}}, 0, false},
+		{"set-cookie", "GET", 200, map[string][]string{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 0, false},
+		{"head", "HEAD", 200, map[string][]string{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"not found", "GET", 404, map[string][]string{"Cache-Control": {"max-age=60"}}, 0, false},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{},
+			Request:    httptest.NewRequest(test.method, "/", nil),
+		}
+		for name, values := range test.header {
+			for _, value := range values {
+				res.Header.Add(name, value)
+			}
+		}
+		got, cacheable := cacheResponseTTL(res)
+		if got != test.want || cacheable != test.cacheable {
+			t.Errorf("%s: got (%s, %t), want (%s, %t)", test.name, got, cacheable, test.want, test.cacheable)
+		}
+	}
+}
+
+func TestCompressResponseWriter(t *testing.T) {
+	config := &common.DomainCompression{
+		Algorithms: []string{common.CompressionGzip},
+		MinSize:    10,
+		Types:      []string{"text/", "application/json"},
+	}
+	body := strings.Repeat("compressible ", 100)
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		status         int
+		header         map[string]string
+		wantEncoding   string
+		wantETag       string
+	}{
+		{"gzip", "GET", "gzip", 200, map[string]string{"Content-Type": "text/html", "ETag": `"abc"`}, "gzip", `W/"abc"`},
+		{"weak etag", "GET", "gzip", 200, map[string]string{"Content-Type": "application/json", "ETag": `W/"abc"`}, "gzip", `W/"abc"`},
+		{"sniffed type", "GET", "gzip", 200, nil, "gzip", ""},
+		{"not accepted", "GET", "br", 200, map[string]string{"Content-Type": "text/html", "ETag": `"abc"`}, "", `"abc"`},
+		{"not compressible", "GET", "gzip", 200, map[string]string{"Content-Type": "image/png"}, "", ""},
+		{"already encoded", "GET", "gzip", 200, map[string]string{"Content-Type": "text/html", "Content-Encoding": "br"}, "br", ""},
+		{"too small", "GET", "gzip", 200, map[string]string{"Content-Type": "text/html", "Content-Length": "5"}, "", ""},
+		{"no-transform", "GET", "gzip", 200, map[string]string{"Content-Type": "text/html", "Cache-Control": "no-transform"}, "", ""},
+		{"not ok", "GET", "gzip", 404, map[string]string{"Content-Type": "text/html"}, "", ""},
+		{"head", "HEAD", "gzip", 200, map[string]string{"Content-Type": "text/html"}, "", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+
+		w := newCompressResponseWriter(rec, req, config)
+		for name, value := range test.header {
+			w.Header().Set(name, value)
+		}
+		if test.header != nil {
+			w.WriteHeader(test.status)
+		}
+		if test.method != http.MethodHead {
+			w.Write([]byte(body))
+		}
+		w.Close()
+
+		res := rec.Result()
+		if got := res.Header.Get("Content-Encoding"); got != test.wantEncoding {
+			t.Errorf("%s: got encoding %q, want %q", test.name, got, test.wantEncoding)
+			continue
+		}
+		if got := res.Header.Get("ETag"); got != test.wantETag {
+			t.Errorf("%s: got ETag %q, want %q", test.name, got, test.wantETag)
+		}
+
+		compressible := test.status == 200 && test.header["Content-Type"] != "image/png" && test.header["Content-Encoding"] == ""
+		if compressible && !strings.Contains(res.Header.Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%s: missing Vary header", test.name)
+		}
+
+		if test.wantEncoding == common.CompressionGzip {
+			if res.Header.Get("Content-Length") != "" {
+				t.Errorf("%s: Content-Length must be removed", test.name)
+			}
+			reader, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			got, err := ioutil.ReadAll(reader)
+			if err != nil || string(got) != body {
+				t.Errorf("%s: invalid compressed body (%v)", test.name, err)
+			}
+		} else if test.method != http.MethodHead && rec.Body.String() != body {
+			t.Errorf("%s: body must not be modified", test.name)
+		}
+	}
+}
+
+func TestHTTPCacheDisk(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "mulch-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	config := &common.DomainCache{MaxSize: 8, MaxObjectSize: 6, Disk: true}
+	cache, err := NewHTTPCache(config, "", baseDir, NewLog(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := func() int {
+		infos, err := ioutil.ReadDir(cache.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(infos)
+	}
+	put := func(key string, body string) {
+		cache.Put(&cacheEntry{
+			key:     key,
+			status:  http.StatusOK,
+			header:  http.Header{},
+			expires: time.Now().Add(time.Hour),
+		}, []byte(body))
+	}
+
+	put("a", "aaaa")
+	entry, body := cache.Get("a")
+	if entry == nil {
+		t.Fatal("entry 'a' not found")
+	}
+
+	// the served file survives a replacement
+	put("a", "AAAA")
+	if files() != 1 {
+		t.Errorf("replaced entry: got %d files, want 1", files())
+	}
+	rec := httptest.NewRecorder()
+	entry.Serve(rec, httptest.NewRequest("GET", "/", nil), body)
+	if rec.Body.String() != "aaaa" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("got body %q, want %q", rec.Body.String(), "aaaa")
+	}
+
+	entry, body = cache.Get("a")
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(data, []byte("AAAA")) {
+		t.Errorf("got body %q, want %q", data, "AAAA")
+	}
+
+	// eviction
+	put("b", "bbbbbb")
+	if entry, _ := cache.Get("a"); entry != nil {
+		t.Errorf("entry 'a' must be evicted")
+	}
+	if files() != 1 || cache.size != 6 {
+		t.Errorf("after eviction: got %d files (size %d), want 1 (size 6)", files(), cache.size)
+	}
+
+	// too large
+	put("c", "ccccccc")
+	if entry, _ := cache.Get("c"); entry != nil {
+		t.Errorf("entry 'c' is too large")
+	}
+
+	// expired
+	cache.Put(&cacheEntry{key: "d", expires: time.Now().Add(-time.Second)}, []byte("d"))
+	if entry, _ := cache.Get("d"); entry != nil {
+		t.Errorf("entry 'd' is expired")
+	}
+	if files() != 1 {
+		t.Errorf("after expiration: got %d files, want 1", files())
+	}
+
+	cache.Purge()
+	put("e", "e")
+	if _, err := os.Stat(cache.dir); !os.IsNotExist(err) {
+		t.Errorf("purged cache directory must be removed")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// CertErrorsFilename is the database of certificate issuance errors
+// (in data_path), read by mulchd for certificate inventory and alerts
+const CertErrorsFilename = "mulch-proxy-cert-errors.db"
+
+// CertErrorDatabase records the last certificate issuance error of domains
+type CertErrorDatabase struct {
+	filename string
+	db       map[string]*common.ProxyCertError
+	mutex    sync.Mutex
+	log      *Log
+}
+
+// NewCertErrorDatabase creates a new database, starting empty (errors
+// of the previous run are not relevant anymore)
+func NewCertErrorDatabase(filename string, log *Log) (*CertErrorDatabase, error) {
+	cdb := &CertErrorDatabase{
+		filename: filename,
+		db:       make(map[string]*common.ProxyCertError),
+		log:      log,
+	}
+
+	// check if we can write
+	err := cdb.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return cdb, nil
+}
+
+func (cdb *CertErrorDatabase) save() error {
+	f, err := os.OpenFile(cdb.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&cdb.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Set the last error of a domain, keeping the time of the first failure
+func (cdb *CertErrorDatabase) Set(domain string, certErr error) {
+	cdb.mutex.Lock()
+	defer cdb.mutex.Unlock()
+
+	now := time.Now()
+	previous, exists := cdb.db[domain]
+	if exists && previous.Error == certErr.Error() && now.Sub(previous.Last) < time.Hour {
+		return // don't rewrite the file for each handshake
+	}
+
+	first := now
+	if exists {
+		first = previous.Time // still failing
+	}
+
+	cdb.db[domain] = &common.ProxyCertError{
+		Time:  first,
+		Last:  now,
+		Error: certErr.Error(),
+	}
+	err := cdb.save()
+	if err != nil {
+		cdb.log.Errorf("saving %s: %s", cdb.filename, err)
+	}
+}
+
+// Clear the error of a domain (successful issuance)
+func (cdb *CertErrorDatabase) Clear(domain string) {
+	cdb.mutex.Lock()
+	defer cdb.mutex.Unlock()
+
+	if _, exists := cdb.db[domain]; !exists {
+		return
+	}
+
+	delete(cdb.db, domain)
+	err := cdb.save()
+	if err != nil {
+		cdb.log.Errorf("saving %s: %s", cdb.filename, err)
+	}
+}
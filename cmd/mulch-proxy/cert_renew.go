@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/OnitiFR/mulch/common"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertRenewIssuingDirectory is where forced renewals are issued (in the
+// autocert cache), certificates are moved to the cache only on success
+const CertRenewIssuingDirectory = "renew-issuing"
+
+// Certificate key types (autocert stores RSA certificates with a "+rsa" suffix)
+const (
+	CertKeyTypeECDSA = "ecdsa"
+	CertKeyTypeRSA   = "rsa"
+)
+
+// certRenewal is a forced renewal requested by mulchd, issued by
+// its own autocert manager on the next TLS handshake for the domain
+type certRenewal struct {
+	manager *autocert.Manager
+	pending map[string]bool // key types
+}
+
+// renewCache is an autocert cache storing the certificates of a domain in
+// a temporary directory, other entries (account key, …) use the main cache
+type renewCache struct {
+	main    autocert.DirCache
+	issuing autocert.DirCache
+	domain  string
+}
+
+func (cache *renewCache) get(key string) autocert.DirCache {
+	if key == cache.domain || key == cache.domain+"+rsa" {
+		return cache.issuing
+	}
+	return cache.main
+}
+
+// Get a cache entry
+func (cache *renewCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return cache.get(key).Get(ctx, key)
+}
+
+// Put a cache entry
+func (cache *renewCache) Put(ctx context.Context, key string, data []byte) error {
+	return cache.get(key).Put(ctx, key, data)
+}
+
+// Delete a cache entry
+func (cache *renewCache) Delete(ctx context.Context, key string) error {
+	return cache.get(key).Delete(ctx, key)
+}
+
+// parse a renewal request file (key types, one per line)
+func parseRenewRequest(content string) map[string]bool {
+	keyTypes := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		switch keyType := strings.TrimSpace(line); keyType {
+		case CertKeyTypeECDSA, CertKeyTypeRSA:
+			keyTypes[keyType] = true
+		}
+	}
+	if len(keyTypes) == 0 {
+		keyTypes[CertKeyTypeECDSA] = true
+	}
+	return keyTypes
+}
+
+// loadRenewRequests reads forced renewal requests written by mulchd
+// (see 'mulch cert renew'), request files are deleted once loaded
+func (proxy *ProxyServer) loadRenewRequests() {
+	dir := path.Clean(proxy.config.DirCache + "/" + common.CertRenewDirectory)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // no request yet
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		domain := info.Name()
+		filename := path.Clean(dir + "/" + domain)
+		content, err := ioutil.ReadFile(filename)
+		os.Remove(filename)
+		if err != nil {
+			proxy.Log.Errorf("renewal request for %s: %s", domain, err)
+			continue
+		}
+
+		// wildcard certificates are issued in the background (DNS-01)
+		if strings.HasPrefix(domain, "*.") {
+			if proxy.config.DNSCertManager != nil {
+				proxy.Log.Infof("%s: forced renewal requested", domain)
+				proxy.config.DNSCertManager.Renew(domain)
+			}
+			continue
+		}
+
+		manager := proxy.newManager()
+		manager.Cache = &renewCache{
+			main:    autocert.DirCache(proxy.config.DirCache),
+			issuing: autocert.DirCache(path.Clean(proxy.config.DirCache + "/" + CertRenewIssuingDirectory)),
+			domain:  domain,
+		}
+		manager.HTTPHandler(nil) // enables HTTP-01 challenges, like the main manager
+
+		proxy.Log.Infof("%s: forced renewal requested", domain)
+		proxy.managerMutex.Lock()
+		proxy.renewals[domain] = &certRenewal{
+			manager: manager,
+			pending: parseRenewRequest(string(content)),
+		}
+		proxy.managerMutex.Unlock()
+	}
+}
+
+// returns the autocert manager for host (a renewal one, if any)
+func (proxy *ProxyServer) getManagerFor(host string) *autocert.Manager {
+	proxy.managerMutex.Lock()
+	defer proxy.managerMutex.Unlock()
+
+	renewal, exists := proxy.renewals[host]
+	if exists {
+		return renewal.manager
+	}
+	return proxy.manager
+}
+
+// issue the renewed certificate of host, it replaces the current one
+// only if the issuance succeeds
+func (proxy *ProxyServer) renewACMECertificate(hello *tls.ClientHelloInfo, host string) (*tls.Certificate, error) {
+	proxy.managerMutex.Lock()
+	renewal, exists := proxy.renewals[host]
+	proxy.managerMutex.Unlock()
+	if !exists {
+		return nil, nil
+	}
+
+	cert, err := renewal.manager.GetCertificate(hello)
+
+	proxy.managerMutex.Lock()
+	defer proxy.managerMutex.Unlock()
+
+	keyType := CertKeyTypeECDSA
+	if err == nil {
+		if _, isRSA := cert.PrivateKey.(*rsa.PrivateKey); isRSA {
+			keyType = CertKeyTypeRSA
+		}
+	}
+
+	if proxy.renewals[host] == renewal {
+		delete(renewal.pending, keyType)
+		if err != nil || len(renewal.pending) == 0 {
+			delete(proxy.renewals, host)
+		}
+	}
+
+	if err != nil {
+		proxy.Log.Errorf("%s: forced renewal failed: %s", host, err)
+		proxy.config.CertErrors.Set(host, err)
+		return nil, err
+	}
+
+	// move the new certificate to the cache, the main manager is
+	// replaced to forget the previous one
+	for _, name := range []string{host, host + "+rsa"} {
+		issued := path.Clean(proxy.config.DirCache + "/" + CertRenewIssuingDirectory + "/" + name)
+		err = os.Rename(issued, path.Clean(proxy.config.DirCache+"/"+name))
+		if err != nil && !os.IsNotExist(err) {
+			proxy.Log.Errorf("%s: forced renewal: %s", host, err)
+			proxy.config.CertErrors.Set(host, err)
+			return nil, err
+		}
+	}
+	proxy.manager = proxy.newManager()
+	proxy.certFiles = proxy.listCertFiles()
+
+	proxy.Log.Infof("%s: %s certificate renewed", host, keyType)
+	proxy.config.CertErrors.Clear(host)
+	return cert, nil
+}
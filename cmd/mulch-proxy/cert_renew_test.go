@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestParseRenewRequest(t *testing.T) {
+	tests := map[string][]string{
+		"":              {CertKeyTypeECDSA},
+		"ecdsa\n":       {CertKeyTypeECDSA},
+		"ecdsa\nrsa\n":  {CertKeyTypeECDSA, CertKeyTypeRSA},
+		"rsa":           {CertKeyTypeRSA},
+		" rsa \nother ": {CertKeyTypeRSA},
+	}
+	for content, want := range tests {
+		got := parseRenewRequest(content)
+		if len(got) != len(want) {
+			t.Errorf("%q: got %v, want %v", content, got, want)
+			continue
+		}
+		for _, keyType := range want {
+			if got[keyType] == false {
+				t.Errorf("%q: got %v, want %v", content, got, want)
+			}
+		}
+	}
+}
+
+func TestRenewCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := &renewCache{
+		main:    autocert.DirCache(dir),
+		issuing: autocert.DirCache(path.Join(dir, CertRenewIssuingDirectory)),
+		domain:  "test.com",
+	}
+	ctx := context.Background()
+
+	// current certificate is not visible to the renewal manager
+	ioutil.WriteFile(path.Join(dir, "test.com"), []byte("current"), 0600)
+	if _, err := cache.Get(ctx, "test.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("got %v, want a cache miss", err)
+	}
+
+	for _, key := range []string{"test.com", "test.com+rsa"} {
+		if err := cache.Put(ctx, key, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path.Join(dir, CertRenewIssuingDirectory, key)); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+	data, _ := ioutil.ReadFile(path.Join(dir, "test.com"))
+	if string(data) != "current" {
+		t.Errorf("current certificate was modified: %s", data)
+	}
+
+	// account key and other domains use the main cache
+	if err := cache.Put(ctx, "acme_account+key", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "acme_account+key")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadRenewRequests(t *testing.T) {
+	dir := t.TempDir()
+	renewDir := path.Join(dir, common.CertRenewDirectory)
+	os.Mkdir(renewDir, 0700)
+	ioutil.WriteFile(path.Join(renewDir, "test.com"), []byte("ecdsa\nrsa\n"), 0600)
+	ioutil.WriteFile(path.Join(renewDir, "*.test.com"), nil, 0600)
+
+	proxy := &ProxyServer{
+		Log:      NewLog(false),
+		config:   &ProxyServerParams{DirCache: dir},
+		renewals: make(map[string]*certRenewal),
+	}
+	proxy.manager = proxy.newManager()
+	proxy.loadRenewRequests()
+
+	renewal, exists := proxy.renewals["test.com"]
+	if !exists || len(renewal.pending) != 2 {
+		t.Fatalf("got renewals %v", proxy.renewals)
+	}
+	if len(proxy.renewals) != 1 {
+		t.Errorf("got %d renewals, want 1 (no DNS manager for wildcards)", len(proxy.renewals))
+	}
+	if proxy.getManagerFor("test.com") != renewal.manager || proxy.getManagerFor("other.com") != proxy.manager {
+		t.Error("wrong manager")
+	}
+
+	files, _ := ioutil.ReadDir(renewDir)
+	if len(files) != 0 {
+		t.Errorf("%d request file(s) left", len(files))
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/OnitiFR/mulch/common"
+	"github.com/andybalholm/brotli"
+)
+
+// compression levels, favoring speed (responses are compressed on the fly)
+const (
+	compressBrotliLevel = 4
+	compressGzipLevel   = 5
+)
+
+var brotliWriterPool = sync.Pool{
+	New: func() interface{} {
+		return brotli.NewWriterLevel(nil, compressBrotliLevel)
+	},
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(nil, compressGzipLevel)
+		return writer
+	},
+}
+
+// compressor is implemented by brotli and gzip writers
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressResponseWriter compresses the response, if the client supports
+// it and if the response is worth compressing (see Close)
+type compressResponseWriter struct {
+	http.ResponseWriter
+	config   *common.DomainCompression
+	encoding string // chosen encoding, "" if not supported by the client
+	head     bool
+	decided  bool
+	writer   compressor // nil if the response is not compressed
+}
+
+func newCompressResponseWriter(res http.ResponseWriter, req *http.Request, config *common.DomainCompression) *compressResponseWriter {
+	return &compressResponseWriter{
+		ResponseWriter: res,
+		config:         config,
+		encoding:       compressNegotiate(req.Header.Get("Accept-Encoding"), config.Algorithms),
+		head:           req.Method == http.MethodHead,
+	}
+}
+
+// returns the first algorithm accepted by the client, "" if none
+func compressNegotiate(acceptEncoding string, algorithms []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = value
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+
+	for _, algorithm := range algorithms {
+		if accepted[algorithm] {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// is this MIME type compressible?
+func (w *compressResponseWriter) compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, mimeType := range w.config.Types {
+		if mediaType == mimeType || (strings.HasSuffix(mimeType, "/") && strings.HasPrefix(mediaType, mimeType)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	// informational responses (ex: 103 Early Hints) are followed by the real one
+	if w.decided || (code >= 100 && code < 200 && code != http.StatusSwitchingProtocols) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.decided = true
+
+	header := w.Header()
+	if code != http.StatusOK || header.Get("Content-Encoding") != "" || !w.compressibleType(header.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// the response may vary, even if this client does not support compression
+	if !strings.Contains(strings.ToLower(strings.Join(header.Values("Vary"), ",")), "accept-encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	small := false
+	if length, err := strconv.ParseUint(header.Get("Content-Length"), 10, 64); err == nil && length < w.config.MinSize {
+		small = true
+	}
+
+	if w.encoding == "" || w.head || small || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	switch w.encoding {
+	case common.CompressionBrotli:
+		w.writer = brotliWriterPool.Get().(*brotli.Writer)
+	case common.CompressionGzip:
+		w.writer = gzipWriterPool.Get().(*gzip.Writer)
+	}
+	w.writer.Reset(w.ResponseWriter)
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer != nil {
+		return w.writer.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush is needed for streamed responses
+func (w *compressResponseWriter) Flush() {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is needed for protocol upgrades (websockets)
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection hijacking is not supported")
+	}
+	return hijacker.Hijack()
+}
+
+// Close flushes the compressed stream, must be called at the end of the request
+func (w *compressResponseWriter) Close() {
+	if w.writer == nil {
+		return
+	}
+	w.writer.Close()
+
+	switch writer := w.writer.(type) {
+	case *brotli.Writer:
+		writer.Reset(nil)
+		brotliWriterPool.Put(writer)
+	case *gzip.Writer:
+		writer.Reset(nil)
+		gzipWriterPool.Put(writer)
+	}
+	w.writer = nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CustomCertsDirectory is the directory (in data_path) of certificates
+// imported using mulchd (see 'mulch cert import'), one file per domain
+// using autocert format
+const CustomCertsDirectory = "custom-certs"
+
+// CustomCertStore serves imported certificates, preferred over ACME
+type CustomCertStore struct {
+	dir   string
+	certs map[string]*tls.Certificate
+	mutex sync.Mutex
+	log   *Log
+}
+
+// NewCustomCertStore creates a new CustomCertStore and loads certificates
+func NewCustomCertStore(dir string, log *Log) *CustomCertStore {
+	store := &CustomCertStore{
+		dir:   dir,
+		certs: make(map[string]*tls.Certificate),
+		log:   log,
+	}
+	store.Reload()
+	return store
+}
+
+// Reload all certificates from disk (the directory may not exist)
+func (store *CustomCertStore) Reload() {
+	certs := make(map[string]*tls.Certificate)
+
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil && !os.IsNotExist(err) {
+		store.log.Errorf("custom certificates: %s", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Clean(store.dir + "/" + file.Name()))
+		if err != nil {
+			store.log.Errorf("custom certificate %s: %s", file.Name(), err)
+			continue
+		}
+		cert, err := parseCertificate(data)
+		if err != nil {
+			store.log.Errorf("custom certificate %s: %s", file.Name(), err)
+			continue
+		}
+		certs[strings.ToLower(file.Name())] = cert
+	}
+
+	store.mutex.Lock()
+	store.certs = certs
+	store.mutex.Unlock()
+
+	if len(certs) > 0 {
+		store.log.Infof("loaded %d custom certificate(s)", len(certs))
+	}
+}
+
+// Get returns the certificate for host (exact or wildcard match), or
+// nil if there's no valid imported certificate
+func (store *CustomCertStore) Get(host string) *tls.Certificate {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for _, name := range []string{host, wildcardHost(host)} {
+		cert, exists := store.certs[name]
+		if exists && now.Before(cert.Leaf.NotAfter) {
+			return cert
+		}
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS providers
+const (
+	DNSProviderRFC2136 = "rfc2136"
+)
+
+// DNSProvider publishes TXT records for ACME DNS-01 challenges
+type DNSProvider interface {
+	// Present creates the TXT record fqdn (ex: _acme-challenge.example.com.)
+	Present(fqdn string, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(fqdn string, value string) error
+}
+
+// NewDNSProvider returns the DNS provider selected in the configuration
+func NewDNSProvider(config *AppConfig) (DNSProvider, error) {
+	switch config.AcmeDNSProvider {
+	case DNSProviderRFC2136:
+		return NewRFC2136Provider(
+			config.RFC2136Server,
+			config.RFC2136Zone,
+			config.RFC2136TSIGKey,
+			config.RFC2136TSIGSecret,
+			config.RFC2136TSIGAlgorithm,
+		)
+	}
+	return nil, fmt.Errorf("unknown DNS provider '%s'", config.AcmeDNSProvider)
+}
+
+// RFC2136 (DNS UPDATE) constants
+const (
+	rfc2136Timeout     = 10 * time.Second
+	rfc2136TTL         = 60
+	rfc2136OpCode      = 5
+	rfc2136ClassNone   = 254
+	rfc2136TypeTSIG    = 250
+	rfc2136TSIGFudge   = 300
+	rfc2136DefaultAlgo = "hmac-sha256"
+)
+
+var rfc2136Algorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// RFC2136Provider updates TXT records using DNS UPDATE messages (RFC 2136),
+// signed with a TSIG key (RFC 8945), ex: BIND nsupdate compatible servers
+type RFC2136Provider struct {
+	server    string // host:port
+	zone      string // "" = auto (SOA lookup)
+	keyName   string
+	secret    []byte
+	algorithm string
+}
+
+// NewRFC2136Provider creates a RFC2136Provider, secret is base64 encoded
+// (TSIG is optional but strongly recommended)
+func NewRFC2136Provider(server string, zone string, keyName string, secret string, algorithm string) (*RFC2136Provider, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, fmt.Errorf("rfc2136: invalid server '%s' (ex: 127.0.0.1:53)", server)
+	}
+
+	if algorithm == "" {
+		algorithm = rfc2136DefaultAlgo
+	}
+	algorithm = strings.TrimSuffix(strings.ToLower(algorithm), ".")
+	if _, exists := rfc2136Algorithms[algorithm]; !exists {
+		return nil, fmt.Errorf("rfc2136: unsupported TSIG algorithm '%s'", algorithm)
+	}
+
+	provider := &RFC2136Provider{
+		server:    server,
+		algorithm: algorithm,
+	}
+	if zone != "" {
+		provider.zone = dnsFQDN(zone)
+	}
+
+	if keyName != "" {
+		provider.keyName = dnsFQDN(keyName)
+		decoded, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2136: invalid TSIG secret: %s", err)
+		}
+		provider.secret = decoded
+	}
+
+	return provider, nil
+}
+
+// Present implements DNSProvider
+func (p *RFC2136Provider) Present(fqdn string, value string) error {
+	return p.update(fqdn, value, false)
+}
+
+// CleanUp implements DNSProvider
+func (p *RFC2136Provider) CleanUp(fqdn string, value string) error {
+	return p.update(fqdn, value, true)
+}
+
+func (p *RFC2136Provider) update(fqdn string, value string, remove bool) error {
+	fqdn = dnsFQDN(fqdn)
+
+	zone := p.zone
+	if zone == "" {
+		var err error
+		zone, err = p.findZone(fqdn)
+		if err != nil {
+			return err
+		}
+	}
+
+	zoneName, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return err
+	}
+	rrName, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return err
+	}
+
+	id := uint16(rand.Intn(65536))
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:     id,
+		OpCode: rfc2136OpCode,
+	})
+
+	// zone section
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  zoneName,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	})
+
+	// (no prerequisite) update section
+	builder.StartAnswers()
+	builder.StartAuthorities()
+	hdr := dnsmessage.ResourceHeader{
+		Name:  rrName,
+		Class: dnsmessage.ClassINET,
+		TTL:   rfc2136TTL,
+	}
+	if remove {
+		// delete this RR from the RRset
+		hdr.Class = rfc2136ClassNone
+		hdr.TTL = 0
+	}
+	err = builder.TXTResource(hdr, dnsmessage.TXTResource{TXT: []string{value}})
+	if err != nil {
+		return err
+	}
+
+	msg, err := builder.Finish()
+	if err != nil {
+		return err
+	}
+
+	var requestMAC []byte
+	if p.keyName != "" {
+		msg, requestMAC, err = p.sign(msg, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := p.exchange(msg)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(res)
+	if err != nil {
+		return fmt.Errorf("rfc2136: invalid response: %s", err)
+	}
+	if header.ID != id {
+		return errors.New("rfc2136: invalid response ID")
+	}
+
+	if p.keyName != "" {
+		err = p.verify(res, requestMAC)
+		// error responses may be unsigned (RFC 8945, section 5.3.2)
+		if err != nil && (err != errRFC2136Unsigned || header.RCode == dnsmessage.RCodeSuccess) {
+			return err
+		}
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rfc2136: server refused update of %s: %s", fqdn, header.RCode)
+	}
+	return nil
+}
+
+// find the zone of fqdn using a SOA query (the SOA record is in the answer
+// section for the apex, in the authority section otherwise)
+func (p *RFC2136Provider) findZone(fqdn string) (string, error) {
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return "", err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID: uint16(rand.Intn(65536)),
+	})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := builder.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := p.exchange(msg)
+	if err != nil {
+		return "", err
+	}
+
+	var parser dnsmessage.Parser
+	if _, err = parser.Start(res); err != nil {
+		return "", err
+	}
+	if err = parser.SkipAllQuestions(); err != nil {
+		return "", err
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return "", err
+	}
+	authorities, err := parser.AllAuthorities()
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(answers, authorities...) {
+		if rr.Header.Type == dnsmessage.TypeSOA {
+			return rr.Header.Name.String(), nil
+		}
+	}
+	return "", fmt.Errorf("rfc2136: can't find the zone of %s (no SOA), see proxy_acme_rfc2136_zone setting", fqdn)
+}
+
+// add a TSIG record to the message, returns the signed message and its MAC
+func (p *RFC2136Provider) sign(msg []byte, id uint16) ([]byte, []byte, error) {
+	keyName := dnsWireName(p.keyName)
+	algoName := dnsWireName(p.algorithm)
+	now := uint64(time.Now().Unix())
+
+	timers := make([]byte, 8)
+	binary.BigEndian.PutUint16(timers[0:], uint16(now>>32))
+	binary.BigEndian.PutUint32(timers[2:], uint32(now))
+	binary.BigEndian.PutUint16(timers[6:], rfc2136TSIGFudge)
+
+	// digest: message, then TSIG variables
+	mac := hmac.New(rfc2136Algorithms[p.algorithm], p.secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{0, 255, 0, 0, 0, 0}) // class ANY, TTL 0
+	mac.Write(algoName)
+	mac.Write(timers)
+	mac.Write([]byte{0, 0, 0, 0}) // error, other len
+	sum := mac.Sum(nil)
+
+	var rdata []byte
+	rdata = append(rdata, algoName...)
+	rdata = append(rdata, timers...)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = append(rdata, 0, 0, 0, 0) // error, other len
+
+	signed := append([]byte(nil), msg...)
+	signed = append(signed, keyName...)
+	signed = binary.BigEndian.AppendUint16(signed, rfc2136TypeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, 255) // class ANY
+	signed = binary.BigEndian.AppendUint32(signed, 0)   // TTL
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	// one more additional record
+	if len(signed) < 12 {
+		return nil, nil, errors.New("rfc2136: invalid message")
+	}
+	arCount := binary.BigEndian.Uint16(signed[10:])
+	binary.BigEndian.PutUint16(signed[10:], arCount+1)
+
+	return signed, sum, nil
+}
+
+var errRFC2136Unsigned = errors.New("rfc2136: response is not signed (TSIG)")
+
+// check the TSIG record of a response to a request signed with requestMAC
+// (RFC 8945, section 5.3)
+func (p *RFC2136Provider) verify(res []byte, requestMAC []byte) error {
+	offset, err := dnsLastRecordOffset(res)
+	if err != nil {
+		return fmt.Errorf("rfc2136: invalid response: %s", err)
+	}
+	if offset == -1 {
+		return errRFC2136Unsigned
+	}
+
+	// owner name, type, class, TTL, RDLENGTH
+	record := res[offset:]
+	nameEnd, err := dnsSkipName(record, 0)
+	if err != nil || len(record) < nameEnd+10 {
+		return errRFC2136Unsigned
+	}
+	if binary.BigEndian.Uint16(record[nameEnd:]) != rfc2136TypeTSIG {
+		return errRFC2136Unsigned
+	}
+	rdata := record[nameEnd+10:]
+
+	// RDATA: algorithm, timers, MAC, original ID, error, other
+	algoEnd, err := dnsSkipName(rdata, 0)
+	if err != nil || len(rdata) < algoEnd+10 {
+		return errors.New("rfc2136: invalid response TSIG record")
+	}
+	algoName := rdata[:algoEnd]
+	timers := rdata[algoEnd : algoEnd+8]
+	macSize := int(binary.BigEndian.Uint16(rdata[algoEnd+8:]))
+	rest := rdata[algoEnd+10:]
+	if len(rest) < macSize+6 {
+		return errors.New("rfc2136: invalid response TSIG record")
+	}
+	mac := rest[:macSize]
+	originalID := rest[macSize : macSize+2]
+	tsigError := binary.BigEndian.Uint16(rest[macSize+2:])
+	variables := rest[macSize+2:] // error, other len, other
+
+	if tsigError != 0 {
+		// 16: BADSIG, 17: BADKEY, 18: BADTIME
+		return fmt.Errorf("rfc2136: server rejected our TSIG signature (error %d)", tsigError)
+	}
+	if strings.EqualFold(string(algoName), string(dnsWireName(p.algorithm))) == false {
+		return errors.New("rfc2136: unexpected response TSIG algorithm")
+	}
+
+	signTime := int64(binary.BigEndian.Uint16(timers))<<32 | int64(binary.BigEndian.Uint32(timers[2:]))
+	fudge := int64(binary.BigEndian.Uint16(timers[6:]))
+	delta := time.Now().Unix() - signTime
+	if delta < -fudge || delta > fudge {
+		return errors.New("rfc2136: response TSIG time is out of range")
+	}
+
+	// the response is digested without its TSIG record, using the original ID
+	unsigned := append([]byte(nil), res[:offset]...)
+	copy(unsigned[0:], originalID)
+	arCount := binary.BigEndian.Uint16(unsigned[10:])
+	binary.BigEndian.PutUint16(unsigned[10:], arCount-1)
+
+	expected := hmac.New(rfc2136Algorithms[p.algorithm], p.secret)
+	expected.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+	expected.Write(requestMAC)
+	expected.Write(unsigned)
+	expected.Write(dnsWireName(p.keyName))
+	expected.Write([]byte{0, 255, 0, 0, 0, 0}) // class ANY, TTL 0
+	expected.Write(dnsWireName(p.algorithm))
+	expected.Write(timers)
+	expected.Write(variables)
+	if !hmac.Equal(mac, expected.Sum(nil)) {
+		return errors.New("rfc2136: invalid response TSIG signature")
+	}
+	return nil
+}
+
+// send a message to the server (TCP) and return the response
+func (p *RFC2136Provider) exchange(msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", p.server, rfc2136Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("rfc2136: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rfc2136Timeout))
+
+	packet := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	packet = append(packet, msg...)
+	if _, err = conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("rfc2136: %s", err)
+	}
+
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return nil, fmt.Errorf("rfc2136: %s", err)
+	}
+	res := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(conn, res); err != nil {
+		return nil, fmt.Errorf("rfc2136: %s", err)
+	}
+	return res, nil
+}
+
+// returns the offset of the last additional record of msg (-1 if none)
+func dnsLastRecordOffset(msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, errors.New("message too short")
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	arCount := int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		end, err := dnsSkipName(msg, offset)
+		if err != nil {
+			return 0, err
+		}
+		offset = end + 4 // type, class
+	}
+
+	last := -1
+	for i := 0; i < rrCount; i++ {
+		if i == rrCount-1 && arCount > 0 {
+			last = offset
+		}
+		end, err := dnsSkipName(msg, offset)
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) < end+10 {
+			return 0, errors.New("truncated record")
+		}
+		offset = end + 10 + int(binary.BigEndian.Uint16(msg[end+8:]))
+	}
+	if offset != len(msg) {
+		return 0, errors.New("invalid message length")
+	}
+	return last, nil
+}
+
+// returns the offset following the (maybe compressed) name at offset
+func dnsSkipName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errors.New("truncated name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xC0 == 0xC0: // pointer
+			if offset+2 > len(msg) {
+				return 0, errors.New("truncated name")
+			}
+			return offset + 2, nil
+		case length&0xC0 != 0:
+			return 0, errors.New("invalid name label")
+		}
+		offset += length + 1
+	}
+}
+
+// returns a fully qualified (lowercase) domain name, ex: "example.com."
+func dnsFQDN(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".") + "."
+}
+
+// uncompressed wire format of a domain name
+func dnsWireName(name string) []byte {
+	var buf []byte
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	testTSIGKey    = "mulch-key."
+	testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0IQ=="
+)
+
+// local stand-in for a DNS server (TCP), handler returns the response
+// to each received message
+func startTestDNSServer(t *testing.T, handler func(msg []byte) []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				res := handler(msg)
+				packet := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+				conn.Write(append(packet, res...))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// builds a response to msg with the given rcode and authority records
+func testDNSResponse(t *testing.T, msg []byte, rcode dnsmessage.RCode, authorities ...dnsmessage.Resource) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       header.ID,
+			Response: true,
+			OpCode:   header.OpCode,
+			RCode:    rcode,
+		},
+		Questions:   questions,
+		Authorities: authorities,
+	}
+	packed, err := res.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return packed
+}
+
+// signs a response (hmac-sha256) to a request signed with requestMAC,
+// tsigError is sent with an empty MAC, as servers do for BADSIG/BADKEY
+func signTestResponse(res []byte, requestMAC []byte, secret string, tsigError uint16) []byte {
+	algorithm := dnsWireName("hmac-sha256")
+	now := time.Now().Unix()
+	timers := make([]byte, 8)
+	binary.BigEndian.PutUint16(timers[0:], uint16(now>>32))
+	binary.BigEndian.PutUint32(timers[2:], uint32(now))
+	binary.BigEndian.PutUint16(timers[6:], 300)
+	variables := []byte{byte(tsigError >> 8), byte(tsigError), 0, 0} // error, other len
+
+	var sum []byte
+	if tsigError == 0 {
+		key, _ := base64.StdEncoding.DecodeString(secret)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+		mac.Write(res)
+		mac.Write(dnsWireName(testTSIGKey))
+		mac.Write([]byte{0, 255, 0, 0, 0, 0}) // class ANY, TTL 0
+		mac.Write(algorithm)
+		mac.Write(timers)
+		mac.Write(variables)
+		sum = mac.Sum(nil)
+	}
+
+	var rdata []byte
+	rdata = append(rdata, algorithm...)
+	rdata = append(rdata, timers...)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, res[0:2]...) // original ID
+	rdata = append(rdata, variables...)
+
+	signed := append([]byte(nil), res...)
+	signed = append(signed, dnsWireName(testTSIGKey)...)
+	signed = append(signed, 0, 250, 0, 255, 0, 0, 0, 0) // TSIG, ANY, TTL 0
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed
+}
+
+// MAC of a request signed with hmac-sha256 (no other data)
+func testRequestMAC(msg []byte) []byte {
+	return msg[len(msg)-6-sha256.Size : len(msg)-6]
+}
+
+// testUpdate is a parsed DNS UPDATE message
+type testUpdate struct {
+	header  dnsmessage.Header
+	zone    dnsmessage.Question
+	updates []dnsmessage.Resource
+	tsig    []byte // TSIG RDATA, nil if unsigned
+	signed  []byte // message before TSIG (ARCOUNT not including it)
+}
+
+func parseTestUpdate(t *testing.T, msg []byte) *testUpdate {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(questions) != 1 {
+		t.Fatalf("zone section: got %d records, want 1", len(questions))
+	}
+	if err = parser.SkipAllAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := parser.AllAuthorities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := &testUpdate{
+		header:  header,
+		zone:    questions[0],
+		updates: updates,
+	}
+
+	for index, rr := range additionals {
+		if rr.Header.Type != rfc2136TypeTSIG {
+			continue
+		}
+		if index != len(additionals)-1 {
+			t.Fatal("TSIG must be the last additional record")
+		}
+		if rr.Header.Name.String() != testTSIGKey {
+			t.Errorf("TSIG key name: got %s, want %s", rr.Header.Name, testTSIGKey)
+		}
+		if rr.Header.Class != 255 || rr.Header.TTL != 0 {
+			t.Errorf("TSIG class/TTL: got %d/%d, want 255/0", rr.Header.Class, rr.Header.TTL)
+		}
+		unknown, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			t.Fatalf("TSIG record: unexpected body %T", rr.Body)
+		}
+		update.tsig = unknown.Data
+
+		// owner name (uncompressed) + type, class, TTL, rdlength + rdata
+		length := len(dnsWireName(testTSIGKey)) + 10 + len(unknown.Data)
+		update.signed = append([]byte(nil), msg[:len(msg)-length]...)
+		arCount := binary.BigEndian.Uint16(update.signed[10:])
+		binary.BigEndian.PutUint16(update.signed[10:], arCount-1)
+	}
+
+	return update
+}
+
+// checks the TSIG MAC (RFC 8945, section 4.3.3) of an hmac-sha256 signed message
+func checkTestTSIG(t *testing.T, update *testUpdate) {
+	if update.tsig == nil {
+		t.Fatal("message is not signed")
+	}
+	rdata := update.tsig
+
+	algorithm := dnsWireName("hmac-sha256")
+	if len(rdata) < len(algorithm)+10 || string(rdata[:len(algorithm)]) != string(algorithm) {
+		t.Fatalf("TSIG algorithm: got %q", rdata)
+	}
+	timers := rdata[len(algorithm) : len(algorithm)+8]
+	macSize := int(binary.BigEndian.Uint16(rdata[len(algorithm)+8:]))
+	rest := rdata[len(algorithm)+10:]
+	if len(rest) != macSize+6 {
+		t.Fatalf("TSIG RDATA: got %d bytes after MAC size, want %d", len(rest), macSize+6)
+	}
+	mac := rest[:macSize]
+	originalID := binary.BigEndian.Uint16(rest[macSize:])
+	tail := rest[macSize+2:]
+
+	if originalID != update.header.ID {
+		t.Errorf("TSIG original ID: got %d, want %d", originalID, update.header.ID)
+	}
+	if string(tail) != "\x00\x00\x00\x00" {
+		t.Errorf("TSIG error/other: got %x, want 00000000", tail)
+	}
+
+	signTime := int64(binary.BigEndian.Uint16(timers))<<32 | int64(binary.BigEndian.Uint32(timers[2:]))
+	if delta := time.Now().Unix() - signTime; delta < -5 || delta > 5 {
+		t.Errorf("TSIG time signed: %d seconds from now", delta)
+	}
+	if fudge := binary.BigEndian.Uint16(timers[6:]); fudge != rfc2136TSIGFudge {
+		t.Errorf("TSIG fudge: got %d, want %d", fudge, rfc2136TSIGFudge)
+	}
+
+	secret, _ := base64.StdEncoding.DecodeString(testTSIGSecret)
+	expected := hmac.New(sha256.New, secret)
+	expected.Write(update.signed)
+	expected.Write(dnsWireName(testTSIGKey))
+	expected.Write([]byte{0, 255})     // class ANY
+	expected.Write([]byte{0, 0, 0, 0}) // TTL
+	expected.Write(algorithm)          // algorithm name
+	expected.Write(timers)             // time signed, fudge
+	expected.Write([]byte{0, 0, 0, 0}) // error, other len
+	if !hmac.Equal(mac, expected.Sum(nil)) {
+		t.Error("TSIG MAC mismatch")
+	}
+}
+
+func TestRFC2136PresentAndCleanUp(t *testing.T) {
+	const fqdn = "_acme-challenge.preview.example.com."
+	const value = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+
+	received := make(chan []byte, 1)
+	server := startTestDNSServer(t, func(msg []byte) []byte {
+		received <- msg
+		res := testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+		return signTestResponse(res, testRequestMAC(msg), testTSIGSecret, 0)
+	})
+
+	provider, err := NewRFC2136Provider(server, "Example.COM", "mulch-key", testTSIGSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		call  func(fqdn string, value string) error
+		class dnsmessage.Class
+		ttl   uint32
+	}{
+		{"present", provider.Present, dnsmessage.ClassINET, rfc2136TTL},
+		{"cleanup", provider.CleanUp, rfc2136ClassNone, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(fqdn, value); err != nil {
+				t.Fatal(err)
+			}
+			update := parseTestUpdate(t, <-received)
+
+			if update.header.OpCode != rfc2136OpCode {
+				t.Errorf("opcode: got %d, want %d", update.header.OpCode, rfc2136OpCode)
+			}
+			if update.zone.Name.String() != "example.com." || update.zone.Type != dnsmessage.TypeSOA || update.zone.Class != dnsmessage.ClassINET {
+				t.Errorf("zone: got %s %s %s, want example.com. SOA IN", update.zone.Name, update.zone.Type, update.zone.Class)
+			}
+
+			if len(update.updates) != 1 {
+				t.Fatalf("update section: got %d records, want 1", len(update.updates))
+			}
+			rr := update.updates[0]
+			if rr.Header.Name.String() != fqdn || rr.Header.Type != dnsmessage.TypeTXT {
+				t.Errorf("update: got %s %s, want %s TXT", rr.Header.Name, rr.Header.Type, fqdn)
+			}
+			if rr.Header.Class != test.class || rr.Header.TTL != test.ttl {
+				t.Errorf("update class/TTL: got %d/%d, want %d/%d", rr.Header.Class, rr.Header.TTL, test.class, test.ttl)
+			}
+			txt, ok := rr.Body.(*dnsmessage.TXTResource)
+			if !ok || len(txt.TXT) != 1 || txt.TXT[0] != value {
+				t.Errorf("update TXT: got %v, want [%s]", rr.Body, value)
+			}
+
+			checkTestTSIG(t, update)
+		})
+	}
+}
+
+func TestRFC2136Refused(t *testing.T) {
+	server := startTestDNSServer(t, func(msg []byte) []byte {
+		return testDNSResponse(t, msg, dnsmessage.RCodeRefused)
+	})
+
+	provider, err := NewRFC2136Provider(server, "example.com", "mulch-key", testTSIGSecret, "hmac-sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Present("_acme-challenge.example.com", "value"); err == nil {
+		t.Error("refused update must fail")
+	}
+}
+
+func TestRFC2136ResponseTSIG(t *testing.T) {
+	const otherSecret = "b3RoZXItc2VjcmV0LW90aGVyLXNlY3JldCE="
+
+	tests := []struct {
+		name    string
+		respond func(msg []byte) []byte
+		wantErr string // "" = success
+	}{
+		{"signed", func(msg []byte) []byte {
+			res := testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+			return signTestResponse(res, testRequestMAC(msg), testTSIGSecret, 0)
+		}, ""},
+		{"unsigned", func(msg []byte) []byte {
+			return testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+		}, "not signed"},
+		{"other key", func(msg []byte) []byte {
+			res := testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+			return signTestResponse(res, testRequestMAC(msg), otherSecret, 0)
+		}, "invalid response TSIG signature"},
+		{"other request", func(msg []byte) []byte {
+			res := testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+			return signTestResponse(res, make([]byte, sha256.Size), testTSIGSecret, 0)
+		}, "invalid response TSIG signature"},
+		{"tampered", func(msg []byte) []byte {
+			res := testDNSResponse(t, msg, dnsmessage.RCodeRefused)
+			signed := signTestResponse(res, testRequestMAC(msg), testTSIGSecret, 0)
+			signed[3] &^= 0x0F // RCODE: success
+			return signed
+		}, "invalid response TSIG signature"},
+		{"BADSIG", func(msg []byte) []byte {
+			res := testDNSResponse(t, msg, dnsmessage.RCode(9)) // NOTAUTH
+			return signTestResponse(res, testRequestMAC(msg), testTSIGSecret, 16)
+		}, "rejected our TSIG signature (error 16)"},
+		{"unsigned error", func(msg []byte) []byte {
+			return testDNSResponse(t, msg, dnsmessage.RCodeServerFailure)
+		}, "server refused update"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startTestDNSServer(t, test.respond)
+			provider, err := NewRFC2136Provider(server, "example.com", "mulch-key", testTSIGSecret, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = provider.Present("_acme-challenge.example.com", "value")
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("got error: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("want an error (%s)", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("got error '%s', want '%s'", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSLastRecordOffset(t *testing.T) {
+	res := testDNSResponse(t, []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, dnsmessage.RCodeSuccess)
+	if offset, err := dnsLastRecordOffset(res); err != nil || offset != -1 {
+		t.Errorf("no additional record: got %d, %v", offset, err)
+	}
+
+	signed := signTestResponse(res, nil, testTSIGSecret, 0)
+	if offset, err := dnsLastRecordOffset(signed); err != nil || offset != len(res) {
+		t.Errorf("got %d, %v, want %d", offset, err, len(res))
+	}
+
+	if _, err := dnsLastRecordOffset(signed[:len(signed)-1]); err == nil {
+		t.Error("truncated message must fail")
+	}
+	if _, err := dnsLastRecordOffset(append(signed, 0)); err == nil {
+		t.Error("trailing data must fail")
+	}
+}
+
+func TestRFC2136FindZone(t *testing.T) {
+	zone := dnsmessage.MustNewName("example.com.")
+	received := make(chan []byte, 1)
+	server := startTestDNSServer(t, func(msg []byte) []byte {
+		var parser dnsmessage.Parser
+		header, err := parser.Start(msg)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		// SOA query first, then the update
+		if header.OpCode == rfc2136OpCode {
+			received <- msg
+			return testDNSResponse(t, msg, dnsmessage.RCodeSuccess)
+		}
+		return testDNSResponse(t, msg, dnsmessage.RCodeSuccess, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: zone, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS:      dnsmessage.MustNewName("ns1.example.com."),
+				MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+				Serial:  1,
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				MinTTL:  60,
+			},
+		})
+	})
+
+	provider, err := NewRFC2136Provider(server, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Present("_acme-challenge.preview.example.com", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	update := parseTestUpdate(t, <-received)
+	if update.zone.Name != zone {
+		t.Errorf("zone: got %s, want %s", update.zone.Name, zone)
+	}
+	if update.tsig != nil {
+		t.Error("message is signed without TSIG key")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/OnitiFR/mulch/common"
@@ -84,7 +85,7 @@ func (ddb *DomainDatabase) Reload() error {
 	return ddb.load()
 }
 
-// GetDomainsNames return all domain names in the database
+// GetDomainsNames return all domain keys (domain and path) in the database
 func (ddb *DomainDatabase) GetDomainsNames() []string {
 	ddb.mutex.Lock()
 	defer ddb.mutex.Unlock()
@@ -96,7 +97,117 @@ func (ddb *DomainDatabase) GetDomainsNames() []string {
 	return keys
 }
 
-// GetByName lookups a Domain by its domain
+// GetHostNames return all hosts (domains without paths) in the database
+func (ddb *DomainDatabase) GetHostNames() []string {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, domain := range ddb.db {
+		if seen[domain.Name] {
+			continue
+		}
+		seen[domain.Name] = true
+		hosts = append(hosts, domain.Name)
+	}
+	return hosts
+}
+
+// GetWildcardHosts return all wildcard hosts (ex: *.example.com) in the database
+func (ddb *DomainDatabase) GetWildcardHosts() []string {
+	var hosts []string
+	for _, host := range ddb.GetHostNames() {
+		if strings.HasPrefix(host, "*.") {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// HostExists returns true if any route exists for this exact host (hosts
+// only matching a wildcard host are not included, see GetWildcardFor)
+func (ddb *DomainDatabase) HostExists(host string) bool {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+
+	return ddb.hostExists(host)
+}
+
+// GetWildcardFor returns the wildcard host serving this host, or an
+// empty string if the host has its own routes or no wildcard matches
+func (ddb *DomainDatabase) GetWildcardFor(host string) string {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+
+	if ddb.hostExists(host) {
+		return ""
+	}
+	wildcard := wildcardHost(host)
+	if ddb.hostExists(wildcard) {
+		return wildcard
+	}
+	return ""
+}
+
+func (ddb *DomainDatabase) hostExists(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, domain := range ddb.db {
+		if domain.Name == host {
+			return true
+		}
+	}
+	return false
+}
+
+// GetByHostPath lookups the Domain with the longest path prefix
+// matching the request (prefixes match whole path segments), exact
+// hosts are preferred over wildcard hosts
+func (ddb *DomainDatabase) GetByHostPath(host string, reqPath string) (*common.Domain, error) {
+	ddb.mutex.Lock()
+	defer ddb.mutex.Unlock()
+
+	for _, candidate := range []string{host, wildcardHost(host)} {
+		if candidate == "" {
+			continue
+		}
+		prefix := strings.TrimRight(reqPath, "/")
+		for {
+			domain, exists := ddb.db[candidate+prefix]
+			if exists {
+				return domain, nil
+			}
+			if prefix == "" {
+				break
+			}
+			slash := strings.LastIndex(prefix, "/")
+			if slash == -1 {
+				slash = 0 // ex: "OPTIONS *"
+			}
+			prefix = prefix[:slash]
+		}
+	}
+	return nil, fmt.Errorf("Domain '%s' not found in database", host)
+}
+
+// wildcardHost returns the wildcard host matching host
+// (ex: a.preview.example.com -> *.preview.example.com), a wildcard only
+// matches a single label
+func wildcardHost(host string) string {
+	dot := strings.Index(host, ".")
+	if dot <= 0 || strings.HasPrefix(host, "*.") {
+		return ""
+	}
+	rest := host[dot+1:]
+	if strings.Contains(rest, ".") == false {
+		return "" // no *.com
+	}
+	return "*." + rest
+}
+
+// GetByName lookups a Domain by its key (domain and path)
 func (ddb *DomainDatabase) GetByName(name string) (*common.Domain, error) {
 	ddb.mutex.Lock()
 	defer ddb.mutex.Unlock()
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestGetByHostPath(t *testing.T) {
+	ddb := &DomainDatabase{db: make(map[string]*common.Domain)}
+	for _, domain := range []*common.Domain{
+		{Name: "example.com"},
+		{Name: "example.com", PathPrefix: "/api"},
+		{Name: "example.com", PathPrefix: "/api/v2"},
+		{Name: "*.preview.example.com"},
+		{Name: "*.preview.example.com", PathPrefix: "/static"},
+		{Name: "a.preview.example.com", PathPrefix: "/admin"},
+		{Name: "api.example.org", PathPrefix: "/v1"},
+	} {
+		ddb.db[domain.Key()] = domain
+	}
+
+	tests := []struct {
+		host string
+		path string
+		want string // key, "" if not found
+	}{
+		{"example.com", "/", "example.com"},
+		{"example.com", "", "example.com"},
+		{"example.com", "/index.html", "example.com"},
+		{"example.com", "/api", "example.com/api"},
+		{"example.com", "/api/", "example.com/api"},
+		{"example.com", "/api/users", "example.com/api"},
+		{"example.com", "/apis", "example.com"}, // segments only
+		{"example.com", "/api/v2/users", "example.com/api/v2"},
+		{"example.com", "/api/v22", "example.com/api"},
+		{"example.com", "*", "example.com"},
+		{"b.preview.example.com", "/", "*.preview.example.com"},
+		{"b.preview.example.com", "/static/a.css", "*.preview.example.com/static"},
+		{"a.preview.example.com", "/admin/", "a.preview.example.com/admin"},
+		{"a.preview.example.com", "/static/a.css", "*.preview.example.com/static"},
+		{"a.preview.example.com", "/", "*.preview.example.com"},
+		{"a.b.preview.example.com", "/", ""},
+		{"api.example.org", "/v1/x", "api.example.org/v1"},
+		{"api.example.org", "/", ""},
+		{"unknown.com", "/", ""},
+	}
+
+	for _, test := range tests {
+		domain, err := ddb.GetByHostPath(test.host, test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s%s: got %s, want an error", test.host, test.path, domain.Key())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%s: %s", test.host, test.path, err)
+			continue
+		}
+		if domain.Key() != test.want {
+			t.Errorf("%s%s: got %s, want %s", test.host, test.path, domain.Key(), test.want)
+		}
+	}
+}
+
+func TestWildcardHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.preview.example.com", "*.preview.example.com"},
+		{"preview.example.com", "*.example.com"},
+		{"example.com", ""},
+		{"localhost", ""},
+		{"*.example.com", ""},
+		{".example.com", ""},
+	}
+
+	for _, test := range tests {
+		if got := wildcardHost(test.host); got != test.want {
+			t.Errorf("wildcardHost(%q): got %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	tests := []struct {
+		url         string
+		prefix      string
+		wantPath    string
+		wantRequest string
+	}{
+		{"/api", "/api", "/", "/"},
+		{"/api/", "/api", "/", "/"},
+		{"/api/users?id=1", "/api", "/users", "/users?id=1"},
+		{"/api//users", "/api", "//users", "//users"},
+		{"/api/a%2Fb", "/api", "/a/b", "/a%2Fb"},
+		{"/api/v2/a%20b", "/api/v2", "/a b", "/a%20b"},
+		{"/%61pi/a%2Fb", "/api", "/a/b", "/a/b"}, // escaped prefix
+		{"/api%2Fb", "/api", "/b", "/b"},         // escaped slash
+	}
+
+	for _, test := range tests {
+		u, err := url.ParseRequestURI(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stripPathPrefix(u, test.prefix)
+		if u.Path != test.wantPath || u.RequestURI() != test.wantRequest {
+			t.Errorf("%s: got (%q, %q), want (%q, %q)", test.url, u.Path, u.RequestURI(), test.wantPath, test.wantRequest)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// applyHeaderRules modifies headers with domain rules, in order
+func applyHeaderRules(header http.Header, rules []common.DomainHeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case common.HeaderActionSet:
+			header.Set(rule.Name, rule.Value)
+		case common.HeaderActionSetIfAbsent:
+			if len(header.Values(rule.Name)) == 0 {
+				header.Set(rule.Name, rule.Value)
+			}
+		case common.HeaderActionAdd:
+			header.Add(rule.Name, rule.Value)
+		case common.HeaderActionRemove:
+			header.Del(rule.Name)
+		}
+	}
+}
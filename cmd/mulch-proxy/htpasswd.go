@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdVerify checks a password against an htpasswd hash, supported
+// hashes are bcrypt ($2y$, htpasswd -B), SHA1 ({SHA}) and Apache MD5 ($apr1$)
+func htpasswdVerify(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		computed := apr1Crypt(password, parts[0])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	}
+	return false
+}
+
+// Apache variant of the MD5-based crypt() algorithm
+func apr1Crypt(password string, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	// stretching
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var buf []byte
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			buf = append(buf, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	to64(uint(final[0])<<16|uint(final[6])<<8|uint(final[12]), 4)
+	to64(uint(final[1])<<16|uint(final[7])<<8|uint(final[13]), 4)
+	to64(uint(final[2])<<16|uint(final[8])<<8|uint(final[14]), 4)
+	to64(uint(final[3])<<16|uint(final[9])<<8|uint(final[15]), 4)
+	to64(uint(final[4])<<16|uint(final[10])<<8|uint(final[5]), 4)
+	to64(uint(final[11]), 2)
+
+	return magic + salt + "$" + string(buf)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// LimiterPruneInterval is the delay between two cleanups of per-IP states
+const LimiterPruneInterval = 1 * time.Minute
+
+// token bucket, refilled at "rate" tokens per second, up to "burst" tokens
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// refill the bucket, returns true if a token is available
+func (b *tokenBucket) refill(rate int, burst int, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+// take a token, refill() must have returned true
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// the bucket would be full by now, it can be forgotten
+func (b *tokenBucket) full(rate int, burst int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*float64(rate) >= float64(burst)
+}
+
+// DomainLimiter enforces common.DomainLimits of a domain
+type DomainLimiter struct {
+	limits    common.DomainLimits
+	bucket    *tokenBucket
+	ipBuckets map[string]*tokenBucket
+	active    int
+	ipActive  map[string]int
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// NewDomainLimiter creates a new DomainLimiter
+func NewDomainLimiter(limits *common.DomainLimits) *DomainLimiter {
+	now := time.Now()
+	return &DomainLimiter{
+		limits:    *limits,
+		bucket:    newTokenBucket(limits.Burst, now),
+		ipBuckets: make(map[string]*tokenBucket),
+		ipActive:  make(map[string]int),
+		lastPrune: now,
+	}
+}
+
+// Acquire a slot for a request of a client, returns 0 if the request
+// is accepted (release() must then be called when the request is done),
+// or an HTTP status code (429 or 503) otherwise
+func (l *DomainLimiter) Acquire(ip string) (int, func()) {
+	return l.acquire(ip, time.Now())
+}
+
+func (l *DomainLimiter) acquire(ip string, now time.Time) (int, func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) > LimiterPruneInterval {
+		l.prune(now)
+	}
+
+	// connections are in-flight requests (a websocket counts until closed)
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return http.StatusServiceUnavailable, nil
+	}
+	if l.limits.IPMaxConnections > 0 && l.ipActive[ip] >= l.limits.IPMaxConnections {
+		return http.StatusTooManyRequests, nil
+	}
+
+	// check both buckets before taking from any, so a rejected request
+	// does not consume a token
+	var ipBucket *tokenBucket
+	if l.limits.IPRate > 0 {
+		bucket, exists := l.ipBuckets[ip]
+		if !exists {
+			bucket = newTokenBucket(l.limits.IPBurst, now)
+			l.ipBuckets[ip] = bucket
+		}
+		if !bucket.refill(l.limits.IPRate, l.limits.IPBurst, now) {
+			return http.StatusTooManyRequests, nil
+		}
+		ipBucket = bucket
+	}
+
+	if l.limits.Rate > 0 && !l.bucket.refill(l.limits.Rate, l.limits.Burst, now) {
+		return http.StatusTooManyRequests, nil
+	}
+
+	if ipBucket != nil {
+		ipBucket.take()
+	}
+	if l.limits.Rate > 0 {
+		l.bucket.take()
+	}
+
+	l.active++
+	l.ipActive[ip]++
+
+	return 0, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.active--
+		l.ipActive[ip]--
+		if l.ipActive[ip] <= 0 {
+			delete(l.ipActive, ip)
+		}
+	}
+}
+
+// forget idle clients (mutex must be locked)
+func (l *DomainLimiter) prune(now time.Time) {
+	for ip, bucket := range l.ipBuckets {
+		if bucket.full(l.limits.IPRate, l.limits.IPBurst, now) {
+			delete(l.ipBuckets, ip)
+		}
+	}
+	l.lastPrune = now
+}
+
+// Limits returns the limits enforced by this limiter
+func (l *DomainLimiter) Limits() common.DomainLimits {
+	return l.limits
+}
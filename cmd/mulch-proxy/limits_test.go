@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(3, now)
+
+	// burst
+	for i := 0; i < 3; i++ {
+		if !bucket.refill(2, 3, now) {
+			t.Fatalf("token %d: want a token", i)
+		}
+		bucket.take()
+	}
+	if bucket.refill(2, 3, now) {
+		t.Errorf("empty bucket: want no token")
+	}
+
+	// 2 tokens per second
+	now = now.Add(250 * time.Millisecond)
+	if bucket.refill(2, 3, now) {
+		t.Errorf("half a token: want no token")
+	}
+	now = now.Add(250 * time.Millisecond)
+	if !bucket.refill(2, 3, now) {
+		t.Errorf("one token: want a token")
+	}
+	bucket.take()
+
+	// never more than burst
+	now = now.Add(time.Hour)
+	if !bucket.full(2, 3, now) {
+		t.Errorf("bucket must be full")
+	}
+	bucket.refill(2, 3, now)
+	if bucket.tokens != 3 {
+		t.Errorf("got %f tokens, want 3", bucket.tokens)
+	}
+	bucket.take()
+	if bucket.full(2, 3, now) {
+		t.Errorf("bucket must not be full")
+	}
+}
+
+func TestDomainLimiterRate(t *testing.T) {
+	limiter := NewDomainLimiter(&common.DomainLimits{
+		Rate:    10,
+		Burst:   3,
+		IPRate:  1,
+		IPBurst: 2,
+	})
+	now := time.Now()
+
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"10.0.0.1", 0},
+		{"10.0.0.1", 0},
+		{"10.0.0.1", http.StatusTooManyRequests}, // IP burst
+		{"10.0.0.2", 0},
+		{"10.0.0.3", http.StatusTooManyRequests}, // domain burst
+		{"10.0.0.3", http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		status, release := limiter.acquire(test.ip, now)
+		if status != test.want {
+			t.Errorf("request %d (%s): got %d, want %d", i, test.ip, status, test.want)
+		}
+		if release != nil {
+			release()
+		}
+	}
+
+	// rejected requests did not consume the other bucket
+	if limiter.ipBuckets["10.0.0.3"].tokens != 2 {
+		t.Errorf("10.0.0.3: got %f tokens, want 2", limiter.ipBuckets["10.0.0.3"].tokens)
+	}
+	if limiter.bucket.tokens >= 1 {
+		t.Errorf("domain: got %f tokens, want none", limiter.bucket.tokens)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if status, _ := limiter.acquire("10.0.0.3", now); status != 0 {
+		t.Errorf("after refill: got %d, want 0", status)
+	}
+	if status, _ := limiter.acquire("10.0.0.1", now); status != http.StatusTooManyRequests {
+		t.Errorf("after refill: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	// idle clients are forgotten
+	now = now.Add(LimiterPruneInterval + time.Second)
+	limiter.acquire("10.0.0.4", now)
+	if len(limiter.ipBuckets) != 1 {
+		t.Errorf("got %d IP buckets after prune, want 1", len(limiter.ipBuckets))
+	}
+}
+
+func TestDomainLimiterConnections(t *testing.T) {
+	limiter := NewDomainLimiter(&common.DomainLimits{
+		MaxConnections:   3,
+		IPMaxConnections: 2,
+	})
+	now := time.Now()
+
+	var releases []func()
+	acquire := func(ip string, want int) {
+		t.Helper()
+		status, release := limiter.acquire(ip, now)
+		if status != want {
+			t.Errorf("%s: got %d, want %d", ip, status, want)
+		}
+		if release != nil {
+			releases = append(releases, release)
+		}
+	}
+
+	acquire("10.0.0.1", 0)
+	acquire("10.0.0.1", 0)
+	acquire("10.0.0.1", http.StatusTooManyRequests)
+	acquire("10.0.0.2", 0)
+	acquire("10.0.0.3", http.StatusServiceUnavailable)
+
+	releases[0]()
+	acquire("10.0.0.3", 0)
+	acquire("10.0.0.1", http.StatusServiceUnavailable)
+
+	for _, release := range releases[1:] {
+		release()
+	}
+	if limiter.active != 0 || len(limiter.ipActive) != 0 {
+		t.Errorf("got %d active (%d IPs), want 0", limiter.active, len(limiter.ipActive))
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// PoolEjectFailures is the number of consecutive upstream errors before
+// a backend is ejected from its pool
+const PoolEjectFailures = 3
+
+// PoolEjectDuration is how long a failing backend is ejected from its pool
+const PoolEjectDuration = 30 * time.Second
+
+// PoolCookieName is the prefix of the cookie used by sticky pools (the
+// pool key hash is appended, for pools sharing a domain)
+const PoolCookieName = "mulch_backend"
+
+// PoolBackend is a VM of a domain pool
+type PoolBackend struct {
+	active       int64          // current requests (atomic, keep first for alignment)
+	Domain       *common.Domain // backend copy of the pool domain
+	key          string         // sticky cookie value
+	weight       int
+	current      int // smooth weighted round-robin state (pool mutex)
+	failures     int
+	ejectedUntil time.Time
+	mutex        sync.Mutex
+}
+
+// DomainPool balances requests of a domain between its backends
+type DomainPool struct {
+	Mode        string
+	Backends    []*PoolBackend
+	cookieName  string
+	fingerprint string // pool is reused if the domain is unchanged
+	mutex       sync.Mutex
+}
+
+// NewDomainPool creates a pool from a pool domain, backend domains are
+// copies of the pool domain, targeting each VM
+func NewDomainPool(domain *common.Domain) *DomainPool {
+	keyHash := fnv.New32a()
+	keyHash.Write([]byte(domain.Key()))
+
+	pool := &DomainPool{
+		Mode:        domain.Pool,
+		cookieName:  fmt.Sprintf("%s_%08x", PoolCookieName, keyHash.Sum32()),
+		fingerprint: poolFingerprint(domain),
+	}
+
+	for _, backend := range domain.Backends {
+		bDomain := *domain
+		bDomain.VMName = backend.VMName
+		bDomain.DestinationHost = backend.DestinationHost
+		bDomain.DestinationPort = backend.DestinationPort
+		bDomain.Maintenance = backend.Maintenance
+		bDomain.TargetURL = "http://" + net.JoinHostPort(backend.DestinationHost, strconv.Itoa(backend.DestinationPort))
+		bDomain.Backends = nil
+
+		hash := fnv.New32a()
+		hash.Write([]byte(domain.Key() + "@" + backend.VMName))
+
+		weight := backend.Weight
+		if weight <= 0 {
+			weight = 100
+		}
+
+		pool.Backends = append(pool.Backends, &PoolBackend{
+			Domain: &bDomain,
+			key:    fmt.Sprintf("%08x", hash.Sum32()),
+			weight: weight,
+		})
+	}
+	return pool
+}
+
+// poolFingerprint identifies the configuration and the members of a pool
+func poolFingerprint(domain *common.Domain) string {
+	data, _ := json.Marshal(domain)
+	return string(data)
+}
+
+// inherit keeps the state (ejection, failures, round-robin) of the
+// backends of a previous pool, for the same VMs
+func (pool *DomainPool) inherit(previous *DomainPool) {
+	previous.mutex.Lock()
+	defer previous.mutex.Unlock()
+
+	for _, backend := range pool.Backends {
+		for _, prev := range previous.Backends {
+			if prev.key != backend.key {
+				continue
+			}
+			prev.mutex.Lock()
+			backend.failures = prev.failures
+			backend.ejectedUntil = prev.ejectedUntil
+			prev.mutex.Unlock()
+			backend.current = prev.current
+		}
+	}
+}
+
+// available returns true if the backend can receive requests
+func (backend *PoolBackend) available(now time.Time) bool {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return backend.Domain.Maintenance == false && now.After(backend.ejectedUntil)
+}
+
+// Failure records an upstream error, ejecting the backend if needed
+func (backend *PoolBackend) Failure(log *Log) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.failures++
+	if backend.failures >= PoolEjectFailures {
+		log.Warningf("%s: ejecting backend %s from pool for %s", backend.Domain.Name, backend.Domain.VMName, PoolEjectDuration)
+		backend.ejectedUntil = time.Now().Add(PoolEjectDuration)
+		backend.failures = 0
+	}
+}
+
+// Success resets the failure counter of the backend
+func (backend *PoolBackend) Success() {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.failures = 0
+}
+
+// Pick a backend for the request, setting the sticky cookie if needed
+// (returns nil if no backend is available)
+func (pool *DomainPool) Pick(res http.ResponseWriter, req *http.Request) *PoolBackend {
+	now := time.Now()
+
+	var candidates []*PoolBackend
+	for _, backend := range pool.Backends {
+		if backend.available(now) {
+			candidates = append(candidates, backend)
+		}
+	}
+
+	// everyone is ejected? let's try anyway (except maintenance)
+	if len(candidates) == 0 {
+		for _, backend := range pool.Backends {
+			if backend.Domain.Maintenance == false {
+				candidates = append(candidates, backend)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if pool.Mode == common.DomainPoolSticky {
+		cookie, err := req.Cookie(pool.cookieName)
+		if err == nil {
+			for _, backend := range candidates {
+				if backend.key == cookie.Value {
+					return backend
+				}
+			}
+		}
+	}
+
+	selected := pool.nextWeighted(candidates)
+
+	// lowest active requests / weight ratio
+	if pool.Mode == common.DomainPoolLeastConn {
+		for _, backend := range candidates {
+			if atomic.LoadInt64(&backend.active)*int64(selected.weight) < atomic.LoadInt64(&selected.active)*int64(backend.weight) {
+				selected = backend
+			}
+		}
+	}
+
+	if pool.Mode == common.DomainPoolSticky {
+		cookiePath := selected.Domain.PathPrefix
+		if cookiePath == "" {
+			cookiePath = "/"
+		}
+		http.SetCookie(res, &http.Cookie{
+			Name:     pool.cookieName,
+			Value:    selected.key,
+			Path:     cookiePath,
+			HttpOnly: true,
+		})
+	}
+
+	return selected
+}
+
+// smooth weighted round-robin (same as nginx), this is a simple
+// round-robin when all weights are equal
+func (pool *DomainPool) nextWeighted(candidates []*PoolBackend) *PoolBackend {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	total := 0
+	var best *PoolBackend
+	for _, backend := range candidates {
+		backend.current += backend.weight
+		total += backend.weight
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+	best.current -= total
+	return best
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func testPoolDomain(mode string, weights ...int) *common.Domain {
+	domain := &common.Domain{
+		Name:       "shop.example.com",
+		PathPrefix: "/api",
+		Pool:       mode,
+	}
+	for i, weight := range weights {
+		domain.Backends = append(domain.Backends, &common.DomainBackend{
+			VMName:          string(rune('a' + i)),
+			DestinationHost: "10.104.0.1",
+			DestinationPort: 8000 + i,
+			Weight:          weight,
+		})
+	}
+	return domain
+}
+
+func testPoolSequence(pool *DomainPool, count int) string {
+	var seq []string
+	for i := 0; i < count; i++ {
+		seq = append(seq, pool.nextWeighted(pool.Backends).Domain.VMName)
+	}
+	return strings.Join(seq, "")
+}
+
+func TestPoolNextWeighted(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    string
+	}{
+		{[]int{0, 0, 0}, "abcabc"}, // default weight
+		{[]int{100, 100}, "abab"},
+		{[]int{5, 1, 1}, "aabacaaaabacaa"}, // smooth, like nginx
+		{[]int{2, 1}, "abaaba"},
+		{[]int{1}, "aaa"},
+	}
+
+	for _, test := range tests {
+		pool := NewDomainPool(testPoolDomain(common.DomainPoolRoundRobin, test.weights...))
+		if got := testPoolSequence(pool, len(test.want)); got != test.want {
+			t.Errorf("weights %v: got %s, want %s", test.weights, got, test.want)
+		}
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	domain := testPoolDomain(common.DomainPoolRoundRobin, 0, 0, 0)
+	domain.Backends[1].Maintenance = true
+	pool := NewDomainPool(domain)
+
+	pick := func() string {
+		req := httptest.NewRequest("GET", "/api/", nil)
+		backend := pool.Pick(httptest.NewRecorder(), req)
+		if backend == nil {
+			return "-"
+		}
+		return backend.Domain.VMName
+	}
+
+	// maintenance
+	got := pick() + pick() + pick() + pick()
+	if got != "acac" {
+		t.Errorf("maintenance: got %s, want acac", got)
+	}
+
+	// ejection
+	log := NewLog(false)
+	for i := 0; i < PoolEjectFailures; i++ {
+		pool.Backends[0].Failure(log)
+	}
+	got = pick() + pick()
+	if got != "cc" {
+		t.Errorf("ejection: got %s, want cc", got)
+	}
+
+	// everyone ejected, let's try anyway (but not in maintenance)
+	for i := 0; i < PoolEjectFailures; i++ {
+		pool.Backends[2].Failure(log)
+	}
+	got = pick() + pick()
+	if got != "ac" && got != "ca" {
+		t.Errorf("all ejected: got %s, want ac or ca", got)
+	}
+
+	// everyone in maintenance
+	pool.Backends[0].Domain.Maintenance = true
+	pool.Backends[2].Domain.Maintenance = true
+	if got = pick(); got != "-" {
+		t.Errorf("all in maintenance: got %s, want none", got)
+	}
+}
+
+func TestPoolPickLeastConn(t *testing.T) {
+	pool := NewDomainPool(testPoolDomain(common.DomainPoolLeastConn, 100, 100, 200))
+	atomic.StoreInt64(&pool.Backends[0].active, 3)
+	atomic.StoreInt64(&pool.Backends[1].active, 1)
+	atomic.StoreInt64(&pool.Backends[2].active, 4)
+
+	req := httptest.NewRequest("GET", "/api/", nil)
+	backend := pool.Pick(httptest.NewRecorder(), req)
+	if backend.Domain.VMName != "b" {
+		t.Errorf("got %s, want b", backend.Domain.VMName)
+	}
+
+	// 4/200 < 3/100
+	atomic.StoreInt64(&pool.Backends[1].active, 5)
+	backend = pool.Pick(httptest.NewRecorder(), req)
+	if backend.Domain.VMName != "c" {
+		t.Errorf("got %s, want c", backend.Domain.VMName)
+	}
+}
+
+func TestPoolPickSticky(t *testing.T) {
+	pool := NewDomainPool(testPoolDomain(common.DomainPoolSticky, 0, 0))
+
+	rec := httptest.NewRecorder()
+	first := pool.Pick(rec, httptest.NewRequest("GET", "/api/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if !strings.HasPrefix(cookie.Name, PoolCookieName+"_") || cookie.Path != "/api" || cookie.Value != first.key {
+		t.Errorf("invalid cookie %s", cookie)
+	}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/", nil)
+		req.AddCookie(cookie)
+		if backend := pool.Pick(httptest.NewRecorder(), req); backend != first {
+			t.Errorf("sticky: got %s, want %s", backend.Domain.VMName, first.Domain.VMName)
+		}
+	}
+
+	// unknown backend
+	req := httptest.NewRequest("GET", "/api/", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: "unknown"})
+	if backend := pool.Pick(httptest.NewRecorder(), req); backend == nil {
+		t.Errorf("unknown cookie: no backend")
+	}
+
+	// the cookie of another pool is ignored
+	other := testPoolDomain(common.DomainPoolSticky, 0, 0)
+	other.PathPrefix = ""
+	otherPool := NewDomainPool(other)
+	if otherPool.cookieName == pool.cookieName {
+		t.Errorf("pools must not share the same cookie name (%s)", pool.cookieName)
+	}
+}
+
+func TestPoolInherit(t *testing.T) {
+	log := NewLog(false)
+	previous := NewDomainPool(testPoolDomain(common.DomainPoolRoundRobin, 0, 0))
+	for i := 0; i < PoolEjectFailures; i++ {
+		previous.Backends[1].Failure(log)
+	}
+	previous.Backends[0].Failure(log)
+
+	domain := testPoolDomain(common.DomainPoolRoundRobin, 0, 0, 0)
+	pool := NewDomainPool(domain)
+	pool.inherit(previous)
+
+	if pool.Backends[0].failures != 1 {
+		t.Errorf("a: got %d failures, want 1", pool.Backends[0].failures)
+	}
+	now := time.Now()
+	if pool.Backends[1].available(now) {
+		t.Errorf("b must still be ejected")
+	}
+	if !pool.Backends[2].available(now) {
+		t.Errorf("c must be available")
+	}
+
+	if poolFingerprint(domain) == poolFingerprint(testPoolDomain(common.DomainPoolRoundRobin, 0, 0)) {
+		t.Errorf("fingerprints must differ")
+	}
+	if poolFingerprint(domain) != pool.fingerprint {
+		t.Errorf("invalid pool fingerprint")
+	}
+}
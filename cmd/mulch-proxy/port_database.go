@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// PortDatabase describes a persistent DataBase of Port structures
+type PortDatabase struct {
+	filename string
+	db       map[string]*common.Port
+	mutex    sync.Mutex
+}
+
+// NewPortDatabase instanciates a new PortDatabase
+// A missing file is not an error, it's an empty database (proxy chain
+// parents, for instance, have no nearby mulchd to create the file)
+func NewPortDatabase(filename string) (*PortDatabase, error) {
+	pdb := &PortDatabase{
+		filename: filename,
+		db:       make(map[string]*common.Port),
+	}
+
+	err := pdb.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return pdb, nil
+}
+
+func (pdb *PortDatabase) load() error {
+	// clear any previous map
+	pdb.db = make(map[string]*common.Port)
+
+	if common.PathExist(pdb.filename) == false {
+		return nil
+	}
+
+	f, err := os.Open(pdb.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&pdb.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Reload is the mutex-protected variant of load()
+func (pdb *PortDatabase) Reload() error {
+	pdb.mutex.Lock()
+	defer pdb.mutex.Unlock()
+
+	return pdb.load()
+}
+
+// GetByName lookups a Port by its name ("5432/tcp"), nil if not found
+func (pdb *PortDatabase) GetByName(name string) *common.Port {
+	pdb.mutex.Lock()
+	defer pdb.mutex.Unlock()
+
+	return pdb.db[name]
+}
+
+// GetPortsNames return all port names in the database
+func (pdb *PortDatabase) GetPortsNames() []string {
+	pdb.mutex.Lock()
+	defer pdb.mutex.Unlock()
+
+	keys := make([]string, 0, len(pdb.db))
+	for key := range pdb.db {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Count returns the number of Ports in the database
+func (pdb *PortDatabase) Count() int {
+	pdb.mutex.Lock()
+	defer pdb.mutex.Unlock()
+
+	return len(pdb.db)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// PortProxyDialTimeout is the timeout when connecting to a VM (TCP)
+const PortProxyDialTimeout = 10 * time.Second
+
+// PortProxyUDPTimeout is the UDP "session" idle timeout
+const PortProxyUDPTimeout = 2 * time.Minute
+
+// PortProxy publishes raw TCP/UDP ports, forwarding traffic to VMs
+type PortProxy struct {
+	PortDB    *PortDatabase
+	Log       *Log
+	listeners map[string]*portListener
+	mutex     sync.Mutex
+}
+
+// portListener is a listening port, TCP or UDP
+type portListener struct {
+	name        string
+	destination string
+	tcp         net.Listener
+	udp         *net.UDPConn
+	udpSessions map[string]*udpSession
+	closed      bool
+	mutex       sync.Mutex
+	log         *Log
+}
+
+// udpSession is the upstream connection of a UDP client
+type udpSession struct {
+	lastActivity int64 // unix nanoseconds (atomic, keep first for alignment)
+	conn         *net.UDPConn
+}
+
+// touch records an activity (in any direction) on the session
+func (session *udpSession) touch() {
+	atomic.StoreInt64(&session.lastActivity, time.Now().UnixNano())
+}
+
+// idle returns the duration since the last activity of the session
+func (session *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActivity)))
+}
+
+// NewPortProxy creates a new PortProxy
+func NewPortProxy(pdb *PortDatabase, log *Log) *PortProxy {
+	return &PortProxy{
+		PortDB:    pdb,
+		Log:       log,
+		listeners: make(map[string]*portListener),
+	}
+}
+
+// ReloadPorts reloads the database and refresh listeners
+func (pp *PortProxy) ReloadPorts() {
+	err := pp.PortDB.Reload()
+	if err != nil {
+		pp.Log.Errorf("reloading ports: %s", err)
+		return
+	}
+	pp.RefreshListeners()
+}
+
+// RefreshListeners opens new ports, closes removed ones and updates
+// destinations, using the port database
+func (pp *PortProxy) RefreshListeners() {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, name := range pp.PortDB.GetPortsNames() {
+		port := pp.PortDB.GetByName(name)
+		if port == nil {
+			continue
+		}
+		wanted[name] = true
+
+		destination := net.JoinHostPort(port.DestinationHost, strconv.Itoa(port.DestinationPort))
+		if port.DestinationHost == "" {
+			pp.Log.Warningf("port %s: no IP yet for VM %s", name, port.VMName)
+			destination = ""
+		}
+
+		listener, exists := pp.listeners[name]
+		if exists {
+			listener.setDestination(destination)
+			continue
+		}
+
+		listener, err := newPortListener(port, destination, pp.Log)
+		if err != nil {
+			pp.Log.Errorf("port %s: %s", name, err)
+			continue
+		}
+		pp.Log.Infof("port %s forwarded to VM %s", name, port.VMName)
+		pp.listeners[name] = listener
+	}
+
+	for name, listener := range pp.listeners {
+		if wanted[name] == false {
+			pp.Log.Infof("closing port %s", name)
+			listener.close()
+			delete(pp.listeners, name)
+		}
+	}
+}
+
+func newPortListener(port *common.Port, destination string, log *Log) (*portListener, error) {
+	pl := &portListener{
+		name:        port.String(),
+		destination: destination,
+		udpSessions: make(map[string]*udpSession),
+		log:         log,
+	}
+
+	address := ":" + strconv.Itoa(port.ListenPort)
+
+	switch port.Protocol {
+	case common.PortProtocolTCP:
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		pl.tcp = listener
+		go pl.serveTCP()
+	case common.PortProtocolUDP:
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		pl.udp = conn
+		go pl.serveUDP()
+	}
+
+	return pl, nil
+}
+
+func (pl *portListener) setDestination(destination string) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	pl.destination = destination
+}
+
+func (pl *portListener) getDestination() string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return pl.destination
+}
+
+func (pl *portListener) isClosed() bool {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return pl.closed
+}
+
+// current connections and UDP sessions are not closed
+func (pl *portListener) close() {
+	pl.mutex.Lock()
+	pl.closed = true
+	pl.mutex.Unlock()
+
+	if pl.tcp != nil {
+		pl.tcp.Close()
+	}
+	if pl.udp != nil {
+		pl.udp.Close()
+	}
+}
+
+func (pl *portListener) serveTCP() {
+	for {
+		conn, err := pl.tcp.Accept()
+		if err != nil {
+			if pl.isClosed() {
+				return
+			}
+			pl.log.Errorf("port %s: %s", pl.name, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go pl.handleTCP(conn)
+	}
+}
+
+func (pl *portListener) handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	destination := pl.getDestination()
+	if destination == "" {
+		pl.log.Tracef("port %s: no destination", pl.name)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", destination, PortProxyDialTimeout)
+	if err != nil {
+		pl.log.Errorf("port %s: %s", pl.name, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.(*net.TCPConn).CloseWrite()
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.(*net.TCPConn).CloseWrite()
+		done <- true
+	}()
+	<-done
+	<-done
+}
+
+func (pl *portListener) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pl.udp.ReadFromUDP(buf)
+		if err != nil {
+			if pl.isClosed() {
+				return
+			}
+			pl.log.Errorf("port %s: %s", pl.name, err)
+			continue
+		}
+
+		session, err := pl.getUDPSession(addr)
+		if err != nil {
+			pl.log.Errorf("port %s: %s", pl.name, err)
+			continue
+		}
+		if session == nil {
+			continue
+		}
+		// client to VM traffic keeps the session alive too
+		session.touch()
+		session.conn.Write(buf[:n])
+	}
+}
+
+// returns the upstream session for this client, creating it if needed
+func (pl *portListener) getUDPSession(addr *net.UDPAddr) (*udpSession, error) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	session, exists := pl.udpSessions[addr.String()]
+	if exists {
+		return session, nil
+	}
+
+	if pl.destination == "" {
+		return nil, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", pl.destination)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	session = &udpSession{conn: conn}
+	session.touch()
+	pl.udpSessions[addr.String()] = session
+	go pl.serveUDPSession(addr, session, PortProxyUDPTimeout)
+
+	return session, nil
+}
+
+// forward VM responses to the client, until the session is idle (in
+// both directions) for the timeout
+func (pl *portListener) serveUDPSession(addr *net.UDPAddr, session *udpSession, timeout time.Duration) {
+	defer func() {
+		pl.mutex.Lock()
+		delete(pl.udpSessions, addr.String())
+		pl.mutex.Unlock()
+		session.conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		session.conn.SetReadDeadline(time.Now().Add(timeout - session.idle()))
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && session.idle() < timeout {
+				continue
+			}
+			return
+		}
+		session.touch()
+		_, err = pl.udp.WriteToUDP(buf[:n], addr)
+		if err != nil && pl.isClosed() {
+			return
+		}
+	}
+}
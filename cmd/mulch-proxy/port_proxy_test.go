@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// UDP echo server ("silent" packets are not answered), returns its address
+func testUDPEcho(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "silent" {
+				continue
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func testUDPListener(t *testing.T, destination string) *portListener {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &portListener{
+		name:        "test/udp",
+		destination: destination,
+		udp:         conn,
+		udpSessions: make(map[string]*udpSession),
+		log:         NewLog(false),
+	}
+	t.Cleanup(pl.close)
+	return pl
+}
+
+func (pl *portListener) testSessionCount() int {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return len(pl.udpSessions)
+}
+
+func TestPortProxyUDP(t *testing.T) {
+	destination := testUDPEcho(t)
+	pl := testUDPListener(t, destination)
+	go pl.serveUDP()
+
+	client, err := net.DialUDP("udp", nil, pl.udp.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("hello"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("got '%s'", buf[:n])
+	}
+	if count := pl.testSessionCount(); count != 1 {
+		t.Errorf("got %d sessions, want 1", count)
+	}
+}
+
+func TestPortProxyUDPSessionClientActivity(t *testing.T) {
+	destination := testUDPEcho(t)
+	pl := testUDPListener(t, destination)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	raddr, _ := net.ResolveUDPAddr("udp", destination)
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &udpSession{conn: conn}
+	session.touch()
+	pl.udpSessions[addr.String()] = session
+
+	timeout := 300 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		pl.serveUDPSession(addr, session, timeout)
+		close(done)
+	}()
+
+	// client only traffic (no VM reply) must keep the session alive
+	for i := 0; i < 6; i++ {
+		time.Sleep(timeout / 3)
+		session.touch()
+		conn.Write([]byte("silent"))
+	}
+	select {
+	case <-done:
+		t.Fatal("session expired while the client was active")
+	default:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session did not expire")
+	}
+	if count := pl.testSessionCount(); count != 0 {
+		t.Errorf("got %d sessions, want 0", count)
+	}
+}
+
+func TestPortProxyTCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("banner"))
+		conn.Close()
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &portListener{
+		name:        "test/tcp",
+		destination: upstream.Addr().String(),
+		tcp:         listener,
+		log:         NewLog(false),
+	}
+	defer pl.close()
+	go pl.serveTCP()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	if string(buf[:n]) != "banner" {
+		t.Errorf("got '%s', want 'banner'", buf[:n])
+	}
+}
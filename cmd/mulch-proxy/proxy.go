@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -28,12 +30,26 @@ const (
 
 // ProxyServer describe a Mulch proxy server
 type ProxyServer struct {
-	DomainDB    *DomainDatabase
-	Log         *Log
-	RequestList *RequestList
-	HTTP        *http.Server
-	HTTPS       *http.Server
-	config      *ProxyServerParams
+	DomainDB      *DomainDatabase
+	Log           *Log
+	RequestList   *RequestList
+	Stats         *ProxyStats
+	AccessLog     *AccessLog
+	HTTP          *http.Server
+	HTTPS         *http.Server
+	config        *ProxyServerParams
+	manager       *autocert.Manager
+	managerMutex  sync.Mutex
+	certFiles     map[string]bool // certificates in the autocert cache
+	renewals      map[string]*certRenewal
+	pools         map[string]*DomainPool
+	poolsMutex    sync.Mutex
+	access        map[string]*AccessRules
+	accessMutex   sync.Mutex
+	limiters      map[string]*DomainLimiter
+	limitersMutex sync.Mutex
+	caches        map[string]*HTTPCache
+	cachesMutex   sync.Mutex
 }
 
 // ProxyServerParams is needed to create a ProxyServer
@@ -45,12 +61,23 @@ type ProxyServerParams struct {
 	DirectoryURL          string
 	DomainDB              *DomainDatabase
 	ErrorHTMLTemplateFile string
+	MaintenanceHTMLFile   string // error page is used if missing
+	ReadHeaderTimeout     time.Duration
+	ReadTimeout           time.Duration // 0 = no timeout
+	WriteTimeout          time.Duration // 0 = no timeout
+	IdleTimeout           time.Duration
+	CacheDir              string // disk HTTP caches
 	MulchdHTTPSDomain     string // (for mulchd)
 	ChainMode             int
 	ChainPSK              string
 	ChainDomain           string
 	Log                   *Log
 	RequestList           *RequestList
+	Stats                 *ProxyStats
+	AccessLog             *AccessLog      // may be nil
+	DNSCertManager        *DNSCertManager // may be nil (no wildcard certificates)
+	CustomCerts           *CustomCertStore
+	CertErrors            *CertErrorDatabase
 	Trace                 bool
 	Debug                 bool
 }
@@ -63,6 +90,7 @@ var requestCounter uint64
 type errorHandlingRoundTripper struct {
 	ProxyServer *ProxyServer
 	Domain      *common.Domain
+	Backend     *PoolBackend // nil if the domain is not a pool
 	Log         *Log
 }
 
@@ -71,8 +99,29 @@ func (rt *errorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Respons
 	// t := http.DefaultTransport.(*http.Transport).Clone()
 	tr := http.DefaultTransport
 	res, err := tr.RoundTrip(req)
+
+	// request body over the domain limit, not an upstream error
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		body, errG := rt.ProxyServer.genErrorPage(http.StatusRequestEntityTooLarge, "Request body is too large.")
+		if errG != nil {
+			rt.ProxyServer.Log.Errorf("Error with the error page: %s", errG)
+		}
+		return &http.Response{
+			StatusCode:    http.StatusRequestEntityTooLarge,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+			Header:        make(http.Header, 0),
+		}, nil
+	}
+
 	if err != nil {
 		rt.ProxyServer.Log.Errorf("%s: %s", rt.Domain.Name, err)
+		rt.ProxyServer.Stats.UpstreamError(rt.Domain)
+		if rt.Backend != nil {
+			rt.Backend.Failure(rt.Log)
+		}
 		body, errG := rt.ProxyServer.genErrorPage(502, err.Error())
 		if errG != nil {
 			rt.ProxyServer.Log.Errorf("Error with the error page: %s", errG)
@@ -85,6 +134,9 @@ func (rt *errorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Respons
 			Header:        make(http.Header, 0),
 		}, nil
 	}
+	if rt.Backend != nil {
+		rt.Backend.Success()
+	}
 	return res, err
 }
 
@@ -94,45 +146,158 @@ func NewProxyServer(config *ProxyServerParams) *ProxyServer {
 		DomainDB:    config.DomainDB,
 		Log:         config.Log,
 		RequestList: config.RequestList,
+		Stats:       config.Stats,
+		AccessLog:   config.AccessLog,
 		config:      config,
+		pools:       make(map[string]*DomainPool),
+		access:      make(map[string]*AccessRules),
+		limiters:    make(map[string]*DomainLimiter),
+		caches:      make(map[string]*HTTPCache),
+		renewals:    make(map[string]*certRenewal),
 	}
 
+	proxy.manager = proxy.newManager()
+	proxy.certFiles = proxy.listCertFiles()
+
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", proxy.handleRequest)
+
+	// see proxy_*_timeout settings (there are some legitimate "long
+	// idling request" use case out there, so defaults are gentle)
+	proxy.HTTP = &http.Server{
+		Handler:           proxy.httpHandler(mux),
+		Addr:              config.ListenHTTP,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	proxy.HTTPS = &http.Server{
+		Handler:           mux,
+		Addr:              config.ListenHTTPS,
+		TLSConfig:         &tls.Config{GetCertificate: proxy.getCertificate},
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	return &proxy
+}
+
+func (proxy *ProxyServer) newManager() *autocert.Manager {
 	manager := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: proxy.hostPolicy,
-		Cache:      autocert.DirCache(config.DirCache),
-		Email:      config.Email,
+		Cache:      autocert.DirCache(proxy.config.DirCache),
+		Email:      proxy.config.Email,
 		// RenewBefore: …,
 	}
 
-	if config.DirectoryURL != "" {
+	if proxy.config.DirectoryURL != "" {
 		manager.Client = &acme.Client{
-			DirectoryURL: config.DirectoryURL,
+			DirectoryURL: proxy.config.DirectoryURL,
 		}
 	}
+	return manager
+}
 
-	mux := &http.ServeMux{}
-	mux.HandleFunc("/", proxy.handleRequest)
+func (proxy *ProxyServer) getManager() *autocert.Manager {
+	proxy.managerMutex.Lock()
+	defer proxy.managerMutex.Unlock()
+	return proxy.manager
+}
 
-	// We're still very gentle here, there are some legitimate "long idling request"
-	// use case out there. But we should add a runtime setting somewhere to
-	// allow the admin to drastically lower this value. (ex: Træfik default is 3min)
-	IdleTimeout := 15 * time.Minute
+// HTTP-01 challenges (the autocert manager may be replaced, or be
+// a renewal one for the host)
+func (proxy *ProxyServer) httpHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		proxy.getManagerFor(strings.ToLower(host)).HTTPHandler(fallback).ServeHTTP(res, req)
+	})
+}
 
-	proxy.HTTP = &http.Server{
-		Handler:     manager.HTTPHandler(mux),
-		Addr:        config.ListenHTTP,
-		IdleTimeout: IdleTimeout,
+// list certificates in the autocert cache directory
+func (proxy *ProxyServer) listCertFiles() map[string]bool {
+	files := make(map[string]bool)
+	infos, err := ioutil.ReadDir(proxy.config.DirCache)
+	if err != nil {
+		proxy.Log.Errorf("listing certificates: %s", err)
+		return files
 	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), "+http-01") || strings.HasPrefix(info.Name(), "acme_account") {
+			continue
+		}
+		files[info.Name()] = true
+	}
+	return files
+}
 
-	proxy.HTTPS = &http.Server{
-		Handler:     mux,
-		Addr:        config.ListenHTTPS,
-		TLSConfig:   &tls.Config{GetCertificate: manager.GetCertificate},
-		IdleTimeout: IdleTimeout,
+// certificates deleted from the cache (see 'mulch cert delete/renew') are
+// forgotten: autocert has no way to drop a certificate from its memory, so
+// the manager is replaced (other certificates are read again from the cache)
+// It's also replaced when a certificate is added, since autocert may
+// remember a previous failure for this domain.
+func (proxy *ProxyServer) forgetDeletedCertificates() {
+	files := proxy.listCertFiles()
+
+	proxy.managerMutex.Lock()
+	defer proxy.managerMutex.Unlock()
+
+	var deleted []string
+	for name := range proxy.certFiles {
+		if !files[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	added := 0
+	for name := range files {
+		if !proxy.certFiles[name] {
+			added++
+		}
 	}
+	proxy.certFiles = files
 
-	return &proxy
+	if len(deleted) == 0 && added == 0 {
+		return
+	}
+
+	if len(deleted) > 0 {
+		proxy.Log.Infof("certificate(s) deleted from cache: %s", strings.Join(deleted, ", "))
+	}
+
+	proxy.manager = proxy.newManager()
+
+	if proxy.config.DNSCertManager != nil {
+		for _, name := range deleted {
+			proxy.config.DNSCertManager.Forget(name)
+		}
+	}
+}
+
+// autocert certificate, recording issuance errors
+func (proxy *ProxyServer) getACMECertificate(hello *tls.ClientHelloInfo, host string) (*tls.Certificate, error) {
+	// forced renewal, the current certificate is still served if it fails
+	cert, err := proxy.renewACMECertificate(hello, host)
+	if cert != nil && err == nil {
+		return cert, nil
+	}
+
+	cert, err = proxy.getManager().GetCertificate(hello)
+	if err != nil {
+		// ignore unknown hosts
+		if host != "" && proxy.hostPolicy(context.Background(), host) == nil {
+			proxy.config.CertErrors.Set(host, err)
+		}
+		return nil, err
+	}
+	proxy.config.CertErrors.Clear(host)
+	return cert, nil
 }
 
 func (proxy *ProxyServer) genErrorPage(code int, message string) (string, error) {
@@ -151,6 +316,142 @@ func (proxy *ProxyServer) genErrorPage(code int, message string) (string, error)
 	return expanded, nil
 }
 
+func (proxy *ProxyServer) genMaintenancePage(domain *common.Domain) (string, error) {
+	htmlBytes, err := ioutil.ReadFile(proxy.config.MaintenanceHTMLFile)
+	if err != nil {
+		// old installations have no maintenance template
+		return proxy.genErrorPage(http.StatusServiceUnavailable, "Service under maintenance, please try again later.")
+	}
+	html := string(htmlBytes)
+
+	variables := make(map[string]interface{})
+	variables["DOMAIN"] = domain.Name
+
+	expanded := common.StringExpandVariables(html, variables)
+
+	return expanded, nil
+}
+
+// check domain limits, and write the error response if the request is
+// refused, release() must be called at the end of an accepted request
+func (proxy *ProxyServer) checkLimits(domain *common.Domain, res http.ResponseWriter, req *http.Request, fromParent bool) (bool, func()) {
+	proxy.limitersMutex.Lock()
+	limiter := proxy.limiters[domain.Key()]
+	proxy.limitersMutex.Unlock()
+
+	if limiter == nil {
+		return true, func() {}
+	}
+
+	status, release := limiter.Acquire(clientIP(req, fromParent))
+	if status != 0 {
+		message := "Too many requests, please try again later."
+		if status == http.StatusServiceUnavailable {
+			message = "Server is busy, please try again later."
+		}
+		body, errG := proxy.genErrorPage(status, message)
+		if errG != nil {
+			proxy.Log.Errorf("Error with the error page: %s", errG)
+		}
+		res.Header().Set("Retry-After", "1")
+		res.WriteHeader(status)
+		res.Write([]byte(body))
+		return false, nil
+	}
+
+	maxBodySize := int64(limiter.Limits().MaxBodySize)
+	if maxBodySize > 0 && req.Body != nil {
+		if req.ContentLength > maxBodySize {
+			body, errG := proxy.genErrorPage(http.StatusRequestEntityTooLarge, "Request body is too large.")
+			if errG != nil {
+				proxy.Log.Errorf("Error with the error page: %s", errG)
+			}
+			res.WriteHeader(http.StatusRequestEntityTooLarge)
+			res.Write([]byte(body))
+			release()
+			return false, nil
+		}
+		req.Body = http.MaxBytesReader(res, req.Body, maxBodySize)
+	}
+
+	return true, release
+}
+
+// check domain access rules, and write the error response if the request
+// is refused
+func (proxy *ProxyServer) checkAccess(domain *common.Domain, res http.ResponseWriter, req *http.Request, fromParent bool) bool {
+	proxy.accessMutex.Lock()
+	rules := proxy.access[domain.Key()]
+	proxy.accessMutex.Unlock()
+
+	if rules == nil {
+		return true
+	}
+
+	if !rules.AllowIP(clientIP(req, fromParent)) {
+		body, errG := proxy.genErrorPage(http.StatusForbidden, "Access denied.")
+		if errG != nil {
+			proxy.Log.Errorf("Error with the error page: %s", errG)
+		}
+		res.WriteHeader(http.StatusForbidden)
+		res.Write([]byte(body))
+		return false
+	}
+
+	if rules.NeedAuth() && !rules.CheckAuth(req) {
+		body, errG := proxy.genErrorPage(http.StatusUnauthorized, "Authentication required.")
+		if errG != nil {
+			proxy.Log.Errorf("Error with the error page: %s", errG)
+		}
+		rules.Challenge(res)
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write([]byte(body))
+		return false
+	}
+
+	// proxy credentials are not for the VM
+	if rules.NeedAuth() {
+		req.Header.Del("Authorization")
+	}
+
+	return true
+}
+
+// use the imported certificate if any, then the wildcard certificate if the
+// host is only served by a wildcard domain, per-host autocert certificate otherwise
+func (proxy *ProxyServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+			return proxy.getManagerFor(host).GetCertificate(hello)
+		}
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	cert := proxy.config.CustomCerts.Get(host)
+	if cert != nil {
+		return cert, nil
+	}
+
+	if proxy.config.DNSCertManager == nil {
+		return proxy.getACMECertificate(hello, host)
+	}
+
+	wildcard := proxy.DomainDB.GetWildcardFor(host)
+	if wildcard != "" {
+		cert = proxy.config.DNSCertManager.GetCertificate(wildcard)
+		if cert != nil {
+			return cert, nil
+		}
+		// no autocert fallback: anyone could then trigger issuances
+		// for random hosts and exhaust ACME rate limits
+		return nil, fmt.Errorf("no certificate (yet?) for %s", wildcard)
+	}
+
+	return proxy.getACMECertificate(hello, host)
+}
+
 func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 	if host == proxy.config.MulchdHTTPSDomain && proxy.config.MulchdHTTPSDomain != "" {
 		proxy.Log.Trace("hostPolicy OK for MulchdHTTPSDomain")
@@ -162,8 +463,9 @@ func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 		return nil
 	}
 
-	_, err := proxy.DomainDB.GetByName(host)
-	if err == nil {
+	// hosts only matching a wildcard domain are rejected on purpose
+	// (certificates for those are issued by DNSCertManager)
+	if !strings.HasPrefix(host, "*.") && proxy.DomainDB.HostExists(host) {
 		proxy.Log.Tracef("hostPolicy OK, host '%s' found in DomainDB", host)
 		return nil
 	}
@@ -175,12 +477,36 @@ func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 // 	rw.WriteHeader(http.StatusBadGateway)
 // }
 
+// stripPathPrefix removes prefix from the path of u, like http.StripPrefix
+// (the prefix was matched on path segments, see GetByHostPath)
+func stripPathPrefix(u *url.URL, prefix string) {
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.RawPath != "" {
+		rawPath := strings.TrimPrefix(u.RawPath, prefix)
+		if rawPath == u.RawPath || (rawPath != "" && rawPath[0] != '/') {
+			u.RawPath = "" // escaped prefix or slash, let's use Path
+		} else if rawPath == "" {
+			u.RawPath = "/"
+		} else {
+			u.RawPath = rawPath
+		}
+	}
+}
+
 func (proxy *ProxyServer) serveReverseProxy(domain *common.Domain, proto string, res http.ResponseWriter, req *http.Request, fromParent bool) {
 	url, _ := url.Parse(domain.TargetURL)
 
 	req.URL.Host = url.Host
 	req.URL.Scheme = url.Scheme
 
+	// before our own headers, so they can't be altered by rules
+	if domain.Headers != nil {
+		applyHeaderRules(req.Header, domain.Headers.Request)
+	}
+
 	// TODO: have a look at https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Forwarded
 	req.Header.Set("X-Forwarded-Proto", proto)
 
@@ -194,6 +520,12 @@ func (proxy *ProxyServer) serveReverseProxy(domain *common.Domain, proto string,
 		ip = "invalid-" + req.RemoteAddr
 	}
 
+	// path route, remove the prefix if requested
+	if domain.PathPrefix != "" && domain.StripPrefix {
+		req.Header.Set("X-Forwarded-Prefix", domain.PathPrefix)
+		stripPathPrefix(req.URL, domain.PathPrefix)
+	}
+
 	// we are a parent and this request is forwarded to a child, add PSK to
 	// authenticate ourself
 	if proxy.config.ChainMode == ChainModeParent && domain.Chained == true {
@@ -226,6 +558,27 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		fromParent = true
 	}
 
+	// request stats and access log (see domain assignment below), the
+	// access log uses the backend domain for pools
+	var statsDomain *common.Domain
+	var accessDomain *common.Domain
+	start := time.Now()
+	statsRes := &statsResponseWriter{ResponseWriter: res}
+	statsBody := &statsReadCloser{ReadCloser: req.Body}
+	res = statsRes
+	if req.Body != nil {
+		req.Body = statsBody
+	}
+	accessEntry := NewAccessLogEntry(req, host, fromParent, start)
+	defer func() {
+		duration := time.Now().Sub(start)
+		proxy.Stats.Record(statsDomain, statsRes.status, statsBody.bytes, statsRes.bytes, duration)
+		if proxy.AccessLog != nil {
+			accessEntry.Complete(accessDomain, statsRes.status, statsRes.bytes, duration)
+			proxy.AccessLog.Write(accessEntry)
+		}
+	}()
+
 	proto := ProtoHTTP
 	if req.TLS != nil {
 		proto = ProtoHTTPS
@@ -252,7 +605,7 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		proto = req.Header.Get("X-Forwarded-Proto")
 	}
 
-	domain, err := proxy.DomainDB.GetByName(host)
+	domain, err := proxy.DomainDB.GetByHostPath(host, req.URL.Path)
 	if err != nil {
 		body, errG := proxy.genErrorPage(500, err.Error())
 		if errG != nil {
@@ -263,6 +616,8 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		res.Write([]byte(body))
 		return
 	}
+	statsDomain = domain
+	accessDomain = domain
 
 	// redirect to another URL?
 	if domain.RedirectTo != "" {
@@ -294,15 +649,155 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	// rate and connection limits
+	accepted, release := proxy.checkLimits(domain, res, req, fromParent)
+	if !accepted {
+		return
+	}
+	defer release()
+
+	// access rules (allow/deny lists, basic auth)
+	if !proxy.checkAccess(domain, res, req, fromParent) {
+		return
+	}
+
+	// domain in maintenance mode?
+	if domain.Maintenance == true {
+		body, errG := proxy.genMaintenancePage(domain)
+		if errG != nil {
+			proxy.Log.Errorf("Error with the error page: %s", errG)
+		}
+		res.Header().Set("Retry-After", "60")
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(body))
+		return
+	}
+
+	// response compression
+	if domain.Compression != nil {
+		compressRes := newCompressResponseWriter(res, req, domain.Compression)
+		defer compressRes.Close()
+		res = compressRes
+	}
+
+	// HTTP cache
+	proxy.cachesMutex.Lock()
+	cache := proxy.caches[domain.Key()]
+	proxy.cachesMutex.Unlock()
+	if cache != nil {
+		key, cacheable := cacheRequestKey(req, host, domain.Compression != nil)
+		if cacheable {
+			if !strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+				if entry, body := cache.Get(key); entry != nil {
+					entry.Serve(res, req, body)
+					return
+				}
+			}
+			ctx := context.WithValue(req.Context(), contextKeyCache, &cacheRequest{cache: cache, key: key})
+			req = req.WithContext(ctx)
+		}
+		// only two variants in the cache: gzip and identity
+		if domain.Compression == nil {
+			if compressNegotiate(req.Header.Get("Accept-Encoding"), []string{common.CompressionGzip}) != "" {
+				req.Header.Set("Accept-Encoding", common.CompressionGzip)
+			} else {
+				req.Header.Del("Accept-Encoding")
+			}
+		}
+	}
+
+	// we compress ourselves, so ask the VM for uncompressed responses
+	if domain.Compression != nil {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	// load balanced domain?
+	if domain.Pool != "" {
+		proxy.poolsMutex.Lock()
+		pool := proxy.pools[domain.Key()]
+		proxy.poolsMutex.Unlock()
+
+		var backend *PoolBackend
+		if pool != nil {
+			backend = pool.Pick(res, req)
+		}
+		if backend == nil {
+			body, errG := proxy.genErrorPage(http.StatusServiceUnavailable, "No backend available, please try again later.")
+			if errG != nil {
+				proxy.Log.Errorf("Error with the error page: %s", errG)
+			}
+			proxy.Log.Errorf("%s: no backend available in pool", domain.Key())
+			res.Header().Set("Retry-After", "10")
+			res.WriteHeader(http.StatusServiceUnavailable)
+			res.Write([]byte(body))
+			return
+		}
+		accessDomain = backend.Domain
+
+		atomic.AddInt64(&backend.active, 1)
+		defer atomic.AddInt64(&backend.active, -1)
+
+		proxy.serveReverseProxy(backend.Domain, proto, res, req, fromParent)
+		return
+	}
+
 	// now, do our proxy job
 	proxy.serveReverseProxy(domain, proto, res, req, fromParent)
 }
 
+// setup the ReverseProxy of a domain (or of a pool backend)
+func (proxy *ProxyServer) initReverseProxy(domain *common.Domain, rt *errorHandlingRoundTripper) {
+	pURL, _ := url.Parse(domain.TargetURL)
+	domain.ReverseProxy = httputil.NewSingleHostReverseProxy(pURL)
+
+	// domain.reverseProxy.ErrorHandler = reverseProxyErrorHandler
+	domain.ReverseProxy.ModifyResponse = func(resp *http.Response) (err error) {
+		if proxy.config.ChainMode != ChainModeParent {
+			resp.Header.Set("X-Mulch", domain.VMName)
+		}
+
+		if proxy.config.Debug {
+			ctx := resp.Request.Context()
+			proxy.Log.Tracef("< {%d} %d", ctx.Value(contextKeyID), resp.StatusCode)
+		}
+
+		// before the cache, so cached responses get them too
+		if domain.Headers != nil {
+			applyHeaderRules(resp.Header, domain.Headers.Response)
+		}
+
+		cacheResponse(resp)
+
+		return nil
+	}
+	domain.ReverseProxy.Transport = rt
+}
+
 // RefreshReverseProxies create new (internal) ReverseProxy instances
 // This function should be called when DomainDB is updated
 func (proxy *ProxyServer) RefreshReverseProxies() {
 	domains := proxy.DomainDB.GetDomainsNames()
 	count := 0
+	pools := make(map[string]*DomainPool)
+	access := make(map[string]*AccessRules)
+	limiters := make(map[string]*DomainLimiter)
+
+	caches := make(map[string]*HTTPCache)
+
+	// keep limiters state if limits are unchanged
+	proxy.limitersMutex.Lock()
+	oldLimiters := proxy.limiters
+	proxy.limitersMutex.Unlock()
+
+	// same for caches, if the domain destination is unchanged
+	proxy.cachesMutex.Lock()
+	oldCaches := proxy.caches
+	proxy.cachesMutex.Unlock()
+
+	// same for pools, if the domain is unchanged (or backend state only)
+	proxy.poolsMutex.Lock()
+	oldPools := proxy.pools
+	proxy.poolsMutex.Unlock()
 
 	for _, domainName := range domains {
 		domain, err := proxy.DomainDB.GetByName(domainName)
@@ -311,40 +806,110 @@ func (proxy *ProxyServer) RefreshReverseProxies() {
 			continue
 		}
 
-		if domain.Chained == false {
-			domain.TargetURL = fmt.Sprintf("http://%s:%d", domain.DestinationHost, domain.DestinationPort)
+		if domain.Access != nil {
+			rules, err := NewAccessRules(domain.Access)
+			if err != nil {
+				proxy.Log.Errorf("%s: %s", domain.Key(), err)
+				rules = denyAllAccessRules()
+			}
+			access[domain.Key()] = rules
 		}
 
-		pURL, _ := url.Parse(domain.TargetURL)
-		domain.ReverseProxy = httputil.NewSingleHostReverseProxy(pURL)
+		if domain.Limits != nil {
+			limiter := oldLimiters[domain.Key()]
+			if limiter == nil || limiter.Limits() != *domain.Limits {
+				limiter = NewDomainLimiter(domain.Limits)
+			}
+			limiters[domain.Key()] = limiter
+		}
 
-		// domain.reverseProxy.ErrorHandler = reverseProxyErrorHandler
-		domain.ReverseProxy.ModifyResponse = func(resp *http.Response) (err error) {
-			if proxy.config.ChainMode != ChainModeParent {
-				resp.Header.Set("X-Mulch", domain.VMName)
+		if domain.Cache != nil {
+			fingerprint := cacheFingerprint(domain)
+			cache := oldCaches[domain.Key()]
+			if cache == nil || cache.fingerprint != fingerprint {
+				cache, err = NewHTTPCache(domain.Cache, fingerprint, proxy.config.CacheDir, proxy.Log)
+				if err != nil {
+					proxy.Log.Errorf("%s: cache: %s", domain.Key(), err)
+				}
+			}
+			if cache != nil {
+				caches[domain.Key()] = cache
 			}
+		}
 
-			if proxy.config.Debug {
-				ctx := resp.Request.Context()
-				proxy.Log.Tracef("< {%d} %d", ctx.Value(contextKeyID), resp.StatusCode)
+		if domain.Pool != "" && domain.Chained == false {
+			oldPool := oldPools[domain.Key()]
+			if oldPool != nil && oldPool.fingerprint == poolFingerprint(domain) {
+				pools[domain.Key()] = oldPool
+				count++
+				continue
+			}
+			pool := NewDomainPool(domain)
+			if oldPool != nil {
+				pool.inherit(oldPool)
+			}
+			for _, backend := range pool.Backends {
+				proxy.initReverseProxy(backend.Domain, &errorHandlingRoundTripper{
+					ProxyServer: proxy,
+					Domain:      domain,
+					Backend:     backend,
+					Log:         proxy.Log,
+				})
 			}
+			pools[domain.Key()] = pool
+			count++
+			continue
+		}
 
-			return nil
+		if domain.Chained == false {
+			domain.TargetURL = "http://" + net.JoinHostPort(domain.DestinationHost, strconv.Itoa(domain.DestinationPort))
 		}
-		domain.ReverseProxy.Transport = &errorHandlingRoundTripper{
+
+		proxy.initReverseProxy(domain, &errorHandlingRoundTripper{
 			ProxyServer: proxy,
 			Domain:      domain,
 			Log:         proxy.Log,
-		}
+		})
 		count++
 	}
-	proxy.Log.Infof("refresh: %d domain(s)", count)
+
+	proxy.poolsMutex.Lock()
+	proxy.pools = pools
+	proxy.poolsMutex.Unlock()
+
+	proxy.accessMutex.Lock()
+	proxy.access = access
+	proxy.accessMutex.Unlock()
+
+	proxy.limitersMutex.Lock()
+	proxy.limiters = limiters
+	proxy.limitersMutex.Unlock()
+
+	proxy.cachesMutex.Lock()
+	proxy.caches = caches
+	proxy.cachesMutex.Unlock()
+
+	for key, cache := range oldCaches {
+		if caches[key] != cache {
+			cache.Purge()
+		}
+	}
+
+	if proxy.config.DNSCertManager != nil {
+		proxy.config.DNSCertManager.Update(proxy.DomainDB.GetWildcardHosts())
+	}
+
+	proxy.Log.Infof("refresh: %d domain(s), %d pool(s)", count, len(pools))
 }
 
 // ReloadDomains reload domains config file
 func (proxy *ProxyServer) ReloadDomains() {
 	proxy.DomainDB.Reload()
+	proxy.config.CustomCerts.Reload()
+	proxy.forgetDeletedCertificates()
+	proxy.loadRenewRequests()
 	proxy.RefreshReverseProxies()
+	proxy.Stats.Prune(proxy.DomainDB)
 }
 
 // Run the ProxyServer (foreground)
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// StatsLatencyBuckets are upper bounds (in seconds) of latency histograms
+var StatsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// RequestStats are cumulated counters for a set of requests
+type RequestStats struct {
+	Requests       uint64
+	Status         map[int]uint64
+	BytesIn        uint64
+	BytesOut       uint64
+	UpstreamErrors uint64
+	LatencySum     float64  // seconds
+	LatencyBuckets []uint64 `json:"-"` // see StatsLatencyBuckets
+}
+
+// DomainStats are request stats for a domain
+type DomainStats struct {
+	Domain string
+	VMName string
+	RequestStats
+}
+
+// ChainStats are stats of the link between a parent and its child(ren)
+type ChainStats struct {
+	Children                map[string]*RequestStats // parent only, by child URL
+	Registrations           uint64                   // child only
+	RegistrationErrors      uint64                   // child only
+	LastRegistrationSuccess time.Time                // child only
+}
+
+// ProxyStats stores request counters of the proxy (in memory)
+type ProxyStats struct {
+	domains      map[string]*DomainStats
+	chain        ChainStats
+	unknownHosts uint64
+	certDir      string
+	mutex        sync.Mutex
+}
+
+// APIProxyStats is the JSON response of the /stats API route
+type APIProxyStats struct {
+	Domains      []*DomainStats
+	VMs          map[string]*RequestStats
+	Chain        *ChainStats
+	UnknownHosts uint64
+}
+
+// NewProxyStats instanciates a new ProxyStats
+func NewProxyStats(certDir string) *ProxyStats {
+	return &ProxyStats{
+		domains: make(map[string]*DomainStats),
+		chain: ChainStats{
+			Children: make(map[string]*RequestStats),
+		},
+		certDir: certDir,
+	}
+}
+
+func newRequestStats() *RequestStats {
+	return &RequestStats{
+		Status:         make(map[int]uint64),
+		LatencyBuckets: make([]uint64, len(StatsLatencyBuckets)),
+	}
+}
+
+func (rs *RequestStats) add(status int, bytesIn uint64, bytesOut uint64, latency time.Duration) {
+	rs.Requests++
+	rs.Status[status]++
+	rs.BytesIn += bytesIn
+	rs.BytesOut += bytesOut
+	seconds := latency.Seconds()
+	rs.LatencySum += seconds
+	for i, bound := range StatsLatencyBuckets {
+		if seconds <= bound {
+			rs.LatencyBuckets[i]++
+		}
+	}
+}
+
+func (rs *RequestStats) merge(other *RequestStats) {
+	rs.Requests += other.Requests
+	for status, count := range other.Status {
+		rs.Status[status] += count
+	}
+	rs.BytesIn += other.BytesIn
+	rs.BytesOut += other.BytesOut
+	rs.UpstreamErrors += other.UpstreamErrors
+	rs.LatencySum += other.LatencySum
+	for i := range rs.LatencyBuckets {
+		rs.LatencyBuckets[i] += other.LatencyBuckets[i]
+	}
+}
+
+// get stats of a domain (or path route), creating them if needed (mutex
+// must be locked)
+func (ps *ProxyStats) getDomainStats(domain *common.Domain) *DomainStats {
+	stats, exists := ps.domains[domain.Key()]
+	if !exists || stats.VMName != domain.VMName {
+		stats = &DomainStats{
+			Domain:       domain.Key(),
+			VMName:       domain.VMName,
+			RequestStats: *newRequestStats(),
+		}
+		ps.domains[domain.Key()] = stats
+	}
+	return stats
+}
+
+// get stats of a child link (mutex must be locked)
+func (ps *ProxyStats) getChildStats(childURL string) *RequestStats {
+	stats, exists := ps.chain.Children[childURL]
+	if !exists {
+		stats = newRequestStats()
+		ps.chain.Children[childURL] = stats
+	}
+	return stats
+}
+
+// Record a request, domain is nil for unknown hosts
+func (ps *ProxyStats) Record(domain *common.Domain, status int, bytesIn uint64, bytesOut uint64, latency time.Duration) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if domain == nil {
+		ps.unknownHosts++
+		return
+	}
+
+	// nothing written, net/http will reply with an empty 200
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	ps.getDomainStats(domain).add(status, bytesIn, bytesOut, latency)
+	if domain.Chained {
+		ps.getChildStats(domain.TargetURL).add(status, bytesIn, bytesOut, latency)
+	}
+}
+
+// UpstreamError records an error when contacting the domain destination
+func (ps *ProxyStats) UpstreamError(domain *common.Domain) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.getDomainStats(domain).UpstreamErrors++
+	if domain.Chained {
+		ps.getChildStats(domain.TargetURL).UpstreamErrors++
+	}
+}
+
+// ParentRegistration records a domain registration on our parent (child only)
+func (ps *ProxyStats) ParentRegistration(success bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.chain.Registrations++
+	if success {
+		ps.chain.LastRegistrationSuccess = time.Now()
+	} else {
+		ps.chain.RegistrationErrors++
+	}
+}
+
+// Prune forgets stats of domains that are no more in the database
+func (ps *ProxyStats) Prune(ddb *DomainDatabase) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for name := range ps.domains {
+		if _, err := ddb.GetByName(name); err != nil {
+			delete(ps.domains, name)
+		}
+	}
+
+	children := make(map[string]bool)
+	for _, child := range ddb.GetChildren() {
+		children[child] = true
+	}
+	for child := range ps.chain.Children {
+		if !children[child] {
+			delete(ps.chain.Children, child)
+		}
+	}
+}
+
+// Report returns a copy of current stats, by domain and by VM
+func (ps *ProxyStats) Report() *APIProxyStats {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	report := &APIProxyStats{
+		VMs: make(map[string]*RequestStats),
+		Chain: &ChainStats{
+			Children:                make(map[string]*RequestStats),
+			Registrations:           ps.chain.Registrations,
+			RegistrationErrors:      ps.chain.RegistrationErrors,
+			LastRegistrationSuccess: ps.chain.LastRegistrationSuccess,
+		},
+		UnknownHosts: ps.unknownHosts,
+	}
+
+	for _, stats := range ps.domains {
+		dup := &DomainStats{
+			Domain:       stats.Domain,
+			VMName:       stats.VMName,
+			RequestStats: *newRequestStats(),
+		}
+		dup.merge(&stats.RequestStats)
+		report.Domains = append(report.Domains, dup)
+
+		if stats.VMName != "" {
+			vmStats, exists := report.VMs[stats.VMName]
+			if !exists {
+				vmStats = newRequestStats()
+				report.VMs[stats.VMName] = vmStats
+			}
+			vmStats.merge(&stats.RequestStats)
+		}
+	}
+	sort.Slice(report.Domains, func(i, j int) bool {
+		return report.Domains[i].Domain < report.Domains[j].Domain
+	})
+
+	for child, stats := range ps.chain.Children {
+		dup := newRequestStats()
+		dup.merge(stats)
+		report.Chain.Children[child] = dup
+	}
+
+	return report
+}
+
+// get expiry dates of certificates in the autocert cache directory
+func (ps *ProxyStats) certificatesExpiry() map[string]time.Time {
+	res := make(map[string]time.Time)
+
+	files, err := ioutil.ReadDir(ps.certDir)
+	if err != nil {
+		return res
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Clean(ps.certDir + "/" + file.Name()))
+		if err != nil {
+			continue
+		}
+		// autocert format: private key, then certificate chain (leaf first)
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				res[file.Name()] = cert.NotAfter
+			}
+			break
+		}
+	}
+	return res
+}
+
+func sortedKeys(m map[string]*RequestStats) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write request stats metrics for a set of labeled RequestStats
+func writeRequestMetrics(mw *common.MetricsWriter, prefix string, labelName string, all map[string]*RequestStats, extraLabels map[string][]string) {
+	keys := sortedKeys(all)
+	labels := func(key string) []string {
+		return append([]string{labelName, key}, extraLabels[key]...)
+	}
+
+	mw.Header(prefix+"_requests_total", "counter", "Number of HTTP requests, by status code.")
+	for _, key := range keys {
+		codes := make([]int, 0, len(all[key].Status))
+		for code := range all[key].Status {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			mw.Sample(prefix+"_requests_total", float64(all[key].Status[code]), append(labels(key), "code", strconv.Itoa(code))...)
+		}
+	}
+
+	mw.Header(prefix+"_received_bytes_total", "counter", "Bytes received from clients (request bodies).")
+	for _, key := range keys {
+		mw.Sample(prefix+"_received_bytes_total", float64(all[key].BytesIn), labels(key)...)
+	}
+
+	mw.Header(prefix+"_sent_bytes_total", "counter", "Bytes sent to clients (response bodies).")
+	for _, key := range keys {
+		mw.Sample(prefix+"_sent_bytes_total", float64(all[key].BytesOut), labels(key)...)
+	}
+
+	mw.Header(prefix+"_upstream_errors_total", "counter", "Number of errors when contacting the destination.")
+	for _, key := range keys {
+		mw.Sample(prefix+"_upstream_errors_total", float64(all[key].UpstreamErrors), labels(key)...)
+	}
+
+	mw.Header(prefix+"_request_duration_seconds", "histogram", "Duration of HTTP requests.")
+	for _, key := range keys {
+		stats := all[key]
+		for i, bound := range StatsLatencyBuckets {
+			mw.Sample(prefix+"_request_duration_seconds_bucket", float64(stats.LatencyBuckets[i]), append(labels(key), "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+		}
+		mw.Sample(prefix+"_request_duration_seconds_bucket", float64(stats.Requests), append(labels(key), "le", "+Inf")...)
+		mw.Sample(prefix+"_request_duration_seconds_sum", stats.LatencySum, labels(key)...)
+		mw.Sample(prefix+"_request_duration_seconds_count", float64(stats.Requests), labels(key)...)
+	}
+}
+
+// WriteMetrics writes proxy metrics in Prometheus text format
+func (ps *ProxyStats) WriteMetrics(out io.Writer) error {
+	report := ps.Report()
+	mw := &common.MetricsWriter{}
+
+	domains := make(map[string]*RequestStats)
+	domainLabels := make(map[string][]string)
+	for _, stats := range report.Domains {
+		domains[stats.Domain] = &stats.RequestStats
+		domainLabels[stats.Domain] = []string{"vm", stats.VMName}
+	}
+	writeRequestMetrics(mw, "mulch_proxy_domain", "domain", domains, domainLabels)
+	writeRequestMetrics(mw, "mulch_proxy_vm", "vm", report.VMs, nil)
+	writeRequestMetrics(mw, "mulch_proxy_child", "child", report.Chain.Children, nil)
+
+	mw.Header("mulch_proxy_unknown_host_requests_total", "counter", "Number of requests for unknown hosts.")
+	mw.Sample("mulch_proxy_unknown_host_requests_total", float64(report.UnknownHosts))
+
+	mw.Header("mulch_proxy_parent_registrations_total", "counter", "Number of domain registrations on the parent proxy.")
+	mw.Sample("mulch_proxy_parent_registrations_total", float64(report.Chain.Registrations))
+	mw.Header("mulch_proxy_parent_registration_errors_total", "counter", "Number of failed domain registrations on the parent proxy.")
+	mw.Sample("mulch_proxy_parent_registration_errors_total", float64(report.Chain.RegistrationErrors))
+	if !report.Chain.LastRegistrationSuccess.IsZero() {
+		mw.Header("mulch_proxy_parent_last_registration_timestamp_seconds", "gauge", "Last successful domain registration on the parent proxy.")
+		mw.Sample("mulch_proxy_parent_last_registration_timestamp_seconds", float64(report.Chain.LastRegistrationSuccess.Unix()))
+	}
+
+	expiry := ps.certificatesExpiry()
+	names := make([]string, 0, len(expiry))
+	for name := range expiry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mw.Header("mulch_proxy_certificate_expiry_timestamp_seconds", "gauge", "Expiry date of ACME certificates.")
+	for _, name := range names {
+		keyType := "ecdsa"
+		domain := name
+		if strings.HasSuffix(name, "+rsa") {
+			keyType = "rsa"
+			domain = strings.TrimSuffix(name, "+rsa")
+		}
+		mw.Sample("mulch_proxy_certificate_expiry_timestamp_seconds", float64(expiry[name].Unix()), "domain", domain, "key_type", keyType)
+	}
+
+	_, err := mw.WriteTo(out)
+	return err
+}
+
+// statsResponseWriter captures status code and size of the response
+type statsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  uint64
+}
+
+func (w *statsResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statsResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += uint64(n)
+	return n, err
+}
+
+// Flush is needed for streamed responses
+func (w *statsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is needed for protocol upgrades (websockets)
+func (w *statsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection hijacking is not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// statsReadCloser counts bytes of the request body
+type statsReadCloser struct {
+	io.ReadCloser
+	bytes uint64
+}
+
+func (r *statsReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += uint64(n)
+	return n, err
+}
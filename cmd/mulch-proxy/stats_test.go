@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestRequestStatsAdd(t *testing.T) {
+	rs := newRequestStats()
+	rs.add(200, 10, 1000, 3*time.Millisecond)
+	rs.add(200, 0, 500, 200*time.Millisecond)
+	rs.add(404, 5, 50, 45*time.Second) // over the last bucket
+
+	if rs.Requests != 3 || rs.BytesIn != 15 || rs.BytesOut != 1550 {
+		t.Errorf("got (%d, %d, %d), want (3, 15, 1550)", rs.Requests, rs.BytesIn, rs.BytesOut)
+	}
+	if !reflect.DeepEqual(rs.Status, map[int]uint64{200: 2, 404: 1}) {
+		t.Errorf("got status %v", rs.Status)
+	}
+	if rs.LatencySum < 45.2029 || rs.LatencySum > 45.2031 {
+		t.Errorf("got latency sum %f, want 45.203", rs.LatencySum)
+	}
+
+	// buckets are cumulative (le)
+	want := []uint64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2}
+	if !reflect.DeepEqual(rs.LatencyBuckets, want) {
+		t.Errorf("got buckets %v, want %v", rs.LatencyBuckets, want)
+	}
+}
+
+func TestRequestStatsMerge(t *testing.T) {
+	a := newRequestStats()
+	a.add(200, 1, 2, 20*time.Millisecond)
+	a.UpstreamErrors = 1
+
+	b := newRequestStats()
+	b.add(200, 3, 4, 2*time.Second)
+	b.add(502, 0, 0, 30*time.Second)
+	b.UpstreamErrors = 2
+
+	sum := newRequestStats()
+	sum.merge(a)
+	sum.merge(b)
+
+	if sum.Requests != 3 || sum.BytesIn != 4 || sum.BytesOut != 6 || sum.UpstreamErrors != 3 {
+		t.Errorf("got (%d, %d, %d, %d), want (3, 4, 6, 3)", sum.Requests, sum.BytesIn, sum.BytesOut, sum.UpstreamErrors)
+	}
+	if !reflect.DeepEqual(sum.Status, map[int]uint64{200: 2, 502: 1}) {
+		t.Errorf("got status %v", sum.Status)
+	}
+	want := []uint64{0, 0, 1, 1, 1, 1, 1, 1, 2, 2, 2, 3}
+	if !reflect.DeepEqual(sum.LatencyBuckets, want) {
+		t.Errorf("got buckets %v, want %v", sum.LatencyBuckets, want)
+	}
+
+	// sources are untouched
+	if a.Requests != 1 || b.Requests != 2 {
+		t.Errorf("merge must not modify its source")
+	}
+}
+
+func TestWriteRequestMetrics(t *testing.T) {
+	buckets := StatsLatencyBuckets
+	StatsLatencyBuckets = []float64{0.1, 1}
+	defer func() { StatsLatencyBuckets = buckets }()
+
+	a := newRequestStats()
+	a.add(200, 10, 100, 50*time.Millisecond)
+	a.add(404, 0, 20, 2*time.Second)
+	a.UpstreamErrors = 1
+	b := newRequestStats()
+	b.add(200, 0, 5, 500*time.Millisecond)
+
+	mw := &common.MetricsWriter{}
+	writeRequestMetrics(mw, "mulch_proxy_domain", "domain", map[string]*RequestStats{
+		"b.com": b,
+		"a.com": a,
+	}, map[string][]string{
+		"a.com": {"vm", "vma"},
+	})
+
+	want := `# HELP mulch_proxy_domain_requests_total Number of HTTP requests, by status code.
+# TYPE mulch_proxy_domain_requests_total counter
+mulch_proxy_domain_requests_total{domain="a.com",vm="vma",code="200"} 1
+mulch_proxy_domain_requests_total{domain="a.com",vm="vma",code="404"} 1
+mulch_proxy_domain_requests_total{domain="b.com",code="200"} 1
+# HELP mulch_proxy_domain_received_bytes_total Bytes received from clients (request bodies).
+# TYPE mulch_proxy_domain_received_bytes_total counter
+mulch_proxy_domain_received_bytes_total{domain="a.com",vm="vma"} 10
+mulch_proxy_domain_received_bytes_total{domain="b.com"} 0
+# HELP mulch_proxy_domain_sent_bytes_total Bytes sent to clients (response bodies).
+# TYPE mulch_proxy_domain_sent_bytes_total counter
+mulch_proxy_domain_sent_bytes_total{domain="a.com",vm="vma"} 120
+mulch_proxy_domain_sent_bytes_total{domain="b.com"} 5
+# HELP mulch_proxy_domain_upstream_errors_total Number of errors when contacting the destination.
+# TYPE mulch_proxy_domain_upstream_errors_total counter
+mulch_proxy_domain_upstream_errors_total{domain="a.com",vm="vma"} 1
+mulch_proxy_domain_upstream_errors_total{domain="b.com"} 0
+# HELP mulch_proxy_domain_request_duration_seconds Duration of HTTP requests.
+# TYPE mulch_proxy_domain_request_duration_seconds histogram
+mulch_proxy_domain_request_duration_seconds_bucket{domain="a.com",vm="vma",le="0.1"} 1
+mulch_proxy_domain_request_duration_seconds_bucket{domain="a.com",vm="vma",le="1"} 1
+mulch_proxy_domain_request_duration_seconds_bucket{domain="a.com",vm="vma",le="+Inf"} 2
+mulch_proxy_domain_request_duration_seconds_sum{domain="a.com",vm="vma"} 2.05
+mulch_proxy_domain_request_duration_seconds_count{domain="a.com",vm="vma"} 2
+mulch_proxy_domain_request_duration_seconds_bucket{domain="b.com",le="0.1"} 0
+mulch_proxy_domain_request_duration_seconds_bucket{domain="b.com",le="1"} 1
+mulch_proxy_domain_request_duration_seconds_bucket{domain="b.com",le="+Inf"} 1
+mulch_proxy_domain_request_duration_seconds_sum{domain="b.com"} 0.5
+mulch_proxy_domain_request_duration_seconds_count{domain="b.com"} 1
+`
+
+	var out bytes.Buffer
+	mw.WriteTo(&out)
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
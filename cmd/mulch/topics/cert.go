@@ -0,0 +1,24 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// certCmd represents the "cert" command
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "TLS certificates management",
+	Long: `Manage TLS certificates served by mulch-proxy.
+
+Certificates are issued automatically using ACME (Let's Encrypt by default),
+but you can import your own certificate for a domain (EV, corporate CA, …),
+it will be served instead.
+
+An alert is sent when a certificate is about to expire or when its
+issuance is failing (see cert_expiry_alert_days setting on the server).
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(certCmd)
+}
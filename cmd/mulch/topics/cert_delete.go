@@ -0,0 +1,28 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// certDeleteCmd represents the "cert delete" command
+var certDeleteCmd = &cobra.Command{
+	Use:   "delete <domain>",
+	Short: "Delete a certificate",
+	Long: `Delete the imported certificate of a domain, mulch-proxy will
+use ACME certificates again.
+
+If there's no imported certificate, the ACME certificate is deleted from
+mulch-proxy cache, a new one will be issued on the next request.
+`,
+	Args:    cobra.ExactArgs(1),
+	Aliases: []string{"remove"},
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("DELETE", "/certs/"+args[0], map[string]string{})
+		call.Do()
+	},
+}
+
+func init() {
+	certCmd.AddCommand(certDeleteCmd)
+}
@@ -0,0 +1,40 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// certImportCmd represents the "cert import" command
+var certImportCmd = &cobra.Command{
+	Use:   "import <domain> <cert.pem> <key.pem>",
+	Short: "Import a certificate for a domain",
+	Long: `Import a certificate (PEM, full chain, leaf first) and its private
+key (PEM) for a domain. mulch-proxy will serve it instead of ACME
+certificates. Wildcard domains are supported (ex: *.example.com).
+
+An alert is sent when the certificate is about to expire, import
+the renewed certificate using the same command.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/certs/"+args[0], map[string]string{
+			"action": "import",
+		})
+		err := call.AddFile("cert", args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = call.AddFile("key", args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		call.Do()
+	},
+}
+
+func init() {
+	certCmd.AddCommand(certImportCmd)
+}
@@ -0,0 +1,109 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var certListFlagBasic bool
+
+// certListCmd represents the "cert list" command
+var certListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List certificates",
+	Long: `List TLS certificates served by mulch-proxy: ACME certificates (from
+the proxy cache) and imported certificates, with their last issuance error.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		certListFlagBasic, _ = cmd.Flags().GetBool("basic")
+		if certListFlagBasic == true {
+			client.GetExitMessage().Disable()
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/certs", map[string]string{})
+		call.JSONCallback = certListCB
+		call.Do()
+	},
+}
+
+func certListCB(reader io.Reader, headers http.Header) {
+	var data common.APICertList
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if certListFlagBasic {
+		for _, line := range data {
+			fmt.Println(line.Domain)
+		}
+		return
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No result.\n")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+
+	strData := [][]string{}
+	for _, line := range data {
+		issuer := line.Issuer
+		if line.Staging {
+			issuer = yellow(issuer + " (staging)")
+		}
+
+		expires := "-"
+		if !line.NotAfter.IsZero() {
+			days := int(time.Until(line.NotAfter).Hours() / 24)
+			expires = fmt.Sprintf("%s (%dd)", line.NotAfter.Format("2006-01-02"), days)
+			switch {
+			case days < 0:
+				expires = red(expires)
+			case days < 20:
+				expires = yellow(expires)
+			}
+		}
+
+		lastError := ""
+		if line.Error != "" {
+			lastError = red("since " + line.ErrorTime.Format("2006-01-02 15:04") + ": " + line.Error)
+		}
+
+		strData = append(strData, []string{
+			line.Domain,
+			line.Source,
+			line.KeyType,
+			issuer,
+			expires,
+			lastError,
+		})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Domain", "Source", "Key", "Issuer", "Expires", "Last Error"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	certCmd.AddCommand(certListCmd)
+	certListCmd.Flags().BoolP("basic", "b", false, "show basic list, without any formating")
+}
@@ -0,0 +1,29 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// certRenewCmd represents the "cert renew" command
+var certRenewCmd = &cobra.Command{
+	Use:   "renew <domain>",
+	Short: "Force the renewal of an ACME certificate",
+	Long: `Request a new ACME certificate for a domain (ex: staging certificate,
+invalid certificate). The current certificate is replaced only if the
+new one is successfully issued.
+
+Warning: ACME servers have rate limits, use with care.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/certs/"+args[0], map[string]string{
+			"action": "renew",
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	certCmd.AddCommand(certRenewCmd)
+}
@@ -0,0 +1,25 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// seedRollbackCmd represents the "seed rollback" command
+var seedRollbackCmd = &cobra.Command{
+	Use:   "rollback <seed-name>",
+	Short: "Rollback a seed to its previous version",
+	Long: `Use the previous version of the seed for new VMs. It stays in place
+until the next seed refresh (new upstream image or seeder rebuild).`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/seed/"+args[0], map[string]string{
+			"action": "rollback",
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	seedCmd.AddCommand(seedRollbackCmd)
+}
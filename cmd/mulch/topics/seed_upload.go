@@ -0,0 +1,36 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// seedUploadCmd represents the "seed upload" command
+var seedUploadCmd = &cobra.Command{
+	Use:   "upload <seed-name> <image.qcow2|.img|.raw>",
+	Short: "Upload an image as a seed",
+	Long: `Upload a local image (qcow2 or raw) as a new version of a seed.
+The seed is created if needed. It can't be a seed defined in mulchd
+configuration (url or seeder). Raw images are converted to qcow2, other
+formats (VMDK, VHD, VDI, …) must be converted first (see qemu-img convert).`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		provisioning, _ := cmd.Flags().GetString("provisioning")
+		call := client.GlobalAPI.NewCall("POST", "/seed", map[string]string{
+			"name":         args[0],
+			"provisioning": provisioning,
+		})
+		err := call.AddFile("file", args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		call.Do()
+	},
+}
+
+func init() {
+	seedCmd.AddCommand(seedUploadCmd)
+	seedUploadCmd.Flags().StringP("provisioning", "p", "", "VM provisioning: cloud-init (default), config-drive or ignition")
+}
@@ -16,12 +16,21 @@ The reverse proxy will instantly send requests to the new active revision,
 and all VM commands (ex: lock, backup, ...) will defaults to this revision.
 
 Revision "none" is equivalent to deactivate command.
+
+Use --weight to send only a percentage of the traffic to this revision
+(canary), the active revision keeps the rest (for pool domains, the
+percentage is of the whole pool traffic). Users stay on the same revision
+using a cookie. Weight 0 stops the canary, and activating the revision
+without --weight does the full cutover. The canary revision can also be
+previewed using its revision as a subdomain (ex: r4.example.com).
 `,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
+		weight, _ := cmd.Flags().GetString("weight")
 		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
 			"action":   "activate",
 			"revision": args[1],
+			"weight":   weight,
 		})
 		call.Do()
 	},
@@ -29,4 +38,5 @@ Revision "none" is equivalent to deactivate command.
 
 func init() {
 	vmCmd.AddCommand(vmActivateCmd)
+	vmActivateCmd.Flags().StringP("weight", "w", "", "percentage of the traffic sent to this revision (canary)")
 }
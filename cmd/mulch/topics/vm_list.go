@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
 	"github.com/OnitiFR/mulch/common"
@@ -66,6 +67,9 @@ func vmListCB(reader io.Reader, headers http.Header) {
 			if line.State == "up" {
 				state = green(line.State)
 			}
+			if line.Maintenance == true {
+				state = state + " " + yellow("(maintenance)")
+			}
 
 			locked := "false"
 			if line.Locked == true {
@@ -77,16 +81,35 @@ func vmListCB(reader io.Reader, headers http.Header) {
 				name = grey(name)
 			}
 
+			health := line.Health
+			switch line.Health {
+			case "healthy":
+				health = green(line.Health)
+			case "failing":
+				health = yellow(line.Health)
+			case "unhealthy":
+				health = red(line.Health)
+			case "unknown":
+				health = grey(line.Health)
+			}
+
+			revision := strconv.Itoa(line.Revision)
+			if line.Weight > 0 {
+				revision = fmt.Sprintf("%s (%s)", revision, yellow(strconv.Itoa(line.Weight)+"%"))
+			}
+
 			strData = append(strData, []string{
 				name,
-				strconv.Itoa(line.Revision),
+				revision,
 				state,
+				health,
 				locked,
+				strings.Join(line.Pools, ", "),
 				yellow(line.WIP),
 			})
 		}
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Rev", "State", "Locked", "Operation"})
+		table.SetHeader([]string{"Name", "Rev", "State", "Health", "Locked", "Pools", "Operation"})
 		table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 		table.SetCenterSeparator("|")
 		table.AppendBulk(strData)
@@ -0,0 +1,37 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmMaintenanceCmd represents the "vm maintenance" command
+var vmMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance <on|off> <vm-name>",
+	Short: "Enable or disable VM maintenance mode",
+	Long: `Enable or disable maintenance mode of a VM (by its name). While
+in maintenance mode, mulch-proxy serves a maintenance page for all VM domains.
+
+Maintenance mode is kept during (and after) a rebuild, and preview domains
+(ex: r4.example.com) are not affected, so a new revision can be checked
+before disabling maintenance mode.
+
+See 'vm list' for VM Names.
+`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[1], map[string]string{
+			"action":   "maintenance",
+			"state":    args[0],
+			"revision": revision,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmMaintenanceCmd)
+	vmMaintenanceCmd.Flags().StringP("revision", "r", "", "revision number")
+}
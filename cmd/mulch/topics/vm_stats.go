@@ -0,0 +1,88 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// vmStatsCmd represents the "vm stats" command
+var vmStatsCmd = &cobra.Command{
+	Use:   "stats <vm-name>",
+	Short: "Show resource usage history of a VM",
+	Long: `Show CPU, memory, disk and network usage samples of a VM (mulchd
+keeps a few hours of history). See 'vm top' for live usage of all VMs.
+
+Examples:
+  mulch vm stats myvm
+  mulch vm stats myvm --since 2h
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		since, _ := cmd.Flags().GetDuration("since")
+		if since <= 0 {
+			log.Fatalf("invalid since duration")
+		}
+		call := client.GlobalAPI.NewCall("GET", "/vm/stats/"+args[0], map[string]string{
+			"revision": revision,
+			"since":    since.String(),
+		})
+		call.JSONCallback = vmStatsCB
+		call.Do()
+	},
+}
+
+func vmStatsCB(reader io.Reader, headers http.Header) {
+	var data common.APIVMStats
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data.Samples) == 0 {
+		fmt.Printf("No samples for %s (r%d), is it running?\n", data.Name, data.Revision)
+		return
+	}
+
+	strData := [][]string{}
+	for _, sample := range data.Samples {
+		mem := (datasize.ByteSize(sample.MemoryRSS) * datasize.B).HR()
+		if sample.MemoryMax > 0 {
+			mem = fmt.Sprintf("%s (%.0f%%)", mem, float64(sample.MemoryRSS)/float64(sample.MemoryMax)*100)
+		}
+		strData = append(strData, []string{
+			sample.Time.Format(time.Stamp),
+			fmt.Sprintf("%.1f%%", sample.CPUPercent),
+			mem,
+			vmTopRate(sample.DiskReadRate),
+			vmTopRate(sample.DiskWriteRate),
+			vmTopRate(sample.NetRxRate),
+			vmTopRate(sample.NetTxRate),
+		})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Time", "CPU", "Memory", "Disk Read", "Disk Write", "Net Rx", "Net Tx"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	vmCmd.AddCommand(vmStatsCmd)
+	vmStatsCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmStatsCmd.Flags().DurationP("since", "s", 10*time.Minute, "history duration (ex: 1h)")
+}
@@ -0,0 +1,155 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var vmTopFlagSort string
+var vmTopFlagOnce bool
+
+// vmTopCmd represents the "vm top" command
+var vmTopCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show live resource usage of VMs",
+	Long: `Show CPU, memory, disk and network usage of running VMs, refreshed
+periodically. Rates are computed by mulchd from libvirt samples.
+
+Sort keys: cpu, mem, disk, net, name
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		vmTopFlagSort, _ = cmd.Flags().GetString("sort")
+		vmTopFlagOnce, _ = cmd.Flags().GetBool("once")
+		interval, _ := cmd.Flags().GetDuration("interval")
+
+		switch vmTopFlagSort {
+		case "cpu", "mem", "disk", "net", "name":
+		default:
+			log.Fatalf("invalid sort key '%s'", vmTopFlagSort)
+		}
+
+		if interval < time.Second {
+			log.Fatalf("interval is too short")
+		}
+
+		for {
+			call := client.GlobalAPI.NewCall("GET", "/vm/stats", map[string]string{})
+			call.JSONCallback = vmTopCB
+			call.Do()
+
+			if vmTopFlagOnce {
+				return
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+func vmTopSortValue(stats common.APIVMStats) float64 {
+	if len(stats.Samples) == 0 {
+		return -1
+	}
+	sample := stats.Samples[0]
+	switch vmTopFlagSort {
+	case "mem":
+		return float64(sample.MemoryRSS)
+	case "disk":
+		return sample.DiskReadRate + sample.DiskWriteRate
+	case "net":
+		return sample.NetRxRate + sample.NetTxRate
+	}
+	return sample.CPUPercent
+}
+
+func vmTopRate(rate float64) string {
+	return (datasize.ByteSize(rate) * datasize.B).HR() + "/s"
+}
+
+func vmTopCB(reader io.Reader, headers http.Header) {
+	var data common.APIVMStatsList
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	sort.SliceStable(data, func(i, j int) bool {
+		if vmTopFlagSort == "name" {
+			if data[i].Name == data[j].Name {
+				return data[i].Revision < data[j].Revision
+			}
+			return data[i].Name < data[j].Name
+		}
+		return vmTopSortValue(data[i]) > vmTopSortValue(data[j])
+	})
+
+	strData := [][]string{}
+	red := color.New(color.FgHiRed).SprintFunc()
+	grey := color.New(color.FgHiBlack).SprintFunc()
+	for _, line := range data {
+		name := line.Name
+		if line.Active == false {
+			name = grey(name)
+		}
+
+		if len(line.Samples) == 0 {
+			strData = append(strData, []string{
+				name,
+				strconv.Itoa(line.Revision),
+				red("down"), "", "", "", "", "", "",
+			})
+			continue
+		}
+
+		sample := line.Samples[0]
+		mem := (datasize.ByteSize(sample.MemoryRSS) * datasize.B).HR()
+		if sample.MemoryMax > 0 {
+			mem = fmt.Sprintf("%s (%.0f%%)", mem, float64(sample.MemoryRSS)/float64(sample.MemoryMax)*100)
+		}
+		strData = append(strData, []string{
+			name,
+			strconv.Itoa(line.Revision),
+			fmt.Sprintf("%.1f%%", sample.CPUPercent),
+			mem,
+			vmTopRate(sample.DiskReadRate),
+			vmTopRate(sample.DiskWriteRate),
+			vmTopRate(sample.NetRxRate),
+			vmTopRate(sample.NetTxRate),
+			sample.Time.Format("15:04:05"),
+		})
+	}
+
+	if vmTopFlagOnce == false {
+		// clear screen and move cursor home
+		fmt.Print("\033[H\033[2J")
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Rev", "CPU", "Memory", "Disk Read", "Disk Write", "Net Rx", "Net Tx", "Sample"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	vmCmd.AddCommand(vmTopCmd)
+	vmTopCmd.Flags().StringP("sort", "s", "cpu", "sort key (cpu, mem, disk, net, name)")
+	vmTopCmd.Flags().DurationP("interval", "i", 5*time.Second, "refresh interval")
+	vmTopCmd.Flags().BoolP("once", "1", false, "display once and exit")
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ListCertsController lists certificates served by mulch-proxy
+func ListCertsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	certs, err := req.App.CertInventory.List()
+	if err != nil {
+		msg := "unable to list certificates: " + err.Error()
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 500)
+		return
+	}
+
+	var retData common.APICertList
+	for _, cert := range certs {
+		retData = append(retData, common.APICert{
+			Domain:    cert.Domain,
+			Source:    cert.Source,
+			KeyType:   cert.KeyType,
+			Issuer:    cert.Issuer,
+			Staging:   cert.Staging,
+			NotAfter:  cert.NotAfter,
+			Error:     cert.Error,
+			ErrorTime: cert.ErrorTime,
+		})
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// ActionCertController redirects to the correct action for the certificate
+func ActionCertController(req *server.Request) {
+	req.StartStream()
+	action := req.HTTP.FormValue("action")
+
+	switch action {
+	case "import":
+		importCert(req)
+	case "renew":
+		renewCert(req)
+	default:
+		req.Stream.Failuref("missing or invalid action ('%s') for '%s'", action, req.SubPath)
+	}
+}
+
+// imports a certificate and its private key for a domain, served by
+// mulch-proxy instead of ACME certificates
+func importCert(req *server.Request) {
+	domain := req.SubPath
+
+	var files [2][]byte
+	for i, field := range []string{"cert", "key"} {
+		file, _, err := req.HTTP.FormFile(field)
+		if err != nil {
+			req.Stream.Failuref("error with '%s' field: %s", field, err)
+			return
+		}
+		defer file.Close()
+		files[i], err = ioutil.ReadAll(file)
+		if err != nil {
+			req.Stream.Failuref("error reading '%s' field: %s", field, err)
+			return
+		}
+	}
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "import",
+		Ressource:     "cert",
+		RessourceName: domain,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	cert, err := req.App.CustomCerts.Import(domain, files[0], files[1])
+	if err != nil {
+		req.Stream.Failuref("unable to import certificate: %s", err)
+		return
+	}
+
+	req.Stream.Infof("issuer: %s, expires: %s", cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	alertDays := req.App.Config.CertExpiryAlertDays
+	if time.Until(cert.NotAfter) < time.Duration(alertDays)*24*time.Hour {
+		req.Stream.Warningf("this certificate expires in less than %d days", alertDays)
+	}
+	req.Stream.Successf("certificate for '%s' successfully imported", cert.Domain)
+}
+
+// forces the renewal of the ACME certificate of a domain
+func renewCert(req *server.Request) {
+	domain := req.SubPath
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "renew",
+		Ressource:     "cert",
+		RessourceName: domain,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	err := req.App.CertInventory.Renew(domain, req.Stream)
+	if err != nil {
+		req.Stream.Failuref("unable to renew certificate: %s", err)
+		return
+	}
+
+	req.Stream.Successf("certificate renewal for '%s' done", domain)
+}
+
+// DeleteCertController deletes the imported certificate of a domain, or
+// its ACME certificate if there's no imported certificate
+func DeleteCertController(req *server.Request) {
+	req.StartStream()
+	domain := req.SubPath
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "delete",
+		Ressource:     "cert",
+		RessourceName: domain,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	if req.App.CustomCerts.Exists(domain) {
+		err := req.App.CustomCerts.Delete(domain)
+		if err != nil {
+			req.Stream.Failure(err.Error())
+			return
+		}
+		req.Stream.Successf("imported certificate for '%s' successfully deleted", domain)
+		return
+	}
+
+	err := req.App.CertInventory.DeleteACME(domain)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+	req.Stream.Successf("ACME certificate for '%s' successfully deleted, a new one will be issued on the next request", domain)
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// GetMetricsController returns Prometheus metrics (API key required, see
+// also metrics_listen setting)
+func GetMetricsController(req *server.Request) {
+	var buf bytes.Buffer
+	err := req.App.WriteMetrics(&buf)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	req.Response.Header().Set("Content-Type", common.MetricsContentType)
+	req.Response.Write(buf.Bytes())
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -65,16 +66,34 @@ func GetSeedStatusController(req *server.Request) {
 		return
 	}
 
+	// (versions may change meanwhile, see seeder)
+	seedVersions, current := req.App.Seeder.GetVersions(seed)
+	file := seed.Name + ".qcow2"
+	var versions []string
+	for _, version := range seedVersions {
+		if version.Tag == current {
+			versions = append(versions, version.Tag+" (current)")
+			file = version.Volume
+		} else {
+			versions = append(versions, version.Tag)
+		}
+	}
+
 	data := &common.APISeedStatus{
 		Name:         seedName,
-		File:         seed.GetVolumeName(),
+		File:         file,
 		Ready:        seed.Ready,
 		URL:          seed.URL,
 		Seeder:       seed.Seeder,
+		Uploaded:     seed.Uploaded,
+		Parent:       seed.Parent,
+		Provisioning: seed.GetProvisioning(),
 		Size:         seed.Size,
 		Status:       seed.Status,
 		StatusTime:   seed.StatusTime,
 		LastModified: seed.LastModified,
+		Version:      current,
+		Versions:     versions,
 	}
 
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -111,15 +130,61 @@ func ActionSeedController(req *server.Request) {
 		} else {
 			req.Stream.Successf("refresh completed (%s)", after.Sub(before))
 		}
+	case "rollback":
+		err := req.App.Seeder.Rollback(seed, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("rollback failed: %s", err)
+		} else {
+			_, current := req.App.Seeder.GetVersions(seed)
+			req.Stream.Successf("seed '%s' is now using version %s", seed.Name, current)
+		}
 	default:
 		req.Stream.Failuref("missing or invalid action ('%s')", action)
 		return
 	}
 }
 
+// UploadSeedController will upload an image as a seed
+func UploadSeedController(req *server.Request) {
+	req.StartStream()
+	file, header, err := req.HTTP.FormFile("file")
+	if err != nil {
+		req.Stream.Failuref("error with 'file' field: %s", err)
+		return
+	}
+	defer file.Close()
+
+	seedName := req.HTTP.FormValue("name")
+	req.SetTarget(seedName)
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "upload",
+		Ressource:     "seed",
+		RessourceName: seedName,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	req.Stream.Infof("uploading '%s' as seed '%s'", header.Filename, seedName)
+
+	before := time.Now()
+	provisioning := req.HTTP.FormValue("provisioning")
+	err = req.App.Seeder.Upload(seedName, provisioning, file, req.Stream)
+	after := time.Now()
+	if err != nil {
+		req.Stream.Failuref("unable to upload seed: %s", err)
+		return
+	}
+
+	req.Stream.Successf("seed '%s' uploaded successfully (%s)", seedName, after.Sub(before))
+}
+
 // TODO: should check for conflitcs with any existing automatic seed operation
 func seedRefresh(req *server.Request, seed *server.Seed) error {
 	var err error
+	if seed.Uploaded {
+		return errors.New("uploaded seeds can't be refreshed, upload a new version")
+	}
 	if seed.URL != "" {
 		err = req.App.Seeder.RefreshSeed(seed, server.SeedRefreshForce)
 	}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
@@ -296,28 +297,48 @@ func ListVMsController(req *server.Request) {
 				return
 			}
 
-			active, err := req.App.VMDB.IsVMActive(vmName)
+			entry, err := req.App.VMDB.GetEntryByName(vmName)
 			if err != nil {
 				msg := fmt.Sprintf("VM %s: %s", vmName, err)
 				req.App.Log.Error(msg)
 				http.Error(req.Response, msg, 500)
 				return
 			}
+			active := entry.Active
 
 			// if state == libvirt.DOMAIN_RUNNING {
 			// 	// check if services are running? (SSH? port?)
 			// }
 
+			var pools []string
+			for _, domain := range vm.Config.Domains {
+				if domain.Pool == "" {
+					continue
+				}
+				members, err := server.GetDomainPoolMembers(req.App.VMDB, domain.Key())
+				if err != nil {
+					msg := fmt.Sprintf("VM %s: %s", vmName, err)
+					req.App.Log.Error(msg)
+					http.Error(req.Response, msg, 500)
+					return
+				}
+				pools = append(pools, fmt.Sprintf("%s (%d)", domain.Key(), len(members)))
+			}
+
 			retData = append(retData, common.APIVMListEntry{
-				Name:      vmName.Name,
-				Revision:  vmName.Revision,
-				Active:    active,
-				LastIP:    vm.LastIP,
-				State:     server.LibvirtDomainStateToString(state),
-				Locked:    vm.Locked,
-				WIP:       string(vm.WIP),
-				SuperUser: vm.App.Config.MulchSuperUser,
-				AppUser:   vm.Config.AppUser,
+				Name:        vmName.Name,
+				Revision:    vmName.Revision,
+				Active:      active,
+				LastIP:      vm.LastIP,
+				State:       server.LibvirtDomainStateToString(state),
+				Locked:      vm.Locked,
+				Maintenance: vm.Maintenance || vm.HealthMaintenance,
+				WIP:         string(vm.WIP),
+				SuperUser:   vm.App.Config.MulchSuperUser,
+				AppUser:     vm.Config.AppUser,
+				Health:      req.App.HealthDB.GetGlobalState(vmName),
+				Pools:       pools,
+				Weight:      entry.Weight,
 			})
 		}
 
@@ -398,6 +419,27 @@ func ActionVMController(req *server.Request) {
 		} else {
 			req.Stream.Successf("%s is now unlocked", entry.Name)
 		}
+	case "maintenance":
+		maintenance := false
+		switch req.HTTP.FormValue("state") {
+		case "on":
+			maintenance = true
+		case "off":
+		default:
+			req.Stream.Failuref("invalid maintenance state '%s' (on or off)", req.HTTP.FormValue("state"))
+			return
+		}
+		if vm.Maintenance == maintenance {
+			req.Stream.Warningf("%s maintenance mode already %s", entry.Name, req.HTTP.FormValue("state"))
+		}
+		err := server.VMSetMaintenance(entry.Name, maintenance, req.App.VMDB)
+		if err != nil {
+			req.Stream.Failuref("unable to change maintenance mode of %s: %s", entry.Name, err)
+		} else if maintenance {
+			req.Stream.Successf("%s domains are now in maintenance mode", entry.Name)
+		} else {
+			req.Stream.Successf("%s domains are no more in maintenance mode", entry.Name)
+		}
 	case "start":
 		req.Stream.Infof("starting %s", vmName)
 		err := server.VMStartByName(entry.Name, vm.SecretUUID, req.App, req.Stream)
@@ -441,13 +483,33 @@ func ActionVMController(req *server.Request) {
 			req.Stream.Successf("rebuild completed (%s)", after.Sub(before))
 		}
 	case "redefine":
-		err := RedefineVM(req, vm, entry.Active)
+		err := RedefineVM(req, vm, entry.Name, entry.Active)
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
 			req.Stream.Successf("VM %s redefined (may the sysadmin gods be with you)", entry.Name)
 		}
 	case "activate":
+		weightParam := req.HTTP.FormValue("weight")
+		if weightParam != "" && weightParam != "100" {
+			weight, err := strconv.Atoi(weightParam)
+			if err != nil {
+				req.Stream.Failuref("invalid weight '%s': %s", weightParam, err)
+				return
+			}
+			err = req.App.VMDB.SetCanaryRevision(entry.Name.Name, entry.Name.Revision, weight)
+			if err != nil {
+				req.Stream.Failuref("error: %s", err)
+				return
+			}
+			for _, domain := range vm.Config.Domains {
+				if weight > 0 && domain.RedirectTo == "" && !strings.HasPrefix(domain.Name, "*.") {
+					req.Stream.Infof("preview: r%d.%s", entry.Name.Revision, domain.Name)
+				}
+			}
+			req.Stream.Successf("VM %s now receives %d%% of the traffic", entry.Name, weight)
+			return
+		}
 		err := req.App.VMDB.SetActiveRevision(entry.Name.Name, entry.Name.Revision)
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
@@ -669,7 +731,46 @@ func GetVMInfosController(req *server.Request) {
 
 	var domains []string
 	for _, domain := range vm.Config.Domains {
-		domains = append(domains, domain.Name)
+		name := domain.Key()
+		if domain.StripPrefix {
+			name += " (strip)"
+		}
+		if domain.Pool != "" {
+			name += fmt.Sprintf(" (pool: %s)", domain.Pool)
+		}
+		domains = append(domains, name)
+	}
+
+	var ports []string
+	for _, port := range vm.Config.Ports {
+		ports = append(ports, fmt.Sprintf("%s->%d", port, port.DestinationPort))
+	}
+
+	var firewall []string
+	for _, rule := range vm.Config.Firewall {
+		firewall = append(firewall, rule.String())
+	}
+
+	var interfaces []string
+	for index, intf := range vm.Config.Interfaces {
+		mac := ""
+		if index < len(vm.AssignedInterfacesMACs) {
+			mac = vm.AssignedInterfacesMACs[index]
+		}
+		interfaces = append(interfaces, fmt.Sprintf("%s (%s)", intf, mac))
+	}
+
+	var healthChecks []string
+	states := req.App.HealthDB.GetStates(entry.Name)
+	for index, check := range vm.Config.HealthChecks {
+		state := server.VMHealthUnknown
+		if index < len(states) {
+			state = states[index].State
+			if states[index].LastError != "" {
+				state = fmt.Sprintf("%s (%d failure(s): %s)", state, states[index].Failures, states[index].LastError)
+			}
+		}
+		healthChecks = append(healthChecks, fmt.Sprintf("%s: %s", check, state))
 	}
 
 	data := &common.APIVMInfos{
@@ -685,6 +786,7 @@ func GetVMInfosController(req *server.Request) {
 		BackupDiskSizeMB:    (vm.Config.BackupDiskSize / 1024 / 1024),
 		Hostname:            vm.Config.Hostname,
 		Domains:             domains,
+		Ports:               ports,
 		SuperUser:           vm.App.Config.MulchSuperUser,
 		AppUser:             vm.Config.AppUser,
 		AuthorKey:           vm.AuthorKey,
@@ -693,7 +795,13 @@ func GetVMInfosController(req *server.Request) {
 		LastRebuildDowntime: vm.LastRebuildDowntime,
 		Locked:              vm.Locked,
 		AssignedIPv4:        vm.AssignedIPv4,
+		AssignedIPv6:        vm.AssignedIPv6,
 		AssignedMAC:         vm.AssignedMAC,
+		Firewall:            firewall,
+		Interfaces:          interfaces,
+		HealthChecks:        healthChecks,
+		HealthMaintenance:   vm.HealthMaintenance,
+		Maintenance:         vm.Maintenance,
 	}
 
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -767,7 +875,8 @@ func RebuildVMv2(req *server.Request, vm *server.VM, vmName *server.VMName) erro
 }
 
 // RedefineVM replace VM config file with a new one, for next rebuild
-func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
+// (firewall rules are applied immediately)
+func RedefineVM(req *server.Request, vm *server.VM, vmName *server.VMName, active bool) error {
 	if vm.Locked == true && req.HTTP.FormValue("force") != common.TrueStr {
 		return errors.New("VM is locked (see --force)")
 	}
@@ -796,6 +905,10 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		if err != nil {
 			return err
 		}
+		err = server.CheckPortsConflicts(req.App.VMDB, conf.Ports, conf.Name, req.App.Config)
+		if err != nil {
+			return err
+		}
 	}
 
 	// change author
@@ -824,5 +937,10 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		return err
 	}
 
+	err = server.VMFirewallUpdate(vmName, vm, req.App, req.Stream)
+	if err != nil {
+		return fmt.Errorf("firewall: %s", err)
+	}
+
 	return nil
 }
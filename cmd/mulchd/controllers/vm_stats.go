@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+func vmStatsSampleToAPI(sample *server.VMStatsSample) common.APIVMStatsSample {
+	return common.APIVMStatsSample{
+		Time:          sample.Time,
+		CPUPercent:    sample.CPUPercent,
+		MemoryRSS:     sample.MemoryRSS,
+		MemoryMax:     sample.MemoryMax,
+		DiskReadRate:  sample.DiskReadRate,
+		DiskWriteRate: sample.DiskWriteRate,
+		NetRxRate:     sample.NetRxRate,
+		NetTxRate:     sample.NetTxRate,
+	}
+}
+
+// ListVMStatsController returns the latest resource usage sample of
+// all running VMs
+func ListVMStatsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := common.APIVMStatsList{}
+	for _, vmName := range req.App.VMDB.GetNames() {
+		entry, err := req.App.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue
+		}
+
+		stats := common.APIVMStats{
+			Name:     vmName.Name,
+			Revision: vmName.Revision,
+			Active:   entry.Active,
+		}
+
+		// ignore outdated samples (stopped VM)
+		sample := req.App.VMStatsDB.GetLatest(vmName)
+		if sample != nil && time.Since(sample.Time) < 3*server.VMStatsInterval {
+			stats.Samples = append(stats.Samples, vmStatsSampleToAPI(sample))
+		}
+		retData = append(retData, stats)
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// GetVMStatsController returns resource usage history of a VM (since
+// parameter is a duration, ex: 1h)
+func GetVMStatsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+	vmName := req.SubPath
+
+	if vmName == "" {
+		msg := fmt.Sprintf("no VM name given")
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	entry, err := getEntryFromRequest(vmName, req)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 404)
+		return
+	}
+
+	var since time.Time
+	sinceParam := req.HTTP.FormValue("since")
+	if sinceParam != "" {
+		duration, errP := time.ParseDuration(sinceParam)
+		if errP != nil {
+			msg := fmt.Sprintf("invalid since duration '%s': %s", sinceParam, errP)
+			req.App.Log.Error(msg)
+			http.Error(req.Response, msg, 400)
+			return
+		}
+		since = time.Now().Add(-duration)
+	}
+
+	retData := common.APIVMStats{
+		Name:     entry.Name.Name,
+		Revision: entry.Name.Revision,
+		Active:   entry.Active,
+		Samples:  []common.APIVMStatsSample{},
+	}
+	samples := req.App.VMStatsDB.GetSamples(entry.Name, since)
+	for index := range samples {
+		retData.Samples = append(retData.Samples, vmStatsSampleToAPI(&samples[index]))
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
@@ -25,6 +25,13 @@ func AddRoutes(app *server.App) {
 	}, server.RouteInternal)
 
 	// API routes
+	app.AddRoute(&server.Route{
+		Route:        "GET /metrics",
+		Type:         server.RouteTypeCustom,
+		NoProtoCheck: true,
+		Handler:      controllers.GetMetricsController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /log/history",
 		Type:    server.RouteTypeCustom,
@@ -55,6 +62,18 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetVMInfosController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/stats",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListVMStatsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/stats/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMStatsController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /vm/do-actions/*",
 		Type:    server.RouteTypeCustom,
@@ -103,6 +122,12 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetSeedStatusController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "POST /seed",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.UploadSeedController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "POST /seed/*",
 		Type:    server.RouteTypeStream,
@@ -132,6 +157,24 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.DeleteBackupController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /certs",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListCertsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "POST /certs/*",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.ActionCertController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "DELETE /certs/*",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.DeleteCertController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /key",
 		Type:    server.RouteTypeCustom,
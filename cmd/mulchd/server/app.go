@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/OnitiFR/mulch/common"
@@ -54,9 +55,14 @@ type App struct {
 	APIKeysDB      *APIKeyDatabase
 	AlertSender    *AlertSender
 	Seeder         *SeedDatabase
+	HealthDB       *HealthDatabase
+	VMStatsDB      *VMStatsDatabase
+	CustomCerts    *CustomCertStore
+	CertInventory  *CertInventory
 	routesInternal map[string][]*Route
 	routesAPI      map[string][]*Route
 	sshClients     map[net.Addr]*sshServerClient
+	sshMutex       sync.Mutex
 	Operations     *OperationList
 	ProxyReloader  *ProxyReloader
 }
@@ -109,6 +115,11 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, err
 	}
 
+	err = app.initVMStatsDB()
+	if err != nil {
+		return nil, err
+	}
+
 	err = app.initBackupDB()
 	if err != nil {
 		return nil, err
@@ -140,6 +151,11 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 	}
 	app.AlertSender.RunKeepAlive(5)
 
+	err = app.initCustomCerts()
+	if err != nil {
+		return nil, err
+	}
+
 	err = app.initSeedsDB()
 	if err != nil {
 		return nil, err
@@ -159,6 +175,14 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 
 	go app.VMStateDB.Run()
 
+	app.HealthDB = NewHealthDatabase(app)
+	go app.HealthDB.Run()
+
+	go app.VMStatsDB.Run()
+
+	app.CertInventory = NewCertInventory(app)
+	go app.CertInventory.Run()
+
 	go AutoRebuildSchedule(app)
 
 	return app, nil
@@ -205,6 +229,7 @@ func (app *App) initSSHPairDB() error {
 func (app *App) initVMDB() error {
 	dbPath := app.Config.DataPath + "/mulch-vm-v2.db"
 	domainDbPath := app.Config.DataPath + "/mulch-proxy-domains.db"
+	portDbPath := app.Config.DataPath + "/mulch-proxy-ports.db"
 
 	dbPathV1 := app.Config.DataPath + "/mulch-vm.db"
 	if common.PathExist(dbPathV1) && !common.PathExist(dbPath) {
@@ -224,7 +249,7 @@ func (app *App) initVMDB() error {
 	}
 
 	app.ProxyReloader = NewProxyReloader(app)
-	vmdb, err := NewVMDatabase(dbPath, domainDbPath, app.ProxyReloader.Request, app.Config)
+	vmdb, err := NewVMDatabase(dbPath, domainDbPath, portDbPath, app.ProxyReloader.Request, app.Config)
 	if err != nil {
 		return err
 	}
@@ -315,6 +340,26 @@ func (app *App) initVMStateDB() error {
 	return nil
 }
 
+func (app *App) initVMStatsDB() error {
+	dbPath := app.Config.DataPath + "/mulch-vm-stats.db"
+
+	db, err := NewVMStatsDatabase(dbPath, app)
+	if err != nil {
+		return err
+	}
+	app.VMStatsDB = db
+	return nil
+}
+
+func (app *App) initCustomCerts() error {
+	store, err := NewCustomCertStore(app.Config.DataPath+"/"+CustomCertsDirectory, app)
+	if err != nil {
+		return err
+	}
+	app.CustomCerts = store
+	return nil
+}
+
 func (app *App) initBackupDB() error {
 	dbPath := app.Config.DataPath + "/mulch-backups.db"
 
@@ -400,6 +445,17 @@ func (app *App) initLibvirtNetwork() error {
 	}
 
 	app.Log.Info(fmt.Sprintf("network '%s': %s (%s)", netcfg.Name, netcfg.IPs[0].Address, netcfg.Bridge.Name))
+	if ipv6Index := NetworkIPv6Index(netcfg); ipv6Index != -1 {
+		app.Log.Info(fmt.Sprintf("network '%s': IPv6 enabled (%s)", netcfg.Name, netcfg.IPs[ipv6Index].Address))
+		xmldoc, err := net.GetXMLDesc(0)
+		if err != nil {
+			return fmt.Errorf("initLibvirtNetwork: %s", err)
+		}
+		warning := NetworkIPv6EgressWarning(xmldoc, netcfg.IPs[ipv6Index].Address)
+		if warning != "" {
+			app.Log.Warningf("network '%s': %s", netcfg.Name, warning)
+		}
+	}
 
 	app.Libvirt.Network = net
 	app.Libvirt.NetworkXML = netcfg
@@ -422,6 +478,11 @@ func (app *App) initLibvirtNWFilter() error {
 	if err != nil {
 		return fmt.Errorf("initLibvirtNWFilter: %s", err)
 	}
+
+	err = VMFirewallCleanup(app, app.Log)
+	if err != nil {
+		app.Log.Error(err.Error())
+	}
 	return nil
 }
 
@@ -448,9 +509,10 @@ func (app *App) Run() {
 			app.Log.Infof("API server listening on %s (HTTPS, %s)", app.Config.Listen, app.Config.ListenHTTPSDomain)
 
 			manager := &CertManager{
-				CertDir: app.Config.DataPath + "/certs",
-				Domain:  app.Config.ListenHTTPSDomain,
-				Log:     app.Log,
+				CertDir:       app.Config.DataPath + "/certs",
+				CustomCertDir: app.Config.DataPath + "/" + CustomCertsDirectory,
+				Domain:        app.Config.ListenHTTPSDomain,
+				Log:           app.Log,
 			}
 
 			manager.ScheduleSelfCalls()
@@ -475,6 +537,14 @@ func (app *App) Run() {
 		errChan <- fmt.Errorf("ListenAndServe internal server: %s", err)
 	}()
 
+	if app.Config.MetricsListen != "" {
+		go func() {
+			app.Log.Infof("metrics server listening on %s (HTTP)", app.Config.MetricsListen)
+			err := http.ListenAndServe(app.Config.MetricsListen, http.HandlerFunc(app.metricsHandler))
+			errChan <- fmt.Errorf("ListenAndServe metrics server: %s", err)
+		}()
+	}
+
 	err := <-errChan
 	log.Fatalf("error: %s", err)
 }
@@ -570,7 +640,14 @@ func (app *App) Status() (*common.APIStatus, error) {
 		allocatedDisks += int(vInfos.Allocation / 1024 / 1024)
 	}
 
+	app.sshMutex.Lock()
+	clients := make([]*sshServerClient, 0, len(app.sshClients))
 	for _, client := range app.sshClients {
+		clients = append(clients, client)
+	}
+	app.sshMutex.Unlock()
+
+	for _, client := range clients {
 		entry, err := app.VMDB.GetEntryByVM(client.vm)
 		if err != nil {
 			continue
@@ -584,7 +661,7 @@ func (app *App) Status() (*common.APIStatus, error) {
 		})
 	}
 
-	for _, operation := range app.Operations.operations {
+	for _, operation := range app.Operations.GetOperations() {
 		ret.Operations = append(ret.Operations, common.APIOperation{
 			Origin:        operation.Origin,
 			Action:        operation.Action,
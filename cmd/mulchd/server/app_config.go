@@ -2,9 +2,12 @@ package server
 
 import (
 	"fmt"
+	"net"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -24,6 +27,9 @@ type AppConfig struct {
 	// API server HTTPS domain name (HTTP otherwise)
 	ListenHTTPSDomain string
 
+	// optional dedicated (unauthenticated) listen address for /metrics
+	MetricsListen string
+
 	// URI to libvirtd (qemu only, currently)
 	LibVirtURI string
 
@@ -43,6 +49,11 @@ type AppConfig struct {
 	// SSH proxy listen address
 	ProxyListenSSH string
 
+	// mulch-proxy listen addresses (reserved, see CheckPortsConflicts)
+	ProxyListenHTTP  string
+	ProxyListenHTTPS string
+	ProxyListenAPI   string
+
 	// Extra (limited) SSH keys
 	ProxySSHExtraKeysFile string
 
@@ -68,28 +79,44 @@ type AppConfig struct {
 	// Everyday VM auto-rebuild time ("HH:MM")
 	AutoRebuildTime string
 
+	// Alert if a served certificate expires in less than this number of days
+	CertExpiryAlertDays int
+
 	// Seeds
 	Seeds map[string]ConfigSeed
 
+	// Number of previous seed versions to keep (for pinning and rollbacks)
+	SeedKeepVersions int
+
+	// Delay for a new seed version test VM to phone home
+	SeedTestTimeout time.Duration
+
 	// global mulchd configuration path
 	configPath string
 }
 
 // ConfigSeed describes a OS seed
 type ConfigSeed struct {
-	URL    string
-	Seeder string
+	URL          string
+	Seeder       string
+	SHA256       string
+	ChecksumURL  string
+	Provisioning string
 }
 
 type tomlAppConfig struct {
 	Listen                string
 	ListenHTTPSDomain     string `toml:"listen_https_domain"`
+	MetricsListen         string `toml:"metrics_listen"`
 	LibVirtURI            string `toml:"libvirt_uri"`
 	StoragePath           string `toml:"storage_path"`
 	DataPath              string `toml:"data_path"`
 	TempPath              string `toml:"temp_path"`
 	VMPrefix              string `toml:"vm_prefix"`
 	ProxyListenSSH        string `toml:"proxy_listen_ssh"`
+	ProxyListenHTTP       string `toml:"proxy_listen_http"`
+	ProxyListenHTTPS      string `toml:"proxy_listen_https"`
+	ProxyListenAPI        string `toml:"proxy_listen_api"`
 	ProxySSHExtraKeysFile string `toml:"proxy_ssh_extra_keys_file"`
 	ProxyChainMode        string `toml:"proxy_chain_mode"`
 	ProxyChainParentURL   string `toml:"proxy_chain_parent_url"`
@@ -98,13 +125,19 @@ type tomlAppConfig struct {
 	MulchSuperUser        string `toml:"mulch_super_user"`
 	MulchSuperUserSSHKey  string `toml:"mulch_super_user_ssh_key"`
 	AutoRebuildTime       string `toml:"auto_rebuild_time"`
+	CertExpiryAlertDays   int    `toml:"cert_expiry_alert_days"`
+	SeedKeepVersions      int    `toml:"seed_keep_versions"`
+	SeedTestTimeout       string `toml:"seed_test_timeout"`
 	Seed                  []tomlConfigSeed
 }
 
 type tomlConfigSeed struct {
-	Name   string
-	URL    string
-	Seeder string
+	Name         string
+	URL          string
+	Seeder       string
+	SHA256       string `toml:"sha256"`
+	ChecksumURL  string `toml:"checksum_url"`
+	Provisioning string
 }
 
 // NewAppConfigFromTomlFile return a AppConfig using
@@ -127,10 +160,15 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 		TempPath:              "",
 		VMPrefix:              "mulch-",
 		ProxyListenSSH:        ":8022",
+		ProxyListenHTTP:       ":80",
+		ProxyListenHTTPS:      ":443",
 		ProxySSHExtraKeysFile: "",
 		MulchSuperUser:        "admin",
 		MulchSuperUserSSHKey:  "mulch_super_user",
 		AutoRebuildTime:       "23:30",
+		CertExpiryAlertDays:   20,
+		SeedKeepVersions:      2,
+		SeedTestTimeout:       "10m",
 	}
 
 	meta, err := toml.DecodeFile(filename, tConfig)
@@ -165,6 +203,17 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.Listen = tConfig.Listen
 	appConfig.ListenHTTPSDomain = tConfig.ListenHTTPSDomain
 
+	if tConfig.MetricsListen != "" {
+		_, _, errS := net.SplitHostPort(tConfig.MetricsListen)
+		if errS != nil {
+			return nil, fmt.Errorf("metrics_listen: '%s': wrong format (ex: '127.0.0.1:9686')", tConfig.MetricsListen)
+		}
+		if tConfig.MetricsListen == tConfig.Listen {
+			return nil, fmt.Errorf("metrics_listen: '%s' is already used by the API server", tConfig.MetricsListen)
+		}
+	}
+	appConfig.MetricsListen = tConfig.MetricsListen
+
 	// no check here for most of config elements, it's done later
 	appConfig.LibVirtURI = tConfig.LibVirtURI
 	appConfig.StoragePath = tConfig.StoragePath
@@ -175,6 +224,10 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.MulchSuperUserSSHKey = tConfig.MulchSuperUserSSHKey
 
 	appConfig.ProxyListenSSH = tConfig.ProxyListenSSH
+	// (validated by mulch-proxy)
+	appConfig.ProxyListenHTTP = tConfig.ProxyListenHTTP
+	appConfig.ProxyListenHTTPS = tConfig.ProxyListenHTTPS
+	appConfig.ProxyListenAPI = tConfig.ProxyListenAPI
 	appConfig.ProxySSHExtraKeysFile = tConfig.ProxySSHExtraKeysFile
 
 	switch tConfig.ProxyChainMode {
@@ -206,6 +259,22 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	}
 	appConfig.AutoRebuildTime = tConfig.AutoRebuildTime
 
+	if tConfig.CertExpiryAlertDays < 1 {
+		return nil, fmt.Errorf("cert_expiry_alert_days: invalid value %d", tConfig.CertExpiryAlertDays)
+	}
+	appConfig.CertExpiryAlertDays = tConfig.CertExpiryAlertDays
+
+	if tConfig.SeedKeepVersions < 0 {
+		return nil, fmt.Errorf("seed_keep_versions: invalid value %d", tConfig.SeedKeepVersions)
+	}
+	appConfig.SeedKeepVersions = tConfig.SeedKeepVersions
+
+	seedTestTimeout, err := time.ParseDuration(tConfig.SeedTestTimeout)
+	if err != nil || seedTestTimeout <= 0 {
+		return nil, fmt.Errorf("seed_test_timeout: '%s': invalid duration (ex: 10m)", tConfig.SeedTestTimeout)
+	}
+	appConfig.SeedTestTimeout = seedTestTimeout
+
 	for _, seed := range tConfig.Seed {
 		if seed.Name == "" {
 			return nil, fmt.Errorf("seed 'name' not defined")
@@ -225,9 +294,32 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 			return nil, fmt.Errorf("seed '%s': must have either 'url' or 'seeder' parameter", seed.Name)
 		}
 
+		if (seed.SHA256 != "" || seed.ChecksumURL != "") && seed.URL == "" {
+			return nil, fmt.Errorf("seed '%s': checksums are only available for 'url' seeds", seed.Name)
+		}
+
+		if seed.SHA256 != "" && seed.ChecksumURL != "" {
+			return nil, fmt.Errorf("seed '%s': use either 'sha256' or 'checksum_url' parameter", seed.Name)
+		}
+
+		sha256 := strings.ToLower(seed.SHA256)
+		if match, _ := regexp.MatchString("^([0-9a-f]{64})?$", sha256); !match {
+			return nil, fmt.Errorf("seed '%s': invalid sha256 '%s'", seed.Name, seed.SHA256)
+		}
+
+		if seed.Provisioning == "" {
+			seed.Provisioning = SeedProvisioningCloudInit
+		}
+		if !IsValidSeedProvisioning(seed.Provisioning) {
+			return nil, fmt.Errorf("seed '%s': invalid provisioning '%s' (cloud-init, config-drive or ignition)", seed.Name, seed.Provisioning)
+		}
+
 		appConfig.Seeds[seed.Name] = ConfigSeed{
-			URL:    seed.URL,
-			Seeder: seed.Seeder,
+			URL:          seed.URL,
+			Seeder:       seed.Seeder,
+			SHA256:       sha256,
+			ChecksumURL:  seed.ChecksumURL,
+			Provisioning: seed.Provisioning,
 		}
 
 	}
@@ -21,13 +21,15 @@ import (
 )
 
 // CertManager for HTTPS API server, using mulch-proxy certificates
+// (an imported certificate is preferred, see CustomCertStore)
 type CertManager struct {
-	CertDir     string
-	Domain      string
-	Log         *Log
-	certModTime time.Time
-	cachedCert  *tls.Certificate
-	mutex       sync.Mutex
+	CertDir       string
+	CustomCertDir string
+	Domain        string
+	Log           *Log
+	certModTime   time.Time
+	cachedCert    *tls.Certificate
+	mutex         sync.Mutex
 }
 
 // -- Ripped from acme/autocert package
@@ -67,7 +69,10 @@ func (cm *CertManager) GetAPICertificate(hello *tls.ClientHelloInfo) (*tls.Certi
 		return nil, fmt.Errorf("unkown host '%s'", name)
 	}
 
-	certPath := path.Clean(cm.CertDir + "/" + name)
+	certPath := path.Clean(cm.CustomCertDir + "/" + name)
+	if !common.PathExist(certPath) {
+		certPath = path.Clean(cm.CertDir + "/" + name)
+	}
 
 	if !common.PathExist(certPath) {
 		// the certificate does not exists (yet), let's try to create it
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ProxyCertErrorsFilename is the database of certificate issuance errors
+// written by mulch-proxy (in data_path)
+const ProxyCertErrorsFilename = "mulch-proxy-cert-errors.db"
+
+// CertCheckInterval is the delay between two certificate checks
+const CertCheckInterval = 24 * time.Hour
+
+// CertRenewTimeout is the maximum duration of a forced renewal
+const CertRenewTimeout = 2 * time.Minute
+
+// CertRenewDNSTimeout is the maximum duration of a forced renewal of a
+// wildcard certificate (DNS-01 challenge, see mulch-proxy DNSCertTimeout)
+const CertRenewDNSTimeout = 10 * time.Minute
+
+// CertInfo describes a certificate served by mulch-proxy
+type CertInfo struct {
+	Domain    string
+	Source    string // common.CertSource*
+	KeyType   string
+	Issuer    string
+	Staging   bool
+	NotAfter  time.Time // zero if there's only an issuance error
+	Error     string
+	ErrorTime time.Time // first failure
+}
+
+// CertInventory lists certificates of mulch-proxy (ACME cache and
+// imported certificates) and checks their expiry
+type CertInventory struct {
+	certDir        string
+	errorsFilename string
+	app            *App
+}
+
+// NewCertInventory creates a new CertInventory
+func NewCertInventory(app *App) *CertInventory {
+	return &CertInventory{
+		certDir:        path.Clean(app.Config.DataPath + "/certs"),
+		errorsFilename: path.Clean(app.Config.DataPath + "/" + ProxyCertErrorsFilename),
+		app:            app,
+	}
+}
+
+// the file may not exist (old mulch-proxy)
+func (inv *CertInventory) readErrors() map[string]*common.ProxyCertError {
+	res := make(map[string]*common.ProxyCertError)
+
+	f, err := os.Open(inv.errorsFilename)
+	if err != nil {
+		return res
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&res)
+	if err != nil {
+		inv.app.Log.Errorf("%s: %s", inv.errorsFilename, err)
+	}
+	return res
+}
+
+// List all certificates, sorted by domain
+func (inv *CertInventory) List() ([]*CertInfo, error) {
+	var certs []*CertInfo
+
+	files, err := ioutil.ReadDir(inv.certDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		// autocert also stores its account key and HTTP-01 tokens here
+		if file.IsDir() || strings.HasPrefix(name, "acme_account") || strings.HasSuffix(name, "+http-01") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Clean(inv.certDir + "/" + name))
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := certLeaf(data)
+		if err != nil {
+			inv.app.Log.Errorf("certificate '%s': %s", name, err)
+			continue
+		}
+		certs = append(certs, newCertInfo(strings.TrimSuffix(name, "+rsa"), common.CertSourceACME, leaf))
+	}
+
+	// issuance errors of ACME certificates (maybe not issued yet)
+	for domain, certErr := range inv.readErrors() {
+		found := false
+		for _, cert := range certs {
+			if cert.Domain == domain {
+				cert.Error = certErr.Error
+				cert.ErrorTime = certErr.Time
+				found = true
+			}
+		}
+		if !found {
+			certs = append(certs, &CertInfo{
+				Domain:    domain,
+				Source:    common.CertSourceACME,
+				Error:     certErr.Error,
+				ErrorTime: certErr.Time,
+			})
+		}
+	}
+
+	imported, err := inv.app.CustomCerts.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, custom := range imported {
+		certs = append(certs, &CertInfo{
+			Domain:   custom.Domain,
+			Source:   common.CertSourceImported,
+			KeyType:  custom.KeyType,
+			Issuer:   custom.Issuer,
+			NotAfter: custom.NotAfter,
+		})
+	}
+
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].Domain == certs[j].Domain {
+			return certs[i].Source > certs[j].Source // imported first
+		}
+		return certs[i].Domain < certs[j].Domain
+	})
+	return certs, nil
+}
+
+// DeleteACME deletes the ACME certificate(s) of a domain from the cache,
+// a new certificate will be issued by mulch-proxy on the next request
+func (inv *CertInventory) DeleteACME(domain string) error {
+	domain = strings.ToLower(domain)
+	if !IsValidCertDomain(domain) {
+		return fmt.Errorf("invalid domain '%s'", domain)
+	}
+
+	deleted := 0
+	for _, name := range []string{domain, domain + "+rsa"} {
+		filename := path.Clean(inv.certDir + "/" + name)
+		if common.PathExist(filename) == false {
+			continue
+		}
+		err := os.Remove(filename)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("no ACME certificate for '%s'", domain)
+	}
+
+	// mulch-proxy forgets deleted certificates on reload
+	inv.app.ProxyReloader.Request()
+	return nil
+}
+
+// Renew forces the renewal of the ACME certificate of a domain, the
+// previous certificate is replaced only if the issuance succeeds
+func (inv *CertInventory) Renew(domain string, log *Log) error {
+	domain = strings.ToLower(domain)
+	if !IsValidCertDomain(domain) {
+		return fmt.Errorf("invalid domain '%s'", domain)
+	}
+
+	if inv.app.CustomCerts.Exists(domain) {
+		log.Warningf("an imported certificate is served for '%s', the ACME certificate will not be used", domain)
+	}
+
+	previous := inv.getACMEIssued(domain)
+	if len(previous) == 0 {
+		log.Warningf("no ACME certificate for '%s'", domain)
+	}
+
+	// mulch-proxy loads renewal requests on reload
+	err := inv.requestRenew(domain, previous)
+	if err != nil {
+		return err
+	}
+	inv.app.ProxyReloader.Request()
+
+	return inv.issueACME(domain, previous, log)
+}
+
+// write a renewal request for mulch-proxy (key types of existing certificates)
+func (inv *CertInventory) requestRenew(domain string, previous []*CertInfo) error {
+	renewDir := path.Clean(inv.certDir + "/" + common.CertRenewDirectory)
+	err := os.MkdirAll(renewDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	content := ""
+	for _, cert := range previous {
+		content += cert.KeyType + "\n"
+	}
+	return ioutil.WriteFile(path.Clean(renewDir+"/"+domain), []byte(content), 0600)
+}
+
+// trigger (or wait for) the issuance of new ACME certificate(s)
+func (inv *CertInventory) issueACME(domain string, previous []*CertInfo, log *Log) error {
+	start := time.Now()
+
+	// wildcard certificates are requested by mulch-proxy itself (DNS-01)
+	if strings.HasPrefix(domain, "*.") {
+		log.Info("waiting for the new wildcard certificate (DNS-01), this may take a few minutes")
+		for time.Since(start) < CertRenewDNSTimeout {
+			time.Sleep(5 * time.Second)
+			for _, cert := range inv.getACMEIssued(domain) {
+				if certRenewed(cert, previous) {
+					log.Infof("new %s certificate issued by %s, expires %s", cert.KeyType, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+					return nil
+				}
+			}
+			if certErr, exists := inv.readErrors()[domain]; exists && certErr.Last.After(start) {
+				return errors.New(certErr.Error)
+			}
+		}
+		return errors.New("no certificate issued, see mulch-proxy log")
+	}
+
+	keyTypes := []string{CertKeyTypeECDSA}
+	for _, cert := range previous {
+		if cert.KeyType == CertKeyTypeRSA {
+			keyTypes = append(keyTypes, CertKeyTypeRSA)
+		}
+	}
+
+	// let mulch-proxy reload, then trigger the issuance with a local
+	// TLS handshake (public DNS may target another server)
+	time.Sleep(3 * time.Second)
+	address := localDialAddress(inv.app.Config.ProxyListenHTTPS)
+
+	for _, keyType := range keyTypes {
+		log.Infof("requesting %s certificate for %s on %s", keyType, domain, address)
+		cert, err := certHandshake(address, domain, keyType)
+		if err == nil && certRenewed(cert, previous) {
+			log.Infof("new %s certificate issued by %s, expires %s", cert.KeyType, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+			continue
+		}
+
+		// mulch-proxy still serves the previous certificate on failure
+		if certErr, exists := inv.readErrors()[domain]; exists {
+			return errors.New(certErr.Error)
+		}
+		if err != nil {
+			return err
+		}
+		return errors.New("no certificate issued, see mulch-proxy log")
+	}
+	return nil
+}
+
+// Key types of TLS handshakes (ECDSA is preferred by mulch-proxy)
+const (
+	CertKeyTypeECDSA = "ecdsa"
+	CertKeyTypeRSA   = "rsa"
+)
+
+// TLS handshake with mulch-proxy, returns the served certificate
+func certHandshake(address string, domain string, keyType string) (*CertInfo, error) {
+	config := &tls.Config{
+		ServerName: domain,
+		// staging certificates are fine, we only look at them
+		InsecureSkipVerify: true,
+	}
+	if keyType == CertKeyTypeRSA {
+		// without any ECDSA cipher suite, autocert uses its RSA certificate
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: CertRenewTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate served")
+	}
+	return newCertInfo(domain, common.CertSourceACME, certs[0]), nil
+}
+
+// returns true if the certificate is not one of the previous ones
+func certRenewed(cert *CertInfo, previous []*CertInfo) bool {
+	for _, prev := range previous {
+		if prev.KeyType == cert.KeyType && prev.NotAfter.Equal(cert.NotAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+// local address to contact a listen address (":443" -> "localhost:443")
+func localDialAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// returns issued ACME certificates of a domain (with an expiry date)
+func (inv *CertInventory) getACMEIssued(domain string) []*CertInfo {
+	var res []*CertInfo
+	for _, cert := range inv.getACME(domain) {
+		if !cert.NotAfter.IsZero() {
+			res = append(res, cert)
+		}
+	}
+	return res
+}
+
+func (inv *CertInventory) getACME(domain string) []*CertInfo {
+	var res []*CertInfo
+	certs, err := inv.List()
+	if err != nil {
+		return nil
+	}
+	for _, cert := range certs {
+		if cert.Domain == domain && cert.Source == common.CertSourceACME {
+			res = append(res, cert)
+		}
+	}
+	return res
+}
+
+// domains served over HTTPS by mulch-proxy
+func (inv *CertInventory) servedDomains() []string {
+	seen := make(map[string]bool)
+	var domains []string
+
+	if inv.app.Config.ListenHTTPSDomain != "" {
+		seen[inv.app.Config.ListenHTTPSDomain] = true
+		domains = append(domains, inv.app.Config.ListenHTTPSDomain)
+	}
+
+	for _, vmName := range inv.app.VMDB.GetNames() {
+		entry, err := inv.app.VMDB.GetEntryByName(vmName)
+		if err != nil || entry.Active == false {
+			continue
+		}
+		for _, domain := range entry.VM.Config.Domains {
+			if seen[domain.Name] {
+				continue
+			}
+			seen[domain.Name] = true
+			domains = append(domains, domain.Name)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// Run the check loop (blocking)
+func (inv *CertInventory) Run() {
+	for {
+		inv.check()
+		time.Sleep(CertCheckInterval)
+	}
+}
+
+// send an alert if any served domain has a certificate expiring soon
+// or a failing issuance
+func (inv *CertInventory) check() {
+	certs, err := inv.List()
+	if err != nil {
+		inv.app.Log.Errorf("certificate check: %s", err)
+		return
+	}
+
+	find := func(domain string, source string) *CertInfo {
+		for _, cert := range certs {
+			if cert.Domain == domain && cert.Source == source {
+				return cert
+			}
+		}
+		return nil
+	}
+
+	alertBefore := time.Duration(inv.app.Config.CertExpiryAlertDays) * 24 * time.Hour
+
+	var problems []string
+	for _, domain := range inv.servedDomains() {
+		// same order as mulch-proxy
+		cert := find(domain, common.CertSourceImported)
+		if cert == nil {
+			cert = find(wildcardOf(domain), common.CertSourceImported)
+		}
+		if cert == nil {
+			cert = find(domain, common.CertSourceACME)
+		}
+		if cert == nil {
+			continue // not requested yet
+		}
+
+		remaining := time.Until(cert.NotAfter)
+		switch {
+		case cert.Error != "":
+			problems = append(problems, fmt.Sprintf("%s: %s certificate issuance failing since %s: %s", domain, cert.Source, cert.ErrorTime.Format(time.RFC3339), cert.Error))
+		case remaining <= 0:
+			problems = append(problems, fmt.Sprintf("%s: %s certificate has expired (%s)", domain, cert.Source, cert.NotAfter.Format(time.RFC3339)))
+		case remaining < alertBefore:
+			problems = append(problems, fmt.Sprintf("%s: %s certificate expires in %d day(s) (%s)", domain, cert.Source, int(remaining.Hours()/24), cert.NotAfter.Format(time.RFC3339)))
+		}
+	}
+
+	if len(problems) == 0 {
+		return
+	}
+
+	for _, problem := range problems {
+		inv.app.Log.Warning(problem)
+	}
+	inv.app.AlertSender.Send(&Alert{
+		Type:    AlertTypeBad,
+		Subject: "Certificates",
+		Content: strings.Join(problems, "\n"),
+	})
+}
+
+func newCertInfo(domain string, source string, leaf *x509.Certificate) *CertInfo {
+	issuer := leaf.Issuer.CommonName
+	return &CertInfo{
+		Domain:   domain,
+		Source:   source,
+		KeyType:  certKeyType(leaf),
+		Issuer:   issuer,
+		Staging:  strings.Contains(issuer, "STAGING") || strings.HasPrefix(issuer, "Fake LE"),
+		NotAfter: leaf.NotAfter,
+	}
+}
+
+func certKeyType(leaf *x509.Certificate) string {
+	switch leaf.PublicKeyAlgorithm {
+	case x509.RSA:
+		return CertKeyTypeRSA
+	case x509.ECDSA:
+		return CertKeyTypeECDSA
+	case x509.Ed25519:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+// returns the wildcard domain matching domain (a.example.com -> *.example.com)
+func wildcardOf(domain string) string {
+	dot := strings.Index(domain, ".")
+	if dot <= 0 || strings.HasPrefix(domain, "*.") {
+		return ""
+	}
+	return "*." + domain[dot+1:]
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalDialAddress(t *testing.T) {
+	tests := map[string]string{
+		":443":          "localhost:443",
+		"0.0.0.0:443":   "localhost:443",
+		"[::]:8443":     "localhost:8443",
+		"10.0.0.1:443":  "10.0.0.1:443",
+		"[fd00::1]:443": "[fd00::1]:443",
+		"invalid":       "invalid",
+	}
+	for listen, want := range tests {
+		if got := localDialAddress(listen); got != want {
+			t.Errorf("%s: got %s, want %s", listen, got, want)
+		}
+	}
+}
+
+func TestCertRenewed(t *testing.T) {
+	date := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	previous := []*CertInfo{
+		{KeyType: CertKeyTypeECDSA, NotAfter: date},
+		{KeyType: CertKeyTypeRSA, NotAfter: date.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		cert *CertInfo
+		want bool
+	}{
+		{&CertInfo{KeyType: CertKeyTypeECDSA, NotAfter: date}, false},
+		{&CertInfo{KeyType: CertKeyTypeECDSA, NotAfter: date.Add(90 * 24 * time.Hour)}, true},
+		{&CertInfo{KeyType: CertKeyTypeRSA, NotAfter: date.Add(time.Hour)}, false},
+		{&CertInfo{KeyType: CertKeyTypeRSA, NotAfter: date}, true},
+	}
+	for _, test := range tests {
+		if got := certRenewed(test.cert, previous); got != test.want {
+			t.Errorf("%s %s: got %t, want %t", test.cert.KeyType, test.cert.NotAfter, got, test.want)
+		}
+	}
+
+	if certRenewed(previous[0], nil) == false {
+		t.Error("any certificate is new if there was none")
+	}
+}
+
+func TestCertHandshake(t *testing.T) {
+	var serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "https://")
+	cert, err := certHandshake(address, "test.example.com", CertKeyTypeRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "test.example.com" {
+		t.Errorf("got SNI '%s'", serverName)
+	}
+	leaf := server.Certificate()
+	if cert.NotAfter.Equal(leaf.NotAfter) == false || cert.KeyType != certKeyType(leaf) {
+		t.Errorf("got %s certificate (%s), want %s (%s)", cert.KeyType, cert.NotAfter, certKeyType(leaf), leaf.NotAfter)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/OnitiFR/mulch/common"
+	yaml "gopkg.in/yaml.v3"
 )
 
 func cloudInitMetaData(id string, hostname string) []byte {
@@ -37,53 +38,199 @@ func cloudInitExtraEnv(envMap map[string]string) string {
 	return res
 }
 
-// CloudInitDataGen will return CloudInit meta-data and user-data
-func CloudInitDataGen(vm *VM, vmName *VMName, app *App) (string, string, error) {
-	userDataTemplate := app.Config.GetTemplateFilepath("ci-user-data.yml")
+// CloudInitExtraKeys are the cloud-config keys a VM can add to the
+// generated user-data (lists, appended to template values)
+var CloudInitExtraKeys = []string{"packages", "write_files", "runcmd", "bootcmd", "mounts"}
+
+// CloudInitCheckExtraConfig validates VM extra cloud-config (YAML)
+func CloudInitCheckExtraConfig(extra string) error {
+	_, err := cloudInitParseExtraConfig(extra)
+	return err
+}
+
+func cloudInitIsExtraKey(key string) bool {
+	for _, extraKey := range CloudInitExtraKeys {
+		if key == extraKey {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the top-level mapping node of a YAML document (nil if empty)
+func cloudInitRootMapping(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("a mapping is expected")
+	}
+	return root, nil
+}
+
+// parse VM extra cloud-config and check allowed keys
+func cloudInitParseExtraConfig(extra string) (*yaml.Node, error) {
+	root, err := cloudInitRootMapping([]byte(extra))
+	if err != nil || root == nil {
+		return root, err
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Kind != yaml.ScalarNode || !cloudInitIsExtraKey(key.Value) {
+			return nil, fmt.Errorf("key '%s' is not allowed (allowed: %s)", key.Value, strings.Join(CloudInitExtraKeys, ", "))
+		}
+		if value.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("'%s' must be a list", key.Value)
+		}
+	}
+	return root, nil
+}
+
+// merge VM extra cloud-config in user-data, appending list items (works
+// on YAML nodes, so template comments and key order are kept)
+func cloudInitMergeExtraConfig(userData []byte, extra string) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(userData, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("user-data template: %s", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("user-data template: a mapping is expected")
+	}
+	config := doc.Content[0]
+
+	extraConfig, err := cloudInitParseExtraConfig(extra)
+	if err != nil {
+		return nil, fmt.Errorf("VM cloud_init setting: %s", err)
+	}
+	if extraConfig == nil {
+		return userData, nil
+	}
 
+	for i := 0; i+1 < len(extraConfig.Content); i += 2 {
+		extraKey, extraValue := extraConfig.Content[i], extraConfig.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(config.Content); j += 2 {
+			if config.Content[j].Value != extraKey.Value {
+				continue
+			}
+			found = true
+			value := config.Content[j+1]
+			switch {
+			case value.Kind == yaml.SequenceNode:
+				value.Content = append(value.Content, extraValue.Content...)
+			case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+				config.Content[j+1] = extraValue
+			default:
+				return nil, fmt.Errorf("user-data template: '%s' is not a list", extraKey.Value)
+			}
+		}
+		if !found {
+			config.Content = append(config.Content, extraKey, extraValue)
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	merged := buf.Bytes()
+	if bytes.HasPrefix(merged, []byte("#cloud-config\n")) == false {
+		merged = append([]byte("#cloud-config\n"), merged...)
+	}
+	return merged, nil
+}
+
+// cloudInitVariables returns variables for VM provisioning templates
+func cloudInitVariables(vm *VM, vmName *VMName, app *App) (map[string]interface{}, error) {
 	mulchIP := app.Libvirt.NetworkXML.IPs[0].Address
 
 	phURL := "http://" + mulchIP + ":" + strconv.Itoa(AppInternalServerPost) + "/phone"
 
 	sshKeyPair := app.SSHPairDB.GetByName(vm.MulchSuperUserSSHKey)
 	if sshKeyPair == nil {
-		return "", "", errors.New("can't find SSH super user key pair")
+		return nil, errors.New("can't find SSH super user key pair")
 	}
 
 	var domains []string
 	var firstDomain string
+	seen := make(map[string]bool)
 	for index, domain := range vm.Config.Domains {
 		if index == 0 {
 			firstDomain = domain.Name
 		}
+		// path routes share the same domain
+		if seen[domain.Name] {
+			continue
+		}
+		seen[domain.Name] = true
 		domains = append(domains, domain.Name)
 	}
 
+	// DO NOT FORGET TO UPDATE ci-user-data.yml TEMPLATE TOO!
+	variables := make(map[string]interface{})
+	variables["_INSTANCE_ID"] = vm.SecretUUID
+	variables["_SSH_PUBKEY"] = sshKeyPair.Public
+	variables["_PHONE_HOME_URL"] = phURL
+	variables["_PACKAGE_UPGRADE"] = vm.Config.InitUpgrade
+	variables["_MULCH_SUPER_USER"] = app.Config.MulchSuperUser
+	variables["_TIMEZONE"] = vm.Config.Timezone
+	variables["_APP_USER"] = vm.Config.AppUser
+	variables["_VM_NAME"] = vmName.Name
+	variables["_VM_REVISION"] = vmName.Revision
+	variables["_KEY_DESC"] = vm.AuthorKey
+	variables["_MULCH_VERSION"] = Version
+	variables["_VM_INIT_DATE"] = vm.InitDate.Format(time.RFC3339)
+	variables["_DOMAINS"] = strings.Join(domains, ",")
+	variables["_DOMAIN_FIRST"] = firstDomain
+	variables["_MULCH_PROXY_IP"] = mulchIP
+	variables["__EXTRA_ENV"] = cloudInitExtraEnv(vm.Config.Env)
+	variables["__INTERFACES"] = cloudInitInterfaces(vm)
+
+	// static DHCPv6 leases are based on a DUID-LL (see RandomUniqueIPv6)
+	variables["_IPV6_DUID"] = ""
+	if vm.AssignedIPv6 != "" {
+		variables["_IPV6_DUID"] = DUIDFromMAC(vm.AssignedMAC)
+	}
+
+	return variables, nil
+}
+
+// CloudInitDataGen will return CloudInit meta-data and user-data
+func CloudInitDataGen(vm *VM, vmName *VMName, app *App) (string, string, error) {
+	userDataTemplate := app.Config.GetTemplateFilepath("ci-user-data.yml")
+
 	// 1 - create cidata file contents
 	metaData := cloudInitMetaData(vm.SecretUUID, vm.Config.Hostname)
 
-	// DO NOT FORGET TO UPDATE ci-user-data.yml TEMPLATE TOO!
-	userDataVariables := make(map[string]interface{})
-	userDataVariables["_SSH_PUBKEY"] = sshKeyPair.Public
-	userDataVariables["_PHONE_HOME_URL"] = phURL
-	userDataVariables["_PACKAGE_UPGRADE"] = vm.Config.InitUpgrade
-	userDataVariables["_MULCH_SUPER_USER"] = app.Config.MulchSuperUser
-	userDataVariables["_TIMEZONE"] = vm.Config.Timezone
-	userDataVariables["_APP_USER"] = vm.Config.AppUser
-	userDataVariables["_VM_NAME"] = vmName.Name
-	userDataVariables["_VM_REVISION"] = vmName.Revision
-	userDataVariables["_KEY_DESC"] = vm.AuthorKey
-	userDataVariables["_MULCH_VERSION"] = Version
-	userDataVariables["_VM_INIT_DATE"] = vm.InitDate.Format(time.RFC3339)
-	userDataVariables["_DOMAINS"] = strings.Join(domains, ",")
-	userDataVariables["_DOMAIN_FIRST"] = firstDomain
-	userDataVariables["_MULCH_PROXY_IP"] = mulchIP
-	userDataVariables["__EXTRA_ENV"] = cloudInitExtraEnv(vm.Config.Env)
+	userDataVariables, err := cloudInitVariables(vm, vmName, app)
+	if err != nil {
+		return "", "", err
+	}
 
 	userData, err := cloudInitUserData(userDataTemplate, userDataVariables)
 	if err != nil {
 		return "", "", err
 	}
 
+	if vm.Config.CloudInit != "" {
+		userData, err = cloudInitMergeExtraConfig(userData, vm.Config.CloudInit)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
 	return string(metaData), string(userData), nil
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const cloudInitTestUserData = `#cloud-config
+
+# template comment
+package_upgrade: true
+
+packages:
+  - curl
+
+# runcmd comment
+runcmd:
+  - [ systemctl, enable, phone_home ]
+
+bootcmd:
+
+timezone: Europe/Paris
+`
+
+func TestCloudInitCheckExtraConfig(t *testing.T) {
+	tests := []struct {
+		extra string
+		valid bool
+	}{
+		{"", true},
+		{"packages:\n  - git\nruncmd:\n  - [ ls ]\n", true},
+		{"users:\n  - name: foo\n", false},
+		{"packages: git\n", false},
+		{"- git\n", false},
+		{"packages: [", false},
+	}
+	for _, test := range tests {
+		err := CloudInitCheckExtraConfig(test.extra)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v", test.extra, err)
+		}
+	}
+}
+
+func TestCloudInitMergeExtraConfig(t *testing.T) {
+	extra := "runcmd:\n  - echo hello\npackages:\n  - git\nbootcmd:\n  - [ echo, boot ]\nmounts:\n  - [ /dev/vdb, /data ]\n"
+	merged, err := cloudInitMergeExtraConfig([]byte(cloudInitTestUserData), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := string(merged)
+
+	if strings.HasPrefix(res, "#cloud-config\n") == false {
+		t.Errorf("missing #cloud-config header:\n%s", res)
+	}
+	for _, comment := range []string{"# template comment", "# runcmd comment"} {
+		if strings.Contains(res, comment) == false {
+			t.Errorf("missing comment '%s':\n%s", comment, res)
+		}
+	}
+
+	keys := []string{"package_upgrade:", "packages:", "runcmd:", "bootcmd:", "timezone:", "mounts:"}
+	last := -1
+	for _, key := range keys {
+		index := strings.Index(res, "\n"+key)
+		if index <= last {
+			t.Errorf("key %s is missing or misplaced:\n%s", key, res)
+		}
+		last = index
+	}
+
+	var config struct {
+		Packages []string      `yaml:"packages"`
+		Runcmd   []interface{} `yaml:"runcmd"`
+		Bootcmd  [][]string    `yaml:"bootcmd"`
+		Mounts   [][]string    `yaml:"mounts"`
+		Timezone string        `yaml:"timezone"`
+	}
+	err = yaml.Unmarshal(merged, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(config.Packages, ",") != "curl,git" {
+		t.Errorf("packages: got %v", config.Packages)
+	}
+	if len(config.Runcmd) != 2 || config.Runcmd[1] != "echo hello" {
+		t.Errorf("runcmd: got %v", config.Runcmd)
+	}
+	if len(config.Bootcmd) != 1 || len(config.Mounts) != 1 || config.Timezone != "Europe/Paris" {
+		t.Errorf("got %+v", config)
+	}
+}
+
+func TestCloudInitMergeExtraConfigErrors(t *testing.T) {
+	tests := []struct {
+		userData string
+		extra    string
+	}{
+		{cloudInitTestUserData, "users:\n  - name: foo\n"},
+		{cloudInitTestUserData, "packages: ["},
+		{"packages: curl\n", "packages:\n  - git\n"},
+		{"- curl\n", "packages:\n  - git\n"},
+	}
+	for _, test := range tests {
+		_, err := cloudInitMergeExtraConfig([]byte(test.userData), test.extra)
+		if err == nil {
+			t.Errorf("%q + %q: want an error", test.userData, test.extra)
+		}
+	}
+}
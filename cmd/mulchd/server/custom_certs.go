@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// CustomCertsDirectory is the directory (in data_path) of imported
+// certificates, shared with mulch-proxy
+const CustomCertsDirectory = "custom-certs"
+
+// CustomCert is an imported (bring-your-own) certificate
+type CustomCert struct {
+	Domain   string
+	Issuer   string
+	KeyType  string
+	DNSNames []string
+	NotAfter time.Time
+}
+
+// CustomCertStore manages imported certificates, served by mulch-proxy
+// in preference to ACME certificates. Files use autocert format (private
+// key, then certificate chain, leaf first) and are named after the domain.
+type CustomCertStore struct {
+	dir   string
+	mutex sync.Mutex
+	app   *App
+}
+
+// NewCustomCertStore creates the store, creating its directory if needed
+func NewCustomCertStore(dir string, app *App) (*CustomCertStore, error) {
+	if common.PathExist(dir) == false {
+		err := os.Mkdir(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &CustomCertStore{
+		dir: dir,
+		app: app,
+	}, nil
+}
+
+var certDomainRegexp = regexp.MustCompile(`^(\*\.)?[a-z0-9_-]+(\.[a-z0-9_-]+)+$`)
+
+// IsValidCertDomain returns true if the (lowercase) domain is a valid
+// certificate name, also used as a filename (ex: "*.example.com")
+func IsValidCertDomain(domain string) bool {
+	return certDomainRegexp.MatchString(domain)
+}
+
+func (store *CustomCertStore) filename(domain string) (string, error) {
+	if !IsValidCertDomain(domain) {
+		return "", fmt.Errorf("invalid domain '%s'", domain)
+	}
+	return path.Clean(store.dir + "/" + domain), nil
+}
+
+// Import a certificate (PEM chain, leaf first) and its private key (PEM)
+// for a domain, replacing any previous one
+func (store *CustomCertStore) Import(domain string, certPEM []byte, keyPEM []byte) (*CustomCert, error) {
+	domain = strings.ToLower(domain)
+	filename, err := store.filename(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// checks that the key matches the certificate
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !customCertCovers(leaf, domain) {
+		return nil, fmt.Errorf("certificate is not valid for '%s' (%s)", domain, strings.Join(leaf.DNSNames, ", "))
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	var keyBlock *pem.Block
+	for rest := keyPEM; ; {
+		keyBlock, rest = pem.Decode(rest)
+		if keyBlock == nil || strings.HasSuffix(keyBlock.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+	if keyBlock == nil {
+		return nil, errors.New("can't find private key")
+	}
+
+	data := pem.EncodeToMemory(keyBlock)
+	for _, der := range pair.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store.app.ProxyReloader.Request()
+
+	return newCustomCert(domain, leaf), nil
+}
+
+// Delete the imported certificate of a domain
+func (store *CustomCertStore) Delete(domain string) error {
+	domain = strings.ToLower(domain)
+	filename, err := store.filename(domain)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if common.PathExist(filename) == false {
+		return fmt.Errorf("no imported certificate for '%s'", domain)
+	}
+
+	err = os.Remove(filename)
+	if err != nil {
+		return err
+	}
+
+	store.app.ProxyReloader.Request()
+	return nil
+}
+
+// Exists returns true if a certificate was imported for this domain
+func (store *CustomCertStore) Exists(domain string) bool {
+	filename, err := store.filename(domain)
+	if err != nil {
+		return false
+	}
+	return common.PathExist(filename)
+}
+
+// List all imported certificates, sorted by domain
+func (store *CustomCertStore) List() ([]*CustomCert, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*CustomCert
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Clean(store.dir + "/" + file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := certLeaf(data)
+		if err != nil {
+			store.app.Log.Errorf("custom certificate '%s': %s", file.Name(), err)
+			continue
+		}
+		certs = append(certs, newCustomCert(file.Name(), leaf))
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Domain < certs[j].Domain
+	})
+	return certs, nil
+}
+
+func newCustomCert(domain string, leaf *x509.Certificate) *CustomCert {
+	return &CustomCert{
+		Domain:   domain,
+		Issuer:   leaf.Issuer.CommonName,
+		KeyType:  certKeyType(leaf),
+		DNSNames: leaf.DNSNames,
+		NotAfter: leaf.NotAfter,
+	}
+}
+
+// returns the leaf certificate of an autocert format file
+func certLeaf(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// x509 VerifyHostname does not accept wildcard hosts
+func customCertCovers(leaf *x509.Certificate, domain string) bool {
+	if strings.HasPrefix(domain, "*.") {
+		for _, name := range leaf.DNSNames {
+			if strings.ToLower(name) == domain {
+				return true
+			}
+		}
+		return false
+	}
+	return leaf.VerifyHostname(domain) == nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"time"
 
@@ -15,7 +16,12 @@ import (
 // of other mulchd servers (in case of proxy chaining)
 // You can exclude a specific VM (every revisions) using its name (use empty string otherwise)
 func CheckDomainsConflicts(db *VMDatabase, domains []*common.Domain, excludeVM string, config *AppConfig) error {
-	domainMap := make(map[string]*VM)
+	type domainOwner struct {
+		vm     *VM
+		domain *common.Domain
+	}
+	domainMap := make(map[string]domainOwner) // by key (domain + path)
+	hostMap := make(map[string]domainOwner)   // by domain
 	vmNames := db.GetNames()
 	for _, vmName := range vmNames {
 		if excludeVM != "" && vmName.Name == excludeVM {
@@ -32,15 +38,34 @@ func CheckDomainsConflicts(db *VMDatabase, domains []*common.Domain, excludeVM s
 		}
 
 		for _, domain := range entry.VM.Config.Domains {
-			domainMap[domain.Name] = entry.VM
+			domainMap[domain.Key()] = domainOwner{vm: entry.VM, domain: domain}
+			hostMap[domain.Name] = domainOwner{vm: entry.VM, domain: domain}
 		}
 	}
 
 	for _, domain := range domains {
-		vm, exist := domainMap[domain.Name]
-		if exist == true {
-			return fmt.Errorf("vm '%s' already registered domain '%s'", vm.Config.Name, domain.Name)
+		// a redirected domain can't share any path
+		hostOwner, exist := hostMap[domain.Name]
+		if exist == true && (domain.RedirectTo != "" || hostOwner.domain.RedirectTo != "") {
+			return fmt.Errorf("vm '%s' already registered domain '%s'", hostOwner.vm.Config.Name, domain.Name)
+		}
+
+		owner, exist := domainMap[domain.Key()]
+		if exist == false {
+			continue
+		}
+		// domain pools can be shared, if everyone agrees on the mode
+		// and on proxy settings (the pool domain has only one)
+		if domain.Pool != "" && owner.domain.Pool != "" {
+			if domain.Pool != owner.domain.Pool {
+				return fmt.Errorf("domain pool '%s' of vm '%s' uses '%s' mode, not '%s'", domain.Key(), owner.vm.Config.Name, owner.domain.Pool, domain.Pool)
+			}
+			if setting := domainPoolSettingsDiff(domain, owner.domain); setting != "" {
+				return fmt.Errorf("domain pool '%s' of vm '%s' uses different %s settings, all pool members must use the same ones", domain.Key(), owner.vm.Config.Name, setting)
+			}
+			continue
 		}
+		return fmt.Errorf("vm '%s' already registered domain '%s'", owner.vm.Config.Name, domain.Key())
 	}
 
 	if config.ProxyChainMode == ProxyChainModeChild {
@@ -53,11 +78,58 @@ func CheckDomainsConflicts(db *VMDatabase, domains []*common.Domain, excludeVM s
 	return nil
 }
 
+// returns the first proxy setting (TOML block name) differing between
+// two members of a domain pool, or an empty string
+func domainPoolSettingsDiff(a *common.Domain, b *common.Domain) string {
+	switch {
+	case !reflect.DeepEqual(a.Access, b.Access):
+		return "access"
+	case !reflect.DeepEqual(a.Limits, b.Limits):
+		return "limits"
+	case !reflect.DeepEqual(a.Compression, b.Compression):
+		return "compression"
+	case !reflect.DeepEqual(a.Cache, b.Cache):
+		return "cache"
+	case !reflect.DeepEqual(a.Headers, b.Headers):
+		return "headers"
+	}
+	return ""
+}
+
+// GetDomainPoolMembers returns active VMs sharing a domain pool (using
+// its key, see common.Domain.Key)
+func GetDomainPoolMembers(db *VMDatabase, domainKey string) ([]*VMName, error) {
+	var members []*VMName
+	for _, vmName := range db.GetNames() {
+		entry, err := db.GetEntryByName(vmName)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Active == false {
+			continue
+		}
+
+		for _, domain := range entry.VM.Config.Domains {
+			if domain.Key() == domainKey && domain.Pool != "" {
+				members = append(members, vmName)
+			}
+		}
+	}
+	return members, nil
+}
+
 // CheckDomainsConflictsOnParent will contact proxy-chain parent and ask if any
 // domain is conflicting with another child mulchd
 func CheckDomainsConflictsOnParent(domains []*common.Domain, config *AppConfig) error {
+	// our parent only routes domains, not paths
 	var domainNames []string
+	seen := make(map[string]bool)
 	for _, domain := range domains {
+		if seen[domain.Name] {
+			continue
+		}
+		seen[domain.Name] = true
 		domainNames = append(domainNames, domain.Name)
 	}
 
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"sync/atomic"
+
 	"github.com/OnitiFR/mulch/common"
 )
 
@@ -12,6 +14,7 @@ type Hub struct {
 	register   chan *HubClient
 	unregister chan *HubClient
 	trace      bool
+	count      int64 // clients, see ClientCount()
 }
 
 // HubClient describes a client of a Hub
@@ -40,12 +43,14 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			atomic.StoreInt64(&h.count, int64(len(h.clients)))
 			// fmt.Printf("new client: %s\n", client.clientInfo)
 		case client := <-h.unregister:
 			// fmt.Printf("del client: %s\n", client.clientInfo)
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.Messages)
+				atomic.StoreInt64(&h.count, int64(len(h.clients)))
 			}
 		case message := <-h.broadcast:
 			// fmt.Printf("broadcasting\n")
@@ -88,6 +93,11 @@ func (h *Hub) Register(info string, target string, trace bool) *HubClient {
 	return client
 }
 
+// ClientCount returns the number of currently registered clients
+func (h *Hub) ClientCount() int {
+	return int(atomic.LoadInt64(&h.count))
+}
+
 // Unregister the client from the Hub
 func (hc *HubClient) Unregister() {
 	hc.hub.unregister <- hc
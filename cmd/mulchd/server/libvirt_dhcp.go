@@ -55,7 +55,47 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 	if err != nil {
 		return err
 	}
-	previousHosts := lv.NetworkXML.IPs[0].DHCP.Hosts
+
+	err = lv.rebuildDHCPStaticLeasesForIP(0, -1, app)
+	if err != nil {
+		return err
+	}
+
+	ipv6Index := NetworkIPv6Index(lv.NetworkXML)
+	if ipv6Index != -1 {
+		err = lv.rebuildDHCPStaticLeasesForIP(ipv6Index, ipv6Index, app)
+		if err != nil {
+			return err
+		}
+	}
+
+	// update lv.NetworkXML
+	xmldoc, err := lv.Network.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("GetXMLDesc: %s", err)
+	}
+
+	netcfg := &libvirtxml.Network{}
+	err = netcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return fmt.Errorf("Unmarshal: %s", err)
+	}
+
+	lv.NetworkXML = netcfg
+
+	return nil
+}
+
+// rebuild static leases of a network IP definition (IPv4 or IPv6 DHCP)
+// parentIndex is the libvirt network update index (-1 = first IPv4)
+func (lv *Libvirt) rebuildDHCPStaticLeasesForIP(ipIndex int, parentIndex int, app *App) error {
+	ipDef := lv.NetworkXML.IPs[ipIndex]
+	ipv6 := ipDef.Family == "ipv6"
+
+	var previousHosts []libvirtxml.NetworkDHCPHost
+	if ipDef.DHCP != nil {
+		previousHosts = ipDef.DHCP.Hosts
+	}
 	var hostsToDelete []libvirtxml.NetworkDHCPHost
 	var hostsToAdd []libvirtxml.NetworkDHCPHost // mostly for old VMs (previous "format") where no static IP was set
 
@@ -93,12 +133,26 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 				MAC:  vm.AssignedMAC,
 				IP:   vm.AssignedIPv4,
 			}
+			if ipv6 {
+				if vm.AssignedIPv6 == "" {
+					continue
+				}
+				// libvirt does not allow MAC addresses for DHCPv6 hosts
+				host = libvirtxml.NetworkDHCPHost{
+					Name: name.LibvirtDomainName(app),
+					ID:   DUIDFromMAC(vm.AssignedMAC),
+					IP:   vm.AssignedIPv6,
+				}
+			}
 			hostsToAdd = append(hostsToAdd, host)
 		}
 	}
 
 	// search for leases to add (from transient database)
 	for lease := range lv.dhcpLeases.leases {
+		if IsIPv6(lease.IP) != ipv6 {
+			continue
+		}
 		found := false
 		for _, host := range previousHosts {
 			if host.Name == lease.Name {
@@ -112,7 +166,7 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 	}
 
 	for _, host := range hostsToDelete {
-		app.Log.Tracef("remove DHCP lease for '%s/%s/%s'", host.Name, host.MAC, host.IP)
+		app.Log.Tracef("remove DHCP lease for '%s'", dhcpHostString(&host))
 		xml, err := host.Marshal()
 		if err != nil {
 			return err
@@ -120,7 +174,7 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 		err = lv.Network.Update(
 			libvirt.NETWORK_UPDATE_COMMAND_DELETE,
 			libvirt.NETWORK_SECTION_IP_DHCP_HOST,
-			-1,
+			parentIndex,
 			xml,
 			libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG,
 		)
@@ -130,7 +184,7 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 	}
 
 	for _, host := range hostsToAdd {
-		app.Log.Tracef("add DHCP lease for '%s/%s/%s'", host.Name, host.MAC, host.IP)
+		app.Log.Tracef("add DHCP lease for '%s'", dhcpHostString(&host))
 		xml, err := host.Marshal()
 		if err != nil {
 			return err
@@ -138,7 +192,7 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 		err = lv.Network.Update(
 			libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST,
 			libvirt.NETWORK_SECTION_IP_DHCP_HOST,
-			-1,
+			parentIndex,
 			xml,
 			libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG,
 		)
@@ -147,21 +201,15 @@ func (lv *Libvirt) rebuildDHCPStaticLeases(app *App) error {
 		}
 	}
 
-	// update lv.NetworkXML
-	xmldoc, err := lv.Network.GetXMLDesc(0)
-	if err != nil {
-		return fmt.Errorf("GetXMLDesc: %s", err)
-	}
+	return nil
+}
 
-	netcfg := &libvirtxml.Network{}
-	err = netcfg.Unmarshal(xmldoc)
-	if err != nil {
-		return fmt.Errorf("Unmarshal: %s", err)
+// dhcpHostString returns a "name/mac/ip" (or "name/duid/ip") string
+func dhcpHostString(host *libvirtxml.NetworkDHCPHost) string {
+	if host.ID != "" {
+		return host.Name + "/" + host.ID + "/" + host.IP
 	}
-
-	lv.NetworkXML = netcfg
-
-	return nil
+	return host.Name + "/" + host.MAC + "/" + host.IP
 }
 
 // findByHost returns a NetworkDHCPHost lease by its name (or nil of not found)
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+	libvirt "gopkg.in/libvirt/libvirt-go.v5"
+)
+
+// WriteMetrics writes mulchd metrics in Prometheus text format
+func (app *App) WriteMetrics(out io.Writer) error {
+	mw := &common.MetricsWriter{}
+	now := time.Now()
+
+	mw.Header("mulch_start_time_seconds", "gauge", "Start time of mulchd since unix epoch in seconds.")
+	mw.Sample("mulch_start_time_seconds", float64(app.StartTime.Unix()))
+
+	app.writeVMMetrics(mw)
+
+	// backups
+	backupCount := make(map[string]int)
+	backupSize := make(map[string]uint64)
+	backupNewest := make(map[string]time.Time)
+	for _, backupName := range app.BackupsDB.GetNames() {
+		backup := app.BackupsDB.GetByName(backupName)
+		if backup == nil {
+			continue
+		}
+		vmName := backup.VM.Config.Name
+		backupCount[vmName]++
+		infos, errI := app.Libvirt.VolumeInfos(backupName, app.Libvirt.Pools.Backups)
+		if errI == nil {
+			backupSize[vmName] += infos.Allocation
+		}
+		if backup.Created.After(backupNewest[vmName]) {
+			backupNewest[vmName] = backup.Created
+		}
+	}
+	backupVMs := make([]string, 0, len(backupCount))
+	for vmName := range backupCount {
+		backupVMs = append(backupVMs, vmName)
+	}
+	sort.Strings(backupVMs)
+
+	mw.Header("mulch_backups", "gauge", "Number of backups, per VM name.")
+	for _, vmName := range backupVMs {
+		mw.Sample("mulch_backups", float64(backupCount[vmName]), "vm", vmName)
+	}
+	mw.Header("mulch_backups_size_bytes", "gauge", "Allocated size of backups, per VM name.")
+	for _, vmName := range backupVMs {
+		mw.Sample("mulch_backups_size_bytes", float64(backupSize[vmName]), "vm", vmName)
+	}
+	mw.Header("mulch_backup_newest_age_seconds", "gauge", "Age of the newest backup, per VM name.")
+	for _, vmName := range backupVMs {
+		mw.Sample("mulch_backup_newest_age_seconds", now.Sub(backupNewest[vmName]).Seconds(), "vm", vmName)
+	}
+
+	// seeds
+	seedNames := app.Seeder.GetNames()
+	sort.Strings(seedNames)
+	mw.Header("mulch_seed_ready", "gauge", "Whether the seed is ready to be used.")
+	for _, name := range seedNames {
+		seed, errG := app.Seeder.GetByName(name)
+		if errG != nil {
+			continue
+		}
+		mw.Sample("mulch_seed_ready", common.MetricsBool(seed.Ready), "seed", name)
+	}
+	mw.Header("mulch_seed_age_seconds", "gauge", "Age of the newest version of the seed.")
+	for _, name := range seedNames {
+		seed, errG := app.Seeder.GetByName(name)
+		if errG != nil || seed.LastModified.IsZero() {
+			continue
+		}
+		mw.Sample("mulch_seed_age_seconds", now.Sub(seed.LastModified).Seconds(), "seed", name)
+	}
+	mw.Header("mulch_seed_versions", "gauge", "Number of stored versions of the seed.")
+	for _, name := range seedNames {
+		seed, errG := app.Seeder.GetByName(name)
+		if errG != nil {
+			continue
+		}
+		versions, _ := app.Seeder.GetVersions(seed)
+		mw.Sample("mulch_seed_versions", float64(len(versions)), "seed", name)
+	}
+
+	// operations
+	stats := app.Operations.GetStats()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Ressource == stats[j].Ressource {
+			return stats[i].Action < stats[j].Action
+		}
+		return stats[i].Ressource < stats[j].Ressource
+	})
+	mw.Header("mulch_operations_running", "gauge", "Number of currently running operations.")
+	mw.Sample("mulch_operations_running", float64(app.Operations.Count()))
+	mw.Header("mulch_operation_duration_seconds", "summary", "Duration of finished operations (rebuild, backup, restore, …).")
+	for _, stat := range stats {
+		mw.Sample("mulch_operation_duration_seconds_sum", stat.Duration.Seconds(), "ressource", stat.Ressource, "action", stat.Action)
+		mw.Sample("mulch_operation_duration_seconds_count", float64(stat.Count), "ressource", stat.Ressource, "action", stat.Action)
+	}
+
+	// clients
+	mw.Header("mulch_ssh_proxy_sessions", "gauge", "Number of current SSH proxy sessions.")
+	app.sshMutex.Lock()
+	sshSessions := len(app.sshClients)
+	app.sshMutex.Unlock()
+	mw.Sample("mulch_ssh_proxy_sessions", float64(sshSessions))
+	mw.Header("mulch_hub_clients", "gauge", "Number of clients connected to the log hub.")
+	mw.Sample("mulch_hub_clients", float64(app.Hub.ClientCount()))
+
+	_, err := mw.WriteTo(out)
+	return err
+}
+
+// VM counts and per-VM libvirt stats
+func (app *App) writeVMMetrics(mw *common.MetricsWriter) {
+	type vmStats struct {
+		name   *VMName
+		active bool
+		up     bool
+		state  string
+		info   *libvirt.DomainInfo
+		rss    uint64
+		block  *libvirt.DomainBlockStats
+		alloc  uint64
+		capa   uint64
+	}
+
+	vmNames := app.VMDB.GetNames()
+	sort.Slice(vmNames, func(i, j int) bool {
+		return vmNames[i].ID() < vmNames[j].ID()
+	})
+
+	states := make(map[string]int)
+	var all []*vmStats
+	for _, vmName := range vmNames {
+		entry, err := app.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue
+		}
+		stats := &vmStats{
+			name:   vmName,
+			active: entry.Active,
+			state:  "unknown",
+		}
+		all = append(all, stats)
+
+		// (metrics of other VMs are still useful)
+		domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+		if err != nil {
+			app.Log.Errorf("metrics: VM %s: %s", vmName, err)
+		}
+		if domain == nil {
+			states[stats.state]++
+			continue
+		}
+
+		state, _, err := domain.GetState()
+		if err == nil {
+			stats.state = LibvirtDomainStateToString(state)
+		}
+		states[stats.state]++
+		stats.up = (state == libvirt.DOMAIN_RUNNING)
+
+		stats.info, _ = domain.GetInfo()
+		if stats.up {
+			memStats, errM := domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+			if errM == nil {
+				for _, memStat := range memStats {
+					if memStat.Tag == int32(libvirt.DOMAIN_MEMORY_STAT_RSS) {
+						stats.rss = memStat.Val * 1024
+					}
+				}
+			}
+			stats.block, _ = domain.BlockStats("vda")
+		}
+		domain.Free()
+
+		diskName, err := VMGetDiskName(vmName, app)
+		if err == nil {
+			vInfos, errV := app.Libvirt.VolumeInfos(diskName, app.Libvirt.Pools.Disks)
+			if errV == nil {
+				stats.alloc = vInfos.Allocation
+				stats.capa = vInfos.Capacity
+			}
+		}
+	}
+
+	stateNames := make([]string, 0, len(states))
+	for state := range states {
+		stateNames = append(stateNames, state)
+	}
+	sort.Strings(stateNames)
+
+	mw.Header("mulch_vms", "gauge", "Number of VMs, per libvirt state.")
+	for _, state := range stateNames {
+		mw.Sample("mulch_vms", float64(states[state]), "state", state)
+	}
+
+	labels := func(stats *vmStats) []string {
+		return []string{"vm", stats.name.Name, "revision", strconv.Itoa(stats.name.Revision)}
+	}
+
+	mw.Header("mulch_vm_up", "gauge", "Whether the VM is running.")
+	for _, stats := range all {
+		mw.Sample("mulch_vm_up", common.MetricsBool(stats.up), labels(stats)...)
+	}
+	mw.Header("mulch_vm_active", "gauge", "Whether the VM is the active revision.")
+	for _, stats := range all {
+		mw.Sample("mulch_vm_active", common.MetricsBool(stats.active), labels(stats)...)
+	}
+	mw.Header("mulch_vm_cpus", "gauge", "Number of virtual CPUs of the VM.")
+	for _, stats := range all {
+		if stats.info != nil {
+			mw.Sample("mulch_vm_cpus", float64(stats.info.NrVirtCpu), labels(stats)...)
+		}
+	}
+	mw.Header("mulch_vm_cpu_seconds_total", "counter", "CPU time used by the VM.")
+	for _, stats := range all {
+		if stats.info != nil {
+			mw.Sample("mulch_vm_cpu_seconds_total", float64(stats.info.CpuTime)/1e9, labels(stats)...)
+		}
+	}
+	mw.Header("mulch_vm_memory_max_bytes", "gauge", "Maximum memory of the VM.")
+	for _, stats := range all {
+		if stats.info != nil {
+			mw.Sample("mulch_vm_memory_max_bytes", float64(stats.info.MaxMem*1024), labels(stats)...)
+		}
+	}
+	mw.Header("mulch_vm_memory_rss_bytes", "gauge", "Resident memory of the VM process on the host.")
+	for _, stats := range all {
+		if stats.rss > 0 {
+			mw.Sample("mulch_vm_memory_rss_bytes", float64(stats.rss), labels(stats)...)
+		}
+	}
+	mw.Header("mulch_vm_disk_capacity_bytes", "gauge", "Capacity of the VM disk.")
+	for _, stats := range all {
+		mw.Sample("mulch_vm_disk_capacity_bytes", float64(stats.capa), labels(stats)...)
+	}
+	mw.Header("mulch_vm_disk_allocation_bytes", "gauge", "Allocated size of the VM disk on the host.")
+	for _, stats := range all {
+		mw.Sample("mulch_vm_disk_allocation_bytes", float64(stats.alloc), labels(stats)...)
+	}
+	mw.Header("mulch_vm_disk_read_bytes_total", "counter", "Bytes read from the VM disk.")
+	for _, stats := range all {
+		if stats.block != nil && stats.block.RdBytesSet {
+			mw.Sample("mulch_vm_disk_read_bytes_total", float64(stats.block.RdBytes), labels(stats)...)
+		}
+	}
+	mw.Header("mulch_vm_disk_written_bytes_total", "counter", "Bytes written to the VM disk.")
+	for _, stats := range all {
+		if stats.block != nil && stats.block.WrBytesSet {
+			mw.Sample("mulch_vm_disk_written_bytes_total", float64(stats.block.WrBytes), labels(stats)...)
+		}
+	}
+}
+
+// metricsHandler serves metrics on the dedicated (public) metrics listener
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	err := app.WriteMetrics(&buf)
+	if err != nil {
+		app.Log.Errorf("metrics: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", common.MetricsContentType)
+	w.Write(buf.Bytes())
+}
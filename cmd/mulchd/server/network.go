@@ -3,9 +3,13 @@ package server
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
 )
 
 // IPStringToInt convert an IPv4 string to a unsigned int 32
@@ -33,8 +37,13 @@ func RandomUniqueMAC(app *App) string {
 		mac = fmt.Sprintf("52:54:00:%02x:%02x:%02x", app.Rand.Intn(255), app.Rand.Intn(255), app.Rand.Intn(255))
 		for _, name := range vmNames {
 			vm, err := app.VMDB.GetByName(name)
-			if err == nil && vm.AssignedMAC == mac {
-				unique = false
+			if err != nil {
+				continue
+			}
+			for _, vmMAC := range vm.MACs() {
+				if vmMAC == mac {
+					unique = false
+				}
 			}
 		}
 		if unique {
@@ -85,3 +94,121 @@ func RandomUniqueIPv4(app *App) (string, error) {
 
 	return ip, nil
 }
+
+// NetworkIPv6Index returns the index of the IPv6 definition of the
+// network, or -1 if IPv6 is not enabled
+func NetworkIPv6Index(netcfg *libvirtxml.Network) int {
+	for index, ip := range netcfg.IPs {
+		if ip.Family == "ipv6" {
+			return index
+		}
+	}
+	return -1
+}
+
+// IsIPv6 returns true if the IP string is an IPv6 address
+func IsIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// DUIDFromMAC returns a DHCPv6 DUID-LL client identifier for the MAC address
+// (guests are configured to use this identifier, see ci-user-data.yml)
+func DUIDFromMAC(mac string) string {
+	return "00:03:00:01:" + mac
+}
+
+// DUIDNetworkdConfig is the systemd-networkd configuration for DUID-LL
+// DHCPv6 client identifiers ([DHCP] section for systemd < 249), same
+// as ci-user-data.yml
+const DUIDNetworkdConfig = "[DHCP]\nDUIDType=link-layer\n\n[DHCPv6]\nDUIDType=link-layer\n"
+
+// NetworkIPv6EgressWarning returns a warning if VMs of the network can't
+// reach IPv6 outside of the host: unique local addresses (ULA) need NAT66
+// (<nat ipv6='yes'/> in the <forward> element, libvirt >= 6.5)
+func NetworkIPv6EgressWarning(xmldoc string, address string) string {
+	ip := net.ParseIP(address)
+	_, ula, _ := net.ParseCIDR("fc00::/7")
+	if ip == nil || !ula.Contains(ip) {
+		return ""
+	}
+
+	var network struct {
+		Forward *struct {
+			Mode string `xml:"mode,attr"`
+			NAT  *struct {
+				IPv6 string `xml:"ipv6,attr"`
+			} `xml:"nat"`
+		} `xml:"forward"`
+	}
+	err := xml.Unmarshal([]byte(xmldoc), &network)
+	if err != nil {
+		return err.Error()
+	}
+
+	forward := network.Forward
+	if forward == nil || forward.Mode != "nat" || forward.NAT == nil || forward.NAT.IPv6 != "yes" {
+		return fmt.Sprintf("IPv6 %s is a private (ULA) address without NAT66, VMs will have no IPv6 access outside the host (see network.xml template)", address)
+	}
+	return ""
+}
+
+// RandomUniqueIPv6 generate a random unique IPv6 (among other Mulch VMs)
+// inside libvirt DHCPv6 range, excluding other "external" static leases.
+// Returns an empty string if IPv6 is not enabled on the network.
+func RandomUniqueIPv6(app *App) (string, error) {
+	index := NetworkIPv6Index(app.Libvirt.NetworkXML)
+	if index == -1 {
+		return "", nil
+	}
+	ipDef := app.Libvirt.NetworkXML.IPs[index]
+
+	if ipDef.DHCP == nil || len(ipDef.DHCP.Ranges) == 0 {
+		return "", errors.New("no network DHCPv6 range")
+	}
+
+	start := net.ParseIP(ipDef.DHCP.Ranges[0].Start).To16()
+	end := net.ParseIP(ipDef.DHCP.Ranges[0].End).To16()
+	if start == nil || end == nil || !bytes.Equal(start[:8], end[:8]) {
+		return "", errors.New("invalid network DHCPv6 range (must be inside a /64)")
+	}
+
+	ipStart := binary.BigEndian.Uint64(start[8:])
+	ipEnd := binary.BigEndian.Uint64(end[8:])
+	if ipStart >= ipEnd {
+		return "", errors.New("invalid network DHCPv6 range")
+	}
+
+	vmNames := app.VMDB.GetNames()
+	diff := ipEnd - ipStart
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, start)
+
+	for {
+		unique := true
+		rnd := app.Rand.Uint64()
+		if diff != math.MaxUint64 {
+			rnd = rnd % (diff + 1)
+		}
+		binary.BigEndian.PutUint64(ip[8:], ipStart+rnd)
+		// other VMs
+		for _, name := range vmNames {
+			vm, err := app.VMDB.GetByName(name)
+			if err == nil && ip.Equal(net.ParseIP(vm.AssignedIPv6)) {
+				unique = false
+			}
+		}
+		// static leases
+		for _, host := range ipDef.DHCP.Hosts {
+			if ip.Equal(net.ParseIP(host.IP)) {
+				unique = false
+			}
+		}
+		if unique {
+			break
+		}
+		app.Log.Tracef("(rare) IPv6 conflict for %s, generating a new one", ip)
+	}
+
+	return ip.String(), nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+)
+
+func TestDUIDFromMAC(t *testing.T) {
+	if got := DUIDFromMAC("52:54:00:12:34:56"); got != "00:03:00:01:52:54:00:12:34:56" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestIsIPv6(t *testing.T) {
+	tests := map[string]bool{
+		"10.104.0.1":       false,
+		"::ffff:10.0.0.1":  false,
+		"fd00:104::1":      true,
+		"2001:db8::1:2:3":  true,
+		"not an IP":        false,
+		"fd00:104::1/64":   false,
+		"":                 false,
+		"fe80::5054:ff:fe": true,
+	}
+	for ip, want := range tests {
+		if got := IsIPv6(ip); got != want {
+			t.Errorf("%s: got %t, want %t", ip, got, want)
+		}
+	}
+}
+
+func TestNetworkIPv6EgressWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		address string
+		warning bool
+	}{
+		{"ULA without NAT66", "<network><forward mode='nat'/></network>", "fd00:104::1", true},
+		{"ULA with IPv4 NAT", "<network><forward mode='nat'><nat><port start='1024' end='65535'/></nat></forward></network>", "fd00:104::1", true},
+		{"ULA with NAT66", "<network><forward mode='nat'><nat ipv6='yes'/></forward></network>", "fd00:104::1", false},
+		{"ULA isolated", "<network></network>", "fd00:104::1", true},
+		{"global prefix", "<network><forward mode='nat'/></network>", "2001:db8::1", false},
+		{"global prefix routed", "<network><forward mode='route'/></network>", "2001:db8::1", false},
+	}
+
+	for _, test := range tests {
+		warning := NetworkIPv6EgressWarning(test.xml, test.address)
+		if (warning != "") != test.warning {
+			t.Errorf("%s: got warning '%s', want %t", test.name, warning, test.warning)
+		}
+	}
+}
+
+func testIPv6App(start string, end string, vms ...*VM) *App {
+	netcfg := &libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{
+			{Address: "10.104.0.1"},
+			{
+				Family:  "ipv6",
+				Address: "fd00:104::1",
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: start, End: end}},
+				},
+			},
+		},
+	}
+
+	vmdb := &VMDatabase{db: make(map[string]*VMDatabaseEntry)}
+	for index, vm := range vms {
+		name := NewVMName("vm", index)
+		vmdb.db[name.ID()] = &VMDatabaseEntry{Name: name, VM: vm}
+	}
+
+	return &App{
+		Libvirt: &Libvirt{NetworkXML: netcfg},
+		VMDB:    vmdb,
+		Rand:    rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestRandomUniqueIPv6(t *testing.T) {
+	app := testIPv6App("fd00:104::1:0", "fd00:104::ffff:ffff", &VM{AssignedIPv6: "fd00:104::1:1"})
+
+	if index := NetworkIPv6Index(app.Libvirt.NetworkXML); index != 1 {
+		t.Fatalf("IPv6 index: got %d, want 1", index)
+	}
+
+	low := net.ParseIP("fd00:104::1:0")
+	high := net.ParseIP("fd00:104::ffff:ffff")
+	for i := 0; i < 100; i++ {
+		ip, err := RandomUniqueIPv6(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil || bytes.Compare(parsed, low) < 0 || bytes.Compare(parsed, high) > 0 {
+			t.Fatalf("%s is outside of the DHCPv6 range", ip)
+		}
+		if ip == "fd00:104::1:1" {
+			t.Fatalf("%s is already used", ip)
+		}
+	}
+}
+
+func TestRandomUniqueIPv6Errors(t *testing.T) {
+	app := testIPv6App("fd00:104::1:0", "fd00:105::ffff")
+	if _, err := RandomUniqueIPv6(app); err == nil {
+		t.Error("range over multiple /64 must fail")
+	}
+
+	app = testIPv6App("fd00:104::ffff", "fd00:104::1")
+	if _, err := RandomUniqueIPv6(app); err == nil {
+		t.Error("reversed range must fail")
+	}
+
+	app = testIPv6App("fd00:104::1:0", "fd00:104::ffff:ffff")
+	app.Libvirt.NetworkXML.IPs = app.Libvirt.NetworkXML.IPs[:1]
+	ip, err := RandomUniqueIPv6(app)
+	if err != nil || ip != "" {
+		t.Errorf("IPv4 only network: got '%s' (%v), want no IPv6", ip, err)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -22,9 +23,20 @@ type Operation struct {
 	StartTime     time.Time
 }
 
+// OperationStats are cumulated durations of finished operations
+// for a ressource/action couple (for metrics)
+type OperationStats struct {
+	Ressource string
+	Action    string
+	Count     int
+	Duration  time.Duration
+}
+
 // OperationList is a list of currently running operations
 type OperationList struct {
 	operations map[string]*Operation
+	stats      map[string]*OperationStats
+	mutex      sync.Mutex
 	rand       *rand.Rand
 }
 
@@ -32,12 +44,16 @@ type OperationList struct {
 func NewOperationList(rand *rand.Rand) *OperationList {
 	return &OperationList{
 		operations: make(map[string]*Operation),
+		stats:      make(map[string]*OperationStats),
 		rand:       rand,
 	}
 }
 
 // Add an operation to the list
 func (db *OperationList) Add(op *Operation) string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	id := fmt.Sprintf("operation-%d", rand.Int31())
 	op.StartTime = time.Now()
 	db.operations[id] = op
@@ -46,5 +62,57 @@ func (db *OperationList) Add(op *Operation) string {
 
 // Remove an operation from the list
 func (db *OperationList) Remove(id string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	op, exists := db.operations[id]
+	if exists == false {
+		return
+	}
+
+	key := op.Ressource + "/" + op.Action
+	stats, exists := db.stats[key]
+	if exists == false {
+		stats = &OperationStats{
+			Ressource: op.Ressource,
+			Action:    op.Action,
+		}
+		db.stats[key] = stats
+	}
+	stats.Count++
+	stats.Duration += time.Now().Sub(op.StartTime)
+
 	delete(db.operations, id)
 }
+
+// Count returns the number of currently running operations
+func (db *OperationList) Count() int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return len(db.operations)
+}
+
+// GetOperations returns a copy of currently running operations
+func (db *OperationList) GetOperations() []Operation {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	res := make([]Operation, 0, len(db.operations))
+	for _, op := range db.operations {
+		res = append(res, *op)
+	}
+	return res
+}
+
+// GetStats returns a copy of finished operations statistics
+func (db *OperationList) GetStats() []OperationStats {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var res []OperationStats
+	for _, stats := range db.stats {
+		res = append(res, *stats)
+	}
+	return res
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// CheckPortsConflicts will detect if incoming ports conflicts with existing VMs
+// or with our own listening ports (API, metrics, SSH proxy, reverse proxy)
+// You can exclude a specific VM (every revisions) using its name (use empty string otherwise)
+// Ports already used on the host by something else than mulch (ex: sshd) are
+// also rejected.
+func CheckPortsConflicts(db *VMDatabase, ports []*common.Port, excludeVM string, config *AppConfig) error {
+	portMap := make(map[string]*VM)
+	published := make(map[string]bool) // including the excluded VM
+	vmNames := db.GetNames()
+	for _, vmName := range vmNames {
+		entry, err := db.GetEntryByName(vmName)
+		if err != nil {
+			return err
+		}
+
+		if entry.Active == false {
+			continue
+		}
+
+		for _, port := range entry.VM.Config.Ports {
+			published[port.String()] = true
+			if excludeVM != "" && vmName.Name == excludeVM {
+				continue
+			}
+			portMap[port.String()] = entry.VM
+		}
+	}
+
+	reserved := make(map[int]string)
+	listens := []string{
+		config.Listen,
+		config.MetricsListen,
+		config.ProxyListenSSH,
+		config.ProxyListenHTTP,
+		config.ProxyListenHTTPS,
+		config.ProxyListenAPI,
+	}
+	// parent API server (chained reverse proxies)
+	if config.ProxyChainMode == ProxyChainModeParent {
+		if parentURL, err := url.Parse(config.ProxyChainParentURL); err == nil && parentURL.Port() != "" {
+			listens = append(listens, ":"+parentURL.Port())
+		}
+	}
+	for _, listen := range listens {
+		_, portStr, err := net.SplitHostPort(listen)
+		if err != nil {
+			continue
+		}
+		portNum, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		reserved[portNum] = listen
+	}
+
+	for _, port := range ports {
+		vm, exist := portMap[port.String()]
+		if exist == true {
+			return fmt.Errorf("vm '%s' already registered port '%s'", vm.Config.Name, port)
+		}
+		listen, exist := reserved[port.ListenPort]
+		if exist == true && port.Protocol == common.PortProtocolTCP {
+			return fmt.Errorf("port '%s' is reserved by mulchd or mulch-proxy (%s)", port, listen)
+		}
+	}
+
+	return checkHostPorts(ports, published, procNetPath)
+}
+
+// host listening sockets (Linux)
+const procNetPath = "/proc/net"
+
+// checkHostPorts rejects ports already listened on the host, except
+// ports published by mulch-proxy itself
+func checkHostPorts(ports []*common.Port, published map[string]bool, procNet string) error {
+	used := make(map[string]bool)
+	for _, protocol := range []string{common.PortProtocolTCP, common.PortProtocolUDP} {
+		for _, file := range []string{protocol, protocol + "6"} {
+			f, err := os.Open(procNet + "/" + file)
+			if err != nil {
+				continue // no IPv6, no procfs, …
+			}
+			listening, err := procNetListeningPorts(f, protocol)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("reading %s: %s", file, err)
+			}
+			for _, port := range listening {
+				used[strconv.Itoa(port)+"/"+protocol] = true
+			}
+		}
+	}
+
+	for _, port := range ports {
+		if used[port.String()] && published[port.String()] == false {
+			return fmt.Errorf("port '%s' is already used on this host", port)
+		}
+	}
+	return nil
+}
+
+// procNetListeningPorts parses a /proc/net/{tcp,udp}[6] file and returns
+// local ports of listening (TCP) or bound (UDP) sockets
+func procNetListeningPorts(r io.Reader, protocol string) ([]int, error) {
+	// TCP_LISTEN for TCP, TCP_CLOSE for unconnected UDP sockets
+	state := "0A"
+	if protocol == common.PortProtocolUDP {
+		state = "07"
+	}
+
+	var ports []int
+	scanner := bufio.NewScanner(r)
+	header := true
+	for scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != state {
+			continue
+		}
+		parts := strings.Split(fields[1], ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid local address '%s'", fields[1])
+		}
+		port, err := strconv.ParseInt(parts[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address '%s'", fields[1])
+		}
+		ports = append(ports, int(port))
+	}
+	return ports, scanner.Err()
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+const testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20431 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21212 1 0000000000000000 100 0 0 10 0
+   2: 0A680001:A3C2 0A680002:0016 01 00000000:00000000 02:000A7B3C 00000000     0        0 31337 2 0000000000000000 20 4 30 10 -1
+`
+
+const testProcNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  1: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 18244 2 0000000000000000 0
+  2: 0A680001:D431 08080808:0035 01 00000000:00000000 00:00000000 00000000     0        0 18999 2 0000000000000000 0
+`
+
+func TestProcNetListeningPorts(t *testing.T) {
+	ports, err := procNetListeningPorts(strings.NewReader(testProcNetTCP), common.PortProtocolTCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports[0] != 22 || ports[1] != 8080 {
+		t.Errorf("tcp: got %v, want [22 8080]", ports)
+	}
+
+	ports, err = procNetListeningPorts(strings.NewReader(testProcNetUDP), common.PortProtocolUDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0] != 53 {
+		t.Errorf("udp: got %v, want [53]", ports)
+	}
+
+	_, err = procNetListeningPorts(strings.NewReader("header\n 0: 00000000 00000000:0000 0A\n"), common.PortProtocolTCP)
+	if err == nil {
+		t.Error("invalid address must fail")
+	}
+}
+
+func TestCheckHostPorts(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "tcp"), []byte(testProcNetTCP), 0644)
+	os.WriteFile(filepath.Join(dir, "udp"), []byte(testProcNetUDP), 0644)
+
+	tests := []struct {
+		port      string
+		published bool
+		err       bool
+	}{
+		{"22/tcp", false, true},
+		{"22/udp", false, false},
+		{"53/udp", false, true},
+		{"8080/tcp", true, false}, // published by mulch-proxy
+		{"41410/tcp", false, false},
+		{"5432/tcp", false, false},
+	}
+
+	for _, test := range tests {
+		port, err := vmConfigGetPort(test.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		published := map[string]bool{}
+		if test.published {
+			published[port.String()] = true
+		}
+		err = checkHostPorts([]*common.Port{port}, published, dir)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %t", test.port, err, test.err)
+		}
+	}
+}
+
+func TestVMConfigGetPort(t *testing.T) {
+	tests := []struct {
+		str         string
+		err         bool
+		listen      int
+		protocol    string
+		destination int
+	}{
+		{"25565", false, 25565, common.PortProtocolTCP, 25565},
+		{"5432/tcp", false, 5432, common.PortProtocolTCP, 5432},
+		{"1194/UDP", false, 1194, common.PortProtocolUDP, 1194},
+		{"2222->22/tcp", false, 2222, common.PortProtocolTCP, 22},
+		{" 8000 -> 80 ", false, 8000, common.PortProtocolTCP, 80},
+		{"53/icmp", true, 0, "", 0},
+		{"1->2->3", true, 0, "", 0},
+		{"0/tcp", true, 0, "", 0},
+		{"70000/udp", true, 0, "", 0},
+		{"http", true, 0, "", 0},
+	}
+
+	for _, test := range tests {
+		port, err := vmConfigGetPort(test.str)
+		if test.err {
+			if err == nil {
+				t.Errorf("'%s': want an error", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': %s", test.str, err)
+			continue
+		}
+		if port.ListenPort != test.listen || port.Protocol != test.protocol || port.DestinationPort != test.destination {
+			t.Errorf("'%s': got %d/%s->%d", test.str, port.ListenPort, port.Protocol, port.DestinationPort)
+		}
+	}
+}
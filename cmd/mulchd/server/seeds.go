@@ -1,15 +1,26 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/OnitiFR/mulch/common"
@@ -23,20 +34,100 @@ type SeedDatabase struct {
 	filename string
 	db       map[string]*Seed
 	app      *App
+	mutex    sync.Mutex // protects db and seed versions (Seeder and API goroutines)
 }
 
 // Seed entry in the DB
+// LastModified is the date of the newest version (upstream date for URL
+// seeds, build date for seeders), even if it's not the current one (rollback)
 type Seed struct {
-	Name         string
-	URL          string
-	Seeder       string
-	Ready        bool
+	Name          string
+	URL           string
+	Seeder        string
+	Ready         bool
+	LastModified  time.Time
+	Size          uint64
+	Status        string
+	StatusTime    time.Time
+	Current       string         // tag of the current version
+	Versions      []*SeedVersion // newest first
+	Uploaded      bool           // not in the config, see Upload()
+	Provisioning  string         // see SeedProvisioning* constants
+	Parent        string         // seed used by the seeder
+	ParentTag     string         // version of Parent pinned by the seeder, if any
+	ParentVersion string         // version of Parent used for the last build
+}
+
+// SeedVersion is a stored version (volume) of a seed
+type SeedVersion struct {
+	Tag          string
+	Volume       string
 	LastModified time.Time
 	Size         uint64
-	Status       string
-	StatusTime   time.Time
+	Pending      bool // not boot-tested yet, hidden from version lists
+}
+
+// Seed download retries (resuming the download each time)
+const (
+	SeedDownloadAttempts   = 5
+	SeedDownloadRetryDelay = 30 * time.Second
+)
+
+// Seed download timeouts, there's no global timeout since images are
+// large, but a stalled download is aborted (and resumed, see above)
+const (
+	SeedDownloadDialTimeout   = 30 * time.Second
+	SeedDownloadHeaderTimeout = 1 * time.Minute
+	SeedDownloadIdleTimeout   = 2 * time.Minute // without receiving any data
+)
+
+var seedDownloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   SeedDownloadDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   SeedDownloadDialTimeout,
+		ResponseHeaderTimeout: SeedDownloadHeaderTimeout,
+	},
+}
+
+// idleTimeoutReader calls cancel if no data is read during timeout
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimeoutReader(reader io.Reader, timeout time.Duration, cancel func()) *idleTimeoutReader {
+	return &idleTimeoutReader{
+		reader:  reader,
+		timer:   time.AfterFunc(timeout, cancel),
+		timeout: timeout,
+	}
 }
 
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Stop the timer, must be called once the reading is done
+func (r *idleTimeoutReader) Stop() {
+	r.timer.Stop()
+}
+
+// SeedTagFormat is the (date) format of seed version tags
+const SeedTagFormat = "2006-01-02"
+
+// SeedRefSeparator separates seed name and version tag in a
+// seed reference (ex: "debian_10@2020-07-01")
+const SeedRefSeparator = "@"
+
 // SeedRefresh force flag
 const (
 	SeedRefreshForce    = true
@@ -64,6 +155,26 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 			// Reset LastModified to restart download
 			seed.LastModified = time.Time{}
 		}
+
+		// seeds created before versioning have a single volume
+		if seed.Ready == true && len(seed.Versions) == 0 {
+			tag := seed.LastModified.Format(SeedTagFormat)
+			seed.Versions = []*SeedVersion{&SeedVersion{
+				Tag:          tag,
+				Volume:       seed.Name + ".qcow2",
+				LastModified: seed.LastModified,
+				Size:         seed.Size,
+			}}
+			seed.Current = tag
+		}
+
+		// boot test interrupted by a restart
+		for _, version := range seed.Versions {
+			if version.Pending {
+				app.Log.Warningf("seed '%s': deleting untested version %s", seed.Name, version.Tag)
+				db.deleteVersion(seed, version)
+			}
+		}
 	}
 
 	// reconciliate the DB with the config:
@@ -71,6 +182,9 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 	for name, configEntry := range app.Config.Seeds {
 		seed, exists := db.db[name]
 		if exists {
+			if seed.Uploaded {
+				return nil, fmt.Errorf("seed '%s' was uploaded, it can't be defined in the configuration", name)
+			}
 			if seed.URL != "" && configEntry.URL == "" {
 				return nil, fmt.Errorf("seed '%s': converting URL seeds to Seeders is not supported", name)
 			}
@@ -79,13 +193,15 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 			}
 			seed.URL = configEntry.URL
 			seed.Seeder = configEntry.Seeder
+			seed.Provisioning = configEntry.Provisioning
 		} else {
 			app.Log.Infof("adding a new seed '%s'", name)
 			db.db[name] = &Seed{
-				Name:   name,
-				URL:    configEntry.URL,
-				Seeder: configEntry.Seeder,
-				Ready:  false,
+				Name:         name,
+				URL:          configEntry.URL,
+				Seeder:       configEntry.Seeder,
+				Provisioning: configEntry.Provisioning,
+				Ready:        false,
 			}
 		}
 	}
@@ -93,15 +209,25 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 	// 2 - remove old entries
 	for name, oldSeed := range db.db {
 		_, exists := app.Config.Seeds[name]
-		if exists == false {
+		if exists == false && oldSeed.Uploaded == false {
 			app.Log.Infof("removing old seed '%s'", name)
 			delete(db.db, name)
-			app.Libvirt.DeleteVolume(oldSeed.GetVolumeName(), app.Libvirt.Pools.Seeds)
+			for _, version := range oldSeed.Versions {
+				app.Libvirt.DeleteVolume(version.Volume, app.Libvirt.Pools.Seeds)
+			}
 		}
 	}
 
+	// 3 - seeder dependencies (seeders can be based on other seeders), they
+	// are read from the seeder files during refreshes (see RefreshSeeder),
+	// errors are reported there too
+	_, err := db.seedersOrder()
+	if err != nil {
+		app.Log.Warningf("%s (will be checked again during next seeder refresh)", err)
+	}
+
 	// save the file to check if it's writable
-	err := db.save()
+	err = db.save()
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +236,10 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 }
 
 func (db *SeedDatabase) save() error {
+	// lock before truncating the file (concurrent saves)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
@@ -141,6 +271,9 @@ func (db *SeedDatabase) load() error {
 
 // GetByName returns a seed using its name (or an error)
 func (db *SeedDatabase) GetByName(name string) (*Seed, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	seed, exits := db.db[name]
 	if exits == false {
 		return nil, fmt.Errorf("seed %s does not exists", name)
@@ -148,8 +281,62 @@ func (db *SeedDatabase) GetByName(name string) (*Seed, error) {
 	return seed, nil
 }
 
+// ParseSeedRef splits a seed reference ("debian_10" or "debian_10@2020-07-01")
+// in a seed name and a version tag (empty if no version is given)
+func ParseSeedRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, SeedRefSeparator, 2)
+	name := parts[0]
+	tag := ""
+	if len(parts) == 2 {
+		tag = parts[1]
+		match, _ := regexp.MatchString("^[A-Za-z0-9_.-]+$", tag)
+		if !match {
+			return "", "", fmt.Errorf("invalid seed version '%s'", tag)
+		}
+	}
+	if name == "" || !IsValidName(name) {
+		return "", "", fmt.Errorf("invalid seed name '%s'", name)
+	}
+	return name, tag, nil
+}
+
+// GetByRef returns the seed and the volume of a seed reference, the current
+// version if no version tag is given ("debian_10"), or a pinned
+// version ("debian_10@2020-07-01"), pending versions can only be
+// referenced this way (boot test)
+func (db *SeedDatabase) GetByRef(ref string) (*Seed, string, error) {
+	name, tag, err := ParseSeedRef(ref)
+	if err != nil {
+		return nil, "", err
+	}
+
+	seed, err := db.GetByName(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if tag == "" {
+		if seed.Ready == false {
+			return nil, "", fmt.Errorf("seed %s is not ready", name)
+		}
+		return seed, seed.GetVolumeName(), nil
+	}
+
+	version := seed.GetVersion(tag)
+	if version == nil {
+		return nil, "", fmt.Errorf("seed %s has no version '%s'", name, tag)
+	}
+	return seed, version.Volume, nil
+}
+
 // GetNames returns a list of seed names
 func (db *SeedDatabase) GetNames() []string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	keys := make([]string, 0, len(db.db))
 	for key := range db.db {
 		keys = append(keys, key)
@@ -157,6 +344,21 @@ func (db *SeedDatabase) GetNames() []string {
 	return keys
 }
 
+// GetVersions returns a copy of the versions of a seed (newest first)
+// and the tag of the current one, pending versions are not included
+func (db *SeedDatabase) GetVersions(seed *Seed) ([]*SeedVersion, string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	versions := make([]*SeedVersion, 0, len(seed.Versions))
+	for _, version := range seed.Versions {
+		if version.Pending == false {
+			versions = append(versions, version)
+		}
+	}
+	return versions, seed.Current
+}
+
 // Run the seeder (check Last-Modified dates, download new releases, rebuilds seeders)
 func (db *SeedDatabase) Run() {
 	db.app.VMStateDB.WaitRestore()
@@ -179,14 +381,20 @@ func seedSendErrorAlert(app *App, seed string) {
 func (db *SeedDatabase) reportError(seed *Seed, err error) {
 	msg := fmt.Sprintf("seeder '%s': %s", seed.Name, err)
 	db.app.Log.Error(msg)
-	seed.UpdateStatus(msg)
+	db.updateStatus(seed, msg)
 	db.save()
 	seedSendErrorAlert(db.app, seed.Name)
 }
 
 func (db *SeedDatabase) runStepSeeds() {
-	for _, seed := range db.db {
-		var err error
+	// (the list may change during uploads)
+	names := db.GetNames()
+	sort.Strings(names)
+	for _, name := range names {
+		seed, err := db.GetByName(name)
+		if err != nil {
+			continue
+		}
 
 		if seed.Seeder != "" {
 			continue
@@ -202,22 +410,119 @@ func (db *SeedDatabase) runStepSeeds() {
 	}
 }
 
+// seeders are refreshed parents first, so a rebuilt seeder will trigger
+// the rebuild of seeders based on it during the same step
 func (db *SeedDatabase) runStepSeeders() {
-	for _, seed := range db.db {
-		var err error
+	order, err := db.seedersOrder()
+	if err != nil {
+		db.app.Log.Error(err.Error())
+		db.app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Seed error",
+			Content: err.Error(),
+		})
+		return
+	}
 
-		if seed.URL != "" {
+	for _, name := range order {
+		seed, err := db.GetByName(name)
+		if err != nil {
 			continue
 		}
+		err = db.RefreshSeeder(seed, SeedRefreshIfNeeded)
+		if err != nil {
+			db.reportError(seed, err)
+		}
+	}
+}
 
-		if seed.Seeder != "" {
-			err = db.RefreshSeeder(seed, SeedRefreshIfNeeded)
+// seedersOrder returns seeder names, parents first, or an error
+// if there's a dependency cycle
+func (db *SeedDatabase) seedersOrder() ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var order []string
+	states := make(map[string]int)
+
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		seed, err := db.GetByName(name)
+		if err != nil || seed.Seeder == "" {
+			return nil
+		}
+
+		chain = append(chain[:len(chain):len(chain)], name)
+		switch states[name] {
+		case visiting:
+			return fmt.Errorf("seeder dependency cycle: %s", strings.Join(chain, " -> "))
+		case visited:
+			return nil
+		}
+
+		states[name] = visiting
+		if seed.Parent != "" {
+			err := visit(seed.Parent, chain)
+			if err != nil {
+				return err
+			}
 		}
+		states[name] = visited
+		order = append(order, name)
+		return nil
+	}
 
+	names := db.GetNames()
+	sort.Strings(names)
+	for _, name := range names {
+		err := visit(name, nil)
 		if err != nil {
-			db.reportError(seed, err)
+			return nil, err
 		}
 	}
+	return order, nil
+}
+
+// seedParentVersion returns the version tag of the seed reference
+// (pinned version or current version of the seed)
+func (db *SeedDatabase) seedParentVersion(ref string) string {
+	name, tag, err := ParseSeedRef(ref)
+	if err != nil {
+		return ""
+	}
+	if tag != "" {
+		return tag
+	}
+	parent, err := db.GetByName(name)
+	if err != nil {
+		return ""
+	}
+	return parent.Current
+}
+
+// seedParentChanged returns true if the seeder was built with another
+// version of its parent
+func (db *SeedDatabase) seedParentChanged(seed *Seed, parentName string, parentVersion string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if parentVersion == "" || seed.Ready == false {
+		return false
+	}
+	if seed.ParentVersion != "" {
+		return parentVersion != seed.ParentVersion
+	}
+
+	// built before parent versions were recorded, compare dates
+	parent, exists := db.db[parentName]
+	if exists == false {
+		return false
+	}
+	version := parent.GetVersion(parentVersion)
+	return version != nil && version.LastModified.After(seed.LastModified)
 }
 
 // RefreshSeeder will rebuild seeder using a VM
@@ -244,11 +549,35 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 		return fmt.Errorf("seeder is missing 'auto_rebuild' setting (it's the whole point :)")
 	}
 
-	if !IsRebuildNeeded(conf.AutoRebuild, seed.LastModified) && force != SeedRefreshForce {
+	parent, parentTag, err := ParseSeedRef(conf.Seed)
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetByName(parent); err != nil {
+		return fmt.Errorf("seeder is based on unknown seed '%s'", parent)
+	}
+	db.mutex.Lock()
+	seed.Parent = parent
+	seed.ParentTag = parentTag
+	db.mutex.Unlock()
+
+	_, err = db.seedersOrder()
+	if err != nil {
+		return err
+	}
+
+	parentVersion := db.seedParentVersion(conf.Seed)
+	parentChanged := db.seedParentChanged(seed, parent, parentVersion)
+
+	if !IsRebuildNeeded(conf.AutoRebuild, seed.LastModified) && force != SeedRefreshForce && !parentChanged {
 		log.Tracef("no rebuild needed yet for seeder '%s'", seed.Name)
 		return nil
 	}
 
+	if parentChanged {
+		log.Infof("seed '%s' changed (version %s), seeder '%s' needs a rebuild", parent, parentVersion, seed.Name)
+	}
+
 	db.app.Log.Infof("rebuilding seed '%s'", seed.Name)
 
 	operation := db.app.Operations.Add(&Operation{
@@ -321,37 +650,38 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 		return err
 	}
 
-	seed.Ready = false
+	version := db.newVersion(seed, before)
 
-	// Delete previous seed volume.
 	// no error check, since volume may not already exists and
 	// a real failure will be detected by following CloneVolume
-	db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+	db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
 
 	err = db.app.Libvirt.CloneVolume(
 		diskNameVM,
 		db.app.Libvirt.Pools.Disks,
-		seed.GetVolumeName(),
+		version.Volume,
 		db.app.Libvirt.Pools.Seeds,
 		db.app.Libvirt.Pools.SeedsXML,
 		db.app.Config.GetTemplateFilepath("volume.xml"),
 		log,
 	)
 	if err != nil {
+		db.cancelVersion(seed, version)
 		return err
 	}
 
-	infos, err := db.app.Libvirt.VolumeInfos(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+	err = db.addVersion(seed, version, log)
 	if err != nil {
 		return err
 	}
 
-	seed.Ready = true
-	seed.LastModified = time.Now()
-	seed.Size = infos.Allocation
-	seed.UpdateStatus(fmt.Sprintf("seeder was built in %s", after.Sub(before)))
+	db.mutex.Lock()
+	seed.LastModified = before
+	seed.ParentVersion = parentVersion
+	seed.UpdateStatus(fmt.Sprintf("seeder was built in %s, version %s", after.Sub(before), version.Tag))
+	db.mutex.Unlock()
 	db.save()
-	db.app.Log.Infof("seed '%s' is now ready", seed.Name)
+	db.app.Log.Infof("seed '%s' is now ready (version %s)", seed.Name, version.Tag)
 
 	return nil
 }
@@ -383,22 +713,27 @@ func (db *SeedDatabase) RefreshSeed(seed *Seed, force bool) error {
 		log.Infof("downloading seed '%s'", name)
 
 		before := time.Now()
-		tmpFile, err := db.seedDownload(seed, db.app.Config.TempPath)
+		tmpFile, err := db.seedDownload(seed, lm, db.app.Config.TempPath)
 		if err != nil {
 			return fmt.Errorf("unable to download image: %s", err)
 		}
 		defer os.Remove(tmpFile)
 
-		seed.Ready = false
-		db.save()
+		err = db.seedVerifyChecksum(seed, tmpFile, log)
+		if err != nil {
+			return err
+		}
+
+		version := db.newVersion(seed, t)
 
 		// upload to libvirt seed storage
 		log.Infof("moving seed '%s' to storage", name)
 
-		errR := db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
-		if err != nil {
+		errR := db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
+		if errR != nil {
 			virtErr := errR.(libvirt.Error)
 			if !(virtErr.Domain == libvirt.FROM_STORAGE && virtErr.Code == libvirt.ERR_NO_STORAGE_VOL) {
+				db.cancelVersion(seed, version)
 				return fmt.Errorf("unable to delete old image: %s", errR)
 			}
 		}
@@ -408,72 +743,521 @@ func (db *SeedDatabase) RefreshSeed(seed *Seed, force bool) error {
 			db.app.Libvirt.Pools.SeedsXML,
 			db.app.Config.GetTemplateFilepath("volume.xml"),
 			tmpFile,
-			seed.GetVolumeName(),
+			version.Volume,
 			log)
 		if err != nil {
+			db.cancelVersion(seed, version)
 			return fmt.Errorf("unable to move image to storage: %s", err)
 		}
 		after := time.Now()
 
-		seed.Ready = true
+		// a broken image will stay broken until the next upstream release,
+		// so we don't download it again and again
+		db.mutex.Lock()
 		seed.LastModified = t
-		seed.UpdateStatus(fmt.Sprintf("downloaded and stored in %s", after.Sub(before)))
+		db.mutex.Unlock()
+
+		err = db.addVersion(seed, version, log)
+		if err != nil {
+			db.save()
+			return err
+		}
+
+		db.updateStatus(seed, fmt.Sprintf("downloaded and stored in %s, version %s", after.Sub(before), version.Tag))
 		db.save()
-		log.Infof("seed '%s' is now ready", name)
+		log.Infof("seed '%s' is now ready (version %s)", name, version.Tag)
+	}
+	return nil
+}
+
+// Upload stores an image (qcow2 or raw) as a new version of an uploaded
+// seed, creating the seed if needed
+func (db *SeedDatabase) Upload(name string, provisioning string, image io.Reader, log *Log) error {
+	if !IsValidName(name) {
+		return fmt.Errorf("'%s' is not a valid seed name", name)
+	}
+
+	if provisioning != "" && !IsValidSeedProvisioning(provisioning) {
+		return fmt.Errorf("invalid provisioning '%s'", provisioning)
+	}
+
+	db.mutex.Lock()
+	seed, exists := db.db[name]
+	if exists && seed.Uploaded == false {
+		db.mutex.Unlock()
+		return fmt.Errorf("seed '%s' is defined in the configuration, it can't be uploaded", name)
+	}
+	if !exists {
+		seed = &Seed{
+			Name:     name,
+			Uploaded: true,
+		}
+		db.db[name] = seed
+		defer func() {
+			// failed first upload
+			db.mutex.Lock()
+			failed := len(seed.Versions) == 0
+			if failed {
+				delete(db.db, name)
+			}
+			db.mutex.Unlock()
+			if failed {
+				db.save()
+			}
+		}()
+	}
+	if provisioning != "" {
+		seed.Provisioning = provisioning
+	}
+	db.mutex.Unlock()
+
+	tmpfile, err := ioutil.TempFile(db.app.Config.TempPath, "mulch-seed-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = io.Copy(tmpfile, image)
+	tmpfile.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read image: %s", err)
+	}
+
+	format, err := seedImageFormat(tmpfile.Name())
+	if err != nil {
+		return err
 	}
+
+	now := time.Now()
+	version := db.newVersion(seed, now)
+
+	err = db.uploadImage(tmpfile.Name(), format, version.Volume, log)
+	if err != nil {
+		db.cancelVersion(seed, version)
+		return fmt.Errorf("unable to move image to storage: %s", err)
+	}
+
+	err = db.addVersion(seed, version, log)
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	seed.LastModified = now
+	seed.UpdateStatus(fmt.Sprintf("uploaded, version %s", version.Tag))
+	db.mutex.Unlock()
+	db.save()
+	log.Infof("seed '%s' is now ready (version %s)", name, version.Tag)
+
 	return nil
 }
 
-func (db *SeedDatabase) seedDownload(seed *Seed, tmpPath string) (string, error) {
-	tmpfile, err := ioutil.TempFile(tmpPath, "mulch-seed-image")
+// qemu-img info output (only what we need)
+type seedImageInfo struct {
+	Format          string `json:"format"`
+	BackingFilename string `json:"backing-filename"`
+}
+
+// seedImageFormat probes the format of an image file using qemu-img,
+// only qcow2 (without backing file) and raw images are supported
+func seedImageFormat(filename string) (string, error) {
+	output, err := exec.Command("qemu-img", "info", "--output=json", filename).Output()
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("qemu-img: %s", err)
 	}
-	defer tmpfile.Close()
+	return seedParseImageInfo(output)
+}
+
+func seedParseImageInfo(output []byte) (string, error) {
+	var info seedImageInfo
+	err := json.Unmarshal(output, &info)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse qemu-img output: %s", err)
+	}
+
+	switch info.Format {
+	case "qcow2":
+		if info.BackingFilename != "" {
+			return "", errors.New("qcow2 images with a backing file are not supported")
+		}
+	case "raw":
+	default:
+		return "", fmt.Errorf("unsupported image format '%s' (qcow2 or raw)", info.Format)
+	}
+	return info.Format, nil
+}
+
+// upload an image to seed storage, converting raw images to qcow2
+func (db *SeedDatabase) uploadImage(filename string, format string, volume string, log *Log) error {
+	if format == "raw" {
+		tmpfileQcow, err := ioutil.TempFile(db.app.Config.TempPath, "mulch-seed-qcow2")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpfileQcow.Name())
+		tmpfileQcow.Close()
+
+		log.Infof("converting raw image to qcow2")
+		output, err := exec.Command("qemu-img", "convert", "-f", "raw", "-O", "qcow2", filename, tmpfileQcow.Name()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("qemu-img: %s (%s)", err, strings.TrimSpace(string(output)))
+		}
+		filename = tmpfileQcow.Name()
+	}
+
+	return db.app.Libvirt.UploadFileToLibvirt(
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		filename,
+		volume,
+		log)
+}
+
+// addVersion boot-tests a new (pending) seed version and promotes it as
+// the current version, its volume is deleted if the test fails
+func (db *SeedDatabase) addVersion(seed *Seed, version *SeedVersion, log *Log) error {
+	infos, err := db.app.Libvirt.VolumeInfos(version.Volume, db.app.Libvirt.Pools.Seeds)
+	if err != nil {
+		db.cancelVersion(seed, version)
+		return err
+	}
+	db.mutex.Lock()
+	version.Size = infos.Allocation
+	db.mutex.Unlock()
+	db.save()
+
+	err = db.testVersion(seed, version, infos.Capacity, log)
+	if err != nil {
+		db.deleteVersion(seed, version)
+		db.save()
+		return fmt.Errorf("boot test of version %s failed, previous version is kept: %s", version.Tag, err)
+	}
+
+	db.mutex.Lock()
+	version.Pending = false
+	seed.promote(version)
+	db.mutex.Unlock()
+	db.pruneVersions(seed, log)
+	return nil
+}
+
+// testVersion creates (and deletes) a temporary VM using the version,
+// it must phone home before SeedTestTimeout
+func (db *SeedDatabase) testVersion(seed *Seed, version *SeedVersion, capacity uint64, log *Log) error {
+	log.Infof("boot-testing seed '%s' version %s", seed.Name, version.Tag)
+
+	tomlConf := fmt.Sprintf("name = \"%s\"\nseed = \"%s%s%s\"\n", seedTestVMName(seed, version), seed.Name, SeedRefSeparator, version.Tag)
+	tomlConf += "disk_size = \"20G\"\nram_size = \"1G\"\ninit_upgrade = false\n"
+
+	conf, err := NewVMConfigFromTomlReader(strings.NewReader(tomlConf), log)
+	if err != nil {
+		return err
+	}
+	if capacity > conf.DiskSize {
+		conf.DiskSize = capacity
+	}
+	conf.InitTimeout = db.app.Config.SeedTestTimeout
+
+	_, vmName, err := NewVM(conf, VMInactive, VMStopOnScriptFailure, "[seeder]", db.app, log)
+	if err != nil {
+		return err
+	}
+	return VMDelete(vmName, db.app, log)
+}
+
+// test VM name, unique for each version (concurrent tests)
+func seedTestVMName(seed *Seed, version *SeedVersion) string {
+	tag := strings.NewReplacer("-", "_", ".", "_").Replace(version.Tag)
+	return "seedtest_" + seed.Name + "_" + tag
+}
+
+// pruneVersions deletes old versions, keeping the current one, the
+// SeedKeepVersions previous ones and the ones pinned by VMs or seeders
+func (db *SeedDatabase) pruneVersions(seed *Seed, log *Log) {
+	pinned := db.pinnedVersions(seed)
+
+	db.mutex.Lock()
+	obsolete := seed.obsoleteVersions(pinned, db.app.Config.SeedKeepVersions)
+	db.mutex.Unlock()
+
+	for _, version := range obsolete {
+		log.Infof("deleting old version %s of seed '%s'", version.Tag, seed.Name)
+		db.deleteVersion(seed, version)
+	}
+}
+
+// pinnedVersions returns the version tags of the seed pinned by VMs
+// ("seed@tag") or by seeders
+func (db *SeedDatabase) pinnedVersions(seed *Seed) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, vmName := range db.app.VMDB.GetNames() {
+		vm, err := db.app.VMDB.GetByName(vmName)
+		if err != nil {
+			continue
+		}
+		name, tag, err := ParseSeedRef(vm.Config.Seed)
+		if err == nil && name == seed.Name && tag != "" {
+			pinned[tag] = true
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, other := range db.db {
+		if other.Seeder != "" && other.Parent == seed.Name && other.ParentTag != "" {
+			pinned[other.ParentTag] = true
+		}
+	}
+	return pinned
+}
+
+// cancelVersion removes a pending version when its volume was not (fully)
+// created, no error is reported if there's no volume
+func (db *SeedDatabase) cancelVersion(seed *Seed, version *SeedVersion) {
+	db.mutex.Lock()
+	seed.removeVersion(version)
+	db.mutex.Unlock()
+	db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
+}
+
+// deleteVersion removes the version from the seed and deletes its volume
+func (db *SeedDatabase) deleteVersion(seed *Seed, version *SeedVersion) {
+	db.mutex.Lock()
+	seed.removeVersion(version)
+	db.mutex.Unlock()
+
+	err := db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
+	if err != nil {
+		db.app.Log.Errorf("unable to delete seed volume %s: %s", version.Volume, err)
+	}
+}
+
+// Rollback makes the version preceding the current one the current version
+func (db *SeedDatabase) Rollback(seed *Seed, log *Log) error {
+	db.mutex.Lock()
+	for index, version := range seed.Versions {
+		if version.Tag != seed.Current {
+			continue
+		}
+		var previous *SeedVersion
+		for _, older := range seed.Versions[index+1:] {
+			if older.Pending == false {
+				previous = older
+				break
+			}
+		}
+		if previous == nil {
+			db.mutex.Unlock()
+			return fmt.Errorf("no version older than %s for seed '%s'", version.Tag, seed.Name)
+		}
+		seed.promote(previous)
+		seed.UpdateStatus(fmt.Sprintf("rollback from version %s to %s", version.Tag, previous.Tag))
+		db.mutex.Unlock()
+		db.save()
+		log.Infof("seed '%s': rollback from version %s to %s", seed.Name, version.Tag, previous.Tag)
+		return nil
+	}
+	db.mutex.Unlock()
+	return fmt.Errorf("no current version for seed '%s'", seed.Name)
+}
+
+// seedDownload downloads the seed image in a partial file, resuming any
+// previous interrupted download of the same release (HTTP Range)
+func (db *SeedDatabase) seedDownload(seed *Seed, lastModified string, tmpPath string) (string, error) {
+	if tmpPath == "" {
+		tmpPath = os.TempDir()
+	}
+	filename := path.Join(tmpPath, "mulch-seed-"+seed.Name+".part")
 
 	operation := db.app.Operations.Add(&Operation{
 		Origin:        "[seeder]",
 		Action:        "download",
 		Ressource:     "seed",
-		RessourceName: seed.GetVolumeName(),
+		RessourceName: seed.Name,
 	})
 	defer db.app.Operations.Remove(operation)
 
-	resp, err := http.Get(seed.URL)
+	var err error
+	for attempt := 1; attempt <= SeedDownloadAttempts; attempt++ {
+		err = db.seedDownloadAttempt(seed, lastModified, filename)
+		if err == nil {
+			return filename, nil
+		}
+		if attempt < SeedDownloadAttempts {
+			db.app.Log.Warningf("seed '%s': download error (%s), will resume in %s", seed.Name, err, SeedDownloadRetryDelay)
+			time.Sleep(SeedDownloadRetryDelay)
+		}
+	}
+	return "", err
+}
+
+func (db *SeedDatabase) seedDownloadAttempt(seed *Seed, lastModified string, filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
+	defer file.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("response was %s (%v)", resp.Status, resp.StatusCode)
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
 	}
 
-	total, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
-	if total == 0 {
-		return "", errors.New("image size is 0, check URL")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", seed.URL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// full content will be sent if the upstream image changed
+		req.Header.Set("If-Range", lastModified)
 	}
 
-	seed.Size = uint64(total)
+	resp, err := seedDownloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		db.app.Log.Infof("seed '%s': resuming download at %s", seed.Name, (datasize.ByteSize(offset) * datasize.B).HR())
+	case http.StatusOK:
+		// new image or no Range support, restart from zero
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		file.Truncate(0)
+		return errors.New("invalid partial download, restarting")
+	default:
+		return fmt.Errorf("response was %s (%v)", resp.Status, resp.StatusCode)
+	}
+
+	if resp.ContentLength <= 0 {
+		return errors.New("image size is 0, check URL")
+	}
+	total := uint64(offset) + uint64(resp.ContentLength)
 
 	wc := &common.WriteCounter{
-		Total: uint64(total),
+		Total: total,
 		Step:  1024 * 1024, // 1 MB
 		CB: func(current uint64, total uint64) {
-			seed.UpdateStatus(fmt.Sprintf("downloading %s (%d%%)",
-				(datasize.ByteSize(total) * datasize.B).HR(),
-				(current*100)/total),
+			db.updateStatus(seed, fmt.Sprintf("downloading %s (%d%%)",
+				(datasize.ByteSize(total)*datasize.B).HR(),
+				((uint64(offset)+current)*100)/total),
 			)
 		},
 	}
-	tee := io.TeeReader(resp.Body, wc)
+	body := newIdleTimeoutReader(resp.Body, SeedDownloadIdleTimeout, cancel)
+	defer body.Stop()
+	tee := io.TeeReader(body, wc)
 
-	_, err = io.Copy(tmpfile, tee)
+	_, err = io.Copy(file, tee)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("no data received for %s", SeedDownloadIdleTimeout)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// seedExpectedChecksum returns the expected SHA256 of the seed image, from
+// the configuration or from a checksum file (ex: Debian/Ubuntu SHA256SUMS),
+// or an empty string if there's no checksum to verify
+func (db *SeedDatabase) seedExpectedChecksum(seed *Seed) (string, error) {
+	config := db.app.Config.Seeds[seed.Name]
+
+	if config.SHA256 != "" {
+		return config.SHA256, nil
+	}
+
+	if config.ChecksumURL == "" {
+		return "", nil
+	}
+
+	stream, err := GetContentFromURL(config.ChecksumURL)
 	if err != nil {
 		return "", err
 	}
+	defer stream.Close()
 
-	return tmpfile.Name(), nil
+	sum, err := seedParseChecksums(stream, path.Base(seed.URL))
+	if err != nil {
+		return "", fmt.Errorf("%s in %s", err, config.ChecksumURL)
+	}
+	return sum, nil
+}
+
+// seedParseChecksums returns the SHA256 of imageName from a checksum
+// file, in GNU (sha256sum) or BSD format
+func seedParseChecksums(stream io.Reader, imageName string) (string, error) {
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		// GNU format: "<sum>  file" or "<sum> *file"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == imageName {
+			return strings.ToLower(fields[0]), nil
+		}
+		// BSD format: "SHA256 (file) = <sum>"
+		if len(fields) == 4 && fields[0] == "SHA256" && fields[1] == "("+imageName+")" {
+			return strings.ToLower(fields[3]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no checksum found for '%s'", imageName)
+}
+
+// seedVerifyChecksum checks downloaded image SHA256
+func (db *SeedDatabase) seedVerifyChecksum(seed *Seed, filename string, log *Log) error {
+	expected, err := db.seedExpectedChecksum(seed)
+	if err != nil {
+		return fmt.Errorf("unable to get checksum: %s", err)
+	}
+	if expected == "" {
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != expected {
+		return fmt.Errorf("checksum mismatch (got %s, expected %s)", sum, expected)
+	}
+	log.Infof("seed '%s' checksum is valid", seed.Name)
+	return nil
+}
+
+// updateStatus changes the status of the seed, with the DB lock
+func (db *SeedDatabase) updateStatus(seed *Seed, status string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	seed.UpdateStatus(status)
 }
 
 // UpdateStatus change status informations
@@ -482,7 +1266,95 @@ func (seed *Seed) UpdateStatus(status string) {
 	seed.StatusTime = time.Now()
 }
 
-// GetVolumeName return the seed volume file name
+// GetVolumeName return the volume file name of the current version
 func (seed *Seed) GetVolumeName() string {
-	return seed.Name + ".qcow2"
+	version := seed.GetVersion(seed.Current)
+	if version == nil {
+		return seed.Name + ".qcow2"
+	}
+	return version.Volume
+}
+
+// GetVersion returns a seed version using its tag, nil if not found
+func (seed *Seed) GetVersion(tag string) *SeedVersion {
+	for _, version := range seed.Versions {
+		if version.Tag == tag {
+			return version
+		}
+	}
+	return nil
+}
+
+// GetProvisioning returns the VM provisioning method for this seed
+func (seed *Seed) GetProvisioning() string {
+	if seed.Provisioning == "" {
+		return SeedProvisioningCloudInit
+	}
+	return seed.Provisioning
+}
+
+// make the version the current one
+func (seed *Seed) promote(version *SeedVersion) {
+	seed.Current = version.Tag
+	seed.Size = version.Size
+	seed.Ready = true
+}
+
+// newVersion adds a new pending version to the seed, with an unused
+// tag for the date (see Seed.newVersionTag)
+func (db *SeedDatabase) newVersion(seed *Seed, date time.Time) *SeedVersion {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	version := &SeedVersion{
+		Tag:          seed.newVersionTag(date),
+		LastModified: date,
+		Pending:      true,
+	}
+	version.Volume = seed.versionVolumeName(version.Tag)
+	seed.Versions = append([]*SeedVersion{version}, seed.Versions...)
+	return version
+}
+
+// returns an unused version tag for the date (2020-07-01, 2020-07-01.2, …)
+func (seed *Seed) newVersionTag(date time.Time) string {
+	base := date.Format(SeedTagFormat)
+	tag := base
+	for i := 2; seed.GetVersion(tag) != nil; i++ {
+		tag = base + "." + strconv.Itoa(i)
+	}
+	return tag
+}
+
+// obsoleteVersions returns versions to delete, keeping the current one, the
+// pending ones, the pinned ones and the keep previous ones
+func (seed *Seed) obsoleteVersions(pinned map[string]bool, keep int) []*SeedVersion {
+	kept := 0
+	var obsolete []*SeedVersion
+	for _, version := range seed.Versions {
+		if version.Tag == seed.Current || version.Pending || pinned[version.Tag] {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		obsolete = append(obsolete, version)
+	}
+	return obsolete
+}
+
+// removes the version from the seed (without deleting its volume)
+func (seed *Seed) removeVersion(version *SeedVersion) {
+	versions := make([]*SeedVersion, 0, len(seed.Versions))
+	for _, other := range seed.Versions {
+		if other != version {
+			versions = append(versions, other)
+		}
+	}
+	seed.Versions = versions
+}
+
+func (seed *Seed) versionVolumeName(tag string) string {
+	return seed.Name + SeedRefSeparator + tag + ".qcow2"
 }
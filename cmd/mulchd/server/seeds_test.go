@@ -0,0 +1,353 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSeedVersions(tags ...string) []*SeedVersion {
+	var versions []*SeedVersion
+	for _, tag := range tags {
+		versions = append(versions, &SeedVersion{Tag: tag})
+	}
+	return versions
+}
+
+func TestSeedNewVersionTag(t *testing.T) {
+	date := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		existing []string
+		want     string
+	}{
+		{nil, "2020-07-01"},
+		{[]string{"2020-06-30"}, "2020-07-01"},
+		{[]string{"2020-07-01"}, "2020-07-01.2"},
+		{[]string{"2020-07-01.2", "2020-07-01"}, "2020-07-01.3"},
+		{[]string{"2020-07-01.3", "2020-07-01"}, "2020-07-01.2"},
+	}
+
+	for _, test := range tests {
+		seed := &Seed{Name: "test", Versions: testSeedVersions(test.existing...)}
+		if got := seed.newVersionTag(date); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.existing, got, test.want)
+		}
+	}
+}
+
+func TestSeedDatabaseNewVersion(t *testing.T) {
+	seed := &Seed{Name: "test"}
+	db := &SeedDatabase{db: map[string]*Seed{"test": seed}}
+	date := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	// concurrent builds of the same day must get different tags
+	var wg sync.WaitGroup
+	versions := make([]*SeedVersion, 10)
+	for i := range versions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			versions[i] = db.newVersion(seed, date)
+		}(i)
+	}
+	wg.Wait()
+
+	tags := make(map[string]bool)
+	for _, version := range versions {
+		if tags[version.Tag] {
+			t.Errorf("tag %s was given twice", version.Tag)
+		}
+		tags[version.Tag] = true
+		if version.Pending == false {
+			t.Errorf("version %s must be pending", version.Tag)
+		}
+		if version.Volume != "test@"+version.Tag+".qcow2" {
+			t.Errorf("version %s: unexpected volume %s", version.Tag, version.Volume)
+		}
+	}
+	if len(seed.Versions) != len(versions) {
+		t.Errorf("got %d versions, want %d", len(seed.Versions), len(versions))
+	}
+
+	// pending versions are hidden
+	list, _ := db.GetVersions(seed)
+	if len(list) != 0 {
+		t.Errorf("got %d listed versions, want 0", len(list))
+	}
+	versions[3].Pending = false
+	list, _ = db.GetVersions(seed)
+	if len(list) != 1 || list[0] != versions[3] {
+		t.Errorf("got %v, want only %s", list, versions[3].Tag)
+	}
+}
+
+func TestSeedObsoleteVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		pending  string
+		current  string
+		pinned   []string
+		keep     int
+		want     []string
+	}{
+		{"keep 2", []string{"v5", "v4", "v3", "v2", "v1"}, "", "v5", nil, 2, []string{"v2", "v1"}},
+		{"keep 0", []string{"v3", "v2", "v1"}, "", "v3", nil, 0, []string{"v2", "v1"}},
+		{"rollback", []string{"v3", "v2", "v1"}, "", "v2", nil, 1, []string{"v1"}},
+		{"pinned", []string{"v4", "v3", "v2", "v1"}, "", "v4", []string{"v2"}, 1, []string{"v1"}},
+		{"pinned old", []string{"v4", "v3", "v2", "v1"}, "", "v4", []string{"v1"}, 1, []string{"v2"}},
+		{"pending", []string{"v4", "v3", "v2", "v1"}, "v4", "v3", nil, 1, []string{"v1"}},
+		{"nothing", []string{"v1"}, "", "v1", nil, 0, nil},
+	}
+
+	for _, test := range tests {
+		seed := &Seed{Name: "test", Current: test.current, Versions: testSeedVersions(test.versions...)}
+		for _, version := range seed.Versions {
+			version.Pending = version.Tag == test.pending
+		}
+		pinned := make(map[string]bool)
+		for _, tag := range test.pinned {
+			pinned[tag] = true
+		}
+
+		var got []string
+		for _, version := range seed.obsoleteVersions(pinned, test.keep) {
+			got = append(got, version.Tag)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSeedDatabasePinnedVersions(t *testing.T) {
+	seed := &Seed{Name: "debian_10"}
+	db := &SeedDatabase{
+		db: map[string]*Seed{
+			"debian_10":     seed,
+			"seeder_pinned": {Name: "seeder_pinned", Seeder: "https://x", Parent: "debian_10", ParentTag: "2020-05-01"},
+			"seeder_latest": {Name: "seeder_latest", Seeder: "https://x", Parent: "debian_10"},
+			"seeder_other":  {Name: "seeder_other", Seeder: "https://x", Parent: "ubuntu", ParentTag: "2020-05-02"},
+		},
+		app: &App{VMDB: &VMDatabase{db: make(map[string]*VMDatabaseEntry)}},
+	}
+
+	refs := []string{"debian_10@2020-06-01", "debian_10", "ubuntu@2020-06-02", "debian_10@2020-06-01"}
+	for index, ref := range refs {
+		name := NewVMName("vm", index)
+		db.app.VMDB.db[name.ID()] = &VMDatabaseEntry{Name: name, VM: &VM{Config: &VMConfig{Seed: ref}}}
+	}
+
+	pinned := db.pinnedVersions(seed)
+	if len(pinned) != 2 || pinned["2020-06-01"] == false || pinned["2020-05-01"] == false {
+		t.Errorf("got %v, want 2020-06-01 and 2020-05-01", pinned)
+	}
+}
+
+func TestSeedTestVMName(t *testing.T) {
+	seed := &Seed{Name: "debian_10"}
+	name := seedTestVMName(seed, &SeedVersion{Tag: "2020-07-01.2"})
+	if name != "seedtest_debian_10_2020_07_01_2" {
+		t.Errorf("got %s", name)
+	}
+	if IsValidName(name) == false {
+		t.Errorf("%s is not a valid VM name", name)
+	}
+	if name == seedTestVMName(seed, &SeedVersion{Tag: "2020-07-01"}) {
+		t.Error("test VM names of different versions must differ")
+	}
+}
+
+func TestSeedParseImageInfo(t *testing.T) {
+	tests := []struct {
+		output string
+		format string
+		err    string
+	}{
+		{`{"virtual-size": 2147483648, "filename": "img", "format": "qcow2", "actual-size": 1048576}`, "qcow2", ""},
+		{`{"virtual-size": 2147483648, "filename": "img", "format": "raw", "actual-size": 1048576}`, "raw", ""},
+		{`{"filename": "img", "format": "qcow2", "backing-filename": "/etc/shadow"}`, "", "backing file"},
+		{`{"filename": "img", "format": "vmdk"}`, "", "unsupported image format 'vmdk'"},
+		{`{"filename": "img", "format": "vpc"}`, "", "unsupported image format 'vpc'"},
+		{`{"filename": "img", "format": "vdi"}`, "", "unsupported image format 'vdi'"},
+		{`qemu-img: Could not open 'img'`, "", "unable to parse"},
+	}
+
+	for _, test := range tests {
+		format, err := seedParseImageInfo([]byte(test.output))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want '%s'", test.output, err, test.err)
+			}
+			continue
+		}
+		if err != nil || format != test.format {
+			t.Errorf("%s: got '%s' (%v), want '%s'", test.output, format, err, test.format)
+		}
+	}
+}
+
+func TestSeedParseChecksums(t *testing.T) {
+	const gnu = `0b1a4f0c8d8e2ad5d7a7b20e8e3d13c31d4fd3e4a6e81a71e6b5c67bd4d4de35  debian-10-genericcloud-amd64.qcow2
+E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855 *debian-10-generic-amd64.raw
+
+invalid line
+`
+	const bsd = `SHA256 (Fedora-Cloud-Base-33-1.2.x86_64.raw.xz) = 35fa778f5d4830b58f7baf121fff6bd2b52500411c9abc46761b29a690415c3f
+SHA256 (Fedora-Cloud-Base-33-1.2.x86_64.qcow2) = b9b621b26725ba95442d9a56cbaa054784e0779a9522ec6eafff07c6e6f717ea
+`
+
+	tests := []struct {
+		content string
+		image   string
+		want    string
+		err     bool
+	}{
+		{gnu, "debian-10-genericcloud-amd64.qcow2", "0b1a4f0c8d8e2ad5d7a7b20e8e3d13c31d4fd3e4a6e81a71e6b5c67bd4d4de35", false},
+		{gnu, "debian-10-generic-amd64.raw", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", false}, // binary mode, lowercased
+		{gnu, "debian-10-genericcloud-amd64", "", true},
+		{bsd, "Fedora-Cloud-Base-33-1.2.x86_64.qcow2", "b9b621b26725ba95442d9a56cbaa054784e0779a9522ec6eafff07c6e6f717ea", false},
+		{bsd, "Fedora-Cloud-Base-33-1.2.x86_64.raw", "", true},
+		{"", "image.qcow2", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := seedParseChecksums(strings.NewReader(test.content), test.image)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: want an error", test.image)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.image, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.image, got, test.want)
+		}
+	}
+}
+
+func TestIdleTimeoutReader(t *testing.T) {
+	reader, writer := io.Pipe()
+	canceled := make(chan struct{})
+	body := newIdleTimeoutReader(reader, 100*time.Millisecond, func() {
+		close(canceled)
+		writer.CloseWithError(errors.New("canceled"))
+	})
+	defer body.Stop()
+
+	// data keeps coming: no cancellation
+	go func() {
+		for i := 0; i < 6; i++ {
+			writer.Write([]byte("data"))
+			time.Sleep(40 * time.Millisecond)
+		}
+	}()
+	buf := make([]byte, 16)
+	for i := 0; i < 6; i++ {
+		if _, err := body.Read(buf); err != nil {
+			t.Fatalf("read %d: %s", i, err)
+		}
+	}
+
+	// stalled
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled reader was not canceled")
+	}
+	if _, err := body.Read(buf); err == nil {
+		t.Errorf("want an error after cancellation")
+	}
+}
+
+func TestSeedersOrder(t *testing.T) {
+	db := &SeedDatabase{
+		db: map[string]*Seed{
+			"debian_10": {Name: "debian_10"},
+			"c_php":     {Name: "c_php", Seeder: "https://x", Parent: "b_lamp"},
+			"b_lamp":    {Name: "b_lamp", Seeder: "https://x", Parent: "a_base"},
+			"a_base":    {Name: "a_base", Seeder: "https://x", Parent: "debian_10"},
+			"unknown":   {Name: "unknown", Seeder: "https://x", Parent: "removed"},
+			"new":       {Name: "new", Seeder: "https://x"}, // parent not read yet
+		},
+	}
+
+	order, err := db.seedersOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a_base,b_lamp,c_php,new,unknown"
+	if got := strings.Join(order, ","); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// a_base -> c_php -> b_lamp -> a_base
+	db.db["a_base"].Parent = "c_php"
+	_, err = db.seedersOrder()
+	if err == nil {
+		t.Fatal("want a cycle error")
+	}
+	if !strings.Contains(err.Error(), "a_base -> c_php -> b_lamp -> a_base") {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// self
+	db.db["a_base"].Parent = "a_base"
+	if _, err = db.seedersOrder(); err == nil {
+		t.Error("want a cycle error (self)")
+	}
+}
+
+func TestSeedParentChanged(t *testing.T) {
+	built := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	parent := &Seed{
+		Name: "debian_10",
+		Versions: []*SeedVersion{
+			{Tag: "2020-07-02", LastModified: built.Add(24 * time.Hour)},
+			{Tag: "2020-06-01", LastModified: built.Add(-30 * 24 * time.Hour)},
+		},
+	}
+	db := &SeedDatabase{db: map[string]*Seed{"debian_10": parent}}
+
+	tests := []struct {
+		name          string
+		ready         bool
+		parentVersion string // recorded
+		current       string // parent version to use
+		want          bool
+	}{
+		{"same version", true, "2020-06-01", "2020-06-01", false},
+		{"new version", true, "2020-06-01", "2020-07-02", true},
+		{"unknown current", true, "2020-06-01", "", false},
+		{"not built yet", false, "", "2020-07-02", false},
+		{"upgrade, newer parent", true, "", "2020-07-02", true},
+		{"upgrade, older parent", true, "", "2020-06-01", false},
+		{"upgrade, unknown version", true, "", "2019-01-01", false},
+	}
+
+	for _, test := range tests {
+		seed := &Seed{
+			Name:          "seeder",
+			Ready:         test.ready,
+			LastModified:  built,
+			ParentVersion: test.parentVersion,
+		}
+		if got := db.seedParentChanged(seed, "debian_10", test.current); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
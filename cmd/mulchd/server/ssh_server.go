@@ -146,7 +146,9 @@ func NewSSHProxyServer(app *App) error {
 			client.sshClient = sshClient
 
 			app.Log.Trace("SSH Proxy: adding client to the map")
+			app.sshMutex.Lock()
 			app.sshClients[c.RemoteAddr()] = &client
+			app.sshMutex.Unlock()
 			return nil, nil
 		},
 	}
@@ -159,13 +161,17 @@ func NewSSHProxyServer(app *App) error {
 		config,
 		app.Log,
 		func(c ssh.ConnMetadata) (*ssh.Client, error) {
+			app.sshMutex.Lock()
 			client, _ := app.sshClients[c.RemoteAddr()]
+			app.sshMutex.Unlock()
 			// we could delete entry here, but we keep it for infos/stats (see status command)
 			app.Log.Tracef("SSH proxy: connection accepted from %s forwarded to %s", c.RemoteAddr(), client.sshClient.RemoteAddr())
 
 			return client.sshClient, err
 		}, func(c ssh.ConnMetadata) error {
+			app.sshMutex.Lock()
 			delete(app.sshClients, c.RemoteAddr())
+			app.sshMutex.Unlock()
 			app.Log.Tracef("SSH proxy: connection closed from: %s", c.RemoteAddr())
 			return nil
 		})
@@ -52,26 +52,35 @@ const (
 	VMAllowScriptFailure  = true
 )
 
+// VMInitTimeout is the default delay for the VM to phone home after
+// the first boot (cloud-init)
+const VMInitTimeout = 10 * time.Minute
+
 // BackupBlankRestore disables *install* scripts during a
 // a VM creation (so we can restore backup a bit later)
 const BackupBlankRestore = "-"
 
 // VM defines a virtual machine ("domain")
 type VM struct {
-	App                  *App `json:"-"`
-	LibvirtUUID          string
-	SecretUUID           string
-	Config               *VMConfig
-	AuthorKey            string
-	MulchSuperUserSSHKey string
-	InitDate             time.Time
-	LastIP               string
-	Locked               bool
-	WIP                  VMOperation
-	LastRebuildDuration  time.Duration
-	LastRebuildDowntime  time.Duration
-	AssignedMAC          string
-	AssignedIPv4         string
+	App                    *App `json:"-"`
+	LibvirtUUID            string
+	SecretUUID             string
+	Config                 *VMConfig
+	AuthorKey              string
+	MulchSuperUserSSHKey   string
+	InitDate               time.Time
+	LastIP                 string
+	Locked                 bool
+	WIP                    VMOperation
+	LastRebuildDuration    time.Duration
+	LastRebuildDowntime    time.Duration
+	AssignedMAC            string
+	AssignedIPv4           string
+	AssignedIPv6           string
+	AssignedInterfacesMACs []string
+	ProvisioningVolume     string // config-drive ISO or Ignition config
+	HealthMaintenance      bool   // domains in maintenance (failed health check)
+	Maintenance            bool   // domains in maintenance (manual, see VMSetMaintenance)
 }
 
 // SetOperation change VM WIP
@@ -138,14 +147,11 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 
 	diskName := vmGenDiskName(vmName)
 
-	seed, err := app.Seeder.GetByName(vmConfig.Seed)
+	seed, seedVolume, err := app.Seeder.GetByRef(vmConfig.Seed)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	if seed.Ready == false {
-		return nil, nil, fmt.Errorf("seed %s is not ready", vmConfig.Seed)
-	}
+	provisioning := seed.GetProvisioning()
 
 	if active {
 		// check for conclicting domains (will also be done later while saving vm database)
@@ -153,6 +159,10 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		if err != nil {
 			return nil, nil, err
 		}
+		err = CheckPortsConflicts(app.VMDB, vmConfig.Ports, vmName.Name, app.Config)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// check if backup exists (if a restore was requested)
@@ -172,6 +182,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	}
 	// we assign static DHCP leases for network security reasons (see clean-traffic nwfilter)
 	vm.AssignedMAC = RandomUniqueMAC(app)
+	vmAssignInterfacesMACs(vm, app)
 	vm.AssignedIPv4, err = RandomUniqueIPv4(app)
 	if err != nil {
 		return nil, nil, err
@@ -185,10 +196,26 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	app.Libvirt.AddTransientDHCPHost(transientLease, app)
 	defer app.Libvirt.RemoveTransientDHCPHost(transientLease, app)
 
+	// IPv6 is optional, see network.xml
+	vm.AssignedIPv6, err = RandomUniqueIPv6(app)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if vm.AssignedIPv6 != "" {
+		transientLeaseIPv6 := &libvirtxml.NetworkDHCPHost{
+			Name: vmName.LibvirtDomainName(app),
+			ID:   DUIDFromMAC(vm.AssignedMAC),
+			IP:   vm.AssignedIPv6,
+		}
+		app.Libvirt.AddTransientDHCPHost(transientLeaseIPv6, app)
+		defer app.Libvirt.RemoveTransientDHCPHost(transientLeaseIPv6, app)
+	}
+
 	// 1 - copy from reference image
 	log.Infof("creating VM disk '%s'", diskName)
 	err = app.Libvirt.CreateDiskFromSeed(
-		seed.GetVolumeName(),
+		seedVolume,
 		diskName,
 		app.Config.GetTemplateFilepath("volume.xml"),
 		log)
@@ -244,6 +271,10 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	domcfg.VCPU.Value = vm.Config.CPUCount
 
 	serial := "ds=nocloud-net;s=http://" + app.Libvirt.NetworkXML.IPs[0].Address + ":" + strconv.Itoa(AppInternalServerPost) + "/cloud-init/" + vm.SecretUUID + "/"
+	if provisioning != SeedProvisioningCloudInit {
+		// config is provided locally (cdrom, fw_cfg)
+		serial = "ds=nocloud"
+	}
 	serialFound := false
 	for i, entry := range domcfg.SysInfo.System.Entry {
 		if entry.Name == "version" {
@@ -281,6 +312,8 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 			if intf.FilterRef.Filter != AppNWFilter {
 				return nil, nil, fmt.Errorf("vm xml file: need filterref '%s'", AppNWFilter)
 			}
+			// our VM filter references AppNWFilter
+			intf.FilterRef.Filter = VMFirewallFilterName(vmName, app)
 			foundParam := 0
 			for index, param := range intf.FilterRef.Parameters {
 				if param.Name == "IP" {
@@ -300,11 +333,50 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, fmt.Errorf("vm xml file: found %d interface(s) with 'ua-mulch-bridge' alias, exactly one is needed", foundInterfaces)
 	}
 
+	extraInterfaces, err := vmInterfacesDomainXML(vm, app)
+	if err != nil {
+		return nil, nil, err
+	}
+	domcfg.Devices.Interfaces = append(domcfg.Devices.Interfaces, extraInterfaces...)
+
+	switch provisioning {
+	case SeedProvisioningConfigDrive:
+		err = vmAddConfigDrive(vm, vmName, domcfg, app, log)
+	case SeedProvisioningIgnition:
+		err = vmAddIgnition(vm, vmName, domcfg, app, log)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if !commit && vm.ProvisioningVolume != "" {
+			errDef := app.Libvirt.DeleteVolume(vm.ProvisioningVolume, app.Libvirt.Pools.Disks)
+			if errDef != nil {
+				log.Errorf("can't delete provisioning volume: %s", errDef)
+			}
+		}
+	}()
+
 	xml2, err := domcfg.Marshal()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	err = VMFirewallApply(vmName, vm, app, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if !commit {
+			errDef := VMFirewallDelete(vmName, app, log)
+			if errDef != nil {
+				log.Errorf("can't delete nwfilter: %s", errDef)
+			}
+		}
+	}()
+
 	dom, err := conn.DomainDefineXML(string(xml2))
 	if err != nil {
 		return nil, nil, err
@@ -343,9 +415,15 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	phone := app.PhoneHome.Register(secretUUID.String())
 	defer phone.Unregister()
 
+	initTimeout := vmConfig.InitTimeout
+	if initTimeout == 0 {
+		initTimeout = VMInitTimeout
+	}
+	initTimeoutChan := time.After(initTimeout)
+
 	for done := false; done == false; {
 		select {
-		case <-time.After(10 * time.Minute):
+		case <-initTimeoutChan:
 			return nil, nil, errors.New("vm init is too long, something probably went wrong")
 		case call := <-phone.PhoneCalls:
 			// seeders already have phone call service, let's filter it out
@@ -677,6 +755,18 @@ func VMLockUnlock(vmName *VMName, locked bool, vmdb *VMDatabase) error {
 	return nil
 }
 
+// VMSetMaintenance enable or disable manual maintenance mode of VM
+// domains, mulch-proxy will serve the maintenance page
+func VMSetMaintenance(vmName *VMName, maintenance bool, vmdb *VMDatabase) error {
+	vm, err := vmdb.GetByName(vmName)
+	if err != nil {
+		return err
+	}
+
+	vm.Maintenance = maintenance
+	return vmdb.Update()
+}
+
 // VMDelete will delete a VM (using its name) and linked storages.
 func VMDelete(vmName *VMName, app *App, log *Log) error {
 	vm, err := app.VMDB.GetByName(vmName)
@@ -754,6 +844,14 @@ func VMDelete(vmName *VMName, app *App, log *Log) error {
 		}
 	}
 
+	if vm.ProvisioningVolume != "" {
+		log.Infof("removing provisioning volume '%s'", vm.ProvisioningVolume)
+		errV := app.Libvirt.DeleteVolume(vm.ProvisioningVolume, app.Libvirt.Pools.Disks)
+		if errV != nil {
+			log.Errorf("can't delete provisioning volume: %s", errV)
+		}
+	}
+
 	log.Infof("removing VM from libvirt and database")
 
 	// undefine domain
@@ -762,6 +860,11 @@ func VMDelete(vmName *VMName, app *App, log *Log) error {
 		return errU
 	}
 
+	errF := VMFirewallDelete(vmName, app, log)
+	if errF != nil {
+		log.Errorf("can't delete nwfilter: %s", errF)
+	}
+
 	// remove from database
 	errD := app.VMDB.Delete(vmName)
 	if errD != nil {
@@ -1295,6 +1398,23 @@ func VMRename(orgVMName *VMName, newVMName *VMName, app *App, log *Log) error {
 	// rename in libvirt
 	domcfg.Name = newLibvirtName
 
+	// nwfilter name is based on VM name too
+	err = VMFirewallApply(newVMName, vm, app, log)
+	if err != nil {
+		return err
+	}
+	vmFirewallSetFilterRef(domcfg, VMFirewallFilterName(newVMName, app))
+
+	filterCommit := false
+	defer func() {
+		if !filterCommit {
+			errF := VMFirewallDelete(newVMName, app, log)
+			if errF != nil {
+				log.Errorf("can't delete nwfilter: %s", errF)
+			}
+		}
+	}()
+
 	out, err := domcfg.Marshal()
 	if err != nil {
 		return err
@@ -1312,6 +1432,12 @@ func VMRename(orgVMName *VMName, newVMName *VMName, app *App, log *Log) error {
 		return err
 	}
 	defer dom2.Free()
+	filterCommit = true
+
+	err = VMFirewallDelete(orgVMName, app, log)
+	if err != nil {
+		log.Errorf("can't delete nwfilter: %s", err)
+	}
 
 	active, err := app.VMDB.IsVMActive(orgVMName)
 	if err != nil {
@@ -1409,6 +1535,15 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 		}
 	}()
 
+	// keep maintenance mode (the new revision is not active yet)
+	if vm.Maintenance {
+		err = VMSetMaintenance(newVMName, true, app.VMDB)
+		if err != nil {
+			return fmt.Errorf("can't set maintenance mode: %s", err)
+		}
+		log.Info("VM is still in maintenance mode (see 'vm maintenance off')")
+	}
+
 	sourceIsActive := entry.Active
 
 	downtimeStart := time.Now()
@@ -1,13 +1,17 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/OnitiFR/mulch/common"
@@ -35,11 +39,17 @@ type VMConfig struct {
 	RAMSize        uint64
 	CPUCount       int
 	Domains        []*common.Domain
+	Ports          []*common.Port
 	Env            map[string]string
 	BackupDiskSize uint64
 	BackupCompress bool
 	RestoreBackup  string
 	AutoRebuild    string
+	Firewall       []*VMFirewallRule
+	Interfaces     []*VMInterface
+	HealthChecks   []*VMHealthCheck
+	CloudInit      string        // extra cloud-config (YAML)
+	InitTimeout    time.Duration // not available in TOML files (seed tests)
 
 	Prepare []*VMConfigScript
 	Install []*VMConfigScript
@@ -49,12 +59,80 @@ type VMConfig struct {
 	DoActions map[string]*VMDoAction
 }
 
+// VMAccessDefaultRealm is the default basic auth realm of domain access rules
+const VMAccessDefaultRealm = "Restricted"
+
+// VMCompressionDefaultTypes are compressed MIME types, if not set
+var VMCompressionDefaultTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+// VMCacheDefaultMaxSize is the default max_size of a domain cache
+const VMCacheDefaultMaxSize = 64 * 1024 * 1024
+
+// VMCacheDefaultMaxObjectSize is the default max_object_size of a domain cache
+const VMCacheDefaultMaxObjectSize = 2 * 1024 * 1024
+
+// VMHeadersPresetSecure is the name of the "secure defaults" headers preset
+const VMHeadersPresetSecure = "secure"
+
+// VMHeadersSecureRules are response rules of the "secure" headers preset,
+// applied before the rules of the block (so they can be overridden), the
+// (maybe stronger) headers sent by the VM are kept
+var VMHeadersSecureRules = []common.DomainHeaderRule{
+	{Action: common.HeaderActionSetIfAbsent, Name: "Strict-Transport-Security", Value: "max-age=31536000"},
+	{Action: common.HeaderActionSetIfAbsent, Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+	{Action: common.HeaderActionSetIfAbsent, Name: "X-Content-Type-Options", Value: "nosniff"},
+	{Action: common.HeaderActionSetIfAbsent, Name: "Referrer-Policy", Value: "strict-origin-when-cross-origin"},
+	{Action: common.HeaderActionRemove, Name: "Server"},
+	{Action: common.HeaderActionRemove, Name: "X-Powered-By"},
+}
+
+// headers managed by HTTP itself or by the proxy, rules can't touch them
+var vmHeadersForbidden = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Content-Length":    true,
+}
+
 // VMConfigScript is a script for prepare, install, save and restore steps
 type VMConfigScript struct {
 	ScriptURL string
 	As        string
 }
 
+// VMFirewallRule is an allow/deny rule for VM network traffic
+type VMFirewallRule struct {
+	Action    string
+	Direction string
+	Protocol  string
+	PortStart int
+	PortEnd   int
+	CIDR      string
+}
+
+// VMInterface is an additional network interface (other than the mulch network)
+type VMInterface struct {
+	Network string // libvirt network name
+	Bridge  string // host bridge name
+	IP      string // optional static IP, CIDR notation
+}
+
 // VMDoAction is a script for a "do" action (scripts for usual tasks in the VM)
 type VMDoAction struct {
 	Name        string
@@ -77,11 +155,13 @@ type tomlVMConfig struct {
 	Domains         []string
 	RedirectToHTTPS bool `toml:"redirect_to_https"`
 	Redirects       [][]string
+	Ports           []string
 	Env             [][]string
 	BackupDiskSize  datasize.ByteSize `toml:"backup_disk_size"`
 	BackupCompress  bool              `toml:"backup_compress"`
 	RestoreBackup   string            `toml:"restore_backup"`
 	AutoRebuild     string            `toml:"auto_rebuild"`
+	CloudInit       string            `toml:"cloud_init"`
 
 	PreparePrefixURL string `toml:"prepare_prefix_url"`
 	Prepare          []string
@@ -92,7 +172,81 @@ type tomlVMConfig struct {
 	RestorePrefixURL string `toml:"restore_prefix_url"`
 	Restore          []string
 
-	DoActions []tomlVMDoAction `toml:"do-actions"`
+	DoActions    []tomlVMDoAction     `toml:"do-actions"`
+	Firewall     []tomlVMFirewallRule `toml:"firewall"`
+	Interfaces   []tomlVMInterface    `toml:"interfaces"`
+	HealthChecks []tomlVMHealthCheck  `toml:"healthcheck"`
+	Access       []tomlVMAccess       `toml:"access"`
+	Limits       []tomlVMLimits       `toml:"limits"`
+	Compression  []tomlVMCompression  `toml:"compression"`
+	Cache        []tomlVMCache        `toml:"cache"`
+	Headers      []tomlVMHeaders      `toml:"headers"`
+}
+
+type tomlVMHeaders struct {
+	Domains  []string
+	Preset   string
+	Request  [][]string
+	Response [][]string
+}
+
+type tomlVMCompression struct {
+	Domains    []string
+	Algorithms []string
+	MinSize    datasize.ByteSize `toml:"min_size"`
+	Types      []string
+}
+
+type tomlVMCache struct {
+	Domains       []string
+	MaxSize       datasize.ByteSize `toml:"max_size"`
+	MaxObjectSize datasize.ByteSize `toml:"max_object_size"`
+	Disk          bool
+}
+
+type tomlVMLimits struct {
+	Domains          []string
+	Rate             int
+	Burst            int
+	IPRate           int               `toml:"ip_rate"`
+	IPBurst          int               `toml:"ip_burst"`
+	MaxConnections   int               `toml:"max_connections"`
+	IPMaxConnections int               `toml:"ip_max_connections"`
+	MaxBodySize      datasize.ByteSize `toml:"max_body_size"`
+}
+
+type tomlVMAccess struct {
+	Domains   []string
+	Allow     []string
+	Deny      []string
+	BasicAuth []string `toml:"basic_auth"`
+	Realm     string
+}
+
+type tomlVMHealthCheck struct {
+	Type     string
+	Domain   string
+	Port     int
+	Path     string
+	Command  string
+	Interval string
+	Timeout  string
+	Failures int
+	Action   string
+}
+
+type tomlVMInterface struct {
+	Network string
+	Bridge  string
+	IP      string
+}
+
+type tomlVMFirewallRule struct {
+	Action    string
+	Direction string
+	Protocol  string
+	Port      string
+	CIDR      string
 }
 
 type tomlVMDoAction struct {
@@ -179,6 +333,680 @@ func vmConfigGetDoAction(tDoAction *tomlVMDoAction) (*VMDoAction, error) {
 	return doAction, nil
 }
 
+// parse a port string: "[public->]vm/protocol" (ex: "5432->5432/tcp", "25565/tcp")
+func vmConfigGetPort(portStr string) (*common.Port, error) {
+	protocol := common.PortProtocolTCP
+	ports := strings.TrimSpace(portStr)
+
+	sepPlace := strings.LastIndex(ports, "/")
+	if sepPlace != -1 {
+		protocol = strings.ToLower(ports[sepPlace+1:])
+		ports = ports[:sepPlace]
+	}
+	if protocol != common.PortProtocolTCP && protocol != common.PortProtocolUDP {
+		return nil, fmt.Errorf("invalid protocol in port string '%s' (tcp or udp)", portStr)
+	}
+
+	parts := strings.Split(ports, "->")
+	if len(parts) != 1 && len(parts) != 2 {
+		return nil, fmt.Errorf("invalid port string '%s'", portStr)
+	}
+
+	portNums := make([]int, len(parts))
+	for i, part := range parts {
+		portNum, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || portNum < 1 || portNum > 65535 {
+			return nil, fmt.Errorf("invalid port number '%s'", part)
+		}
+		portNums[i] = portNum
+	}
+
+	port := &common.Port{
+		ListenPort:      portNums[0],
+		Protocol:        protocol,
+		DestinationPort: portNums[len(portNums)-1],
+	}
+	return port, nil
+}
+
+func vmConfigGetFirewallRule(tRule *tomlVMFirewallRule) (*VMFirewallRule, error) {
+	rule := &VMFirewallRule{}
+
+	switch tRule.Action {
+	case VMFirewallActionAllow, VMFirewallActionDeny:
+		rule.Action = tRule.Action
+	default:
+		return nil, fmt.Errorf("invalid firewall action '%s' (allow or deny)", tRule.Action)
+	}
+
+	switch tRule.Direction {
+	case VMFirewallDirectionIn, VMFirewallDirectionOut:
+		rule.Direction = tRule.Direction
+	default:
+		return nil, fmt.Errorf("invalid firewall direction '%s' (in or out)", tRule.Direction)
+	}
+
+	protocol := tRule.Protocol
+	if protocol == "" {
+		protocol = VMFirewallProtocolAll
+	}
+	switch protocol {
+	case VMFirewallProtocolTCP, VMFirewallProtocolUDP, VMFirewallProtocolICMP, VMFirewallProtocolAll:
+		rule.Protocol = protocol
+	default:
+		return nil, fmt.Errorf("invalid firewall protocol '%s' (tcp, udp, icmp or all)", tRule.Protocol)
+	}
+
+	if tRule.Port != "" {
+		if rule.Protocol != VMFirewallProtocolTCP && rule.Protocol != VMFirewallProtocolUDP {
+			return nil, fmt.Errorf("firewall port '%s' needs tcp or udp protocol", tRule.Port)
+		}
+		parts := strings.Split(tRule.Port, "-")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid firewall port '%s'", tRule.Port)
+		}
+		ports := make([]int, len(parts))
+		for i, part := range parts {
+			port, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid firewall port '%s'", tRule.Port)
+			}
+			ports[i] = port
+		}
+		rule.PortStart = ports[0]
+		if len(ports) == 2 {
+			if ports[1] < ports[0] {
+				return nil, fmt.Errorf("invalid firewall port range '%s'", tRule.Port)
+			}
+			rule.PortEnd = ports[1]
+		}
+	}
+
+	if tRule.CIDR != "" {
+		cidr := tRule.CIDR
+		if !strings.Contains(cidr, "/") {
+			if IsIPv6(cidr) {
+				cidr = cidr + "/128"
+			} else {
+				cidr = cidr + "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid firewall CIDR '%s'", tRule.CIDR)
+		}
+		rule.CIDR = ipNet.String()
+	}
+
+	return rule, nil
+}
+
+// parse an access CIDR, a single IP is allowed (ex: 10.1.2.3)
+func vmConfigGetAccessCIDR(cidrStr string) (string, error) {
+	cidr := strings.TrimSpace(cidrStr)
+	if !strings.Contains(cidr, "/") {
+		if IsIPv6(cidr) {
+			cidr = cidr + "/128"
+		} else {
+			cidr = cidr + "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("access: invalid CIDR '%s'", cidrStr)
+	}
+	return ipNet.String(), nil
+}
+
+// htpasswd line: "user:hash", with bcrypt, SHA1 or Apache MD5 hashes
+// (plain text and crypt() passwords are refused)
+func vmConfigGetAccessBasicAuth(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("access: invalid basic_auth line '%s' (user:hash)", line)
+	}
+	user := parts[0]
+	hash := parts[1]
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+	case strings.HasPrefix(hash, "{SHA}"):
+	case strings.HasPrefix(hash, "$apr1$"):
+	default:
+		return "", fmt.Errorf("access: unsupported hash for user '%s' (use bcrypt, ex: htpasswd -nB %s)", user, user)
+	}
+	return line, nil
+}
+
+// returns proxied VM domains matching names (all proxied domains if names
+// is empty), block is the setting name (for errors)
+func vmConfigSelectDomains(block string, names []string, domains []*common.Domain) ([]*common.Domain, error) {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[strings.TrimSpace(strings.ToLower(name))] = true
+	}
+
+	var selected []*common.Domain
+	found := make(map[string]bool)
+	for _, domain := range domains {
+		if domain.RedirectTo != "" {
+			continue
+		}
+		if len(wanted) > 0 && wanted[domain.Name] == false {
+			continue
+		}
+		selected = append(selected, domain)
+		found[domain.Name] = true
+	}
+
+	for name := range wanted {
+		if found[name] == false {
+			return nil, fmt.Errorf("%s: domain '%s' is not a (proxied) domain of this VM", block, name)
+		}
+	}
+
+	return selected, nil
+}
+
+// applies an access block to VM domains (all proxied domains by default)
+func vmConfigApplyAccess(tAccess *tomlVMAccess, domains []*common.Domain) error {
+	access := &common.DomainAccess{
+		Realm: tAccess.Realm,
+	}
+	if access.Realm == "" {
+		access.Realm = VMAccessDefaultRealm
+	}
+	if strings.Contains(access.Realm, `"`) {
+		return fmt.Errorf("access: invalid realm '%s'", access.Realm)
+	}
+
+	for _, cidrStr := range tAccess.Allow {
+		cidr, err := vmConfigGetAccessCIDR(cidrStr)
+		if err != nil {
+			return err
+		}
+		access.Allow = append(access.Allow, cidr)
+	}
+
+	for _, cidrStr := range tAccess.Deny {
+		cidr, err := vmConfigGetAccessCIDR(cidrStr)
+		if err != nil {
+			return err
+		}
+		access.Deny = append(access.Deny, cidr)
+	}
+
+	users := make(map[string]bool)
+	for _, line := range tAccess.BasicAuth {
+		authLine, err := vmConfigGetAccessBasicAuth(line)
+		if err != nil {
+			return err
+		}
+		user := strings.SplitN(authLine, ":", 2)[0]
+		if users[user] {
+			return fmt.Errorf("access: duplicated basic_auth user '%s'", user)
+		}
+		users[user] = true
+		access.BasicAuth = append(access.BasicAuth, authLine)
+	}
+
+	if len(access.Allow) == 0 && len(access.Deny) == 0 && len(access.BasicAuth) == 0 {
+		return errors.New("access: needs at least an 'allow', 'deny' or 'basic_auth' setting")
+	}
+
+	selected, err := vmConfigSelectDomains("access", tAccess.Domains, domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range selected {
+		if domain.Access != nil {
+			return fmt.Errorf("access: domain '%s' is in multiple access blocks", domain.Key())
+		}
+		domain.Access = access
+	}
+
+	return nil
+}
+
+// applies a limits block to VM domains (all proxied domains by default)
+func vmConfigApplyLimits(tLimits *tomlVMLimits, domains []*common.Domain) error {
+	limits := &common.DomainLimits{
+		Rate:             tLimits.Rate,
+		Burst:            tLimits.Burst,
+		IPRate:           tLimits.IPRate,
+		IPBurst:          tLimits.IPBurst,
+		MaxConnections:   tLimits.MaxConnections,
+		IPMaxConnections: tLimits.IPMaxConnections,
+		MaxBodySize:      tLimits.MaxBodySize.Bytes(),
+	}
+
+	if limits.Rate < 0 || limits.Burst < 0 || limits.IPRate < 0 || limits.IPBurst < 0 ||
+		limits.MaxConnections < 0 || limits.IPMaxConnections < 0 {
+		return errors.New("limits: values can't be negative")
+	}
+
+	// default burst: two seconds of traffic
+	if limits.Burst == 0 {
+		limits.Burst = limits.Rate * 2
+	}
+	if limits.IPBurst == 0 {
+		limits.IPBurst = limits.IPRate * 2
+	}
+	if limits.Burst < limits.Rate || limits.IPBurst < limits.IPRate {
+		return errors.New("limits: burst can't be lower than rate")
+	}
+	if (limits.Rate == 0 && tLimits.Burst != 0) || (limits.IPRate == 0 && tLimits.IPBurst != 0) {
+		return errors.New("limits: burst needs a rate")
+	}
+
+	if *limits == (common.DomainLimits{}) {
+		return errors.New("limits: needs at least one limit")
+	}
+
+	selected, err := vmConfigSelectDomains("limits", tLimits.Domains, domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range selected {
+		if domain.Limits != nil {
+			return fmt.Errorf("limits: domain '%s' is in multiple limits blocks", domain.Key())
+		}
+		domain.Limits = limits
+	}
+
+	return nil
+}
+
+// applies a compression block to VM domains (all proxied domains by default)
+func vmConfigApplyCompression(tCompression *tomlVMCompression, domains []*common.Domain) error {
+	compression := &common.DomainCompression{
+		Algorithms: tCompression.Algorithms,
+		MinSize:    tCompression.MinSize.Bytes(),
+	}
+
+	if len(compression.Algorithms) == 0 {
+		compression.Algorithms = []string{common.CompressionBrotli, common.CompressionGzip}
+	}
+	seen := make(map[string]bool)
+	for _, algorithm := range compression.Algorithms {
+		switch algorithm {
+		case common.CompressionBrotli, common.CompressionGzip:
+		default:
+			return fmt.Errorf("compression: invalid algorithm '%s' (%s or %s)", algorithm, common.CompressionBrotli, common.CompressionGzip)
+		}
+		if seen[algorithm] {
+			return fmt.Errorf("compression: duplicated algorithm '%s'", algorithm)
+		}
+		seen[algorithm] = true
+	}
+
+	if tCompression.MinSize == 0 {
+		compression.MinSize = 1024
+	}
+
+	types := tCompression.Types
+	if len(types) == 0 {
+		types = VMCompressionDefaultTypes
+	}
+	for _, mimeType := range types {
+		mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+		if !strings.Contains(mimeType, "/") || strings.ContainsAny(mimeType, "*; ") {
+			return fmt.Errorf("compression: invalid type '%s' (ex: text/html, text/)", mimeType)
+		}
+		compression.Types = append(compression.Types, mimeType)
+	}
+
+	selected, err := vmConfigSelectDomains("compression", tCompression.Domains, domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range selected {
+		if domain.Compression != nil {
+			return fmt.Errorf("compression: domain '%s' is in multiple compression blocks", domain.Key())
+		}
+		domain.Compression = compression
+	}
+
+	return nil
+}
+
+// applies a cache block to VM domains (all proxied domains by default)
+func vmConfigApplyCache(tCache *tomlVMCache, domains []*common.Domain) error {
+	cache := &common.DomainCache{
+		MaxSize:       tCache.MaxSize.Bytes(),
+		MaxObjectSize: tCache.MaxObjectSize.Bytes(),
+		Disk:          tCache.Disk,
+	}
+
+	if cache.MaxSize == 0 {
+		cache.MaxSize = VMCacheDefaultMaxSize
+	}
+	if cache.MaxObjectSize == 0 {
+		cache.MaxObjectSize = VMCacheDefaultMaxObjectSize
+	}
+	if cache.MaxObjectSize > cache.MaxSize {
+		return fmt.Errorf("cache: max_object_size (%s) can't be greater than max_size (%s)", tCache.MaxObjectSize.HR(), datasize.ByteSize(cache.MaxSize).HR())
+	}
+
+	selected, err := vmConfigSelectDomains("cache", tCache.Domains, domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range selected {
+		if domain.Cache != nil {
+			return fmt.Errorf("cache: domain '%s' is in multiple cache blocks", domain.Key())
+		}
+		domain.Cache = cache
+	}
+
+	return nil
+}
+
+// parses header rules (["set", "name", "value"], ["remove", "name"], …),
+// side is "request" or "response" (for errors)
+func vmConfigGetHeaderRules(side string, tRules [][]string) ([]common.DomainHeaderRule, error) {
+	var rules []common.DomainHeaderRule
+	for _, parts := range tRules {
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("headers: empty %s rule", side)
+		}
+		rule := common.DomainHeaderRule{
+			Action: strings.TrimSpace(strings.ToLower(parts[0])),
+		}
+
+		switch rule.Action {
+		case common.HeaderActionSet, common.HeaderActionSetIfAbsent, common.HeaderActionAdd:
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("headers: %s rule '%s' needs a name and a value (ex: ['%s', 'X-Frame-Options', 'DENY'])", side, rule.Action, rule.Action)
+			}
+			rule.Value = parts[2]
+		case common.HeaderActionRemove:
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("headers: %s rule '%s' needs a name (ex: ['remove', 'X-Powered-By'])", side, rule.Action)
+			}
+		default:
+			return nil, fmt.Errorf("headers: invalid %s rule action '%s' (%s, %s, %s or %s)", side, parts[0], common.HeaderActionSet, common.HeaderActionSetIfAbsent, common.HeaderActionAdd, common.HeaderActionRemove)
+		}
+
+		name := strings.TrimSpace(parts[1])
+		if name == "" || strings.IndexFunc(name, vmConfigIsNotHeaderNameChar) != -1 {
+			return nil, fmt.Errorf("headers: invalid %s header name '%s'", side, name)
+		}
+		rule.Name = http.CanonicalHeaderKey(name)
+		if vmHeadersForbidden[rule.Name] {
+			return nil, fmt.Errorf("headers: %s header '%s' can't be modified", side, rule.Name)
+		}
+
+		if strings.ContainsAny(rule.Value, "\r\n\x00") {
+			return nil, fmt.Errorf("headers: invalid %s value for header '%s'", side, rule.Name)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// is c forbidden in a header name? (RFC 7230 token)
+func vmConfigIsNotHeaderNameChar(c rune) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// applies a headers block to VM domains (all proxied domains by default)
+func vmConfigApplyHeaders(tHeaders *tomlVMHeaders, domains []*common.Domain) error {
+	headers := &common.DomainHeaders{}
+
+	switch tHeaders.Preset {
+	case "":
+	case VMHeadersPresetSecure:
+		headers.Response = append(headers.Response, VMHeadersSecureRules...)
+	default:
+		return fmt.Errorf("headers: invalid preset '%s' (only '%s' is supported)", tHeaders.Preset, VMHeadersPresetSecure)
+	}
+
+	request, err := vmConfigGetHeaderRules("request", tHeaders.Request)
+	if err != nil {
+		return err
+	}
+	headers.Request = append(headers.Request, request...)
+
+	response, err := vmConfigGetHeaderRules("response", tHeaders.Response)
+	if err != nil {
+		return err
+	}
+	headers.Response = append(headers.Response, response...)
+
+	if len(headers.Request) == 0 && len(headers.Response) == 0 {
+		return errors.New("headers: needs at least a 'preset', 'request' or 'response' setting")
+	}
+
+	selected, err := vmConfigSelectDomains("headers", tHeaders.Domains, domains)
+	if err != nil {
+		return err
+	}
+	for _, domain := range selected {
+		if domain.Headers != nil {
+			return fmt.Errorf("headers: domain '%s' is in multiple headers blocks", domain.Key())
+		}
+		domain.Headers = headers
+	}
+
+	return nil
+}
+
+func vmConfigGetInterface(tIntf *tomlVMInterface) (*VMInterface, error) {
+	intf := &VMInterface{
+		Network: tIntf.Network,
+		Bridge:  tIntf.Bridge,
+	}
+
+	if (intf.Network == "") == (intf.Bridge == "") {
+		return nil, errors.New("interface needs a network or a bridge setting (but not both)")
+	}
+
+	if intf.Network == AppNetwork {
+		return nil, fmt.Errorf("interface can't use '%s' network (it's the main VM interface)", AppNetwork)
+	}
+
+	if tIntf.IP != "" {
+		ip, ipNet, err := net.ParseCIDR(tIntf.IP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface IP '%s' (CIDR notation needed, ex: 10.0.0.5/24)", tIntf.IP)
+		}
+		prefix, _ := ipNet.Mask.Size()
+		intf.IP = ip.String() + "/" + strconv.Itoa(prefix)
+	}
+
+	return intf, nil
+}
+
+// parse a domain string: "host[/path][->port][@options]", with a comma
+// separated list of options: "pool[:mode]" and "strip" (path prefix)
+// ex: "example.com/api->8080@pool:sticky,strip"
+func vmConfigGetDomain(domainStr string) (*common.Domain, error) {
+	domain := &common.Domain{
+		DestinationPort: 80,
+	}
+
+	parts := strings.Split(domainStr, "@")
+	if len(parts) != 1 && len(parts) != 2 {
+		return nil, fmt.Errorf("invalid domain string '%s'", domainStr)
+	}
+
+	if len(parts) == 2 {
+		for _, option := range strings.Split(parts[1], ",") {
+			option = strings.TrimSpace(option)
+			optParts := strings.Split(option, ":")
+			switch optParts[0] {
+			case "pool":
+				if len(optParts) > 2 {
+					return nil, fmt.Errorf("invalid domain pool '%s' (ex: @pool, @pool:sticky)", option)
+				}
+				domain.Pool = common.DomainPoolRoundRobin
+				if len(optParts) == 2 {
+					domain.Pool = optParts[1]
+				}
+				switch domain.Pool {
+				case common.DomainPoolRoundRobin:
+				case common.DomainPoolLeastConn:
+				case common.DomainPoolSticky:
+				default:
+					return nil, fmt.Errorf("invalid domain pool mode '%s' (%s, %s or %s)", domain.Pool, common.DomainPoolRoundRobin, common.DomainPoolLeastConn, common.DomainPoolSticky)
+				}
+			case "strip":
+				domain.StripPrefix = true
+			default:
+				return nil, fmt.Errorf("invalid domain option '%s' (pool, strip)", option)
+			}
+		}
+	}
+
+	routeParts := strings.Split(parts[0], "->")
+	if len(routeParts) != 1 && len(routeParts) != 2 {
+		return nil, fmt.Errorf("invalid domain string '%s'", domainStr)
+	}
+	if len(routeParts) == 2 {
+		portNum, err := strconv.Atoi(strings.TrimSpace(routeParts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port number '%s'", routeParts[1])
+		}
+		domain.DestinationPort = portNum
+	}
+
+	// (URL paths are case-sensitive, only the host is lowercased)
+	hostName := strings.TrimSpace(routeParts[0])
+	slash := strings.Index(hostName, "/")
+	if slash != -1 {
+		prefix := path.Clean(hostName[slash:])
+		hostName = hostName[:slash]
+		if strings.ContainsAny(prefix, "*?#") {
+			return nil, fmt.Errorf("invalid path prefix '%s'", prefix)
+		}
+		if prefix != "/" {
+			domain.PathPrefix = prefix
+		}
+	}
+	hostName = strings.ToLower(hostName)
+	if hostName == "" {
+		return nil, fmt.Errorf("invalid domain string '%s'", domainStr)
+	}
+	err := vmConfigCheckWildcard(hostName)
+	if err != nil {
+		return nil, err
+	}
+	domain.Name = hostName
+
+	if domain.StripPrefix && domain.PathPrefix == "" {
+		return nil, fmt.Errorf("domain '%s': strip option needs a path prefix", domainStr)
+	}
+
+	return domain, nil
+}
+
+// wildcard domains must start with '*.' (ex: *.preview.example.com),
+// and a wildcard only matches a single label
+func vmConfigCheckWildcard(hostName string) error {
+	if !strings.Contains(hostName, "*") {
+		return nil
+	}
+	rest := strings.TrimPrefix(hostName, "*.")
+	if rest == hostName || strings.Contains(rest, "*") || !strings.Contains(rest, ".") {
+		return fmt.Errorf("invalid wildcard domain '%s' (ex: *.preview.example.com)", hostName)
+	}
+	return nil
+}
+
+func vmConfigGetHealthCheck(tCheck *tomlVMHealthCheck, domains []*common.Domain) (*VMHealthCheck, error) {
+	check := &VMHealthCheck{
+		Type:     tCheck.Type,
+		Port:     tCheck.Port,
+		Failures: tCheck.Failures,
+	}
+
+	switch tCheck.Type {
+	case VMHealthCheckHTTP:
+		check.Path = tCheck.Path
+		if check.Path == "" {
+			check.Path = "/"
+		}
+		if !strings.HasPrefix(check.Path, "/") {
+			return nil, fmt.Errorf("healthcheck: invalid path '%s'", tCheck.Path)
+		}
+		if strings.HasPrefix(tCheck.Domain, "*.") {
+			return nil, fmt.Errorf("healthcheck: can't use wildcard domain '%s'", tCheck.Domain)
+		}
+		if tCheck.Domain != "" {
+			var found *common.Domain
+			for _, domain := range domains {
+				if domain.Name == tCheck.Domain && domain.RedirectTo == "" {
+					found = domain
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("healthcheck: domain '%s' is not a (proxied) domain of this VM", tCheck.Domain)
+			}
+			check.Domain = found.Name
+			if check.Port == 0 {
+				check.Port = found.DestinationPort
+			}
+		}
+		if check.Port == 0 {
+			check.Port = 80
+		}
+		if tCheck.Command != "" {
+			return nil, errors.New("healthcheck: 'command' is only available for ssh checks")
+		}
+	case VMHealthCheckTCP:
+		if tCheck.Port == 0 {
+			return nil, errors.New("healthcheck: tcp check needs a 'port' setting")
+		}
+		if tCheck.Domain != "" || tCheck.Path != "" || tCheck.Command != "" {
+			return nil, errors.New("healthcheck: tcp check only needs a 'port' setting")
+		}
+	case VMHealthCheckSSH:
+		if tCheck.Command == "" {
+			return nil, errors.New("healthcheck: ssh check needs a 'command' setting")
+		}
+		if tCheck.Domain != "" || tCheck.Path != "" || tCheck.Port != 0 {
+			return nil, errors.New("healthcheck: ssh check only needs a 'command' setting")
+		}
+		check.Command = tCheck.Command
+	default:
+		return nil, fmt.Errorf("invalid healthcheck type '%s' (http, tcp or ssh)", tCheck.Type)
+	}
+
+	if check.Port < 0 || check.Port > 65535 {
+		return nil, fmt.Errorf("healthcheck: invalid port %d", tCheck.Port)
+	}
+
+	interval, err := time.ParseDuration(tCheck.Interval)
+	if err != nil || interval < 10*time.Second {
+		return nil, fmt.Errorf("healthcheck: invalid interval '%s' (min is 10s)", tCheck.Interval)
+	}
+	check.Interval = interval
+
+	timeout, err := time.ParseDuration(tCheck.Timeout)
+	if err != nil || timeout <= 0 || timeout >= interval {
+		return nil, fmt.Errorf("healthcheck: invalid timeout '%s' (must be lower than interval)", tCheck.Timeout)
+	}
+	check.Timeout = timeout
+
+	if check.Failures < 1 {
+		return nil, fmt.Errorf("healthcheck: invalid failures value %d", tCheck.Failures)
+	}
+
+	switch tCheck.Action {
+	case VMHealthActionNone, VMHealthActionRestart, VMHealthActionMaintenance:
+		check.Action = tCheck.Action
+	default:
+		return nil, fmt.Errorf("invalid healthcheck action '%s' (restart or maintenance)", tCheck.Action)
+	}
+
+	return check, nil
+}
+
 // NewVMConfigFromTomlReader cretes a new VMConfig instance from
 // a io.Reader containing VM configuration description
 func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error) {
@@ -227,8 +1055,9 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.AppUser = tConfig.AppUser
 
-	if tConfig.Seed == "" || !IsValidName(tConfig.Seed) {
-		return nil, fmt.Errorf("invalid seed image '%s'", tConfig.Seed)
+	_, _, err = ParseSeedRef(tConfig.Seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed image '%s': %s", tConfig.Seed, err)
 	}
 	vmConfig.Seed = tConfig.Seed
 
@@ -255,26 +1084,14 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	// }
 
 	var domainList []string
-	for _, domainName := range tConfig.Domains {
-		parts := strings.Split(domainName, "->")
-		if len(parts) != 1 && len(parts) != 2 {
-			return nil, fmt.Errorf("invalid domain string '%s'", domainName)
-		}
-		hostName := strings.TrimSpace(strings.ToLower(parts[0]))
-		portNum := 80
-		if len(parts) == 2 {
-			portNum, err = strconv.Atoi(parts[1])
-			if err != nil {
-				return nil, fmt.Errorf("invalid port number '%s'", parts[1])
-			}
-		}
-		domain := common.Domain{
-			Name:            hostName,
-			DestinationPort: portNum,
-			RedirectToHTTPS: tConfig.RedirectToHTTPS,
+	for _, domainStr := range tConfig.Domains {
+		domain, err := vmConfigGetDomain(domainStr)
+		if err != nil {
+			return nil, err
 		}
-		vmConfig.Domains = append(vmConfig.Domains, &domain)
-		domainList = append(domainList, hostName)
+		domain.RedirectToHTTPS = tConfig.RedirectToHTTPS
+		vmConfig.Domains = append(vmConfig.Domains, domain)
+		domainList = append(domainList, domain.Name)
 	}
 
 	for _, redirectParts := range tConfig.Redirects {
@@ -283,6 +1100,16 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 		}
 		from := strings.TrimSpace(strings.ToLower(redirectParts[0]))
 		dest := strings.TrimSpace(strings.ToLower(redirectParts[1]))
+		if strings.Contains(from, "/") {
+			return nil, fmt.Errorf("cannot redirect '%s', only whole domains can be redirected", from)
+		}
+		err = vmConfigCheckWildcard(from)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(dest, "*.") {
+			return nil, fmt.Errorf("cannot redirect to '%s', it's a wildcard domain", dest)
+		}
 
 		// default redirect code
 		status := http.StatusFound
@@ -330,16 +1157,74 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	// check for ducplicated domain
 	domainMap := make(map[string]bool)
 	for _, domain := range vmConfig.Domains {
-		_, exist := domainMap[domain.Name]
+		_, exist := domainMap[domain.Key()]
 		if exist == true {
-			return nil, fmt.Errorf("domain '%s' is duplicated in this VM", domain.Name)
+			return nil, fmt.Errorf("domain '%s' is duplicated in this VM", domain.Key())
+		}
+		domainMap[domain.Key()] = true
+	}
+	for _, redirect := range vmConfig.Domains {
+		if redirect.RedirectTo == "" {
+			continue
+		}
+		for _, domain := range vmConfig.Domains {
+			if domain.RedirectTo == "" && domain.Name == redirect.Name {
+				return nil, fmt.Errorf("domain '%s' cannot be both redirected and proxied", domain.Name)
+			}
+		}
+	}
+
+	for _, tAccess := range tConfig.Access {
+		err := vmConfigApplyAccess(&tAccess, vmConfig.Domains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tLimits := range tConfig.Limits {
+		err := vmConfigApplyLimits(&tLimits, vmConfig.Domains)
+		if err != nil {
+			return nil, err
 		}
-		domainMap[domain.Name] = true
+	}
+
+	for _, tCompression := range tConfig.Compression {
+		err := vmConfigApplyCompression(&tCompression, vmConfig.Domains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tCache := range tConfig.Cache {
+		err := vmConfigApplyCache(&tCache, vmConfig.Domains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tHeaders := range tConfig.Headers {
+		err := vmConfigApplyHeaders(&tHeaders, vmConfig.Domains)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, portStr := range tConfig.Ports {
+		port, err := vmConfigGetPort(portStr)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range vmConfig.Ports {
+			if other.String() == port.String() {
+				return nil, fmt.Errorf("port '%s' is duplicated in this VM", port)
+			}
+		}
+		vmConfig.Ports = append(vmConfig.Ports, port)
 	}
 
 	if vmConfig.Hostname == "" {
 		if len(vmConfig.Domains) > 0 {
-			vmConfig.Hostname = vmConfig.Domains[0].Name
+			vmConfig.Hostname = strings.TrimPrefix(vmConfig.Domains[0].Name, "*.")
 		} else {
 			vmConfig.Hostname = "localhost.localdomain"
 		}
@@ -411,6 +1296,60 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.AutoRebuild = tConfig.AutoRebuild
 
+	for _, tRule := range tConfig.Firewall {
+		rule, err := vmConfigGetFirewallRule(&tRule)
+		if err != nil {
+			return nil, err
+		}
+		vmConfig.Firewall = append(vmConfig.Firewall, rule)
+	}
+
+	if len(vmConfig.Firewall) > VMFirewallMaxRules {
+		return nil, fmt.Errorf("too many firewall rules (%d, max is %d)", len(vmConfig.Firewall), VMFirewallMaxRules)
+	}
+
+	if tConfig.CloudInit != "" {
+		err = CloudInitCheckExtraConfig(tConfig.CloudInit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloud_init setting: %s", err)
+		}
+	}
+	vmConfig.CloudInit = tConfig.CloudInit
+
+	for _, tIntf := range tConfig.Interfaces {
+		intf, err := vmConfigGetInterface(&tIntf)
+		if err != nil {
+			return nil, err
+		}
+		vmConfig.Interfaces = append(vmConfig.Interfaces, intf)
+	}
+
+	if len(vmConfig.Interfaces) > VMInterfacesMax {
+		return nil, fmt.Errorf("too many interfaces (%d, max is %d)", len(vmConfig.Interfaces), VMInterfacesMax)
+	}
+
+	for _, tCheck := range tConfig.HealthChecks {
+		// defaults
+		if tCheck.Interval == "" {
+			tCheck.Interval = "1m"
+		}
+		if tCheck.Timeout == "" {
+			tCheck.Timeout = "10s"
+		}
+		if tCheck.Failures == 0 {
+			tCheck.Failures = 3
+		}
+		check, err := vmConfigGetHealthCheck(&tCheck, vmConfig.Domains)
+		if err != nil {
+			return nil, err
+		}
+		vmConfig.HealthChecks = append(vmConfig.HealthChecks, check)
+	}
+
+	if len(vmConfig.HealthChecks) > VMHealthChecksMax {
+		return nil, fmt.Errorf("too many health checks (%d, max is %d)", len(vmConfig.HealthChecks), VMHealthChecksMax)
+	}
+
 	var actions []*VMDoAction
 
 	for _, tDoAction := range tConfig.DoActions {
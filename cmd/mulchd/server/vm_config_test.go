@@ -0,0 +1,94 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestVMConfigGetDomain(t *testing.T) {
+	tests := []struct {
+		str    string
+		err    bool
+		name   string
+		prefix string
+		port   int
+		strip  bool
+	}{
+		{"example.com", false, "example.com", "", 80, false},
+		{"Example.COM->8080", false, "example.com", "", 8080, false},
+		{" example.com -> 8080 ", false, "example.com", "", 8080, false},
+		{"example.com/", false, "example.com", "", 80, false},
+		{"example.com/api->8080", false, "example.com", "/api", 8080, false},
+		{"example.com/API/", false, "example.com", "/API", 80, false},
+		{"example.com//api/../v2/->8080@strip", false, "example.com", "/v2", 8080, true},
+		{"*.preview.example.com/static", false, "*.preview.example.com", "/static", 80, false},
+		{"example.com@strip", true, "", "", 0, false},
+		{"example.com/a*b", true, "", "", 0, false},
+		{"example.com/a?b", true, "", "", 0, false},
+		{"/api->8080", true, "", "", 0, false},
+		{"example.com->http", true, "", "", 0, false},
+		{"example.com->80->81", true, "", "", 0, false},
+		{"example.com@unknown", true, "", "", 0, false},
+		{"example.com@a@b", true, "", "", 0, false},
+		{"*.com", true, "", "", 0, false},
+		{"a.*.example.com", true, "", "", 0, false},
+	}
+
+	for _, test := range tests {
+		domain, err := vmConfigGetDomain(test.str)
+		if test.err {
+			if err == nil {
+				t.Errorf("'%s': want an error", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': %s", test.str, err)
+			continue
+		}
+		if domain.Name != test.name || domain.PathPrefix != test.prefix || domain.DestinationPort != test.port || domain.StripPrefix != test.strip {
+			t.Errorf("'%s': got (%s, %s, %d, %t), want (%s, %s, %d, %t)", test.str,
+				domain.Name, domain.PathPrefix, domain.DestinationPort, domain.StripPrefix,
+				test.name, test.prefix, test.port, test.strip)
+		}
+		if domain.Pool != "" {
+			t.Errorf("'%s': unexpected pool '%s'", test.str, domain.Pool)
+		}
+	}
+}
+
+func TestVMConfigGetDomainPool(t *testing.T) {
+	tests := []struct {
+		str   string
+		err   bool
+		pool  string
+		strip bool
+	}{
+		{"shop.example.com@pool", false, common.DomainPoolRoundRobin, false},
+		{"shop.example.com->8080@pool:round-robin", false, common.DomainPoolRoundRobin, false},
+		{"shop.example.com@pool:least-conn", false, common.DomainPoolLeastConn, false},
+		{"shop.example.com/api->8080@pool:sticky,strip", false, common.DomainPoolSticky, true},
+		{"shop.example.com/api@strip, pool", false, common.DomainPoolRoundRobin, true},
+		{"shop.example.com@pool:random", true, "", false},
+		{"shop.example.com@pool:sticky:x", true, "", false},
+		{"shop.example.com@pool,", true, "", false},
+	}
+
+	for _, test := range tests {
+		domain, err := vmConfigGetDomain(test.str)
+		if test.err {
+			if err == nil {
+				t.Errorf("'%s': want an error", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': %s", test.str, err)
+			continue
+		}
+		if domain.Pool != test.pool || domain.StripPrefix != test.strip {
+			t.Errorf("'%s': got (%s, %t), want (%s, %t)", test.str, domain.Pool, domain.StripPrefix, test.pool, test.strip)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/OnitiFR/mulch/common"
@@ -22,6 +24,7 @@ type VMDatabaseEntry struct {
 	Name   *VMName
 	VM     *VM
 	Active bool
+	Weight int // traffic percentage of an inactive (canary) revision
 }
 
 // VMDatabase describes a persistent DataBase of VMs structures
@@ -32,6 +35,7 @@ type VMDatabaseEntry struct {
 type VMDatabase struct {
 	filename       string
 	domainFilename string
+	portFilename   string
 	db             map[string]*VMDatabaseEntry
 	maternityDB    map[string]*VMDatabaseEntry
 	mutex          sync.Mutex
@@ -40,10 +44,11 @@ type VMDatabase struct {
 }
 
 // NewVMDatabase instanciates a new VMDatabase
-func NewVMDatabase(filename string, domainFilename string, onUpdate updateCallback, config *AppConfig) (*VMDatabase, error) {
+func NewVMDatabase(filename string, domainFilename string, portFilename string, onUpdate updateCallback, config *AppConfig) (*VMDatabase, error) {
 	vmdb := &VMDatabase{
 		filename:       filename,
 		domainFilename: domainFilename,
+		portFilename:   portFilename,
 		db:             make(map[string]*VMDatabaseEntry),
 		maternityDB:    make(map[string]*VMDatabaseEntry),
 		onUpdate:       onUpdate,
@@ -67,31 +72,235 @@ func NewVMDatabase(filename string, domainFilename string, onUpdate updateCallba
 	return vmdb, nil
 }
 
+// add a VM domain to a pool domain, creating the pool if needed
+// canary is the traffic percentage of a canary revision (0 for
+// regular members), see genDomainsDBNormalizeWeights
+func genDomainsDBAddBackend(domains map[string]*common.Domain, domain *common.Domain, mode string, canary int) error {
+	pool, exist := domains[domain.Key()]
+	if exist == false {
+		// pool domain, shared by all its members (with the settings
+		// of this first member)
+		dup := *domain
+		dup.VMName = ""
+		dup.DestinationHost = ""
+		dup.Maintenance = true
+		dup.Pool = mode
+		dup.Backends = nil
+		pool = &dup
+		domains[domain.Key()] = pool
+	} else if pool.Pool != mode {
+		return fmt.Errorf("domain '%s' is duplicated in '%s' and '%s' VMs", domain.Key(), pool.VMName, domain.VMName)
+	}
+
+	pool.Backends = append(pool.Backends, &common.DomainBackend{
+		VMName:          domain.VMName,
+		DestinationHost: domain.DestinationHost,
+		DestinationPort: domain.DestinationPort,
+		Maintenance:     domain.Maintenance,
+		Weight:          canary,
+	})
+	// the pool is in maintenance only if all its members are
+	pool.Maintenance = pool.Maintenance && domain.Maintenance
+	return nil
+}
+
+// canary backends (non-zero weight) get their percentage of the pool
+// traffic, regular members equally share the rest
+func genDomainsDBNormalizeWeights(domain *common.Domain) {
+	canaryTotal := 0
+	regulars := 0
+	for _, backend := range domain.Backends {
+		if backend.Weight > 0 {
+			canaryTotal += backend.Weight
+		} else {
+			regulars++
+		}
+	}
+
+	if regulars == 0 || canaryTotal == 0 {
+		for _, backend := range domain.Backends {
+			backend.Weight = 100
+		}
+		return
+	}
+
+	// weights are in 1/100 of percent, canaries of multiple pool members
+	// can't take all the traffic
+	scale := 100
+	if canaryTotal > 99 {
+		scale = 100 * 99 / canaryTotal
+		canaryTotal = 99
+	}
+	regularWeight := (100 - canaryTotal) * 100 / regulars
+
+	for _, backend := range domain.Backends {
+		if backend.Weight > 0 {
+			backend.Weight = backend.Weight * scale
+		} else {
+			backend.Weight = regularWeight
+		}
+	}
+}
+
+// update VM related fields of a domain
+func genDomainsDBUpdateDomain(domain *common.Domain, entry *VMDatabaseEntry) {
+	domain.VMName = entry.Name.ID()
+	if domain.RedirectTo == "" {
+		domain.DestinationHost = entry.VM.LastIP
+	}
+	domain.Maintenance = entry.VM.HealthMaintenance || entry.VM.Maintenance
+}
+
 // build domain database, updated with each vm.LastIP (and name, as it's not
 // available at config file reading time)
+// Domains shared by the active revision and a canary revision (see
+// SetCanaryRevision) are weighted pools, and the canary revision gets a
+// preview domain for each proxied domain (ex: r4.test.com)
+// VMs in maintenance mode without any active revision (ex: during a
+// rebuild) keep their domains, serving the maintenance page.
 func (vmdb *VMDatabase) genDomainsDB() error {
 	domains := make(map[string]*common.Domain)
 
+	canaries := make(map[string]*VMDatabaseEntry)
+	actives := make(map[string]bool)
 	for _, entry := range vmdb.db {
+		if entry.Active == false && entry.Weight > 0 {
+			canaries[entry.Name.Name] = entry
+		}
+		if entry.Active == true {
+			actives[entry.Name.Name] = true
+		}
+	}
+
+	// sorted: a pool domain is a copy of its first member, pool members
+	// should share the same settings (see CheckDomainsConflicts), but
+	// this copy must not depend on map order
+	keys := make([]string, 0, len(vmdb.db))
+	for key := range vmdb.db {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		entry := vmdb.db[key]
 		if entry.Active == false {
 			continue
 		}
 		vm := entry.VM
+		canary := canaries[entry.Name.Name]
+		canaryDomains := make(map[string]*common.Domain)
+		if canary != nil {
+			for _, domain := range canary.VM.Config.Domains {
+				if domain.RedirectTo == "" {
+					genDomainsDBUpdateDomain(domain, canary)
+					canaryDomains[domain.Key()] = domain
+				}
+			}
+		}
+
 		for _, domain := range vm.Config.Domains {
-			domain.VMName = entry.Name.ID()
-			if domain.RedirectTo == "" {
-				domain.DestinationHost = vm.LastIP
+			genDomainsDBUpdateDomain(domain, entry)
+
+			canaryDomain := canaryDomains[domain.Key()]
+			if domain.RedirectTo != "" {
+				canaryDomain = nil
+			}
+			delete(canaryDomains, domain.Key())
+
+			if domain.Pool != "" || canaryDomain != nil {
+				// canary of a simple domain: keep users on the same revision
+				mode := domain.Pool
+				if mode == "" {
+					mode = common.DomainPoolSticky
+				}
+
+				err := genDomainsDBAddBackend(domains, domain, mode, 0)
+				if err != nil {
+					return err
+				}
+				if canaryDomain != nil {
+					err = genDomainsDBAddBackend(domains, canaryDomain, mode, canary.Weight)
+					if err != nil {
+						return err
+					}
+				}
+				continue
 			}
 
-			otherDomain, exist := domains[domain.Name]
+			otherDomain, exist := domains[domain.Key()]
 			if exist == true {
-				return fmt.Errorf("domain '%s' is duplicated in '%s' and '%s' VMs", domain.Name, otherDomain.VMName, domain.VMName)
+				return fmt.Errorf("domain '%s' is duplicated in '%s' and '%s' VMs", domain.Key(), otherDomain.VMName, domain.VMName)
 			}
 
-			domains[domain.Name] = domain
+			domains[domain.Key()] = domain
+		}
+
+		// new domains of the canary revision
+		for _, domain := range canaryDomains {
+			if domain.Pool != "" {
+				err := genDomainsDBAddBackend(domains, domain, domain.Pool, canary.Weight)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			otherDomain, exist := domains[domain.Key()]
+			if exist == true {
+				return fmt.Errorf("domain '%s' is duplicated in '%s' and '%s' VMs", domain.Key(), otherDomain.VMName, domain.VMName)
+			}
+			domains[domain.Key()] = domain
 		}
 	}
 
+	// maintenance page for VMs without active revision
+	for _, entry := range vmdb.db {
+		if actives[entry.Name.Name] || entry.VM == nil || entry.VM.Maintenance == false {
+			continue
+		}
+		for _, domain := range entry.VM.Config.Domains {
+			if _, exist := domains[domain.Key()]; exist == true {
+				continue
+			}
+			dup := *domain
+			dup.Backends = nil
+			genDomainsDBUpdateDomain(&dup, entry)
+			if dup.RedirectTo == "" {
+				dup.Pool = ""
+				dup.Maintenance = true
+			}
+			domains[dup.Key()] = &dup
+		}
+	}
+
+	// preview domains for canary revisions (real domains win), other
+	// inactive revisions may have been deactivated on purpose
+	for _, entry := range canaries {
+		for _, domain := range entry.VM.Config.Domains {
+			// no preview for redirects and wildcard domains
+			if domain.RedirectTo != "" || strings.HasPrefix(domain.Name, "*.") {
+				continue
+			}
+			preview := *domain
+			preview.Name = fmt.Sprintf("r%d.%s", entry.Name.Revision, domain.Name)
+			preview.Pool = ""
+			preview.Backends = nil
+			if _, exist := domains[preview.Key()]; exist == true {
+				continue
+			}
+			genDomainsDBUpdateDomain(&preview, entry)
+			// previews ignore manual maintenance, to check a revision before opening it
+			preview.Maintenance = entry.VM.HealthMaintenance
+			domains[preview.Key()] = &preview
+		}
+	}
+
+	for _, domain := range domains {
+		genDomainsDBNormalizeWeights(domain)
+		sort.Slice(domain.Backends, func(i, j int) bool {
+			return domain.Backends[i].VMName < domain.Backends[j].VMName
+		})
+	}
+
 	f, err := os.OpenFile(vmdb.domainFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
@@ -107,6 +316,43 @@ func (vmdb *VMDatabase) genDomainsDB() error {
 	return nil
 }
 
+// build port database, updated with each vm.LastIP (and name)
+func (vmdb *VMDatabase) genPortsDB() error {
+	ports := make(map[string]*common.Port)
+
+	for _, entry := range vmdb.db {
+		if entry.Active == false {
+			continue
+		}
+		vm := entry.VM
+		for _, port := range vm.Config.Ports {
+			port.VMName = entry.Name.ID()
+			port.DestinationHost = vm.LastIP
+
+			otherPort, exist := ports[port.String()]
+			if exist == true {
+				return fmt.Errorf("port '%s' is duplicated in '%s' and '%s' VMs", port, otherPort.VMName, port.VMName)
+			}
+
+			ports[port.String()] = port
+		}
+	}
+
+	f, err := os.OpenFile(vmdb.portFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&ports)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // This is done internaly, because it must be done with the mutex locked,
 // but we can't lock it here, since save() is called by functions that
 // are already locking the mutex.
@@ -128,6 +374,11 @@ func (vmdb *VMDatabase) save() error {
 		return err
 	}
 
+	err = vmdb.genPortsDB()
+	if err != nil {
+		return err
+	}
+
 	if vmdb.onUpdate != nil {
 		vmdb.onUpdate()
 	}
@@ -172,6 +423,19 @@ func (vmdb *VMDatabase) Update() error {
 	return vmdb.save()
 }
 
+// SetHealthMaintenance enables or disables the maintenance mode of VM
+// domains after health checks, returns true if the mode was changed
+func (vmdb *VMDatabase) SetHealthMaintenance(vm *VM, maintenance bool) (bool, error) {
+	vmdb.mutex.Lock()
+	defer vmdb.mutex.Unlock()
+
+	if vm.HealthMaintenance == maintenance {
+		return false, nil
+	}
+	vm.HealthMaintenance = maintenance
+	return true, vmdb.save()
+}
+
 // Delete the VM from the database using its name
 func (vmdb *VMDatabase) Delete(name *VMName) error {
 	entryToDelete, err := vmdb.GetEntryByName(name)
@@ -225,6 +489,10 @@ func (vmdb *VMDatabase) Add(vm *VM, name *VMName, active bool) error {
 		if err != nil {
 			return err
 		}
+		err = CheckPortsConflicts(vmdb, vm.Config.Ports, name.Name, vmdb.config)
+		if err != nil {
+			return err
+		}
 	}
 
 	vmdb.mutex.Lock()
@@ -512,6 +780,10 @@ func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 		if err != nil {
 			return err
 		}
+		err = CheckPortsConflicts(vmdb, vm.Config.Ports, name, vmdb.config)
+		if err != nil {
+			return err
+		}
 	}
 
 	vmdb.mutex.Lock()
@@ -524,6 +796,7 @@ func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 			} else {
 				entry.Active = false
 			}
+			entry.Weight = 0
 		}
 	}
 
@@ -533,3 +806,46 @@ func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 	}
 	return nil
 }
+
+// SetCanaryRevision sends a percentage of the traffic of the active
+// revision to another revision (weight 0 = no traffic)
+func (vmdb *VMDatabase) SetCanaryRevision(name string, revision int, weight int) error {
+	if weight < 0 || weight > 99 {
+		return fmt.Errorf("invalid weight %d (must be between 0 and 99)", weight)
+	}
+
+	// sanity checks (out of lock!)
+	vmName := NewVMName(name, revision)
+	entry, err := vmdb.GetEntryByName(vmName)
+	if err != nil {
+		return err
+	}
+	if entry.Active == true {
+		return fmt.Errorf("VM %s is the active revision", vmName)
+	}
+	_, err = vmdb.GetActiveEntryByName(name)
+	if err != nil {
+		return err
+	}
+	err = CheckDomainsConflicts(vmdb, entry.VM.Config.Domains, name, vmdb.config)
+	if err != nil {
+		return err
+	}
+
+	vmdb.mutex.Lock()
+	defer vmdb.mutex.Unlock()
+
+	// only one canary per VM
+	for _, other := range vmdb.db {
+		if other.Name.Name == name {
+			other.Weight = 0
+		}
+	}
+	entry.Weight = weight
+
+	err = vmdb.save()
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestGenDomainsDBNormalizeWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int // input: canary percentage, 0 for regular members
+		want    []int
+	}{
+		{"single", []int{0}, []int{100}},
+		{"regular pool", []int{0, 0, 0}, []int{100, 100, 100}},
+		{"canary only", []int{10}, []int{100}},
+		{"simple domain canary", []int{0, 10}, []int{9000, 1000}},
+		{"pool canary", []int{0, 0, 10}, []int{4500, 4500, 1000}},
+		{"multiple canaries", []int{0, 20, 30}, []int{5000, 2000, 3000}},
+		{"canaries over 99%", []int{0, 60, 60}, []int{100, 4920, 4920}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domain := &common.Domain{}
+			for _, weight := range test.weights {
+				domain.Backends = append(domain.Backends, &common.DomainBackend{Weight: weight})
+			}
+			genDomainsDBNormalizeWeights(domain)
+			for i, backend := range domain.Backends {
+				if backend.Weight != test.want[i] {
+					t.Errorf("backend %d: got weight %d, want %d", i, backend.Weight, test.want[i])
+				}
+			}
+		})
+	}
+}
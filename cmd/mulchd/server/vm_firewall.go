@@ -0,0 +1,376 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+	"gopkg.in/libvirt/libvirt-go.v5"
+)
+
+// firewall setting values
+const (
+	VMFirewallActionAllow  = "allow"
+	VMFirewallActionDeny   = "deny"
+	VMFirewallDirectionIn  = "in"
+	VMFirewallDirectionOut = "out"
+	VMFirewallProtocolTCP  = "tcp"
+	VMFirewallProtocolUDP  = "udp"
+	VMFirewallProtocolICMP = "icmp"
+	VMFirewallProtocolAll  = "all"
+)
+
+// VMFirewallMaxRules is the maximum number of firewall rules for a VM
+const VMFirewallMaxRules = 80
+
+const vmFirewallFilterSuffix = "-nwfilter"
+
+// Rules priorities: VM rules must be evaluated before mulch-filter
+// rules (-701) but after clean-traffic MAC anti-spoofing chain (-800)
+const (
+	vmFirewallIPv6DropPriority   = -799
+	vmFirewallIPv6AcceptPriority = -798
+	vmFirewallHostPriority       = -795
+	vmFirewallFirstPriority      = -790
+)
+
+// nwfilter protocol elements, IPv4 and IPv6
+var vmFirewallIPv6Protocols = map[string]string{
+	VMFirewallProtocolTCP:  "tcp-ipv6",
+	VMFirewallProtocolUDP:  "udp-ipv6",
+	VMFirewallProtocolICMP: "icmpv6",
+	VMFirewallProtocolAll:  "all-ipv6",
+}
+
+// String returns a human readable version of the rule
+func (rule *VMFirewallRule) String() string {
+	str := rule.Action + " " + rule.Direction + " " + rule.Protocol
+	if rule.PortStart != 0 {
+		str += "/" + strconv.Itoa(rule.PortStart)
+		if rule.PortEnd != 0 {
+			str += "-" + strconv.Itoa(rule.PortEnd)
+		}
+	}
+	if rule.CIDR != "" {
+		if rule.Direction == VMFirewallDirectionIn {
+			str += " from " + rule.CIDR
+		} else {
+			str += " to " + rule.CIDR
+		}
+	}
+	return str
+}
+
+// nwfilterAttributes returns match attributes for the rule
+func (rule *VMFirewallRule) nwfilterAttributes() string {
+	attrs := ""
+	if rule.PortStart != 0 {
+		attrs += fmt.Sprintf(" dstportstart='%d'", rule.PortStart)
+		if rule.PortEnd != 0 {
+			attrs += fmt.Sprintf(" dstportend='%d'", rule.PortEnd)
+		}
+	}
+	if rule.CIDR != "" {
+		parts := strings.Split(rule.CIDR, "/")
+		if rule.Direction == VMFirewallDirectionIn {
+			attrs += fmt.Sprintf(" srcipaddr='%s' srcipmask='%s'", parts[0], parts[1])
+		} else {
+			attrs += fmt.Sprintf(" dstipaddr='%s' dstipmask='%s'", parts[0], parts[1])
+		}
+	}
+	return attrs
+}
+
+// nwfilterXML returns nwfilter rules for this rule, for IPv4 or IPv6
+// (vmIPv6 is the VM IPv6 address, for anti-spoofing)
+func (rule *VMFirewallRule) nwfilterXML(priority int, ipv6 bool, vmIPv6 string) string {
+	var xml strings.Builder
+	attrs := rule.nwfilterAttributes()
+
+	ipElement := "ip"
+	ipProtocol := rule.Protocol
+	protocolElement := rule.Protocol
+	srcIP := "$IP"
+	if ipv6 {
+		ipElement = "ipv6"
+		if ipProtocol == VMFirewallProtocolICMP {
+			ipProtocol = "icmpv6"
+		}
+		protocolElement = vmFirewallIPv6Protocols[rule.Protocol]
+		srcIP = vmIPv6
+	}
+
+	fmt.Fprintf(&xml, "  <!-- %s -->\n", rule.String())
+	if rule.Action == VMFirewallActionAllow {
+		// layer 2 (ebtables) accept, so we can override mulch-filter drops
+		ipAttrs := attrs
+		if rule.Protocol != VMFirewallProtocolAll {
+			ipAttrs = fmt.Sprintf(" protocol='%s'", ipProtocol) + ipAttrs
+		}
+		if rule.Direction == VMFirewallDirectionOut {
+			ipAttrs = fmt.Sprintf(" srcipaddr='%s'", srcIP) + ipAttrs
+		}
+		fmt.Fprintf(&xml, "  <rule action='accept' direction='%s' priority='%d'>\n", rule.Direction, priority)
+		fmt.Fprintf(&xml, "    <%s%s/>\n", ipElement, ipAttrs)
+		fmt.Fprintf(&xml, "  </rule>\n")
+
+		// layer 3 (iptables) accept, tracking the connection
+		fmt.Fprintf(&xml, "  <rule action='accept' direction='%s' priority='%d'>\n", rule.Direction, priority)
+		fmt.Fprintf(&xml, "    <%s%s/>\n", protocolElement, attrs)
+		fmt.Fprintf(&xml, "  </rule>\n")
+	} else {
+		// only deny new connections, so replies are still allowed
+		fmt.Fprintf(&xml, "  <rule action='drop' direction='%s' priority='%d'>\n", rule.Direction, priority)
+		fmt.Fprintf(&xml, "    <%s state='NEW'%s/>\n", protocolElement, attrs)
+		fmt.Fprintf(&xml, "  </rule>\n")
+	}
+	return xml.String()
+}
+
+// VMFirewallFilterName returns the name of the VM nwfilter
+func VMFirewallFilterName(vmName *VMName, app *App) string {
+	return vmName.LibvirtDomainName(app) + vmFirewallFilterSuffix
+}
+
+// vmFirewallIPv6XML generates IPv6 rules: clean-traffic only allows IPv4
+// (and drops other L2 traffic), so we allow IPv6 here, with anti-spoofing
+func vmFirewallIPv6XML(vmIPv6 string, hostIPv6 string) string {
+	var xml strings.Builder
+
+	rule := func(action string, direction string, priority int, attrs string) {
+		fmt.Fprintf(&xml, "  <rule action='%s' direction='%s' priority='%d'>\n", action, direction, priority)
+		fmt.Fprintf(&xml, "    <ipv6%s/>\n", attrs)
+		fmt.Fprintf(&xml, "  </rule>\n")
+	}
+
+	fmt.Fprintf(&xml, "  <!-- IPv6: deny router advertisements and DHCPv6 answers -->\n")
+	rule("drop", "out", vmFirewallIPv6DropPriority, " protocol='icmpv6' type='134'")
+	rule("drop", "out", vmFirewallIPv6DropPriority, " protocol='udp' srcportstart='547'")
+
+	fmt.Fprintf(&xml, "  <!-- IPv6: allow our address, link-local and unspecified (DAD) -->\n")
+	rule("accept", "out", vmFirewallIPv6AcceptPriority, fmt.Sprintf(" srcipaddr='%s'", vmIPv6))
+	rule("accept", "out", vmFirewallIPv6AcceptPriority, " srcipaddr='fe80::' srcipmask='10'")
+	rule("accept", "out", vmFirewallIPv6AcceptPriority, " srcipaddr='::' srcipmask='128'")
+	rule("accept", "in", vmFirewallIPv6AcceptPriority, "")
+
+	fmt.Fprintf(&xml, "  <rule action='accept' direction='out' priority='%d'>\n", vmFirewallHostPriority)
+	fmt.Fprintf(&xml, "    <all-ipv6 dstipaddr='%s'/>\n", hostIPv6)
+	fmt.Fprintf(&xml, "  </rule>\n")
+	fmt.Fprintf(&xml, "  <rule action='accept' direction='in' priority='%d'>\n", vmFirewallHostPriority)
+	fmt.Fprintf(&xml, "    <all-ipv6 srcipaddr='%s'/>\n", hostIPv6)
+	fmt.Fprintf(&xml, "  </rule>\n")
+
+	return xml.String()
+}
+
+// vmFirewallGenXML generates the VM nwfilter, referencing our global
+// filter. Traffic with the host (DHCP, DNS, SSH, cloud-init,
+// phone-home…) is always allowed.
+func vmFirewallGenXML(filterName string, vm *VM, app *App) string {
+	var xml strings.Builder
+	hostIP := app.Libvirt.NetworkXML.IPs[0].Address
+
+	hostIPv6 := ""
+	ipv6Index := NetworkIPv6Index(app.Libvirt.NetworkXML)
+	if ipv6Index != -1 {
+		hostIPv6 = app.Libvirt.NetworkXML.IPs[ipv6Index].Address
+	}
+	ipv6 := vm.AssignedIPv6 != "" && hostIPv6 != ""
+
+	fmt.Fprintf(&xml, "<filter name='%s' chain='root'>\n", filterName)
+	fmt.Fprintf(&xml, "  <filterref filter='%s'/>\n", AppNWFilter)
+
+	fmt.Fprintf(&xml, "  <rule action='accept' direction='out' priority='%d'>\n", vmFirewallHostPriority)
+	fmt.Fprintf(&xml, "    <all dstipaddr='%s'/>\n", hostIP)
+	fmt.Fprintf(&xml, "  </rule>\n")
+	fmt.Fprintf(&xml, "  <rule action='accept' direction='in' priority='%d'>\n", vmFirewallHostPriority)
+	fmt.Fprintf(&xml, "    <all srcipaddr='%s'/>\n", hostIP)
+	fmt.Fprintf(&xml, "  </rule>\n")
+
+	if ipv6 {
+		xml.WriteString(vmFirewallIPv6XML(vm.AssignedIPv6, hostIPv6))
+	}
+
+	for i, rule := range vm.Config.Firewall {
+		ruleIPv6 := rule.CIDR != "" && IsIPv6(strings.Split(rule.CIDR, "/")[0])
+		if !ruleIPv6 {
+			xml.WriteString(rule.nwfilterXML(vmFirewallFirstPriority+i, false, ""))
+		}
+		if ipv6 && (rule.CIDR == "" || ruleIPv6) {
+			xml.WriteString(rule.nwfilterXML(vmFirewallFirstPriority+i, true, vm.AssignedIPv6))
+		}
+	}
+
+	fmt.Fprintf(&xml, "</filter>\n")
+	return xml.String()
+}
+
+// VMFirewallApply creates or updates the VM nwfilter using VM config
+// firewall rules (libvirt will update running VMs)
+func VMFirewallApply(vmName *VMName, vm *VM, app *App, log *Log) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	filterName := VMFirewallFilterName(vmName, app)
+	xml := vmFirewallGenXML(filterName, vm, app)
+
+	log.Tracef("defining nwfilter '%s' (%d rule(s))", filterName, len(vm.Config.Firewall))
+	filter, err := conn.NWFilterDefineXML(xml)
+	if err != nil {
+		return fmt.Errorf("VMFirewallApply: NWFilterDefineXML: %s", err)
+	}
+	defer filter.Free()
+
+	return nil
+}
+
+// vmFirewallSetFilterRef makes VM bridge interface reference the filter,
+// returning modified interfaces
+func vmFirewallSetFilterRef(domcfg *libvirtxml.Domain, filterName string) []*libvirtxml.DomainInterface {
+	var modified []*libvirtxml.DomainInterface
+	for index := range domcfg.Devices.Interfaces {
+		intf := &domcfg.Devices.Interfaces[index]
+		if intf.Alias == nil || intf.Alias.Name != VMNetworkAliasBridge {
+			continue
+		}
+		if intf.FilterRef == nil || intf.FilterRef.Filter == filterName {
+			continue
+		}
+		intf.FilterRef.Filter = filterName
+		modified = append(modified, intf)
+	}
+	return modified
+}
+
+// vmFirewallOrphanFilters returns VM nwfilters without any VM in database
+// (left by a failed deletion, for instance)
+func vmFirewallOrphanFilters(filterNames []string, app *App) []string {
+	var orphans []string
+	for _, name := range filterNames {
+		if !strings.HasPrefix(name, app.Config.VMPrefix) || !strings.HasSuffix(name, vmFirewallFilterSuffix) {
+			continue
+		}
+		nameID := strings.TrimSuffix(strings.TrimPrefix(name, app.Config.VMPrefix), vmFirewallFilterSuffix)
+		vm, _ := app.VMDB.GetByNameID(nameID)
+		if vm == nil {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans
+}
+
+// VMFirewallCleanup removes orphan VM nwfilters
+func VMFirewallCleanup(app *App, log *Log) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	filters, err := conn.ListAllNWFilters(0)
+	if err != nil {
+		return fmt.Errorf("VMFirewallCleanup: ListAllNWFilters: %s", err)
+	}
+
+	var names []string
+	for index := range filters {
+		name, err := filters[index].GetName()
+		if err == nil {
+			names = append(names, name)
+		}
+	}
+
+	orphans := make(map[string]bool)
+	for _, name := range vmFirewallOrphanFilters(names, app) {
+		orphans[name] = true
+	}
+
+	for index := range filters {
+		filter := &filters[index]
+		name, _ := filter.GetName()
+		if orphans[name] {
+			log.Infof("removing orphan nwfilter '%s'", name)
+			err := filter.Undefine()
+			if err != nil {
+				log.Errorf("can't delete nwfilter '%s': %s", name, err)
+			}
+		}
+		filter.Free()
+	}
+	return nil
+}
+
+// VMFirewallDelete removes the VM nwfilter (if it exists)
+func VMFirewallDelete(vmName *VMName, app *App, log *Log) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	filterName := VMFirewallFilterName(vmName, app)
+	filter, err := conn.LookupNWFilterByName(filterName)
+	if err != nil {
+		virtErr := err.(libvirt.Error)
+		if virtErr.Domain == libvirt.FROM_NWFILTER && virtErr.Code == libvirt.ERR_NO_NWFILTER {
+			return nil
+		}
+		return err
+	}
+	defer filter.Free()
+
+	log.Tracef("removing nwfilter '%s'", filterName)
+	return filter.Undefine()
+}
+
+// VMFirewallUpdate applies VM firewall rules, and attaches the VM
+// nwfilter to the VM interface if needed (VMs created before per-VM
+// firewall rules were using our global filter directly)
+func VMFirewallUpdate(vmName *VMName, vm *VM, app *App, log *Log) error {
+	err := VMFirewallApply(vmName, vm, app, log)
+	if err != nil {
+		return err
+	}
+
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if domain == nil {
+		return fmt.Errorf("VM %s: does not exists in libvirt", vmName.LibvirtDomainName(app))
+	}
+	defer domain.Free()
+
+	xmldoc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return err
+	}
+
+	filterName := VMFirewallFilterName(vmName, app)
+	for _, intf := range vmFirewallSetFilterRef(domcfg, filterName) {
+		log.Infof("attaching nwfilter '%s' to VM interface", filterName)
+		xml, err := intf.Marshal()
+		if err != nil {
+			return err
+		}
+
+		flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+		running, _ := VMIsRunning(vmName, app)
+		if running {
+			flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+		}
+		err = domain.UpdateDeviceFlags(xml, flags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+)
+
+func testFirewallApp(ipv6 bool) *App {
+	netcfg := &libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{{Address: "10.104.0.1"}},
+	}
+	if ipv6 {
+		netcfg.IPs = append(netcfg.IPs, libvirtxml.NetworkIP{Family: "ipv6", Address: "fd00:104::1"})
+	}
+	return &App{
+		Config:  &AppConfig{VMPrefix: "mulch-"},
+		Libvirt: &Libvirt{NetworkXML: netcfg},
+		VMDB:    &VMDatabase{db: make(map[string]*VMDatabaseEntry)},
+	}
+}
+
+func TestVMFirewallRuleString(t *testing.T) {
+	tests := []struct {
+		rule VMFirewallRule
+		want string
+	}{
+		{VMFirewallRule{Action: "allow", Direction: "in", Protocol: "tcp", PortStart: 22}, "allow in tcp/22"},
+		{VMFirewallRule{Action: "deny", Direction: "out", Protocol: "udp", PortStart: 1000, PortEnd: 2000, CIDR: "10.0.0.0/8"}, "deny out udp/1000-2000 to 10.0.0.0/8"},
+		{VMFirewallRule{Action: "allow", Direction: "in", Protocol: "all", CIDR: "192.168.1.0/24"}, "allow in all from 192.168.1.0/24"},
+	}
+	for _, test := range tests {
+		if got := test.rule.String(); got != test.want {
+			t.Errorf("got '%s', want '%s'", got, test.want)
+		}
+	}
+}
+
+func TestVMFirewallRuleXML(t *testing.T) {
+	allow := &VMFirewallRule{Action: "allow", Direction: "out", Protocol: "tcp", PortStart: 80, PortEnd: 443, CIDR: "10.0.0.0/8"}
+	xml := allow.nwfilterXML(-790, false, "")
+	for _, want := range []string{
+		"<rule action='accept' direction='out' priority='-790'>",
+		"<ip srcipaddr='$IP' protocol='tcp' dstportstart='80' dstportend='443' dstipaddr='10.0.0.0' dstipmask='8'/>",
+		"<tcp dstportstart='80' dstportend='443' dstipaddr='10.0.0.0' dstipmask='8'/>",
+	} {
+		if !strings.Contains(xml, want) {
+			t.Errorf("missing %s in:\n%s", want, xml)
+		}
+	}
+
+	deny := &VMFirewallRule{Action: "deny", Direction: "in", Protocol: "icmp"}
+	xml = deny.nwfilterXML(-789, true, "fd00:104::10")
+	if !strings.Contains(xml, "<rule action='drop' direction='in' priority='-789'>") || !strings.Contains(xml, "<icmpv6 state='NEW'/>") {
+		t.Errorf("invalid deny rule:\n%s", xml)
+	}
+
+	all := &VMFirewallRule{Action: "allow", Direction: "out", Protocol: "all"}
+	xml = all.nwfilterXML(-788, true, "fd00:104::10")
+	if !strings.Contains(xml, "<ipv6 srcipaddr='fd00:104::10'/>") || !strings.Contains(xml, "<all-ipv6/>") {
+		t.Errorf("invalid IPv6 rule:\n%s", xml)
+	}
+}
+
+func TestVMFirewallGenXML(t *testing.T) {
+	vm := &VM{
+		AssignedIPv6: "fd00:104::10",
+		Config: &VMConfig{
+			Firewall: []*VMFirewallRule{
+				{Action: "allow", Direction: "in", Protocol: "tcp", PortStart: 22},
+				{Action: "deny", Direction: "out", Protocol: "all", CIDR: "10.0.0.0/8"},
+				{Action: "deny", Direction: "out", Protocol: "all", CIDR: "2001:db8::/32"},
+			},
+		},
+	}
+
+	// IPv4 only network
+	xml := vmFirewallGenXML("mulch-test-nwfilter", vm, testFirewallApp(false))
+	if !strings.HasPrefix(xml, "<filter name='mulch-test-nwfilter' chain='root'>\n  <filterref filter='mulch-filter'/>\n") {
+		t.Errorf("invalid filter header:\n%s", xml)
+	}
+	if !strings.Contains(xml, "<all dstipaddr='10.104.0.1'/>") {
+		t.Errorf("host traffic must be allowed")
+	}
+	if strings.Contains(xml, "ipv6") || strings.Contains(xml, "2001:db8::") {
+		t.Errorf("no IPv6 rule expected:\n%s", xml)
+	}
+	if !strings.Contains(xml, "priority='-790'") || !strings.Contains(xml, "priority='-789'") || strings.Contains(xml, "priority='-788'") {
+		t.Errorf("invalid priorities:\n%s", xml)
+	}
+
+	// dual stack network
+	xml = vmFirewallGenXML("mulch-test-nwfilter", vm, testFirewallApp(true))
+	for _, want := range []string{
+		"<all-ipv6 dstipaddr='fd00:104::1'/>",
+		"<ipv6 srcipaddr='fd00:104::10'/>",
+		"<ipv6 protocol='icmpv6' type='134'/>",
+		"<tcp-ipv6 dstportstart='22'/>",
+		"<all-ipv6 state='NEW' dstipaddr='2001:db8::' dstipmask='32'/>",
+	} {
+		if !strings.Contains(xml, want) {
+			t.Errorf("missing %s in:\n%s", want, xml)
+		}
+	}
+	if strings.Contains(xml, "<all state='NEW' dstipaddr='2001:db8::'") || strings.Contains(xml, "<all-ipv6 state='NEW' dstipaddr='10.0.0.0'") {
+		t.Errorf("rule with a CIDR must only match its IP version:\n%s", xml)
+	}
+}
+
+func TestVMFirewallSetFilterRef(t *testing.T) {
+	domcfg := &libvirtxml.Domain{
+		Devices: &libvirtxml.DomainDeviceList{
+			Interfaces: []libvirtxml.DomainInterface{
+				{
+					Alias:     &libvirtxml.DomainAlias{Name: VMNetworkAliasBridge},
+					FilterRef: &libvirtxml.DomainInterfaceFilterRef{Filter: "mulch-test-nwfilter"},
+				},
+				{
+					Alias: &libvirtxml.DomainAlias{Name: "ua-mulch-intf-1"},
+				},
+			},
+		},
+	}
+
+	// rename (or VM created before per-VM firewall rules)
+	modified := vmFirewallSetFilterRef(domcfg, "mulch-test2-nwfilter")
+	if len(modified) != 1 || domcfg.Devices.Interfaces[0].FilterRef.Filter != "mulch-test2-nwfilter" {
+		t.Errorf("filterref not updated: %+v", domcfg.Devices.Interfaces[0].FilterRef)
+	}
+	if domcfg.Devices.Interfaces[1].FilterRef != nil {
+		t.Errorf("additional interfaces must not be modified")
+	}
+
+	if modified := vmFirewallSetFilterRef(domcfg, "mulch-test2-nwfilter"); len(modified) != 0 {
+		t.Errorf("already up to date, got %d modification(s)", len(modified))
+	}
+}
+
+func TestVMFirewallOrphanFilters(t *testing.T) {
+	app := testFirewallApp(false)
+	for _, name := range []*VMName{NewVMName("test", 0), NewVMName("web", 3)} {
+		app.VMDB.db[name.ID()] = &VMDatabaseEntry{Name: name, VM: &VM{}}
+	}
+
+	filters := []string{
+		"mulch-filter",
+		"clean-traffic",
+		VMFirewallFilterName(NewVMName("test", 0), app),
+		VMFirewallFilterName(NewVMName("web", 3), app),
+		VMFirewallFilterName(NewVMName("web", 2), app), // rebuild
+		VMFirewallFilterName(NewVMName("old", 0), app), // rename
+		"other-web-r2-nwfilter",
+	}
+	orphans := vmFirewallOrphanFilters(filters, app)
+	if strings.Join(orphans, ",") != "mulch-web-r2-nwfilter,mulch-old-nwfilter" {
+		t.Errorf("got %v", orphans)
+	}
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Health check types
+const (
+	VMHealthCheckHTTP = "http"
+	VMHealthCheckTCP  = "tcp"
+	VMHealthCheckSSH  = "ssh"
+)
+
+// Health check actions (when the failure threshold is reached)
+const (
+	VMHealthActionNone        = ""
+	VMHealthActionRestart     = "restart"
+	VMHealthActionMaintenance = "maintenance"
+)
+
+// VM health states
+const (
+	VMHealthUnknown   = "unknown"
+	VMHealthHealthy   = "healthy"
+	VMHealthFailing   = "failing" // failed, but below the threshold
+	VMHealthUnhealthy = "unhealthy"
+)
+
+// VMHealthRestartDelay is the delay before checking a VM again after a
+// restart (so it can start its services)
+const VMHealthRestartDelay = 1 * time.Minute
+
+// VMHealthChecksMax is the maximum number of health checks for a VM
+const VMHealthChecksMax = 8
+
+// VMHealthCheck is a periodic check of a service in the VM
+type VMHealthCheck struct {
+	Type     string
+	Domain   string // http: Host header
+	Port     int
+	Path     string // http
+	Command  string // ssh, executed as the super user
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures int // consecutive failures before the check is unhealthy
+	Action   string
+}
+
+// VMHealthCheckState is the current state of a health check
+type VMHealthCheckState struct {
+	State     string
+	Failures  int // consecutive failures
+	LastCheck time.Time
+	LastError string
+	nextCheck time.Time
+	running   bool
+}
+
+// HealthDatabase stores (in memory) health check states of VMs
+type HealthDatabase struct {
+	db         map[string][]*VMHealthCheckState
+	restarting map[string]bool
+	mutex      sync.Mutex
+	app        *App
+}
+
+// String returns a description of the check, ex: "http example.com:80/"
+func (check *VMHealthCheck) String() string {
+	switch check.Type {
+	case VMHealthCheckHTTP:
+		host := check.Domain
+		if host == "" {
+			host = "vm"
+		}
+		return fmt.Sprintf("http %s:%d%s", host, check.Port, check.Path)
+	case VMHealthCheckTCP:
+		return fmt.Sprintf("tcp %d", check.Port)
+	case VMHealthCheckSSH:
+		return fmt.Sprintf("ssh '%s'", check.Command)
+	}
+	return check.Type
+}
+
+// NewHealthDatabase instanciates a new HealthDatabase
+func NewHealthDatabase(app *App) *HealthDatabase {
+	return &HealthDatabase{
+		db:         make(map[string][]*VMHealthCheckState),
+		restarting: make(map[string]bool),
+		app:        app,
+	}
+}
+
+// Run the VM health checks loop
+func (hdb *HealthDatabase) Run() {
+	hdb.app.VMStateDB.WaitRestore()
+
+	for {
+		hdb.schedule()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// launch due health checks of active and running VMs
+func (hdb *HealthDatabase) schedule() {
+	type scheduled struct {
+		name    *VMName
+		vm      *VM
+		running bool
+	}
+
+	// VM database and libvirt queries are done without the lock, health
+	// checks results must not wait for libvirt
+	seen := make(map[string]bool)
+	var vms []*scheduled
+	for _, vmName := range hdb.app.VMDB.GetNames() {
+		entry, err := hdb.app.VMDB.GetEntryByName(vmName)
+		if err != nil || entry.Active == false {
+			continue
+		}
+		vm := entry.VM
+		if len(vm.Config.HealthChecks) == 0 {
+			continue
+		}
+		seen[vmName.ID()] = true
+
+		if vm.WIP != VMOperationNone {
+			continue
+		}
+		running, _ := VMIsRunning(vmName, hdb.app)
+		vms = append(vms, &scheduled{
+			name:    vmName,
+			vm:      vm,
+			running: running,
+		})
+	}
+
+	hdb.mutex.Lock()
+	defer hdb.mutex.Unlock()
+
+	// forget deleted (or inactive) VMs, and VMs without health checks
+	for id := range hdb.db {
+		if !seen[id] {
+			delete(hdb.db, id)
+		}
+	}
+
+	now := time.Now()
+	for _, item := range vms {
+		vm := item.vm
+		id := item.name.ID()
+
+		states := hdb.db[id]
+		if len(states) != len(vm.Config.HealthChecks) {
+			states = make([]*VMHealthCheckState, len(vm.Config.HealthChecks))
+			for i := range states {
+				states[i] = &VMHealthCheckState{State: VMHealthUnknown}
+			}
+			hdb.db[id] = states
+		}
+
+		if hdb.restarting[id] {
+			continue
+		}
+
+		if item.running == false {
+			for _, state := range states {
+				if state.running == false {
+					state.State = VMHealthUnknown
+					state.Failures = 0
+				}
+			}
+			continue
+		}
+
+		for index, check := range vm.Config.HealthChecks {
+			state := states[index]
+			if state.running || now.Before(state.nextCheck) {
+				continue
+			}
+			state.running = true
+			state.nextCheck = now.Add(check.Interval)
+			go hdb.check(item.name, vm, check, index)
+		}
+	}
+}
+
+// run a health check and process its result
+func (hdb *HealthDatabase) check(vmName *VMName, vm *VM, check *VMHealthCheck, index int) {
+	errC := vmHealthCheckRun(check, vm, hdb.app)
+
+	hdb.mutex.Lock()
+	defer hdb.mutex.Unlock()
+
+	states := hdb.db[vmName.ID()]
+	if index >= len(states) {
+		return
+	}
+	state := states[index]
+	state.running = false
+	state.LastCheck = time.Now()
+
+	if errC == nil {
+		if state.State == VMHealthUnhealthy {
+			hdb.app.Log.Infof("VM %s: health check '%s' is back to normal", vmName, check)
+			hdb.app.AlertSender.Send(&Alert{
+				Type:    AlertTypeGood,
+				Subject: "VM health",
+				Content: fmt.Sprintf("VM %s: health check '%s' is back to normal", vmName, check),
+			})
+		}
+		state.State = VMHealthHealthy
+		state.Failures = 0
+		state.LastError = ""
+		hdb.updateMaintenance(vmName, vm)
+		return
+	}
+
+	state.Failures++
+	state.LastError = errC.Error()
+	hdb.app.Log.Tracef("VM %s: health check '%s' failed (%d/%d): %s", vmName, check, state.Failures, check.Failures, errC)
+
+	if state.Failures < check.Failures {
+		if state.State != VMHealthUnhealthy {
+			state.State = VMHealthFailing
+		}
+		return
+	}
+
+	if state.State != VMHealthUnhealthy {
+		hdb.app.Log.Errorf("VM %s: health check '%s' failed %d times: %s", vmName, check, state.Failures, errC)
+		hdb.app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "VM health",
+			Content: fmt.Sprintf("VM %s: health check '%s' failed %d times: %s", vmName, check, state.Failures, errC),
+		})
+	}
+	state.State = VMHealthUnhealthy
+
+	switch check.Action {
+	case VMHealthActionMaintenance:
+		hdb.updateMaintenance(vmName, vm)
+	case VMHealthActionRestart:
+		// wait for another full set of failures before the next restart
+		state.Failures = 0
+		hdb.restarting[vmName.ID()] = true
+		go hdb.restart(vmName, vm)
+	}
+}
+
+// set VM domains in maintenance mode if any "maintenance" check is
+// unhealthy (mutex must be locked)
+func (hdb *HealthDatabase) updateMaintenance(vmName *VMName, vm *VM) {
+	maintenance := false
+	checks := vm.Config.HealthChecks
+	for index, state := range hdb.db[vmName.ID()] {
+		if index >= len(checks) {
+			break
+		}
+		check := checks[index]
+		if check.Action == VMHealthActionMaintenance && state.State == VMHealthUnhealthy {
+			maintenance = true
+		}
+	}
+
+	changed, err := hdb.app.VMDB.SetHealthMaintenance(vm, maintenance)
+	if err != nil {
+		hdb.app.Log.Error(err.Error())
+	}
+	if changed == false {
+		return
+	}
+
+	if maintenance {
+		hdb.app.Log.Warningf("VM %s: domains are now in maintenance mode", vmName)
+	} else {
+		hdb.app.Log.Infof("VM %s: domains are no more in maintenance mode", vmName)
+	}
+}
+
+// restart a VM after a failed health check
+func (hdb *HealthDatabase) restart(vmName *VMName, vm *VM) {
+	defer func() {
+		hdb.mutex.Lock()
+		delete(hdb.restarting, vmName.ID())
+		for _, state := range hdb.db[vmName.ID()] {
+			state.nextCheck = time.Now().Add(VMHealthRestartDelay)
+		}
+		hdb.mutex.Unlock()
+	}()
+
+	log := NewLog(vm.Config.Name, hdb.app.Hub, hdb.app.LogHistory)
+	log.Warningf("restarting %s (failed health check)", vmName)
+
+	operation := hdb.app.Operations.Add(&Operation{
+		Origin:        "[health-check]",
+		Action:        "restart",
+		Ressource:     "vm",
+		RessourceName: vmName.ID(),
+	})
+	defer hdb.app.Operations.Remove(operation)
+
+	err := VMStopByName(vmName, hdb.app, log)
+	if err != nil {
+		log.Errorf("unable to stop %s: %s", vmName, err)
+	}
+
+	err = VMStartByName(vmName, vm.SecretUUID, hdb.app, log)
+	if err != nil {
+		log.Errorf("unable to start %s: %s", vmName, err)
+		hdb.app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "VM health",
+			Content: fmt.Sprintf("VM %s: restart failed: %s", vmName, err),
+		})
+		return
+	}
+	log.Infof("%s restarted", vmName)
+}
+
+// GetStates returns a copy of the health check states of the VM (nil
+// if the VM have no health check or if no check was done yet)
+func (hdb *HealthDatabase) GetStates(vmName *VMName) []VMHealthCheckState {
+	hdb.mutex.Lock()
+	defer hdb.mutex.Unlock()
+
+	var res []VMHealthCheckState
+	for _, state := range hdb.db[vmName.ID()] {
+		res = append(res, *state)
+	}
+	return res
+}
+
+// GetGlobalState returns the global health state of a VM (the worst state
+// of its checks), or an empty string if the VM have no health check
+func (hdb *HealthDatabase) GetGlobalState(vmName *VMName) string {
+	states := hdb.GetStates(vmName)
+	if len(states) == 0 {
+		return ""
+	}
+
+	ranks := map[string]int{
+		VMHealthHealthy:   0,
+		VMHealthUnknown:   1,
+		VMHealthFailing:   2,
+		VMHealthUnhealthy: 3,
+	}
+
+	global := VMHealthHealthy
+	for _, state := range states {
+		if ranks[state.State] > ranks[global] {
+			global = state.State
+		}
+	}
+	return global
+}
+
+// execute a health check, returning nil if the check is successful
+func vmHealthCheckRun(check *VMHealthCheck, vm *VM, app *App) error {
+	if vm.LastIP == "" {
+		return errors.New("VM have no IP")
+	}
+	address := net.JoinHostPort(vm.LastIP, strconv.Itoa(check.Port))
+
+	switch check.Type {
+	case VMHealthCheckHTTP:
+		req, err := http.NewRequest("GET", "http://"+address+check.Path, nil)
+		if err != nil {
+			return err
+		}
+		if check.Domain != "" {
+			req.Host = check.Domain
+		}
+		client := &http.Client{
+			Timeout: check.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			return fmt.Errorf("HTTP status %s", res.Status)
+		}
+		return nil
+
+	case VMHealthCheckTCP:
+		conn, err := net.DialTimeout("tcp", address, check.Timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+
+	case VMHealthCheckSSH:
+		auth, err := app.SSHPairDB.GetPublicKeyAuth(vm.MulchSuperUserSSHKey)
+		if err != nil {
+			return err
+		}
+		sshConfig := &ssh.ClientConfig{
+			User:            app.Config.MulchSuperUser,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: hostKeyBilndTrustChecker,
+		}
+		return vmHealthCheckSSH(net.JoinHostPort(vm.LastIP, "22"), sshConfig, check.Command, check.Timeout)
+	}
+
+	return fmt.Errorf("unknown health check type '%s'", check.Type)
+}
+
+// run a command using SSH, the whole check (connection included) is
+// limited by the timeout
+func vmHealthCheckSSH(address string, sshConfig *ssh.ClientConfig, command string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	timeoutError := fmt.Errorf("timeout after %s", timeout)
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// interrupts handshake, session and command when reached
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		if time.Now().After(deadline) {
+			return timeoutError
+		}
+		return err
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		if time.Now().After(deadline) {
+			return timeoutError
+		}
+		return err
+	}
+	defer session.Close()
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+	err = session.Run(command)
+	if err != nil {
+		if time.Now().After(deadline) {
+			return timeoutError
+		}
+		msg := strings.TrimSpace(output.String())
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return fmt.Errorf("%s: %s", err, msg)
+	}
+	return nil
+}
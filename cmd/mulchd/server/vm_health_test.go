@@ -0,0 +1,212 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVMConfigGetHealthCheck(t *testing.T) {
+	domains := []*common.Domain{
+		{Name: "test.com", DestinationPort: 8080},
+		{Name: "www.test.com", RedirectTo: "test.com"},
+	}
+
+	tests := []struct {
+		name   string
+		check  tomlVMHealthCheck
+		err    string
+		port   int
+		path   string
+		domain string
+	}{
+		{name: "http default", check: tomlVMHealthCheck{Type: "http"}, port: 80, path: "/"},
+		{name: "http domain port", check: tomlVMHealthCheck{Type: "http", Domain: "test.com", Path: "/health"}, port: 8080, path: "/health", domain: "test.com"},
+		{name: "http explicit port", check: tomlVMHealthCheck{Type: "http", Domain: "test.com", Port: 81}, port: 81, path: "/", domain: "test.com"},
+		{name: "http redirect domain", check: tomlVMHealthCheck{Type: "http", Domain: "www.test.com"}, err: "not a (proxied) domain"},
+		{name: "http wildcard domain", check: tomlVMHealthCheck{Type: "http", Domain: "*.test.com"}, err: "wildcard"},
+		{name: "http invalid path", check: tomlVMHealthCheck{Type: "http", Path: "health"}, err: "invalid path"},
+		{name: "http command", check: tomlVMHealthCheck{Type: "http", Command: "true"}, err: "only available for ssh"},
+		{name: "tcp", check: tomlVMHealthCheck{Type: "tcp", Port: 5432}, port: 5432},
+		{name: "tcp without port", check: tomlVMHealthCheck{Type: "tcp"}, err: "needs a 'port'"},
+		{name: "tcp with path", check: tomlVMHealthCheck{Type: "tcp", Port: 5432, Path: "/"}, err: "only needs a 'port'"},
+		{name: "ssh", check: tomlVMHealthCheck{Type: "ssh", Command: "true"}},
+		{name: "ssh without command", check: tomlVMHealthCheck{Type: "ssh"}, err: "needs a 'command'"},
+		{name: "ssh with port", check: tomlVMHealthCheck{Type: "ssh", Command: "true", Port: 22}, err: "only needs a 'command'"},
+		{name: "invalid type", check: tomlVMHealthCheck{Type: "icmp"}, err: "invalid healthcheck type"},
+		{name: "invalid port", check: tomlVMHealthCheck{Type: "tcp", Port: 70000}, err: "invalid port"},
+		{name: "short interval", check: tomlVMHealthCheck{Type: "tcp", Port: 1, Interval: "5s"}, err: "invalid interval"},
+		{name: "timeout over interval", check: tomlVMHealthCheck{Type: "tcp", Port: 1, Timeout: "1m"}, err: "invalid timeout"},
+		{name: "no failures", check: tomlVMHealthCheck{Type: "tcp", Port: 1, Failures: -1}, err: "invalid failures"},
+		{name: "invalid action", check: tomlVMHealthCheck{Type: "tcp", Port: 1, Action: "reboot"}, err: "invalid healthcheck action"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tCheck := test.check
+			if tCheck.Interval == "" {
+				tCheck.Interval = "1m"
+			}
+			if tCheck.Timeout == "" {
+				tCheck.Timeout = "10s"
+			}
+			if tCheck.Failures == 0 {
+				tCheck.Failures = 3
+			}
+
+			check, err := vmConfigGetHealthCheck(&tCheck, domains)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want '%s'", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.Port != test.port || check.Path != test.path || check.Domain != test.domain {
+				t.Errorf("got port %d, path '%s', domain '%s', want %d, '%s', '%s'", check.Port, check.Path, check.Domain, test.port, test.path, test.domain)
+			}
+		})
+	}
+}
+
+func TestVMHealthCheckRunHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			if req.Host != "test.com" {
+				res.WriteHeader(http.StatusBadRequest)
+			}
+		case "/redirect":
+			http.Redirect(res, req, "/missing", http.StatusFound)
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	vm := &VM{LastIP: serverURL.Hostname()}
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"/ok", true},
+		{"/redirect", true}, // redirects are not followed
+		{"/missing", false},
+	}
+
+	for _, test := range tests {
+		check := &VMHealthCheck{
+			Type:    VMHealthCheckHTTP,
+			Domain:  "test.com",
+			Port:    port,
+			Path:    test.path,
+			Timeout: 5 * time.Second,
+		}
+		err := vmHealthCheckRun(check, vm, nil)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want success %t", test.path, err, test.ok)
+		}
+	}
+
+	if err := vmHealthCheckRun(&VMHealthCheck{Type: VMHealthCheckHTTP}, &VM{}, nil); err == nil {
+		t.Error("VM without IP must fail")
+	}
+}
+
+func TestVMHealthCheckRunTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	vm := &VM{LastIP: "127.0.0.1"}
+	check := &VMHealthCheck{Type: VMHealthCheckTCP, Port: port, Timeout: 5 * time.Second}
+
+	if err := vmHealthCheckRun(check, vm, nil); err != nil {
+		t.Errorf("open port: %s", err)
+	}
+
+	listener.Close()
+	if err := vmHealthCheckRun(check, vm, nil); err == nil {
+		t.Error("closed port must fail")
+	}
+}
+
+func TestVMHealthCheckSSHTimeout(t *testing.T) {
+	// accepts connections, but never talks
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// the check must close its connection
+		conn.Read(make([]byte, 4096))
+		conn.Read(make([]byte, 4096))
+		conn.Close()
+		close(closed)
+	}()
+
+	sshConfig := &ssh.ClientConfig{
+		User:            "admin",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	start := time.Now()
+	err = vmHealthCheckSSH(listener.Addr().String(), sshConfig, "true", 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("check took %s", elapsed)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("connection was not closed after the timeout")
+	}
+}
+
+func TestHealthDatabaseGetGlobalState(t *testing.T) {
+	vmName := NewVMName("test", 0)
+
+	tests := []struct {
+		states []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{VMHealthHealthy, VMHealthHealthy}, VMHealthHealthy},
+		{[]string{VMHealthHealthy, VMHealthUnknown}, VMHealthUnknown},
+		{[]string{VMHealthFailing, VMHealthUnknown}, VMHealthFailing},
+		{[]string{VMHealthHealthy, VMHealthUnhealthy, VMHealthFailing}, VMHealthUnhealthy},
+	}
+
+	for _, test := range tests {
+		hdb := &HealthDatabase{db: make(map[string][]*VMHealthCheckState)}
+		for _, state := range test.states {
+			hdb.db[vmName.ID()] = append(hdb.db[vmName.ID()], &VMHealthCheckState{State: state})
+		}
+		if got := hdb.GetGlobalState(vmName); got != test.want {
+			t.Errorf("%v: got '%s', want '%s'", test.states, got, test.want)
+		}
+	}
+}
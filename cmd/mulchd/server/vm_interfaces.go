@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+)
+
+// VMNetworkAliasInterfacePrefix is the alias prefix of additional interfaces
+// (ua-mulch-intf-0, ua-mulch-intf-1, …)
+const VMNetworkAliasInterfacePrefix = "ua-mulch-intf-"
+
+// VMInterfacesMax is the maximum number of additional interfaces for a VM
+const VMInterfacesMax = 8
+
+// String returns a description of the interface, ex: "network storage 10.0.0.5/24"
+func (intf *VMInterface) String() string {
+	res := "network " + intf.Network
+	if intf.Bridge != "" {
+		res = "bridge " + intf.Bridge
+	}
+	if intf.IP != "" {
+		res = res + " " + intf.IP
+	}
+	return res
+}
+
+// MACs returns all MAC addresses of the VM (main interface first)
+func (vm *VM) MACs() []string {
+	macs := []string{vm.AssignedMAC}
+	return append(macs, vm.AssignedInterfacesMACs...)
+}
+
+// assign a MAC address to each additional interface of the VM
+func vmAssignInterfacesMACs(vm *VM, app *App) {
+	vm.AssignedInterfacesMACs = nil
+	for range vm.Config.Interfaces {
+		for {
+			mac := RandomUniqueMAC(app)
+			unique := true
+			for _, other := range vm.MACs() {
+				if other == mac {
+					unique = false
+				}
+			}
+			if unique {
+				vm.AssignedInterfacesMACs = append(vm.AssignedInterfacesMACs, mac)
+				break
+			}
+		}
+	}
+}
+
+// generate libvirt domain interfaces for additional VM interfaces, checking
+// that the requested networks and bridges exist on the host
+func vmInterfacesDomainXML(vm *VM, app *App) ([]libvirtxml.DomainInterface, error) {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vm.AssignedInterfacesMACs) != len(vm.Config.Interfaces) {
+		return nil, fmt.Errorf("found %d MAC(s) for %d interface(s)", len(vm.AssignedInterfacesMACs), len(vm.Config.Interfaces))
+	}
+
+	var res []libvirtxml.DomainInterface
+	for index, intf := range vm.Config.Interfaces {
+		domIntf := libvirtxml.DomainInterface{
+			Alias: &libvirtxml.DomainAlias{
+				Name: VMNetworkAliasInterfacePrefix + strconv.Itoa(index),
+			},
+			MAC: &libvirtxml.DomainInterfaceMAC{
+				Address: vm.AssignedInterfacesMACs[index],
+			},
+			Model: &libvirtxml.DomainInterfaceModel{
+				Type: "virtio",
+			},
+		}
+
+		if intf.Network != "" {
+			network, errL := conn.LookupNetworkByName(intf.Network)
+			if errL != nil {
+				return nil, fmt.Errorf("interface %d: network '%s': %s", index, intf.Network, errL)
+			}
+			network.Free()
+			domIntf.Source = &libvirtxml.DomainInterfaceSource{
+				Network: &libvirtxml.DomainInterfaceSourceNetwork{
+					Network: intf.Network,
+				},
+			}
+		} else {
+			_, errI := net.InterfaceByName(intf.Bridge)
+			if errI != nil {
+				return nil, fmt.Errorf("interface %d: bridge '%s': %s", index, intf.Bridge, errI)
+			}
+			domIntf.Source = &libvirtxml.DomainInterfaceSource{
+				Bridge: &libvirtxml.DomainInterfaceSourceBridge{
+					Bridge: intf.Bridge,
+				},
+			}
+		}
+
+		res = append(res, domIntf)
+	}
+
+	return res, nil
+}
+
+// generate mulch_intf calls for the VM interfaces setup script (see
+// ci-user-data.yml template), one line per additional interface
+func cloudInitInterfaces(vm *VM) string {
+	var lines []string
+	for index, intf := range vm.Config.Interfaces {
+		if index >= len(vm.AssignedInterfacesMACs) {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("mulch_intf '%s' '%s'", vm.AssignedInterfacesMACs[index], intf.IP))
+	}
+	// keep YAML block indentation for each line
+	return strings.Join(lines, "\n      ")
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// VM provisioning methods (see seed 'provisioning' setting)
+const (
+	// cloud-init fetches its configuration from mulchd (HTTP)
+	SeedProvisioningCloudInit = "cloud-init"
+	// cloud-init reads its configuration from a NoCloud ISO (cdrom)
+	SeedProvisioningConfigDrive = "config-drive"
+	// Ignition (Fedora CoreOS, Flatcar, …) reads its configuration from QEMU fw_cfg
+	SeedProvisioningIgnition = "ignition"
+)
+
+// VMStorageAliasConfigDrive is the alias of the config-drive cdrom
+const VMStorageAliasConfigDrive = "ua-mulch-config-drive"
+
+// IgnitionFwCfgNames are the QEMU fw_cfg entries read by Ignition, the
+// config is passed with both names (Fedora CoreOS uses the first one,
+// Flatcar the second one)
+var IgnitionFwCfgNames = []string{"opt/com.coreos/config", "opt/org.flatcar-linux/config"}
+
+// IsValidSeedProvisioning returns true if the provisioning method is known
+func IsValidSeedProvisioning(provisioning string) bool {
+	switch provisioning {
+	case SeedProvisioningCloudInit, SeedProvisioningConfigDrive, SeedProvisioningIgnition:
+		return true
+	}
+	return false
+}
+
+// store content as a volume in the disk pool, so it's available to QEMU
+func vmProvisioningUploadVolume(content []byte, volName string, app *App, log *Log) error {
+	tmpfile, err := ioutil.TempFile(app.Config.TempPath, "mulch-provisioning")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.Write(content)
+	tmpfile.Close()
+	if err != nil {
+		return err
+	}
+
+	// no error check, volume may be a leftover of a failed creation
+	app.Libvirt.DeleteVolume(volName, app.Libvirt.Pools.Disks)
+
+	return app.Libvirt.UploadFileToLibvirt(
+		app.Libvirt.Pools.Disks,
+		app.Libvirt.Pools.DisksXML,
+		app.Config.GetTemplateFilepath("volume.xml"),
+		tmpfile.Name(),
+		volName,
+		log)
+}
+
+// vmAddConfigDrive generates a NoCloud ISO (cloud-init meta-data and user-data)
+// and attaches it to the domain as a cdrom
+func vmAddConfigDrive(vm *VM, vmName *VMName, domcfg *libvirtxml.Domain, app *App, log *Log) error {
+	metaData, userData, err := CloudInitDataGen(vm, vmName, app)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(app.Config.TempPath, "mulch-config-drive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = ioutil.WriteFile(path.Join(tmpDir, "meta-data"), []byte(metaData), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(tmpDir, "user-data"), []byte(userData), 0600)
+	if err != nil {
+		return err
+	}
+
+	isoFile := path.Join(tmpDir, "config-drive.iso")
+	args := []string{"-output", isoFile, "-volid", "cidata", "-joliet", "-rock",
+		path.Join(tmpDir, "user-data"), path.Join(tmpDir, "meta-data")}
+
+	var output []byte
+	errCmd := fmt.Errorf("no ISO tool found (genisoimage, mkisofs or xorriso needed)")
+	for _, tool := range [][]string{{"genisoimage"}, {"mkisofs"}, {"xorriso", "-as", "mkisofs"}} {
+		_, errL := exec.LookPath(tool[0])
+		if errL != nil {
+			continue
+		}
+		output, errCmd = exec.Command(tool[0], append(tool[1:], args...)...).CombinedOutput()
+		break
+	}
+	if errCmd != nil {
+		return fmt.Errorf("config-drive ISO: %s (%s)", errCmd, strings.TrimSpace(string(output)))
+	}
+
+	content, err := ioutil.ReadFile(isoFile)
+	if err != nil {
+		return err
+	}
+
+	volName := vmName.ID() + "-config-drive.iso"
+	log.Infof("creating config-drive '%s'", volName)
+	err = vmProvisioningUploadVolume(content, volName, app, log)
+	if err != nil {
+		return err
+	}
+	vm.ProvisioningVolume = volName
+
+	domcfg.Devices.Disks = append(domcfg.Devices.Disks, libvirtxml.DomainDisk{
+		Device: "cdrom",
+		Driver: &libvirtxml.DomainDiskDriver{
+			Name: "qemu",
+			Type: "raw",
+		},
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: app.Libvirt.Pools.DisksXML.Target.Path + "/" + volName,
+			},
+		},
+		Target: &libvirtxml.DomainDiskTarget{
+			Dev: "hdc",
+			Bus: "ide",
+		},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		Alias: &libvirtxml.DomainAlias{
+			Name: VMStorageAliasConfigDrive,
+		},
+	})
+
+	return nil
+}
+
+// vmAddIgnition generates an Ignition config and passes it to the
+// domain using QEMU fw_cfg
+func vmAddIgnition(vm *VM, vmName *VMName, domcfg *libvirtxml.Domain, app *App, log *Log) error {
+	if vm.Config.CloudInit != "" {
+		return errors.New("cloud_init setting is not supported by ignition seeds")
+	}
+
+	content, err := ignitionConfigGen(vm, vmName, app)
+	if err != nil {
+		return err
+	}
+
+	volName := vmName.ID() + "-ignition.ign"
+	log.Infof("creating ignition config '%s'", volName)
+	err = vmProvisioningUploadVolume(content, volName, app, log)
+	if err != nil {
+		return err
+	}
+	vm.ProvisioningVolume = volName
+
+	if domcfg.QEMUCommandline == nil {
+		domcfg.QEMUCommandline = &libvirtxml.DomainQEMUCommandline{}
+	}
+	filename := app.Libvirt.Pools.DisksXML.Target.Path + "/" + volName
+	for _, name := range IgnitionFwCfgNames {
+		domcfg.QEMUCommandline.Args = append(domcfg.QEMUCommandline.Args,
+			libvirtxml.DomainQEMUCommandlineArg{Value: "-fw_cfg"},
+			libvirtxml.DomainQEMUCommandlineArg{Value: "name=" + name + ",file=" + filename},
+		)
+	}
+
+	return nil
+}
+
+// Ignition config (spec 3.1.0), only what we need
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []ignitionUser `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []ignitionFile `json:"files"`
+		Links []ignitionLink `json:"links,omitempty"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []ignitionUnit `json:"units"`
+	} `json:"systemd"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	Gecos             string   `json:"gecos,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionFile struct {
+	Path      string `json:"path"`
+	Mode      int    `json:"mode"`
+	Overwrite bool   `json:"overwrite"`
+	Contents  struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+type ignitionLink struct {
+	Path      string `json:"path"`
+	Target    string `json:"target"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents,omitempty"` // empty: unit is a file
+}
+
+func ignitionNewFile(filepath string, mode int, content string) ignitionFile {
+	file := ignitionFile{
+		Path:      filepath,
+		Mode:      mode,
+		Overwrite: true,
+	}
+	file.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(content))
+	return file
+}
+
+// ignitionConfigGen generates the Ignition equivalent of ci-user-data.yml,
+// cloud_init VM setting is not supported
+func ignitionConfigGen(vm *VM, vmName *VMName, app *App) ([]byte, error) {
+	variables, err := cloudInitVariables(vm, vmName, app)
+	if err != nil {
+		return nil, err
+	}
+
+	userData, err := cloudInitUserData(app.Config.GetTemplateFilepath("ci-user-data.yml"), variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return ignitionConfigFromUserData(vm, variables, userData)
+}
+
+// converts cloud-init user-data: files (mulch.env, phone home, …) are
+// shared with cloud-init seeds, systemd services are enabled (cloud-init
+// runcmd is not supported), users are created like in the template
+func ignitionConfigFromUserData(vm *VM, variables map[string]interface{}, userData []byte) ([]byte, error) {
+	str := func(name string) string {
+		return fmt.Sprintf("%v", variables[name])
+	}
+
+	var userConfig struct {
+		WriteFiles []struct {
+			Path        string `yaml:"path"`
+			Content     string `yaml:"content"`
+			Permissions string `yaml:"permissions"`
+		} `yaml:"write_files"`
+	}
+	err := yaml.Unmarshal(userData, &userConfig)
+	if err != nil {
+		return nil, fmt.Errorf("user-data template: %s", err)
+	}
+
+	config := &ignitionConfig{}
+	config.Ignition.Version = "3.1.0"
+
+	config.Passwd.Users = []ignitionUser{
+		ignitionUser{
+			Name:              str("_MULCH_SUPER_USER"),
+			Gecos:             "Mulch Control and Command admin account",
+			Groups:            []string{"wheel"},
+			SSHAuthorizedKeys: []string{str("_SSH_PUBKEY")},
+		},
+		ignitionUser{
+			Name:              str("_APP_USER"),
+			Gecos:             "Application user account",
+			SSHAuthorizedKeys: []string{str("_SSH_PUBKEY")},
+		},
+	}
+
+	// fqdn field tells mulchd that the first boot provisioning is done
+	// (cloud-init phone_home module)
+	phoneFirstBoot := fmt.Sprintf("#!/bin/bash\nid=%s\n/usr/bin/curl -s -d \"instance_id=$id&fqdn=%s\" -X POST %s\n",
+		vm.SecretUUID, vm.Config.Hostname, str("_PHONE_HOME_URL"))
+
+	config.Storage.Files = []ignitionFile{
+		ignitionNewFile("/etc/hostname", 0644, vm.Config.Hostname+"\n"),
+		ignitionNewFile("/etc/sudoers.d/mulch", 0440, str("_MULCH_SUPER_USER")+" ALL=(ALL) NOPASSWD:ALL\n"),
+		ignitionNewFile("/usr/local/bin/phone_home_first_boot", 0755, phoneFirstBoot),
+	}
+
+	for _, file := range userConfig.WriteFiles {
+		mode := 0644
+		if file.Permissions != "" {
+			perm, err := strconv.ParseUint(file.Permissions, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("user-data template: %s: invalid permissions '%s'", file.Path, file.Permissions)
+			}
+			mode = int(perm)
+		}
+		config.Storage.Files = append(config.Storage.Files, ignitionNewFile(file.Path, mode, file.Content))
+
+		if path.Dir(file.Path) == "/etc/systemd/system" && path.Ext(file.Path) == ".service" {
+			config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+				Name:    path.Base(file.Path),
+				Enabled: true,
+			})
+		}
+	}
+
+	// written before the network is up, so used since the first boot
+	if str("_IPV6_DUID") != "" {
+		config.Storage.Files = append(config.Storage.Files,
+			ignitionNewFile("/etc/systemd/networkd.conf.d/mulch-duid.conf", 0644, DUIDNetworkdConfig))
+	}
+
+	if vm.Config.Timezone != "" {
+		config.Storage.Links = []ignitionLink{
+			ignitionLink{
+				Path:      "/etc/localtime",
+				Target:    "../usr/share/zoneinfo/" + vm.Config.Timezone,
+				Overwrite: true,
+			},
+		}
+	}
+
+	config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+		Name:    "phone_home_first_boot.service",
+		Enabled: true,
+		Contents: "[Unit]\nDescription=Phone home on first boot\nConditionFirstBoot=yes\nAfter=network-online.target sshd.service\nWants=network-online.target\n\n" +
+			"[Service]\nType=oneshot\nRemainAfterExit=yes\nExecStart=/usr/local/bin/phone_home_first_boot\nUser=root\n\n" +
+			"[Install]\nWantedBy=multi-user.target\n",
+	})
+
+	return json.MarshalIndent(config, "", "  ")
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIgnitionConfigFromUserData(t *testing.T) {
+	vm := &VM{
+		SecretUUID: "0b4a1a2e-4c1f-4e43-a0cb-1b2a8d3b0a55",
+		Config: &VMConfig{
+			Hostname: "test.example.com",
+			Timezone: "Europe/Paris",
+			Env:      map[string]string{"TEST1": "foo"},
+		},
+	}
+	variables := map[string]interface{}{
+		"_INSTANCE_ID":      vm.SecretUUID,
+		"_SSH_PUBKEY":       "ssh-ed25519 AAAA test",
+		"_PHONE_HOME_URL":   "http://10.104.0.1:8585/phone",
+		"_PACKAGE_UPGRADE":  false,
+		"_MULCH_SUPER_USER": "mulch-cc",
+		"_TIMEZONE":         vm.Config.Timezone,
+		"_APP_USER":         "app",
+		"_VM_NAME":          "test",
+		"_VM_REVISION":      2,
+		"_KEY_DESC":         "user@host",
+		"_MULCH_VERSION":    "1.0",
+		"_VM_INIT_DATE":     "2020-07-01T00:00:00Z",
+		"_DOMAINS":          "test.example.com",
+		"_DOMAIN_FIRST":     "test.example.com",
+		"_MULCH_PROXY_IP":   "10.104.0.1",
+		"__EXTRA_ENV":       cloudInitExtraEnv(vm.Config.Env),
+		"__INTERFACES":      "",
+		"_IPV6_DUID":        "00:03:00:01:52:54:00:12:34:56",
+	}
+
+	userData, err := cloudInitUserData("../../../etc/templates/ci-user-data.yml", variables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ignitionConfigFromUserData(vm, variables, userData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config ignitionConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Ignition.Version != "3.1.0" {
+		t.Errorf("got version %s", config.Ignition.Version)
+	}
+	if len(config.Passwd.Users) != 2 || config.Passwd.Users[0].Name != "mulch-cc" || config.Passwd.Users[1].Name != "app" {
+		t.Errorf("invalid users: %+v", config.Passwd.Users)
+	}
+
+	files := make(map[string]ignitionFile)
+	for _, file := range config.Storage.Files {
+		files[file.Path] = file
+	}
+	fileContent := func(filepath string) string {
+		file, exists := files[filepath]
+		if !exists {
+			t.Errorf("missing file %s", filepath)
+			return ""
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(file.Contents.Source, "data:;base64,"))
+		if err != nil {
+			t.Errorf("%s: %s", filepath, err)
+		}
+		return string(data)
+	}
+
+	// shared with cloud-init (template)
+	env := fileContent("/etc/mulch.env")
+	for _, line := range []string{"export _VM_NAME='test'", "export _VM_REVISION='2'", "export _BACKUP='/mnt/backup'", `export TEST1="foo"`} {
+		if !strings.Contains(env, line) {
+			t.Errorf("mulch.env: missing %s", line)
+		}
+	}
+	phoneHome := fileContent("/usr/local/bin/phone_home")
+	if !strings.Contains(phoneHome, "id='"+vm.SecretUUID+"'") || !strings.Contains(phoneHome, "-X POST http://10.104.0.1:8585/phone") {
+		t.Errorf("invalid phone_home script:\n%s", phoneHome)
+	}
+	if files["/usr/local/bin/phone_home"].Mode != 0755 || files["/etc/mulch.env"].Mode != 0644 {
+		t.Errorf("invalid modes")
+	}
+	if files["/etc/systemd/system/phone_home.service"].Mode != 0644 {
+		t.Errorf("invalid default mode")
+	}
+
+	// ignition only
+	if fileContent("/etc/hostname") != "test.example.com\n" {
+		t.Errorf("invalid hostname")
+	}
+	if !strings.Contains(fileContent("/usr/local/bin/phone_home_first_boot"), "fqdn=test.example.com") {
+		t.Errorf("invalid first boot phone home")
+	}
+	if files["/etc/sudoers.d/mulch"].Mode != 0440 {
+		t.Errorf("invalid sudoers mode")
+	}
+	fileContent("/etc/systemd/networkd.conf.d/mulch-duid.conf")
+
+	if len(config.Storage.Links) != 1 || config.Storage.Links[0].Target != "../usr/share/zoneinfo/Europe/Paris" {
+		t.Errorf("invalid links: %+v", config.Storage.Links)
+	}
+
+	units := make(map[string]ignitionUnit)
+	for _, unit := range config.Systemd.Units {
+		units[unit.Name] = unit
+	}
+	for _, name := range []string{"phone_home.service", "mulch_interfaces.service", "phone_home_first_boot.service"} {
+		if unit, exists := units[name]; !exists || !unit.Enabled {
+			t.Errorf("unit %s must be enabled", name)
+		}
+	}
+	if units["phone_home.service"].Contents != "" || units["phone_home_first_boot.service"].Contents == "" {
+		t.Errorf("invalid unit contents")
+	}
+}
+
+func TestIgnitionConfigFromUserDataErrors(t *testing.T) {
+	vm := &VM{Config: &VMConfig{}}
+	tests := []string{
+		"write_files: [",
+		"write_files:\n  - path: /a\n    permissions: 'rw'\n",
+	}
+	for _, userData := range tests {
+		_, err := ignitionConfigFromUserData(vm, map[string]interface{}{}, []byte(userData))
+		if err == nil {
+			t.Errorf("%q: want an error", userData)
+		}
+	}
+}
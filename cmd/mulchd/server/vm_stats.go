@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+	libvirt "gopkg.in/libvirt/libvirt-go.v5"
+)
+
+// VMStatsInterval is the sampling interval of VM resource usage
+const VMStatsInterval = 10 * time.Second
+
+// VMStatsHistory is how long VM stats samples are kept
+const VMStatsHistory = 6 * time.Hour
+
+// VMStatsSaveInterval is the interval between two saves of the database
+const VMStatsSaveInterval = 5 * time.Minute
+
+// VMStatsSample is a sample of VM resource usage (rates are computed
+// from the previous sample)
+type VMStatsSample struct {
+	Time          time.Time
+	CPUPercent    float64
+	MemoryRSS     uint64
+	MemoryMax     uint64
+	DiskReadRate  float64
+	DiskWriteRate float64
+	NetRxRate     float64
+	NetTxRate     float64
+}
+
+// raw libvirt counters, needed to compute rates
+type vmStatsCounters struct {
+	time    time.Time
+	cpuTime uint64
+	rdBytes int64
+	wrBytes int64
+	rxBytes int64
+	txBytes int64
+}
+
+// host devices of a VM (from its libvirt XML, read once per boot)
+type vmStatsDevices struct {
+	disks      []string // ex: vda
+	interfaces []string // ex: vnet3
+}
+
+// VMStatsDatabase stores a rolling history of VM resource usage, sampled
+// from libvirt, and saved to disk from time to time
+type VMStatsDatabase struct {
+	filename string
+	db       map[string][]*VMStatsSample // VM ID
+	counters map[string]*vmStatsCounters // VM ID
+	devices  map[string]*vmStatsDevices  // VM ID (sampling goroutine only)
+	mutex    sync.Mutex
+	app      *App
+}
+
+// NewVMStatsDatabase instanciates a new VMStatsDatabase
+func NewVMStatsDatabase(filename string, app *App) (*VMStatsDatabase, error) {
+	vmsdb := &VMStatsDatabase{
+		filename: filename,
+		db:       make(map[string][]*VMStatsSample),
+		counters: make(map[string]*vmStatsCounters),
+		devices:  make(map[string]*vmStatsDevices),
+		app:      app,
+	}
+
+	// if the file exists, load it (stats are not worth a startup failure)
+	if _, err := os.Stat(vmsdb.filename); err == nil {
+		err = vmsdb.load()
+		if err != nil {
+			app.Log.Errorf("VM stats: %s: %s, discarding history", vmsdb.filename, err)
+			vmsdb.db = make(map[string][]*VMStatsSample)
+		}
+	}
+
+	// save the file to check if it's writable
+	err := vmsdb.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return vmsdb, nil
+}
+
+// mutex must be locked, the file is replaced only when fully written
+func (vmsdb *VMStatsDatabase) save() error {
+	tmpFilename := vmsdb.filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&vmsdb.db)
+	errC := f.Close()
+	if err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	return os.Rename(tmpFilename, vmsdb.filename)
+}
+
+func (vmsdb *VMStatsDatabase) load() error {
+	f, err := os.Open(vmsdb.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&vmsdb.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run the VM stats sampling loop
+func (vmsdb *VMStatsDatabase) Run() {
+	lastSave := time.Now()
+	for {
+		vmsdb.update()
+
+		if time.Since(lastSave) > VMStatsSaveInterval {
+			vmsdb.mutex.Lock()
+			err := vmsdb.save()
+			vmsdb.mutex.Unlock()
+			if err != nil {
+				vmsdb.app.Log.Errorf("VM stats: %s", err)
+			}
+			lastSave = time.Now()
+		}
+
+		time.Sleep(VMStatsInterval)
+	}
+}
+
+// sample all VMs and remove old samples (and deleted VMs)
+func (vmsdb *VMStatsDatabase) update() {
+	vmNames := vmsdb.app.VMDB.GetNames()
+
+	samples := make(map[string]*VMStatsSample)
+	counters := make(map[string]*vmStatsCounters)
+	for _, vmName := range vmNames {
+		id := vmName.ID()
+
+		vmsdb.mutex.Lock()
+		previous := vmsdb.counters[id]
+		vmsdb.mutex.Unlock()
+
+		if previous == nil {
+			// VM (re)started, devices may have changed
+			delete(vmsdb.devices, id)
+		}
+
+		sample, current, err := vmsdb.sampleVM(vmName, previous)
+		if err != nil {
+			vmsdb.app.Log.Tracef("VM stats: %s: %s", vmName, err)
+			continue
+		}
+		if sample == nil {
+			continue
+		}
+		samples[id] = sample
+		counters[id] = current
+	}
+
+	vmsdb.mutex.Lock()
+	defer vmsdb.mutex.Unlock()
+
+	valid := make(map[string]bool)
+	for _, vmName := range vmNames {
+		valid[vmName.ID()] = true
+	}
+
+	for id := range vmsdb.devices {
+		if counters[id] == nil {
+			delete(vmsdb.devices, id)
+		}
+	}
+
+	limit := time.Now().Add(-VMStatsHistory)
+	for id := range vmsdb.db {
+		if !valid[id] {
+			delete(vmsdb.db, id)
+		}
+	}
+
+	for id, sample := range samples {
+		vmsdb.db[id] = append(vmsdb.db[id], sample)
+	}
+
+	for id, history := range vmsdb.db {
+		first := 0
+		for first < len(history) && history[first].Time.Before(limit) {
+			first++
+		}
+		if first > 0 {
+			vmsdb.db[id] = append([]*VMStatsSample(nil), history[first:]...)
+		}
+	}
+
+	// VMs without counters (down, …) will restart from scratch
+	vmsdb.counters = counters
+}
+
+// sample a VM (previous counters may be nil), the sample is nil if the
+// VM is not running
+func (vmsdb *VMStatsDatabase) sampleVM(vmName *VMName, previous *vmStatsCounters) (*VMStatsSample, *vmStatsCounters, error) {
+	domain, err := vmsdb.app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(vmsdb.app))
+	if err != nil {
+		return nil, nil, err
+	}
+	if domain == nil {
+		return nil, nil, errors.New("can't find domain")
+	}
+	defer domain.Free()
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return nil, nil, err
+	}
+	if state != libvirt.DOMAIN_RUNNING {
+		return nil, nil, nil
+	}
+
+	info, err := domain.GetInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	current := &vmStatsCounters{
+		time:    now,
+		cpuTime: info.CpuTime,
+	}
+	sample := &VMStatsSample{
+		Time:      now,
+		MemoryMax: info.MaxMem * 1024,
+	}
+
+	memStats, err := domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err == nil {
+		for _, memStat := range memStats {
+			if memStat.Tag == int32(libvirt.DOMAIN_MEMORY_STAT_RSS) {
+				sample.MemoryRSS = memStat.Val * 1024
+			}
+		}
+	}
+
+	id := vmName.ID()
+	devices := vmsdb.devices[id]
+	if devices == nil {
+		devices, err = vmStatsGetDevices(domain)
+		if err != nil {
+			return nil, nil, err
+		}
+		vmsdb.devices[id] = devices
+	}
+
+	for _, disk := range devices.disks {
+		block, errB := domain.BlockStats(disk)
+		if errB == nil {
+			current.rdBytes += block.RdBytes
+			current.wrBytes += block.WrBytes
+		}
+	}
+
+	for _, dev := range devices.interfaces {
+		intf, errI := domain.InterfaceStats(dev)
+		if errI == nil {
+			current.rxBytes += intf.RxBytes
+			current.txBytes += intf.TxBytes
+		}
+	}
+
+	if previous == nil {
+		return sample, current, nil
+	}
+
+	elapsed := current.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 || current.cpuTime < previous.cpuTime {
+		// VM was restarted (counters were reset)
+		return sample, current, nil
+	}
+
+	rate := func(cur int64, prev int64) float64 {
+		if cur < prev {
+			return 0
+		}
+		return float64(cur-prev) / elapsed
+	}
+
+	sample.CPUPercent = float64(current.cpuTime-previous.cpuTime) / 1e9 / elapsed * 100
+	sample.DiskReadRate = rate(current.rdBytes, previous.rdBytes)
+	sample.DiskWriteRate = rate(current.wrBytes, previous.wrBytes)
+	sample.NetRxRate = rate(current.rxBytes, previous.rxBytes)
+	sample.NetTxRate = rate(current.txBytes, previous.txBytes)
+
+	return sample, current, nil
+}
+
+// returns disk and network interface devices of a running VM
+func vmStatsGetDevices(domain *libvirt.Domain) (*vmStatsDevices, error) {
+	xmldoc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+
+	return vmStatsDomainDevices(domcfg), nil
+}
+
+// all disks (except CD-ROMs, …) and network interfaces of the domain
+func vmStatsDomainDevices(domcfg *libvirtxml.Domain) *vmStatsDevices {
+	devices := &vmStatsDevices{}
+	if domcfg.Devices == nil {
+		return devices
+	}
+
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Device != "" && disk.Device != "disk" {
+			continue
+		}
+		if disk.Target != nil && disk.Target.Dev != "" {
+			devices.disks = append(devices.disks, disk.Target.Dev)
+		}
+	}
+
+	for _, intf := range domcfg.Devices.Interfaces {
+		if intf.Target != nil && intf.Target.Dev != "" {
+			devices.interfaces = append(devices.interfaces, intf.Target.Dev)
+		}
+	}
+	return devices
+}
+
+// GetSamples returns VM samples since a time (zero time = all samples)
+func (vmsdb *VMStatsDatabase) GetSamples(vmName *VMName, since time.Time) []VMStatsSample {
+	vmsdb.mutex.Lock()
+	defer vmsdb.mutex.Unlock()
+
+	var samples []VMStatsSample
+	for _, sample := range vmsdb.db[vmName.ID()] {
+		if sample.Time.Before(since) {
+			continue
+		}
+		samples = append(samples, *sample)
+	}
+	return samples
+}
+
+// GetLatest returns the latest sample of the VM, if any
+func (vmsdb *VMStatsDatabase) GetLatest(vmName *VMName) *VMStatsSample {
+	vmsdb.mutex.Lock()
+	defer vmsdb.mutex.Unlock()
+
+	history := vmsdb.db[vmName.ID()]
+	if len(history) == 0 {
+		return nil
+	}
+	sample := *history[len(history)-1]
+	return &sample
+}
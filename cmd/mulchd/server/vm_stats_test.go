@@ -0,0 +1,89 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+)
+
+// log to a running hub, without clients
+func testLog() *Log {
+	hub := NewHub(false)
+	go hub.Run()
+	return NewLog("", hub, NewLogHistory(100))
+}
+
+func TestVMStatsDomainDevices(t *testing.T) {
+	domcfg := &libvirtxml.Domain{
+		Devices: &libvirtxml.DomainDeviceList{
+			Disks: []libvirtxml.DomainDisk{
+				{Device: "disk", Target: &libvirtxml.DomainDiskTarget{Dev: "vda"}},
+				{Device: "cdrom", Target: &libvirtxml.DomainDiskTarget{Dev: "sda"}},
+				{Target: &libvirtxml.DomainDiskTarget{Dev: "vdb"}},
+				{Device: "disk"},
+			},
+			Interfaces: []libvirtxml.DomainInterface{
+				{Target: &libvirtxml.DomainInterfaceTarget{Dev: "vnet3"}},
+				{Target: &libvirtxml.DomainInterfaceTarget{Dev: "vnet4"}},
+				{},
+			},
+		},
+	}
+
+	devices := vmStatsDomainDevices(domcfg)
+	if len(devices.disks) != 2 || devices.disks[0] != "vda" || devices.disks[1] != "vdb" {
+		t.Errorf("got disks %v, want [vda vdb]", devices.disks)
+	}
+	if len(devices.interfaces) != 2 || devices.interfaces[0] != "vnet3" || devices.interfaces[1] != "vnet4" {
+		t.Errorf("got interfaces %v, want [vnet3 vnet4]", devices.interfaces)
+	}
+
+	if devices := vmStatsDomainDevices(&libvirtxml.Domain{}); len(devices.disks) != 0 {
+		t.Error("no devices expected")
+	}
+}
+
+func TestVMStatsDatabaseSaveLoad(t *testing.T) {
+	filename := path.Join(t.TempDir(), "vm-stats.db")
+	app := &App{Log: testLog()}
+
+	vmsdb, err := NewVMStatsDatabase(filename, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmName := NewVMName("test", 1)
+	now := time.Now().Truncate(time.Second)
+	vmsdb.db[vmName.ID()] = []*VMStatsSample{{Time: now, CPUPercent: 42}}
+	err = vmsdb.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file was not renamed")
+	}
+
+	vmsdb, err = NewVMStatsDatabase(filename, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := vmsdb.GetLatest(vmName)
+	if latest == nil || latest.CPUPercent != 42 || !latest.Time.Equal(now) {
+		t.Errorf("got %+v", latest)
+	}
+	if samples := vmsdb.GetSamples(vmName, now.Add(time.Second)); len(samples) != 0 {
+		t.Errorf("got %d samples, want 0", len(samples))
+	}
+
+	// an unreadable file is discarded
+	os.WriteFile(filename, []byte("{\"truncated"), 0644)
+	vmsdb, err = NewVMStatsDatabase(filename, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmsdb.GetLatest(vmName) != nil {
+		t.Error("history must be empty")
+	}
+}
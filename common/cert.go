@@ -0,0 +1,38 @@
+package common
+
+import "time"
+
+// Certificate sources
+const (
+	CertSourceACME     = "acme"
+	CertSourceImported = "imported"
+)
+
+// CertRenewDirectory is the directory of the ACME certificate cache where
+// mulchd requests forced renewals to mulch-proxy (a file per domain, listing
+// key types to renew, one per line)
+const CertRenewDirectory = "renew"
+
+// ProxyCertError is the last certificate issuance error of a domain,
+// recorded by mulch-proxy (JSON map by domain)
+type ProxyCertError struct {
+	Time  time.Time // first failure (since the last successful issuance)
+	Last  time.Time // latest failure (updated at most hourly)
+	Error string
+}
+
+// APICert describes a TLS certificate served by mulch-proxy
+// (NotAfter is zero if there's only an issuance error)
+type APICert struct {
+	Domain    string
+	Source    string
+	KeyType   string
+	Issuer    string
+	Staging   bool
+	NotAfter  time.Time
+	Error     string
+	ErrorTime time.Time // first failure
+}
+
+// APICertList is a list of certificates for the API
+type APICertList []APICert
@@ -2,6 +2,27 @@ package common
 
 import "net/http/httputil"
 
+// Domain pool load balancing modes
+const (
+	DomainPoolRoundRobin = "round-robin"
+	DomainPoolLeastConn  = "least-conn"
+	DomainPoolSticky     = "sticky"
+)
+
+// Response compression algorithms (Content-Encoding values)
+const (
+	CompressionBrotli = "br"
+	CompressionGzip   = "gzip"
+)
+
+// Header rule actions
+const (
+	HeaderActionSet         = "set"
+	HeaderActionSetIfAbsent = "set-if-absent" // keep the value sent by the VM, if any
+	HeaderActionAdd         = "add"
+	HeaderActionRemove      = "remove"
+)
+
 // Domain defines a route for the reverse-proxy request handler
 type Domain struct {
 	Name            string
@@ -11,9 +32,83 @@ type Domain struct {
 	DestinationHost string
 	DestinationPort int
 	RedirectToHTTPS bool
+	Maintenance     bool
+	PathPrefix      string           // route only this path prefix (ex: /api), empty for the whole domain
+	StripPrefix     bool             // remove PathPrefix from forwarded requests
+	Pool            string           // load balancing mode, if the domain is shared by multiple VMs
+	Backends        []*DomainBackend // pool members
+	Access          *DomainAccess    // access control, nil if none
+	Limits          *DomainLimits    // rate and connection limits, nil if none
+	Compression     *DomainCompression
+	Cache           *DomainCache
+	Headers         *DomainHeaders
 
 	// used internaly by Mulch reverse proxy server
 	ReverseProxy *httputil.ReverseProxy `json:"-"`
 	TargetURL    string
 	Chained      bool
 }
+
+// Key returns the unique name of the route (domain and path prefix)
+func (domain *Domain) Key() string {
+	return domain.Name + domain.PathPrefix
+}
+
+// DomainBackend is a VM of a domain pool
+type DomainBackend struct {
+	VMName          string
+	DestinationHost string
+	DestinationPort int
+	Maintenance     bool
+	Weight          int // relative weight in the pool (0 = 100)
+}
+
+// DomainAccess restricts access to a domain, checked by the reverse proxy
+// before any backend is involved
+type DomainAccess struct {
+	Allow     []string // CIDRs, all clients allowed if empty
+	Deny      []string // CIDRs, checked first
+	BasicAuth []string // htpasswd lines (user:hash), no auth if empty
+	Realm     string   // basic auth realm
+}
+
+// DomainLimits protects a domain from abusive clients, checked by the
+// reverse proxy (0 = unlimited)
+type DomainLimits struct {
+	Rate             int    // requests per second for the whole domain
+	Burst            int    // max requests in a spike (bucket size)
+	IPRate           int    // requests per second per client IP
+	IPBurst          int    // max requests in a spike per client IP
+	MaxConnections   int    // concurrent (in-flight) requests for the whole domain
+	IPMaxConnections int    // concurrent (in-flight) requests per client IP
+	MaxBodySize      uint64 // request body size, in bytes
+}
+
+// DomainCompression enables response compression by the reverse proxy
+type DomainCompression struct {
+	Algorithms []string // in preference order (Compression* constants)
+	MinSize    uint64   // don't compress smaller responses (if size is known)
+	Types      []string // MIME types, or prefixes (ex: "text/")
+}
+
+// DomainCache enables a shared HTTP cache in the reverse proxy, honoring
+// Cache-Control (only explicitly fresh responses are cached)
+type DomainCache struct {
+	MaxSize       uint64 // total size of cached responses, in bytes
+	MaxObjectSize uint64 // max size of a cached response, in bytes
+	Disk          bool   // store responses on disk instead of memory
+}
+
+// DomainHeaders modifies headers in the reverse proxy, rules are applied
+// in order
+type DomainHeaders struct {
+	Request  []DomainHeaderRule // before forwarding the request to the VM
+	Response []DomainHeaderRule // before sending the VM response to the client
+}
+
+// DomainHeaderRule is a header modification
+type DomainHeaderRule struct {
+	Action string // HeaderAction* constants
+	Name   string // canonical form
+	Value  string // unused for remove
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MetricsContentType is the Prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsWriter is a (very) small Prometheus text format writer
+type MetricsWriter struct {
+	buf bytes.Buffer
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Header writes HELP and TYPE lines of a metric family
+func (mw *MetricsWriter) Header(name string, metricType string, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&mw.buf, "# TYPE %s %s\n", name, metricType)
+}
+
+// Sample writes a sample, labels are name/value pairs
+func (mw *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		var parts []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			parts = append(parts, labels[i]+`="`+metricsLabelEscaper.Replace(labels[i+1])+`"`)
+		}
+		mw.buf.WriteString("{" + strings.Join(parts, ",") + "}")
+	}
+	mw.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// WriteTo writes all metrics to out
+func (mw *MetricsWriter) WriteTo(out io.Writer) (int64, error) {
+	return mw.buf.WriteTo(out)
+}
+
+// MetricsBool converts a boolean to a sample value
+func MetricsBool(val bool) float64 {
+	if val {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	mw := &MetricsWriter{}
+	mw.Header("mulch_vms", "gauge", "Number of VMs, per libvirt state.")
+	mw.Sample("mulch_vms", 3, "state", "up")
+	mw.Sample("mulch_vms", 0, "state", "down")
+	mw.Header("mulch_start_time_seconds", "gauge", "Start time.")
+	mw.Sample("mulch_start_time_seconds", 1593604800)
+	mw.Header("mulch_vm_cpu_seconds_total", "counter", "CPU time.")
+	mw.Sample("mulch_vm_cpu_seconds_total", 12.5, "vm", "test", "revision", "2")
+	mw.Sample("mulch_escaped", MetricsBool(true), "label", "a\"b\\c\nd")
+	mw.Sample("mulch_odd_labels", MetricsBool(false), "vm", "test", "ignored")
+
+	want := `# HELP mulch_vms Number of VMs, per libvirt state.
+# TYPE mulch_vms gauge
+mulch_vms{state="up"} 3
+mulch_vms{state="down"} 0
+# HELP mulch_start_time_seconds Start time.
+# TYPE mulch_start_time_seconds gauge
+mulch_start_time_seconds 1.5936048e+09
+# HELP mulch_vm_cpu_seconds_total CPU time.
+# TYPE mulch_vm_cpu_seconds_total counter
+mulch_vm_cpu_seconds_total{vm="test",revision="2"} 12.5
+mulch_escaped{label="a\"b\\c\nd"} 1
+mulch_odd_labels{vm="test"} 0
+`
+
+	var out bytes.Buffer
+	n, err := mw.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("got %d bytes written, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,24 @@
+package common
+
+import "strconv"
+
+// Port protocols
+const (
+	PortProtocolTCP = "tcp"
+	PortProtocolUDP = "udp"
+)
+
+// Port defines a raw TCP/UDP port published by the reverse-proxy
+type Port struct {
+	ListenPort      int
+	Protocol        string
+	VMName          string
+	DestinationHost string
+	DestinationPort int
+}
+
+// String returns the public side of the port ("5432/tcp"), also used as
+// a key in the port database
+func (port *Port) String() string {
+	return strconv.Itoa(port.ListenPort) + "/" + port.Protocol
+}
@@ -9,8 +9,13 @@ type APISeedStatus struct {
 	Ready        bool
 	URL          string
 	Seeder       string
+	Uploaded     bool
+	Parent       string
+	Provisioning string
 	Size         uint64
 	StatusTime   time.Time
 	Status       string
 	LastModified time.Time
+	Version      string
+	Versions     []string
 }
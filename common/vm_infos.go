@@ -16,6 +16,7 @@ type APIVMInfos struct {
 	BackupDiskSizeMB    uint64
 	Hostname            string
 	Domains             []string
+	Ports               []string
 	SuperUser           string
 	AppUser             string
 	InitDate            time.Time
@@ -24,5 +25,11 @@ type APIVMInfos struct {
 	AuthorKey           string
 	Locked              bool
 	AssignedIPv4        string
+	AssignedIPv6        string
 	AssignedMAC         string
+	Firewall            []string
+	Interfaces          []string
+	HealthChecks        []string
+	HealthMaintenance   bool
+	Maintenance         bool
 }
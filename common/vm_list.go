@@ -5,15 +5,19 @@ type APIVMListEntries []APIVMListEntry
 
 // APIVMListEntry is an entry for a VM
 type APIVMListEntry struct {
-	Name      string
-	Revision  int
-	Active    bool
-	LastIP    string `json:"last_ip"`
-	State     string
-	Locked    bool
-	WIP       string
-	SuperUser string
-	AppUser   string
+	Name        string
+	Revision    int
+	Active      bool
+	LastIP      string `json:"last_ip"`
+	State       string
+	Locked      bool
+	Maintenance bool // domains in maintenance mode (manual or health check)
+	WIP         string
+	SuperUser   string
+	AppUser     string
+	Health      string
+	Pools       []string // shared domains, with member count
+	Weight      int      // traffic percentage of a canary revision
 }
 
 // APIVMBasicListEntries is a light variant of APIVMListEntries
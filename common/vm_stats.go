@@ -0,0 +1,27 @@
+package common
+
+import "time"
+
+// APIVMStatsSample is a sample of VM resource usage
+type APIVMStatsSample struct {
+	Time          time.Time
+	CPUPercent    float64 // 100% = one host CPU
+	MemoryRSS     uint64  // bytes
+	MemoryMax     uint64  // bytes
+	DiskReadRate  float64 // bytes/s
+	DiskWriteRate float64 // bytes/s
+	NetRxRate     float64 // bytes/s
+	NetTxRate     float64 // bytes/s
+}
+
+// APIVMStats is the resource usage history of a VM
+type APIVMStats struct {
+	Name     string
+	Revision int
+	Active   bool
+	Samples  []APIVMStatsSample
+}
+
+// APIVMStatsList is a list of VM stats, with the latest sample only
+// (for "vm top" command)
+type APIVMStatsList []APIVMStats